@@ -3,13 +3,29 @@ package cmd
 import (
   "context"
   "database/sql"
+  "encoding/json"
   "flag"
   "fmt"
+  "io/ioutil"
+  "net/url"
   "os"
+  "os/signal"
   "strconv"
+  "strings"
+  "syscall"
+  "time"
+
+  "github.com/go-redis/redis/v7"
+  _ "github.com/lib/pq"
+  "go.mongodb.org/mongo-driver/mongo"
+  "go.mongodb.org/mongo-driver/mongo/options"
+  "go.uber.org/zap"
 
   "github.com/ckbball/os-company/pkg/logger"
+  "github.com/ckbball/os-company/pkg/mailer"
   companyGrpc "github.com/ckbball/os-company/pkg/protocol/grpc"
+  "github.com/ckbball/os-company/pkg/protocol/grpc/middleware"
+  "github.com/ckbball/os-company/pkg/protocol/rest"
   v1 "github.com/ckbball/os-company/pkg/service/v1"
 )
 
@@ -22,7 +38,18 @@ type Config struct {
   // the port to listen for http calls
   HTTPPort string
 
-  // DB Datastore parameters section
+  // Datastore selects the repository backend: mongo, postgres or memory
+  Datastore string
+
+  // Mongo parameters section
+  // MongoAddress is the connection uri of mongo
+  MongoAddress string
+  // MongoName is the mongo database name
+  MongoName string
+  // MongoCollection is the collection storing companies
+  MongoCollection string
+
+  // DB Datastore parameters section, used by the postgres datastore
   // DatastoreDBHost is host of database
   DatastoreDBHost string
   // DatastoreDBUser is username to connect to database
@@ -31,9 +58,23 @@ type Config struct {
   DatastoreDBPassword string
   // DatastoreDBSchema is schema of database
   DatastoreDBSchema string
+  // DatastoreDBSSLMode is the sslmode of the postgres connection
+  DatastoreDBSSLMode string
   // address for single redis node
   RedisAddress string
 
+  // JWT keys section
+  // JWTSigningKey is the PEM private key (RSA or Ed25519) tokens are signed with
+  JWTSigningKey string
+  // JWTSigningKeyFile is a file holding JWTSigningKey
+  JWTSigningKeyFile string
+  // JWTVerificationKeyFiles are comma separated PEM public keys of retired signing keys,
+  // their tokens are accepted until they expire
+  JWTVerificationKeyFiles string
+  // JWTDevKey signs tokens with a generated key if no signing key is configured, for local use only:
+  // the tokens become invalid on restart and are not accepted by other instances
+  JWTDevKey bool
+
   // LogLevel is global log level: Debug(-1), Info(0), Warn(1), Error(2), DPanic(3), Panic(4), Fatal(5)
   LogLevel int
   // LogTimeFormat is print time format for logger e.g. 2006-01-02T15:04:05Z07:00
@@ -41,6 +82,70 @@ type Config struct {
 
   // user service address
   JobSvcAddress string
+
+  // AdminIds are comma separated ids of members with platform admin rights
+  AdminIds string
+
+  // OidcProvidersFile is a JSON file with a list of v1.OidcProviderConfig,
+  // members can only log in with a password without it
+  OidcProvidersFile string
+
+  // Mail section
+  // SMTPAddress is host:port of the SMTP server, without it emails are written to MailFile
+  SMTPAddress string
+  // SMTPUsername and SMTPPassword authenticate with the SMTP server
+  SMTPUsername string
+  SMTPPassword string
+  // MailFrom is the sender of emails
+  MailFrom string
+  // MailFile is the file emails are written to without SMTP server, standard output if empty
+  MailFile string
+  // ResetPasswordURL is the frontend page password reset links point to
+  ResetPasswordURL string
+  // VerifyEmailURL is the frontend page email verification links point to
+  VerifyEmailURL string
+  // AcceptInvitationURL is the frontend page invitation links point to
+  AcceptInvitationURL string
+  // AcceptOwnershipURL is the frontend page ownership transfer links point to
+  AcceptOwnershipURL string
+
+  // Email verification policy section
+  // UnverifiedLogin lets companies log in before they verify their email
+  UnverifiedLogin bool
+  // UnverifiedListed shows companies in FilterCompanies before they verify their email
+  UnverifiedListed bool
+
+  // Password hashing section, stored hashes of other parameters are replaced on login
+  // PasswordHash is the algorithm of new password hashes: argon2id or bcrypt
+  PasswordHash string
+  // BcryptCost is the cost of bcrypt hashes
+  BcryptCost int
+  // Argon2Memory in KiB, Argon2Iterations and Argon2Parallelism are the parameters of argon2id hashes
+  Argon2Memory      int
+  Argon2Iterations  int
+  Argon2Parallelism int
+
+  // Password policy section
+  // PasswordMinLength and PasswordMaxLength bound the number of characters of new passwords
+  PasswordMinLength int
+  PasswordMaxLength int
+  // PasswordMinClasses is how many character classes new passwords have to contain
+  PasswordMinClasses int
+  // BreachedPasswordsDir is a directory of SHA-1 prefix files of breached passwords, none are checked if empty
+  BreachedPasswordsDir string
+
+  // Login lockout section
+  // LockoutAccountFreeAttempts and LockoutIPFreeAttempts are the failed logins in a row before backoff starts
+  LockoutAccountFreeAttempts int
+  LockoutIPFreeAttempts      int
+  // LockoutBaseDelay is the first backoff delay, every further failure doubles it up to LockoutMaxDelay
+  LockoutBaseDelay time.Duration
+  LockoutMaxDelay  time.Duration
+  // LockoutAttempts failed logins in a row lock an account for LockoutDuration, 0 never locks
+  LockoutAttempts int
+  LockoutDuration time.Duration
+  // LockoutResetAfter is the time without failures after which they are forgotten
+  LockoutResetAfter time.Duration
 }
 
 // RunServer runs gRPC server and HTTP gateway
@@ -51,22 +156,136 @@ func RunServer() error {
   var cfg Config
   flag.StringVar(&cfg.GRPCPort, "grpc-port", "", "gRPC port to bind")
   flag.StringVar(&cfg.HTTPPort, "http-port", "", "http port to bind")
+  flag.StringVar(&cfg.Datastore, "datastore", "", "Datastore backend: mongo, postgres or memory")
+  flag.StringVar(&cfg.MongoAddress, "mongo-address", "", "Mongo connection uri")
+  flag.StringVar(&cfg.MongoName, "mongo-name", "", "Mongo database name")
+  flag.StringVar(&cfg.MongoCollection, "mongo-collection", "", "Mongo collection of companies")
   flag.StringVar(&cfg.DatastoreDBHost, "db-host", "", "Database host")
   flag.StringVar(&cfg.DatastoreDBUser, "db-user", "", "Database user")
   flag.StringVar(&cfg.DatastoreDBPassword, "db-password", "", "Database password")
   flag.StringVar(&cfg.DatastoreDBSchema, "db-schema", "", "Database schema")
+  flag.StringVar(&cfg.DatastoreDBSSLMode, "db-sslmode", "disable", "Database sslmode")
   flag.StringVar(&cfg.RedisAddress, "redis-address", "", "Redis address")
+  flag.StringVar(&cfg.JWTSigningKeyFile, "jwt-signing-key", "", "PEM private key file tokens are signed with")
+  flag.StringVar(&cfg.JWTVerificationKeyFiles, "jwt-verification-keys", "", "Comma separated PEM public key files of retired signing keys")
+  flag.BoolVar(&cfg.JWTDevKey, "jwt-dev-key", false, "Sign tokens with a generated key if no signing key is configured, for local use only")
+  flag.StringVar(&cfg.AdminIds, "admin-ids", "", "Comma separated ids of members with platform admin rights, "+
+    "not of companies: other members of their companies get none")
+  flag.StringVar(&cfg.OidcProvidersFile, "oidc-providers", "", "JSON file of the OpenID Connect providers members can log in with")
+  flag.StringVar(&cfg.SMTPAddress, "smtp-address", "", "SMTP server host:port")
+  flag.StringVar(&cfg.SMTPUsername, "smtp-username", "", "SMTP username")
+  flag.StringVar(&cfg.SMTPPassword, "smtp-password", "", "SMTP password")
+  flag.StringVar(&cfg.MailFrom, "mail-from", "", "Sender of emails")
+  flag.StringVar(&cfg.MailFile, "mail-file", "", "File emails are written to without SMTP server")
+  flag.StringVar(&cfg.ResetPasswordURL, "reset-password-url", "", "Frontend page of password reset links")
+  flag.StringVar(&cfg.VerifyEmailURL, "verify-email-url", "", "Frontend page of email verification links")
+  flag.StringVar(&cfg.AcceptInvitationURL, "accept-invitation-url", "", "Frontend page of invitation links")
+  flag.StringVar(&cfg.AcceptOwnershipURL, "accept-ownership-url", "", "Frontend page of ownership transfer links")
+  flag.BoolVar(&cfg.UnverifiedLogin, "unverified-login", true, "Let companies log in before they verify their email")
+  flag.BoolVar(&cfg.UnverifiedListed, "unverified-listed", false, "List companies before they verify their email")
+  flag.StringVar(&cfg.PasswordHash, "password-hash", v1.DefaultHashingPolicy.Algorithm, "Algorithm of new password hashes: argon2id or bcrypt")
+  flag.IntVar(&cfg.BcryptCost, "bcrypt-cost", v1.DefaultHashingPolicy.BcryptCost, "Cost of bcrypt password hashes")
+  flag.IntVar(&cfg.Argon2Memory, "argon2-memory", int(v1.DefaultHashingPolicy.Argon2Memory), "Memory in KiB of argon2id password hashes")
+  flag.IntVar(&cfg.Argon2Iterations, "argon2-iterations", int(v1.DefaultHashingPolicy.Argon2Iterations), "Iterations of argon2id password hashes")
+  flag.IntVar(&cfg.Argon2Parallelism, "argon2-parallelism", int(v1.DefaultHashingPolicy.Argon2Parallelism), "Parallelism of argon2id password hashes")
+  flag.IntVar(&cfg.PasswordMinLength, "password-min-length", v1.DefaultPasswordPolicy.MinLength, "Minimum number of characters of new passwords")
+  flag.IntVar(&cfg.PasswordMaxLength, "password-max-length", v1.DefaultPasswordPolicy.MaxLength, "Maximum number of characters of new passwords")
+  flag.IntVar(&cfg.PasswordMinClasses, "password-min-classes", v1.DefaultPasswordPolicy.MinCharacterClasses, "Number of character classes new passwords have to contain")
+  flag.StringVar(&cfg.BreachedPasswordsDir, "breached-passwords", "", "Directory of SHA-1 prefix files of breached passwords")
+  flag.IntVar(&cfg.LockoutAccountFreeAttempts, "lockout-account-free-attempts", v1.DefaultLockoutPolicy.AccountFreeAttempts, "Failed logins of an account in a row before backoff starts")
+  flag.IntVar(&cfg.LockoutIPFreeAttempts, "lockout-ip-free-attempts", v1.DefaultLockoutPolicy.IPFreeAttempts, "Failed logins of a client ip in a row before backoff starts")
+  flag.DurationVar(&cfg.LockoutBaseDelay, "lockout-base-delay", v1.DefaultLockoutPolicy.BaseDelay, "First backoff delay, doubled by every further failed login")
+  flag.DurationVar(&cfg.LockoutMaxDelay, "lockout-max-delay", v1.DefaultLockoutPolicy.MaxDelay, "Maximum backoff delay")
+  flag.IntVar(&cfg.LockoutAttempts, "lockout-attempts", v1.DefaultLockoutPolicy.LockoutAttempts, "Failed logins in a row that lock an account, 0 never locks")
+  flag.DurationVar(&cfg.LockoutDuration, "lockout-duration", v1.DefaultLockoutPolicy.LockoutDuration, "Time an account stays locked")
+  flag.DurationVar(&cfg.LockoutResetAfter, "lockout-reset-after", v1.DefaultLockoutPolicy.ResetAfter, "Time without failed logins after which they are forgotten")
   flag.Parse()
 
   if len(cfg.GRPCPort) == 0 {
     cfg.GRPCPort = os.Getenv("GRPC_PORT")
     cfg.HTTPPort = os.Getenv("HTTP_PORT")
+    cfg.Datastore = os.Getenv("DATASTORE")
+    cfg.MongoAddress = os.Getenv("MONGO_ADDRESS")
+    cfg.MongoName = os.Getenv("MONGO_NAME")
+    cfg.MongoCollection = os.Getenv("MONGO_COLLECTION")
     cfg.DatastoreDBHost = os.Getenv("DB_HOST")
     cfg.DatastoreDBUser = os.Getenv("DB_USER")
     cfg.DatastoreDBPassword = os.Getenv("DB_PASSWORD")
     cfg.DatastoreDBSchema = os.Getenv("DB_SCHEMA")
+    if sslMode := os.Getenv("DB_SSLMODE"); sslMode != "" {
+      cfg.DatastoreDBSSLMode = sslMode
+    }
     cfg.RedisAddress = os.Getenv("REDIS_ADDRESS")
+    cfg.JWTSigningKey = os.Getenv("JWT_SIGNING_KEY")
+    cfg.JWTSigningKeyFile = os.Getenv("JWT_SIGNING_KEY_FILE")
+    cfg.JWTVerificationKeyFiles = os.Getenv("JWT_VERIFICATION_KEY_FILES")
+    if value := os.Getenv("JWT_DEV_KEY"); value != "" {
+      cfg.JWTDevKey, _ = strconv.ParseBool(value)
+    }
     cfg.JobSvcAddress = os.Getenv("JOB_ADDRESS")
+    cfg.AdminIds = os.Getenv("ADMIN_IDS")
+    cfg.OidcProvidersFile = os.Getenv("OIDC_PROVIDERS_FILE")
+    cfg.SMTPAddress = os.Getenv("SMTP_ADDRESS")
+    cfg.SMTPUsername = os.Getenv("SMTP_USERNAME")
+    cfg.SMTPPassword = os.Getenv("SMTP_PASSWORD")
+    cfg.MailFrom = os.Getenv("MAIL_FROM")
+    cfg.MailFile = os.Getenv("MAIL_FILE")
+    cfg.ResetPasswordURL = os.Getenv("RESET_PASSWORD_URL")
+    cfg.VerifyEmailURL = os.Getenv("VERIFY_EMAIL_URL")
+    cfg.AcceptInvitationURL = os.Getenv("ACCEPT_INVITATION_URL")
+    cfg.AcceptOwnershipURL = os.Getenv("ACCEPT_OWNERSHIP_URL")
+    if value := os.Getenv("UNVERIFIED_LOGIN"); value != "" {
+      cfg.UnverifiedLogin, _ = strconv.ParseBool(value)
+    }
+    if value := os.Getenv("UNVERIFIED_LISTED"); value != "" {
+      cfg.UnverifiedListed, _ = strconv.ParseBool(value)
+    }
+    if value := os.Getenv("PASSWORD_HASH"); value != "" {
+      cfg.PasswordHash = value
+    }
+    if value := os.Getenv("BCRYPT_COST"); value != "" {
+      cfg.BcryptCost, _ = strconv.Atoi(value)
+    }
+    if value := os.Getenv("ARGON2_MEMORY"); value != "" {
+      cfg.Argon2Memory, _ = strconv.Atoi(value)
+    }
+    if value := os.Getenv("ARGON2_ITERATIONS"); value != "" {
+      cfg.Argon2Iterations, _ = strconv.Atoi(value)
+    }
+    if value := os.Getenv("ARGON2_PARALLELISM"); value != "" {
+      cfg.Argon2Parallelism, _ = strconv.Atoi(value)
+    }
+    if value := os.Getenv("PASSWORD_MIN_LENGTH"); value != "" {
+      cfg.PasswordMinLength, _ = strconv.Atoi(value)
+    }
+    if value := os.Getenv("PASSWORD_MAX_LENGTH"); value != "" {
+      cfg.PasswordMaxLength, _ = strconv.Atoi(value)
+    }
+    if value := os.Getenv("PASSWORD_MIN_CLASSES"); value != "" {
+      cfg.PasswordMinClasses, _ = strconv.Atoi(value)
+    }
+    cfg.BreachedPasswordsDir = os.Getenv("BREACHED_PASSWORDS_DIR")
+    if value := os.Getenv("LOCKOUT_ACCOUNT_FREE_ATTEMPTS"); value != "" {
+      cfg.LockoutAccountFreeAttempts, _ = strconv.Atoi(value)
+    }
+    if value := os.Getenv("LOCKOUT_IP_FREE_ATTEMPTS"); value != "" {
+      cfg.LockoutIPFreeAttempts, _ = strconv.Atoi(value)
+    }
+    if value := os.Getenv("LOCKOUT_BASE_DELAY"); value != "" {
+      cfg.LockoutBaseDelay, _ = time.ParseDuration(value)
+    }
+    if value := os.Getenv("LOCKOUT_MAX_DELAY"); value != "" {
+      cfg.LockoutMaxDelay, _ = time.ParseDuration(value)
+    }
+    if value := os.Getenv("LOCKOUT_ATTEMPTS"); value != "" {
+      cfg.LockoutAttempts, _ = strconv.Atoi(value)
+    }
+    if value := os.Getenv("LOCKOUT_DURATION"); value != "" {
+      cfg.LockoutDuration, _ = time.ParseDuration(value)
+    }
+    if value := os.Getenv("LOCKOUT_RESET_AFTER"); value != "" {
+      cfg.LockoutResetAfter, _ = time.ParseDuration(value)
+    }
     cfg.LogLevel, _ = strconv.Atoi(os.Getenv("LOG_LEVEL"))
     cfg.LogTimeFormat = os.Getenv("LOG_TIME")
   }
@@ -79,28 +298,303 @@ func RunServer() error {
     return fmt.Errorf("invalid TCP port for http server: '%s'", cfg.HTTPPort)
   }
 
-  // SET up mongo client
-  // retry := false
-  clientOptions := options.Client().ApplyURI(cfg.MongoAddress)
-  client, err := mongo.Connect(context.TODO(), clientOptions)
+  // initialize logger
+  if err := logger.Init(cfg.LogLevel, cfg.LogTimeFormat); err != nil {
+    return fmt.Errorf("failed to initialize logger: %v", err)
+  }
+
+  // create repository
+  repository, err := newRepository(ctx, cfg)
   if err != nil {
     return err
   }
-  collection := client.Database(cfg.MongoName).Collection(cfg.MongoCollection)
 
-  // create repository
-  repository := v1.NewCompanyRepository(collection)
+  // enforce unique emails and names and index the other records, duplicate companies stored
+  // before keep the index of their field from being created and have to be resolved by hand
+  duplicates, err := repository.EnsureUniqueIndexes()
+  if err != nil {
+    return fmt.Errorf("failed to create unique indexes: %v", err)
+  }
+  for _, duplicate := range duplicates {
+    logger.Log.Error("duplicate companies keep a unique index from being created",
+      zap.String("field", duplicate.Field),
+      zap.String("value", duplicate.Value),
+      zap.Strings("companies", duplicate.CompanyIds))
+  }
+
+  // connect to redis, which shares token revocations and login failures between instances
+  redisClient, err := newRedisClient(cfg)
+  if err != nil {
+    return err
+  }
+
+  // create token revocation store and login limiter, shared through redis when there is one
+  var revocations v1.RevocationStore = v1.NewMemoryRevocationStore()
+  var attempts v1.AttemptStore = v1.NewMemoryAttemptStore()
+  if redisClient != nil {
+    revocations = v1.NewRedisRevocationStore(redisClient)
+    attempts = v1.NewRedisAttemptStore(redisClient)
+  }
+  if cfg.LockoutAccountFreeAttempts < 0 || cfg.LockoutIPFreeAttempts < 0 || cfg.LockoutAttempts < 0 ||
+    cfg.LockoutBaseDelay < 0 || cfg.LockoutMaxDelay < cfg.LockoutBaseDelay || cfg.LockoutDuration < 0 ||
+    cfg.LockoutResetAfter <= 0 {
+    return fmt.Errorf("invalid lockout policy: free attempts %d/%d, delays %v-%v, lockout %d for %v, reset after %v",
+      cfg.LockoutAccountFreeAttempts, cfg.LockoutIPFreeAttempts, cfg.LockoutBaseDelay, cfg.LockoutMaxDelay,
+      cfg.LockoutAttempts, cfg.LockoutDuration, cfg.LockoutResetAfter)
+  }
+  limiter := v1.NewLoginLimiter(attempts, v1.LockoutPolicy{
+    AccountFreeAttempts: cfg.LockoutAccountFreeAttempts,
+    IPFreeAttempts:      cfg.LockoutIPFreeAttempts,
+    BaseDelay:           cfg.LockoutBaseDelay,
+    MaxDelay:            cfg.LockoutMaxDelay,
+    LockoutAttempts:     cfg.LockoutAttempts,
+    LockoutDuration:     cfg.LockoutDuration,
+    ResetAfter:          cfg.LockoutResetAfter,
+  })
+
+  // load token signing keys
+  keys, err := loadKeySet(cfg)
+  if err != nil {
+    return err
+  }
 
   // create auth service
-  tokenService := v1.NewTokenService()
+  tokenService := v1.NewTokenService(keys, revocations, splitList(cfg.AdminIds))
+
+  // create mailer
+  mail, err := newMailer(cfg)
+  if err != nil {
+    return err
+  }
+
+  // create password hasher
+  if cfg.Argon2Memory < 0 || cfg.Argon2Iterations < 0 || cfg.Argon2Parallelism < 0 || cfg.Argon2Parallelism > 255 {
+    return fmt.Errorf("invalid argon2 parameters m=%d t=%d p=%d", cfg.Argon2Memory, cfg.Argon2Iterations, cfg.Argon2Parallelism)
+  }
+  passwords, err := v1.NewPasswordHasher(v1.HashingPolicy{
+    Algorithm:         cfg.PasswordHash,
+    BcryptCost:        cfg.BcryptCost,
+    Argon2Memory:      uint32(cfg.Argon2Memory),
+    Argon2Iterations:  uint32(cfg.Argon2Iterations),
+    Argon2Parallelism: uint8(cfg.Argon2Parallelism),
+  })
+  if err != nil {
+    return err
+  }
+
+  // create password policy
+  passwordPolicy := &v1.PasswordPolicy{
+    MinLength:           cfg.PasswordMinLength,
+    MaxLength:           cfg.PasswordMaxLength,
+    MinCharacterClasses: cfg.PasswordMinClasses,
+  }
+  if cfg.BreachedPasswordsDir != "" {
+    breached, err := v1.NewPrefixFileBreachList(cfg.BreachedPasswordsDir)
+    if err != nil {
+      return err
+    }
+    passwordPolicy.Breached = breached
+  }
+
+  // discover OpenID Connect providers
+  oidcProviders, err := loadOidcProviders(ctx, cfg)
+  if err != nil {
+    return err
+  }
 
   // pass in fields of handler directly to method
-  v1API := v1.NewCompanyServiceServer(repository, tokenService) // may need to add Job Service address
+  v1API := v1.NewCompanyServiceServer(repository, tokenService, mail, v1.Links{
+    ResetPassword:    cfg.ResetPasswordURL,
+    VerifyEmail:      cfg.VerifyEmailURL,
+    AcceptInvitation: cfg.AcceptInvitationURL,
+    AcceptOwnership:  cfg.AcceptOwnershipURL,
+  }, v1.VerificationPolicy{
+    AllowLogin: cfg.UnverifiedLogin,
+    Listed:     cfg.UnverifiedListed,
+  }, limiter, oidcProviders, passwords, passwordPolicy) // may need to add Job Service address
 
-  // initialize logger
-  if err := logger.Init(cfg.LogLevel, cfg.LogTimeFormat); err != nil {
-    return fmt.Errorf("failed to initialize logger: %v", err)
+  // both servers shut down gracefully on interrupt
+  ctx, cancel := context.WithCancel(ctx)
+  defer cancel()
+  c := make(chan os.Signal, 1)
+  signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+  go func() {
+    select {
+    case <-c:
+      cancel()
+    case <-ctx.Done():
+    }
+  }()
+
+  // run HTTP gateway and gRPC server, the first one to stop takes the other one down
+  errs := make(chan error, 2)
+  go func() {
+    errs <- rest.RunServer(ctx, cfg.GRPCPort, cfg.HTTPPort)
+  }()
+  go func() {
+    // authenticate callers and enforce the policy of each method before the handlers run
+    opts := middleware.AddAuth(v1.NewAuthenticator(tokenService, repository), v1.MethodPolicies, v1.MethodScopes, v1.MethodRoles, nil)
+    errs <- companyGrpc.RunServer(ctx, v1API, cfg.GRPCPort, opts...)
+  }()
+
+  err = <-errs
+  cancel()
+  if err2 := <-errs; err == nil {
+    err = err2
+  }
+  return err
+}
+
+// loadKeySet loads the token signing key and the keys of retired signing keys.
+// A signing key is required, unless JWTDevKey allows a throwaway key to be generated.
+func loadKeySet(cfg Config) (*v1.KeySet, error) {
+  signingPEM := []byte(cfg.JWTSigningKey)
+  if len(signingPEM) == 0 && cfg.JWTSigningKeyFile != "" {
+    var err error
+    signingPEM, err = ioutil.ReadFile(cfg.JWTSigningKeyFile)
+    if err != nil {
+      return nil, fmt.Errorf("failed to read jwt signing key: %v", err)
+    }
   }
 
-  return companyGrpc.RunServer(ctx, v1API, cfg.GRPCPort)
+  var signing *v1.SigningKey
+  var err error
+  switch {
+  case len(signingPEM) == 0 && !cfg.JWTDevKey:
+    return nil, fmt.Errorf("no jwt signing key configured, set --jwt-signing-key or use --jwt-dev-key for local development")
+  case len(signingPEM) == 0:
+    logger.Log.Warn("no jwt signing key configured - tokens are signed with a generated key and become invalid on restart")
+    signing, err = v1.GenerateSigningKey()
+  default:
+    signing, err = v1.ParsePrivateKeyPEM(signingPEM)
+  }
+  if err != nil {
+    return nil, fmt.Errorf("invalid jwt signing key: %v", err)
+  }
+
+  verification := []*v1.SigningKey{}
+  for _, file := range splitList(cfg.JWTVerificationKeyFiles) {
+    data, err := ioutil.ReadFile(file)
+    if err != nil {
+      return nil, fmt.Errorf("failed to read jwt verification key: %v", err)
+    }
+    key, err := v1.ParsePublicKeyPEM(data)
+    if err != nil {
+      return nil, fmt.Errorf("invalid jwt verification key %s: %v", file, err)
+    }
+    verification = append(verification, key)
+  }
+
+  return v1.NewKeySet(signing, verification...)
+}
+
+// loadOidcProviders discovers the OpenID Connect providers of the providers file, if there is one
+func loadOidcProviders(ctx context.Context, cfg Config) (map[string]*v1.OidcProvider, error) {
+  configs := []v1.OidcProviderConfig{}
+  if cfg.OidcProvidersFile != "" {
+    data, err := ioutil.ReadFile(cfg.OidcProvidersFile)
+    if err != nil {
+      return nil, fmt.Errorf("failed to read oidc providers: %v", err)
+    }
+    if err := json.Unmarshal(data, &configs); err != nil {
+      return nil, fmt.Errorf("invalid oidc providers file %s: %v", cfg.OidcProvidersFile, err)
+    }
+  }
+
+  return v1.NewOidcProviders(ctx, configs)
+}
+
+// newRedisClient connects to redis if a redis address is configured, it returns nil otherwise.
+// Without redis revocations and login failures are only known to the instance that saw them.
+func newRedisClient(cfg Config) (*redis.Client, error) {
+  if cfg.RedisAddress == "" {
+    return nil, nil
+  }
+
+  client := redis.NewClient(&redis.Options{
+    Addr: cfg.RedisAddress,
+  })
+  if err := client.Ping().Err(); err != nil {
+    return nil, fmt.Errorf("failed to connect to redis: %v", err)
+  }
+  return client, nil
+}
+
+// newMailer returns an SMTP mailer if an SMTP server is configured.
+// Without one emails are written to the mail file or standard output, for local development.
+func newMailer(cfg Config) (mailer.Mailer, error) {
+  if cfg.SMTPAddress != "" {
+    if cfg.MailFrom == "" {
+      return nil, fmt.Errorf("the sender of emails is not configured")
+    }
+    return mailer.NewSMTPMailer(cfg.SMTPAddress, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom)
+  }
+
+  if cfg.MailFile == "" {
+    logger.Log.Warn("no smtp server configured - emails are written to standard output")
+    return mailer.NewLogMailer(os.Stdout), nil
+  }
+  file, err := os.OpenFile(cfg.MailFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+  if err != nil {
+    return nil, fmt.Errorf("failed to open mail file: %v", err)
+  }
+  return mailer.NewLogMailer(file), nil
+}
+
+// newRepository connects to the configured datastore and returns its repository
+func newRepository(ctx context.Context, cfg Config) (v1.Repository, error) {
+  switch cfg.Datastore {
+  case "", "mongo":
+    // SET up mongo client
+    // retry := false
+    clientOptions := options.Client().ApplyURI(cfg.MongoAddress)
+    client, err := mongo.Connect(ctx, clientOptions)
+    if err != nil {
+      return nil, err
+    }
+    collection := client.Database(cfg.MongoName).Collection(cfg.MongoCollection)
+
+    return v1.NewCompanyRepository(collection), nil
+
+  case "postgres":
+    dsn := url.URL{
+      Scheme:   "postgres",
+      User:     url.UserPassword(cfg.DatastoreDBUser, cfg.DatastoreDBPassword),
+      Host:     cfg.DatastoreDBHost,
+      Path:     cfg.DatastoreDBSchema,
+      RawQuery: url.Values{"sslmode": {cfg.DatastoreDBSSLMode}}.Encode(),
+    }
+    db, err := sql.Open("postgres", dsn.String())
+    if err != nil {
+      return nil, fmt.Errorf("failed to open database: %v", err)
+    }
+    if err := db.PingContext(ctx); err != nil {
+      return nil, fmt.Errorf("failed to connect to database: %v", err)
+    }
+
+    // bring the schema up to date before serving
+    if err := v1.MigratePostgres(ctx, db); err != nil {
+      return nil, err
+    }
+
+    return v1.NewPostgresRepository(db), nil
+
+  case "memory":
+    // nothing is persisted, for local demos
+    return v1.NewMemoryRepository(), nil
+
+  default:
+    return nil, fmt.Errorf("invalid datastore: '%s'", cfg.Datastore)
+  }
+}
+
+// splitList splits a comma separated config value, dropping empty items
+func splitList(value string) []string {
+  items := []string{}
+  for _, item := range strings.Split(value, ",") {
+    if item = strings.TrimSpace(item); item != "" {
+      items = append(items, item)
+    }
+  }
+  return items
 }
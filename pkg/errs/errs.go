@@ -0,0 +1,116 @@
+// Package errs defines the domain errors of the company service. Repositories return them without
+// knowing about gRPC, and the error interceptor of the gRPC server turns them into statuses.
+// Handlers return them too, or gRPC statuses of their own, which the interceptor passes on as
+// they are. Only the message of an error is shown to callers, never its cause.
+package errs
+
+import (
+  "errors"
+)
+
+// Kind is the class of an error, each kind maps to one gRPC status code
+type Kind uint8
+
+const (
+  // Internal errors are failures of the service itself, their message is not shown to callers either
+  Internal Kind = iota
+  NotFound
+  AlreadyExists
+  Unauthenticated
+  PermissionDenied
+  // Conflict is a write that lost against a concurrent one, retrying it may succeed
+  Conflict
+  InvalidArgument
+  // Unavailable is a dependency like the database that cannot be reached right now
+  Unavailable
+)
+
+var kindNames = map[Kind]string{
+  Internal:         "INTERNAL",
+  NotFound:         "NOT_FOUND",
+  AlreadyExists:    "ALREADY_EXISTS",
+  Unauthenticated:  "UNAUTHENTICATED",
+  PermissionDenied: "PERMISSION_DENIED",
+  Conflict:         "CONFLICT",
+  InvalidArgument:  "INVALID_ARGUMENT",
+  Unavailable:      "UNAVAILABLE",
+}
+
+// String returns the name of the kind, e.g. "NOT_FOUND", which is also the reason callers get
+func (k Kind) String() string {
+  if name, ok := kindNames[k]; ok {
+    return name
+  }
+  return kindNames[Internal]
+}
+
+// Error is a domain error
+type Error struct {
+  Kind Kind
+  // Message is what callers get to see, unless the kind is Internal
+  Message string
+  // Field names the field of the request the error is about, e.g. the email that is taken
+  Field string
+  // Err is the cause, it is logged but never shown to callers
+  Err error
+}
+
+// New returns an error of kind with a message for callers
+func New(kind Kind, message string) *Error {
+  return &Error{
+    Kind:    kind,
+    Message: message,
+  }
+}
+
+// NewField returns an error of kind about field with a message for callers
+func NewField(kind Kind, field string, message string) *Error {
+  return &Error{
+    Kind:    kind,
+    Message: message,
+    Field:   field,
+  }
+}
+
+// Wrap returns an error of kind with a message for callers, caused by err
+func Wrap(kind Kind, message string, err error) *Error {
+  return &Error{
+    Kind:    kind,
+    Message: message,
+    Err:     err,
+  }
+}
+
+func (e *Error) Error() string {
+  if e.Err != nil {
+    return e.Message + ": " + e.Err.Error()
+  }
+  return e.Message
+}
+
+func (e *Error) Unwrap() error {
+  return e.Err
+}
+
+// As returns the domain error in the chain of err, if there is one
+func As(err error) (*Error, bool) {
+  var e *Error
+  if errors.As(err, &e) {
+    return e, true
+  }
+  return nil, false
+}
+
+// KindOf returns the kind of the domain error in the chain of err, Internal if there is none
+func KindOf(err error) Kind {
+  if e, ok := As(err); ok {
+    return e.Kind
+  }
+  return Internal
+}
+
+// Is reports if err is a domain error of kind
+func Is(err error, kind Kind) bool {
+  e, ok := As(err)
+  return ok && e.Kind == kind
+}
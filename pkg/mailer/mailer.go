@@ -0,0 +1,103 @@
+// Package mailer sends the emails of the company service
+package mailer
+
+import (
+  "context"
+  "fmt"
+  "io"
+  "net"
+  "net/smtp"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Message is a plain text email
+type Message struct {
+  To      string
+  Subject string
+  Body    string
+}
+
+// Mailer sends emails
+type Mailer interface {
+  Send(ctx context.Context, msg *Message) error
+}
+
+// SMTPMailer sends emails through an SMTP server
+type SMTPMailer struct {
+  addr string
+  from string
+  auth smtp.Auth
+}
+
+// NewSMTPMailer returns a mailer sending from from through the server at addr (host:port).
+// Without username no authentication is done.
+func NewSMTPMailer(addr, username, password, from string) (*SMTPMailer, error) {
+  host, _, err := net.SplitHostPort(addr)
+  if err != nil {
+    return nil, fmt.Errorf("invalid smtp address '%s': %v", addr, err)
+  }
+
+  m := &SMTPMailer{
+    addr: addr,
+    from: from,
+  }
+  if username != "" {
+    m.auth = smtp.PlainAuth("", username, password, host)
+  }
+  return m, nil
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg *Message) error {
+  raw, err := format(m.from, msg)
+  if err != nil {
+    return err
+  }
+  return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, raw)
+}
+
+// LogMailer writes emails to a writer instead of sending them, for local development
+type LogMailer struct {
+  mu sync.Mutex
+  w  io.Writer
+}
+
+func NewLogMailer(w io.Writer) *LogMailer {
+  return &LogMailer{
+    w: w,
+  }
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg *Message) error {
+  raw, err := format("noreply@localhost", msg)
+  if err != nil {
+    return err
+  }
+
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  _, err = fmt.Fprintf(m.w, "%s\r\n.\r\n", raw)
+  return err
+}
+
+// format renders msg as an RFC 5322 message
+func format(from string, msg *Message) ([]byte, error) {
+  // header values must not smuggle in extra headers
+  for _, value := range []string{from, msg.To, msg.Subject} {
+    if strings.ContainsAny(value, "\r\n") {
+      return nil, fmt.Errorf("invalid header value %q", value)
+    }
+  }
+
+  var b strings.Builder
+  fmt.Fprintf(&b, "From: %s\r\n", from)
+  fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+  fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+  fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+  b.WriteString("MIME-Version: 1.0\r\n")
+  b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+  b.WriteString("\r\n")
+  b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+  return []byte(b.String()), nil
+}
@@ -0,0 +1,131 @@
+package middleware
+
+import (
+  "context"
+  "strings"
+
+  "github.com/grpc-ecosystem/go-grpc-middleware"
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/status"
+
+  pb "github.com/ckbball/os-company/pkg/api/v1"
+  v1 "github.com/ckbball/os-company/pkg/service/v1"
+)
+
+// idRequest is implemented by requests naming the company they act on
+type idRequest interface {
+  GetId() string
+}
+
+// AddAuth returns grpc.Server config options that authenticate callers with the bearer token
+// or API key of the "authorization" metadata and enforce the policy of each method.
+// API keys are further limited to the methods in scopes they have the scope for,
+// and members to the methods in roles they have the role for.
+// Handlers read the caller from the context with v1.ClaimsFromContext.
+func AddAuth(credentials *v1.Authenticator, policies map[string]v1.Policy, scopes map[string]pb.ApiKeyScope,
+  roles map[string]pb.MemberRole, opts []grpc.ServerOption) []grpc.ServerOption {
+  a := &authenticator{
+    credentials: credentials,
+    policies:    policies,
+    scopes:      scopes,
+    roles:       roles,
+  }
+
+  opts = append(opts, grpc.ChainUnaryInterceptor(a.unaryInterceptor))
+  opts = append(opts, grpc.ChainStreamInterceptor(a.streamInterceptor))
+
+  return opts
+}
+
+type authenticator struct {
+  credentials *v1.Authenticator
+  policies    map[string]v1.Policy
+  scopes      map[string]pb.ApiKeyScope
+  roles       map[string]pb.MemberRole
+}
+
+func (a *authenticator) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+  ctx, err := a.authorize(ctx, info.FullMethod, req)
+  if err != nil {
+    return nil, err
+  }
+  return handler(ctx, req)
+}
+
+func (a *authenticator) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+  // the request of a stream is not known yet, so owner checks fail closed
+  ctx, err := a.authorize(ss.Context(), info.FullMethod, nil)
+  if err != nil {
+    return err
+  }
+  wrapped := grpc_middleware.WrapServerStream(ss)
+  wrapped.WrappedContext = ctx
+  return handler(srv, wrapped)
+}
+
+// authorize checks the caller against the policy of method and returns a context carrying its claims
+func (a *authenticator) authorize(ctx context.Context, method string, req interface{}) (context.Context, error) {
+  policy, ok := a.policies[method]
+  if !ok {
+    return nil, status.Errorf(codes.PermissionDenied, "method %s is not allowed", method)
+  }
+
+  token := bearerToken(ctx)
+  if policy == v1.PolicyPublic {
+    // public methods still get to know a caller with a valid token
+    if token != "" {
+      if claims, err := a.credentials.Authenticate(token); err == nil {
+        ctx = v1.NewClaimsContext(ctx, claims)
+      }
+    }
+    return ctx, nil
+  }
+
+  if token == "" {
+    return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+  }
+  claims, err := a.credentials.Authenticate(token)
+  if err != nil {
+    return nil, status.Error(codes.Unauthenticated, "invalid token")
+  }
+
+  if claims.ApiKeyId != "" {
+    scope, ok := a.scopes[method]
+    if !ok || !claims.HasScope(scope) {
+      return nil, status.Errorf(codes.PermissionDenied, "API key may not call %s", method)
+    }
+  }
+  if role, ok := a.roles[method]; ok && !claims.HasRole(role) {
+    return nil, status.Errorf(codes.PermissionDenied, "requires the %s role", role)
+  }
+
+  switch policy {
+  case v1.PolicyOwner:
+    target, ok := req.(idRequest)
+    if !ok || target.GetId() == "" || target.GetId() != claims.Company.Id {
+      return nil, status.Error(codes.PermissionDenied, "token does not belong to this company")
+    }
+  case v1.PolicyAdmin:
+    if !claims.Admin {
+      return nil, status.Error(codes.PermissionDenied, "admin only")
+    }
+  }
+
+  return v1.NewClaimsContext(ctx, claims), nil
+}
+
+// bearerToken returns the token of the "authorization: Bearer <token>" metadata
+func bearerToken(ctx context.Context) string {
+  md, ok := metadata.FromIncomingContext(ctx)
+  if !ok {
+    return ""
+  }
+  for _, value := range md.Get("authorization") {
+    if len(value) > 7 && strings.EqualFold(value[:7], "bearer ") {
+      return strings.TrimSpace(value[7:])
+    }
+  }
+  return ""
+}
@@ -0,0 +1,124 @@
+package middleware
+
+import (
+  "context"
+  "crypto/sha256"
+  "encoding/hex"
+  "testing"
+
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/status"
+
+  pb "github.com/ckbball/os-company/pkg/api/v1"
+  v1 "github.com/ckbball/os-company/pkg/service/v1"
+)
+
+const (
+  testCompanyId = "5e0000000000000000000000"
+  testAdminId   = "5e0000000000000000000013"
+  testApiKey    = "osk_test"
+)
+
+// newTestAuthenticator returns an authenticator with the policies of the service and
+// access tokens of an owner, a recruiter and a platform admin, all of one company
+func newTestAuthenticator(t *testing.T) (*authenticator, map[string]string) {
+  key, err := v1.GenerateSigningKey()
+  if err != nil {
+    t.Fatalf("GenerateSigningKey failed: %v", err)
+  }
+  keys, err := v1.NewKeySet(key)
+  if err != nil {
+    t.Fatalf("NewKeySet failed: %v", err)
+  }
+  tokens := v1.NewTokenService(keys, v1.NewMemoryRevocationStore(), []string{testAdminId})
+
+  repo := v1.NewMemoryRepository()
+  hash := sha256.Sum256([]byte(testApiKey))
+  err = repo.CreateApiKey(&v1.ApiKey{
+    Id:        "key",
+    Hash:      hex.EncodeToString(hash[:]),
+    CompanyId: testCompanyId,
+    Scopes:    []string{pb.ApiKeyScope_READ_PROFILE.String()},
+  })
+  if err != nil {
+    t.Fatalf("CreateApiKey failed: %v", err)
+  }
+
+  credentials := map[string]string{"api key": testApiKey}
+  for name, member := range map[string]*pb.Member{
+    "owner":     {Id: "5e0000000000000000000010", Role: pb.MemberRole_OWNER},
+    "recruiter": {Id: "5e0000000000000000000011", Role: pb.MemberRole_RECRUITER},
+    "admin":     {Id: testAdminId, Role: pb.MemberRole_RECRUITER},
+  } {
+    token, err := tokens.Encode(&pb.Company{Id: testCompanyId}, member)
+    if err != nil {
+      t.Fatalf("Encode failed: %v", err)
+    }
+    credentials[name] = token
+  }
+
+  return &authenticator{
+    credentials: v1.NewAuthenticator(tokens, repo),
+    policies:    v1.MethodPolicies,
+    scopes:      v1.MethodScopes,
+    roles:       v1.MethodRoles,
+  }, credentials
+}
+
+func TestAuthorize(t *testing.T) {
+  a, credentials := newTestAuthenticator(t)
+  method := func(name string) string { return "/company.CompanyService/" + name }
+
+  tests := []struct {
+    name   string
+    method string
+    // caller is the key of the credential in credentials, or the credential itself
+    caller string
+    req    interface{}
+    want   codes.Code
+  }{
+    {"public without a token", method("Login"), "", nil, codes.OK},
+    {"public with an invalid token", method("GetById"), "invalid", nil, codes.OK},
+    {"method without a policy", method("Unknown"), "owner", nil, codes.PermissionDenied},
+    {"authenticated without a token", method("GetAuth"), "", nil, codes.Unauthenticated},
+    {"authenticated with an invalid token", method("GetAuth"), "invalid", nil, codes.Unauthenticated},
+    {"authenticated with a token", method("GetAuth"), "recruiter", nil, codes.OK},
+    {"api key with the scope", method("GetAuth"), "api key", nil, codes.OK},
+    {"api key without the scope", method("UpdateCompany"), "api key", &pb.UpsertRequest{Id: testCompanyId},
+      codes.PermissionDenied},
+    {"api key on a method without a scope", method("ListMembers"), "api key", nil, codes.PermissionDenied},
+    {"recruiter on an admin method", method("AddMember"), "recruiter", nil, codes.PermissionDenied},
+    {"owner on an admin method", method("AddMember"), "owner", nil, codes.OK},
+    {"owner of the company", method("UpdateCompany"), "owner", &pb.UpsertRequest{Id: testCompanyId}, codes.OK},
+    {"owner of another company", method("UpdateCompany"), "owner", &pb.UpsertRequest{Id: "5e0000000000000000000001"},
+      codes.PermissionDenied},
+    {"owner policy without an id", method("DeleteCompany"), "owner", &pb.DeleteRequest{}, codes.PermissionDenied},
+    {"owner policy on a stream", method("DeleteCompany"), "owner", nil, codes.PermissionDenied},
+    {"platform admin method by a member", method("UnlockAccount"), "owner", nil, codes.PermissionDenied},
+    {"platform admin method by an admin", method("UnlockAccount"), "admin", nil, codes.OK},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      ctx := context.Background()
+      if test.caller != "" {
+        credential, ok := credentials[test.caller]
+        if !ok {
+          credential = test.caller
+        }
+        ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+credential))
+      }
+
+      ctx, err := a.authorize(ctx, test.method, test.req)
+      if code := status.Code(err); code != test.want {
+        t.Fatalf("authorize returned %v, want %v", err, test.want)
+      }
+      if err != nil || v1.MethodPolicies[test.method] == v1.PolicyPublic {
+        return
+      }
+      if claims, ok := v1.ClaimsFromContext(ctx); !ok || claims.Company.Id != testCompanyId {
+        t.Errorf("context carries claims %+v, want those of company %s", claims, testCompanyId)
+      }
+    })
+  }
+}
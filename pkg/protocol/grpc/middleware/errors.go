@@ -0,0 +1,110 @@
+package middleware
+
+import (
+  "context"
+
+  "go.uber.org/zap"
+  "google.golang.org/genproto/googleapis/rpc/errdetails"
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  "github.com/ckbball/os-company/pkg/errs"
+)
+
+// errorDomain is the domain of the errdetails.ErrorInfo of converted errors
+const errorDomain = "company.os-company"
+
+// kindCodes is the status code of each kind of domain error
+var kindCodes = map[errs.Kind]codes.Code{
+  errs.Internal:         codes.Internal,
+  errs.NotFound:         codes.NotFound,
+  errs.AlreadyExists:    codes.AlreadyExists,
+  errs.Unauthenticated:  codes.Unauthenticated,
+  errs.PermissionDenied: codes.PermissionDenied,
+  errs.Conflict:         codes.Aborted,
+  errs.InvalidArgument:  codes.InvalidArgument,
+  errs.Unavailable:      codes.Unavailable,
+}
+
+// AddErrorStatus returns grpc.Server config options that turn the errors of the handlers into
+// statuses: domain errors of package errs get their status code and an errdetails.ErrorInfo
+// with the field of the request they are about in its "field" metadata. Statuses are returned
+// as they are and every other error becomes an Internal status.
+// The text of internal errors and the causes of domain errors are logged, but never returned.
+func AddErrorStatus(logger *zap.Logger, opts []grpc.ServerOption) []grpc.ServerOption {
+  e := &errorConverter{
+    logger: logger,
+  }
+
+  opts = append(opts, grpc.ChainUnaryInterceptor(e.unaryInterceptor))
+  opts = append(opts, grpc.ChainStreamInterceptor(e.streamInterceptor))
+
+  return opts
+}
+
+type errorConverter struct {
+  logger *zap.Logger
+}
+
+func (e *errorConverter) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+  resp, err := handler(ctx, req)
+  if err != nil {
+    return nil, e.convert(info.FullMethod, err)
+  }
+  return resp, nil
+}
+
+func (e *errorConverter) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+  if err := handler(srv, ss); err != nil {
+    return e.convert(info.FullMethod, err)
+  }
+  return nil
+}
+
+// convert returns the status of err returned by method
+func (e *errorConverter) convert(method string, err error) error {
+  // domain errors first, their causes may be statuses that must not leak
+  domainErr, ok := errs.As(err)
+  if !ok {
+    if _, ok := status.FromError(err); ok {
+      return err
+    }
+    switch err {
+    case context.Canceled:
+      return status.Error(codes.Canceled, "the request was canceled")
+    case context.DeadlineExceeded:
+      return status.Error(codes.DeadlineExceeded, "the request timed out")
+    }
+    domainErr = errs.Wrap(errs.Internal, "", err)
+  }
+
+  code, ok := kindCodes[domainErr.Kind]
+  if !ok {
+    code = codes.Internal
+  }
+  msg := domainErr.Message
+  if code == codes.Internal || code == codes.Unavailable {
+    e.logger.Error("request failed", zap.String("method", method), zap.Error(err))
+  } else if domainErr.Err != nil {
+    e.logger.Debug("request failed", zap.String("method", method), zap.Error(err))
+  }
+  if code == codes.Internal {
+    msg = "internal error"
+  } else if msg == "" {
+    msg = code.String()
+  }
+
+  info := &errdetails.ErrorInfo{
+    Reason: domainErr.Kind.String(),
+    Domain: errorDomain,
+  }
+  if domainErr.Field != "" && code != codes.Internal {
+    info.Metadata = map[string]string{"field": domainErr.Field}
+  }
+  st, detailsErr := status.New(code, msg).WithDetails(info)
+  if detailsErr != nil {
+    return status.Error(code, msg)
+  }
+  return st.Err()
+}
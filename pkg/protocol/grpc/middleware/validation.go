@@ -0,0 +1,146 @@
+package middleware
+
+import (
+  "context"
+  "strings"
+
+  "github.com/grpc-ecosystem/go-grpc-middleware"
+  "google.golang.org/genproto/googleapis/rpc/errdetails"
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+  "google.golang.org/protobuf/proto"
+  "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// validator is implemented by messages with (validate.rules) annotations,
+// protoc-gen-validate generates the method next to the messages
+type validator interface {
+  ValidateAll() error
+}
+
+// fieldError is implemented by the errors ValidateAll reports for a field
+type fieldError interface {
+  error
+  Field() string
+  Reason() string
+  Cause() error
+}
+
+// multiError is implemented by the error ValidateAll returns, which collects every fieldError
+type multiError interface {
+  error
+  AllErrors() []error
+}
+
+// AddValidation returns grpc.Server config options that check requests against the
+// rules of their proto messages before the handlers run. Requests breaking a rule fail
+// with InvalidArgument and an errdetails.BadRequest naming every field and rule.
+func AddValidation(opts []grpc.ServerOption) []grpc.ServerOption {
+  opts = append(opts, grpc.ChainUnaryInterceptor(validationUnaryInterceptor))
+  opts = append(opts, grpc.ChainStreamInterceptor(validationStreamInterceptor))
+
+  return opts
+}
+
+func validationUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+  if err := validate(req); err != nil {
+    return nil, err
+  }
+  return handler(ctx, req)
+}
+
+func validationStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+  return handler(srv, &validatingStream{ServerStream: grpc_middleware.WrapServerStream(ss)})
+}
+
+// validatingStream validates every message received on a stream
+type validatingStream struct {
+  grpc.ServerStream
+}
+
+func (s *validatingStream) RecvMsg(m interface{}) error {
+  if err := s.ServerStream.RecvMsg(m); err != nil {
+    return err
+  }
+  return validate(m)
+}
+
+// validate returns the InvalidArgument error of the rules req breaks, nil if it breaks none
+func validate(req interface{}) error {
+  v, ok := req.(validator)
+  if !ok {
+    return nil
+  }
+  err := v.ValidateAll()
+  if err == nil {
+    return nil
+  }
+
+  var desc protoreflect.MessageDescriptor
+  if message, ok := req.(proto.Message); ok {
+    desc = message.ProtoReflect().Descriptor()
+  }
+  details := &errdetails.BadRequest{
+    FieldViolations: fieldViolations(err, desc, ""),
+  }
+  if len(details.FieldViolations) == 0 {
+    return status.Error(codes.InvalidArgument, err.Error())
+  }
+
+  st, detailsErr := status.New(codes.InvalidArgument, "invalid request: "+details.FieldViolations[0].Field+": "+
+    details.FieldViolations[0].Description).WithDetails(details)
+  if detailsErr != nil {
+    return status.Error(codes.InvalidArgument, err.Error())
+  }
+  return st.Err()
+}
+
+// fieldViolations flattens the errors of ValidateAll into violations of proto field paths,
+// e.g. "company.email". desc describes the message the errors are about, prefix is its path.
+func fieldViolations(err error, desc protoreflect.MessageDescriptor, prefix string) []*errdetails.BadRequest_FieldViolation {
+  if multi, ok := err.(multiError); ok {
+    violations := []*errdetails.BadRequest_FieldViolation{}
+    for _, err := range multi.AllErrors() {
+      violations = append(violations, fieldViolations(err, desc, prefix)...)
+    }
+    return violations
+  }
+
+  fe, ok := err.(fieldError)
+  if !ok {
+    return nil
+  }
+  name, field := protoFieldName(desc, fe.Field())
+  path := prefix + name
+
+  // errors of embedded messages are reported for the fields of the embedded message
+  if cause := fe.Cause(); cause != nil && field != nil && field.Message() != nil {
+    if violations := fieldViolations(cause, field.Message(), path+"."); len(violations) > 0 {
+      return violations
+    }
+  }
+  return []*errdetails.BadRequest_FieldViolation{{
+    Field:       path,
+    Description: fe.Reason(),
+  }}
+}
+
+// protoFieldName translates the Go field name of a generated error, e.g. "NewPassword"
+// or "Scopes[1]", into the proto field name "new_password" or "scopes[1]"
+func protoFieldName(desc protoreflect.MessageDescriptor, goName string) (string, protoreflect.FieldDescriptor) {
+  index := ""
+  if i := strings.IndexByte(goName, '['); i >= 0 {
+    goName, index = goName[:i], goName[i:]
+  }
+  if desc != nil {
+    fields := desc.Fields()
+    for i := 0; i < fields.Len(); i++ {
+      field := fields.Get(i)
+      if strings.EqualFold(strings.ReplaceAll(string(field.Name()), "_", ""), goName) {
+        return string(field.Name()) + index, field
+      }
+    }
+  }
+  return goName + index, nil
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+  "errors"
+  "reflect"
+  "testing"
+
+  "google.golang.org/genproto/googleapis/rpc/errdetails"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+  "google.golang.org/protobuf/reflect/protoreflect"
+
+  pb "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+func TestProtoFieldName(t *testing.T) {
+  tests := []struct {
+    desc   protoreflect.MessageDescriptor
+    goName string
+    want   string
+  }{
+    {(&pb.ResetPasswordRequest{}).ProtoReflect().Descriptor(), "NewPassword", "new_password"},
+    {(&pb.UpsertRequest{}).ProtoReflect().Descriptor(), "Company", "company"},
+    {(&pb.CreateApiKeyRequest{}).ProtoReflect().Descriptor(), "Scopes[1]", "scopes[1]"},
+    // names the message does not have, or without a message, are kept
+    {(&pb.UpsertRequest{}).ProtoReflect().Descriptor(), "Unknown", "Unknown"},
+    {nil, "Scopes[1]", "Scopes[1]"},
+  }
+  for _, test := range tests {
+    name, field := protoFieldName(test.desc, test.goName)
+    if name != test.want {
+      t.Errorf("protoFieldName(%s) = %q, want %q", test.goName, name, test.want)
+    }
+    if (field != nil) != (name != test.goName) {
+      t.Errorf("protoFieldName(%s) returned field %v for %q", test.goName, field, name)
+    }
+  }
+}
+
+func TestValidate(t *testing.T) {
+  tests := []struct {
+    name string
+    req  interface{}
+    // fields are the violations expected in order, none for a valid request
+    fields []string
+  }{
+    {"valid login", &pb.UpsertRequest{Email: "owner@example.com", Password: "secret"}, nil},
+    {"empty request", &pb.UpsertRequest{}, nil},
+    {"message without rules", "not a message", nil},
+    {"nested fields", &pb.UpsertRequest{Id: "xyz", Company: &pb.Company{Email: "nope", Name: string(make([]byte, 101))}},
+      []string{"company.email", "company.name", "id"}},
+    {"field with an underscore", &pb.ResetPasswordRequest{}, []string{"token", "new_password"}},
+    {"repeated field", &pb.CreateApiKeyRequest{Scopes: []pb.ApiKeyScope{pb.ApiKeyScope_READ_PROFILE, 0, 42}},
+      []string{"scopes[1]", "scopes[2]"}},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      err := validate(test.req)
+      if len(test.fields) == 0 {
+        if err != nil {
+          t.Fatalf("validate returned %v, want nil", err)
+        }
+        return
+      }
+
+      st := status.Convert(err)
+      if st.Code() != codes.InvalidArgument {
+        t.Fatalf("validate returned %v, want InvalidArgument", err)
+      }
+      fields := []string{}
+      for _, detail := range st.Details() {
+        if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+          for _, violation := range badRequest.FieldViolations {
+            fields = append(fields, violation.Field)
+          }
+        }
+      }
+      if !reflect.DeepEqual(fields, test.fields) {
+        t.Errorf("validate reported violations of %v, want %v", fields, test.fields)
+      }
+    })
+  }
+}
+
+func TestFieldViolationsOfOtherErrors(t *testing.T) {
+  if violations := fieldViolations(errors.New("failed"), nil, ""); violations != nil {
+    t.Errorf("fieldViolations of an error without a field returned %v, want none", violations)
+  }
+}
@@ -4,8 +4,6 @@ import (
   "context"
   "log"
   "net"
-  "os"
-  "os/signal"
 
   "google.golang.org/grpc"
 
@@ -14,33 +12,30 @@ import (
   "github.com/ckbball/os-company/pkg/protocol/grpc/middleware"
 )
 
-// RunServer runs gRPC service to publish User service
-func RunServer(ctx context.Context, v1API v1.CompanyServiceServer, port string) error {
+// RunServer runs gRPC service to publish Company service, it stops gracefully when ctx is cancelled.
+// opts are added to the server options, e.g. the interceptors of middleware.AddAuth.
+func RunServer(ctx context.Context, v1API v1.CompanyServiceServer, port string, opts ...grpc.ServerOption) error {
   listen, err := net.Listen("tcp", ":"+port)
   if err != nil {
     return err
   }
 
-  opts := []grpc.ServerOption{}
-
   opts = middleware.AddLogging(logger.Log, opts)
+  // errors are converted inside the logging, so that the log shows the codes callers get
+  opts = middleware.AddErrorStatus(logger.Log, opts)
+  // validation runs last, so that rejected requests are logged and callers are authenticated first
+  opts = middleware.AddValidation(opts)
 
   // register service
   server := grpc.NewServer(opts...)
   v1.RegisterCompanyServiceServer(server, v1API)
 
   // graceful shutdown
-  c := make(chan os.Signal, 1)
-  signal.Notify(c, os.Interrupt)
   go func() {
-    for range c {
-      // sig is a ^C, handle it
-      log.Println("shutting down gRPC server...")
-
-      server.GracefulStop()
+    <-ctx.Done()
+    log.Println("shutting down gRPC server...")
 
-      <-ctx.Done()
-    }
+    server.GracefulStop()
   }()
 
   // start gRPC server
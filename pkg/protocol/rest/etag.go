@@ -0,0 +1,65 @@
+package rest
+
+import (
+  "context"
+  "fmt"
+  "net/http"
+  "net/textproto"
+
+  "github.com/golang/protobuf/proto"
+  "github.com/grpc-ecosystem/grpc-gateway/runtime"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+// ifMatchMetadata is the metadata the service reads the If-Match header from
+const ifMatchMetadata = "if-match"
+
+// incomingHeader passes If-Match to the service as is, the other headers the default way
+func incomingHeader(key string) (string, bool) {
+  if textproto.CanonicalMIMEHeaderKey(key) == "If-Match" {
+    return ifMatchMetadata, true
+  }
+  return runtime.DefaultHeaderMatcher(key)
+}
+
+// setETag sets the ETag header of responses carrying a company to its version, which is
+// what If-Match of UpdateCompany and DeleteCompany expects
+func setETag(ctx context.Context, w http.ResponseWriter, resp proto.Message) error {
+  var version int64
+  switch resp := resp.(type) {
+  case *v1.FindResponse:
+    version = resp.GetCompany().GetVersion()
+  case *v1.AuthResponse:
+    version = resp.GetCompany().GetVersion()
+  case *v1.UpsertResponse:
+    version = resp.GetVersion()
+  }
+  if version > 0 {
+    w.Header().Set("ETag", fmt.Sprintf(`"%d"`, version))
+  }
+  return nil
+}
+
+// preconditionError answers requests whose If-Match does not match the version of the company
+// with 412 Precondition Failed instead of the 409 Conflict of Aborted, other errors as usual
+func preconditionError(ctx context.Context, mux *runtime.ServeMux, marshaler runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+  if status.Code(err) == codes.Aborted && r.Header.Get("If-Match") != "" {
+    w = preconditionFailedWriter{w}
+  }
+  runtime.DefaultHTTPError(ctx, mux, marshaler, w, r, err)
+}
+
+// preconditionFailedWriter turns the status 409 Conflict into 412 Precondition Failed
+type preconditionFailedWriter struct {
+  http.ResponseWriter
+}
+
+func (w preconditionFailedWriter) WriteHeader(code int) {
+  if code == http.StatusConflict {
+    code = http.StatusPreconditionFailed
+  }
+  w.ResponseWriter.WriteHeader(code)
+}
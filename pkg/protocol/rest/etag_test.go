@@ -0,0 +1,81 @@
+package rest
+
+import (
+  "context"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+
+  "github.com/golang/protobuf/proto"
+  "github.com/grpc-ecosystem/grpc-gateway/runtime"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+func TestIncomingHeader(t *testing.T) {
+  for _, key := range []string{"If-Match", "if-match"} {
+    if name, ok := incomingHeader(key); !ok || name != ifMatchMetadata {
+      t.Errorf("incomingHeader(%s) = %q, %v, want %q", key, name, ok, ifMatchMetadata)
+    }
+  }
+  for _, key := range []string{"Authorization", "X-Unknown"} {
+    name, ok := incomingHeader(key)
+    wantName, wantOk := runtime.DefaultHeaderMatcher(key)
+    if name != wantName || ok != wantOk {
+      t.Errorf("incomingHeader(%s) = %q, %v, want the default %q, %v", key, name, ok, wantName, wantOk)
+    }
+  }
+}
+
+func TestSetETag(t *testing.T) {
+  tests := []struct {
+    name string
+    resp proto.Message
+    want string
+  }{
+    {"company", &v1.FindResponse{Company: &v1.Company{Version: 3}}, `"3"`},
+    {"caller", &v1.AuthResponse{Company: &v1.Company{Version: 4}}, `"4"`},
+    {"update", &v1.UpsertResponse{Version: 5}, `"5"`},
+    {"no company", &v1.FindResponse{}, ""},
+    {"company from before versions", &v1.FindResponse{Company: &v1.Company{}}, ""},
+    {"other response", &v1.DeleteResponse{Count: 1}, ""},
+  }
+  for _, test := range tests {
+    w := httptest.NewRecorder()
+    if err := setETag(context.Background(), w, test.resp); err != nil {
+      t.Fatalf("setETag failed: %v", err)
+    }
+    if got := w.Header().Get("ETag"); got != test.want {
+      t.Errorf("%s: ETag is %q, want %q", test.name, got, test.want)
+    }
+  }
+}
+
+func TestPreconditionError(t *testing.T) {
+  tests := []struct {
+    name    string
+    ifMatch string
+    err     error
+    want    int
+  }{
+    {"version mismatch with If-Match", `"3"`, status.Error(codes.Aborted, "changed"), http.StatusPreconditionFailed},
+    {"version mismatch with any version", "*", status.Error(codes.Aborted, "changed"), http.StatusPreconditionFailed},
+    {"version mismatch without If-Match", "", status.Error(codes.Aborted, "changed"), http.StatusConflict},
+    {"other error with If-Match", `"3"`, status.Error(codes.NotFound, "company not found"), http.StatusNotFound},
+    {"internal error with If-Match", `"3"`, errors.New("failed"), http.StatusInternalServerError},
+  }
+  for _, test := range tests {
+    r := httptest.NewRequest(http.MethodPatch, "/v1/companies/5e0000000000000000000000", nil)
+    if test.ifMatch != "" {
+      r.Header.Set("If-Match", test.ifMatch)
+    }
+    w := httptest.NewRecorder()
+    preconditionError(context.Background(), runtime.NewServeMux(), &runtime.JSONPb{}, w, r, test.err)
+    if w.Code != test.want {
+      t.Errorf("%s: status is %d, want %d", test.name, w.Code, test.want)
+    }
+  }
+}
@@ -0,0 +1,18 @@
+// Package openapi serves the OpenAPI (swagger 2.0) document of the HTTP gateway.
+// The document is generated from proto/company/v1/company.proto by third_party/protoc-gen.sh,
+// regenerate it whenever the proto changes.
+package openapi
+
+import (
+  _ "embed"
+  "net/http"
+)
+
+//go:embed company/v1/company.swagger.json
+var spec []byte
+
+// ServeSpec writes the OpenAPI document
+func ServeSpec(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "application/json")
+  _, _ = w.Write(spec)
+}
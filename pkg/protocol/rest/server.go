@@ -0,0 +1,65 @@
+package rest
+
+import (
+  "context"
+  "log"
+  "net/http"
+  "time"
+
+  "github.com/grpc-ecosystem/grpc-gateway/runtime"
+  httpSwagger "github.com/swaggo/http-swagger"
+  "google.golang.org/grpc"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+  "github.com/ckbball/os-company/pkg/protocol/rest/openapi"
+)
+
+// shutdownTimeout is how long in-flight HTTP requests get to finish on shutdown
+const shutdownTimeout = 5 * time.Second
+
+// RunServer runs the HTTP/JSON gateway in front of the gRPC server listening on grpcPort.
+// It shuts down gracefully when ctx is cancelled.
+func RunServer(ctx context.Context, grpcPort, httpPort string) error {
+  ctx, cancel := context.WithCancel(ctx)
+  defer cancel()
+
+  mux := runtime.NewServeMux(
+    // keep the proto field names (next_page_token) in JSON
+    runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{OrigName: true}),
+    // versions of companies as ETag and If-Match
+    runtime.WithIncomingHeaderMatcher(incomingHeader),
+    runtime.WithForwardResponseOption(setETag),
+    runtime.WithProtoErrorHandler(preconditionError),
+  )
+  opts := []grpc.DialOption{grpc.WithInsecure()}
+  if err := v1.RegisterCompanyServiceHandlerFromEndpoint(ctx, mux, "localhost:"+grpcPort, opts); err != nil {
+    return err
+  }
+
+  // API docs next to the gateway, the swagger-ui assets are bundled in the binary
+  httpMux := http.NewServeMux()
+  httpMux.Handle("/", mux)
+  httpMux.HandleFunc("/openapi.json", openapi.ServeSpec)
+  httpMux.Handle("/docs/", httpSwagger.Handler(httpSwagger.URL("/openapi.json")))
+
+  srv := &http.Server{
+    Addr:    ":" + httpPort,
+    Handler: httpMux,
+  }
+
+  // graceful shutdown
+  go func() {
+    <-ctx.Done()
+    log.Println("shutting down HTTP gateway...")
+
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+    defer cancel()
+    _ = srv.Shutdown(shutdownCtx)
+  }()
+
+  log.Println("starting HTTP/REST gateway...")
+  if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+    return err
+  }
+  return nil
+}
@@ -0,0 +1,100 @@
+package v1
+
+import (
+  "context"
+  "fmt"
+  "net/url"
+  "time"
+
+  "go.uber.org/zap"
+
+  "github.com/ckbball/os-company/pkg/logger"
+  "github.com/ckbball/os-company/pkg/mailer"
+)
+
+const (
+  // purposePasswordReset tokens let a member choose a new password
+  purposePasswordReset = "password_reset"
+  // purposeEmailVerification tokens confirm the email of a company
+  purposeEmailVerification = "email_verification"
+
+  // mailTimeout bounds sending a single email
+  mailTimeout = 30 * time.Second
+)
+
+// ActionToken is the server-side record of a single-use token emailed to a company or a member
+// to confirm an action such as a password reset. Only the hash of the token is stored,
+// and consuming it deletes it.
+type ActionToken struct {
+  Hash      string `json:"hash" bson:"_id"`
+  Purpose   string `json:"purpose" bson:"purpose"`
+  CompanyId string `json:"companyId" bson:"company_id"`
+  // MemberId is set instead of CompanyId for tokens about the login of a member,
+  // and together with it for tokens about the member in the company
+  MemberId string `json:"memberId" bson:"member_id,omitempty"`
+  // Email is the email of the company or member when the token was sent
+  Email     string    `json:"email" bson:"email"`
+  ExpiresAt time.Time `json:"expiresAt" bson:"expires_at"`
+  CreatedAt time.Time `json:"createdAt" bson:"created_at"`
+}
+
+// newActionToken returns a new token for purpose and the record to store for it
+func newActionToken(purpose string, company *Company, ttl time.Duration) (string, *ActionToken) {
+  token := newOpaqueToken()
+  now := time.Now()
+  return token, &ActionToken{
+    Hash:      hashToken(token),
+    Purpose:   purpose,
+    CompanyId: company.Id.Hex(),
+    Email:     company.Email,
+    ExpiresAt: now.Add(ttl),
+    CreatedAt: now,
+  }
+}
+
+// newMemberActionToken returns a new token for purpose about the login of member and the record to store for it
+func newMemberActionToken(purpose string, member *Member, ttl time.Duration) (string, *ActionToken) {
+  token := newOpaqueToken()
+  now := time.Now()
+  return token, &ActionToken{
+    Hash:      hashToken(token),
+    Purpose:   purpose,
+    MemberId:  member.Id.Hex(),
+    Email:     member.Email,
+    ExpiresAt: now.Add(ttl),
+    CreatedAt: now,
+  }
+}
+
+// Links are the pages of the frontend that emailed tokens point to,
+// the token is appended as the "token" query parameter
+type Links struct {
+  ResetPassword    string
+  VerifyEmail      string
+  AcceptInvitation string
+  AcceptOwnership  string
+}
+
+// sendMail sends msg in the background, so that the response time does not
+// depend on the mail server or tell whether an email was sent at all
+func (s *handler) sendMail(msg *mailer.Message) {
+  go func() {
+    ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+    defer cancel()
+    if err := s.mailer.Send(ctx, msg); err != nil {
+      logger.Log.Error("failed to send email", zap.String("subject", msg.Subject), zap.Error(err))
+    }
+  }()
+}
+
+// withToken appends token to the link of a frontend page
+func withToken(link, token string) (string, error) {
+  u, err := url.Parse(link)
+  if err != nil {
+    return "", fmt.Errorf("invalid link '%s': %v", link, err)
+  }
+  query := u.Query()
+  query.Set("token", token)
+  u.RawQuery = query.Encode()
+  return u.String(), nil
+}
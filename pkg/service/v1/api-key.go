@@ -0,0 +1,216 @@
+package v1
+
+import (
+  "context"
+  "strings"
+  "time"
+
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+const (
+  // apiKeyPrefix starts every API key, so that keys are told apart from access tokens
+  // and found by secret scanners
+  apiKeyPrefix = "osk_"
+  // apiKeyTouchInterval limits how often the last use of a key is written
+  apiKeyTouchInterval = time.Minute
+  // maxApiKeys is the number of keys a company may have
+  maxApiKeys = 20
+)
+
+// errInvalidApiKey is returned for every unusable API key
+var errInvalidApiKey = status.Error(codes.Unauthenticated, "invalid API key")
+
+// ApiKey is the server-side record of an API key. Only the hash of the key is stored.
+type ApiKey struct {
+  Id        string `json:"id" bson:"_id"`
+  Hash      string `json:"hash" bson:"hash"`
+  CompanyId string `json:"companyId" bson:"company_id"`
+  Name      string `json:"name" bson:"name"`
+  // Prefix is the start of the key, shown to tell keys apart
+  Prefix string `json:"prefix" bson:"prefix"`
+  // Scopes are names of v1.ApiKeyScope values
+  Scopes     []string  `json:"scopes" bson:"scopes"`
+  CreatedAt  time.Time `json:"createdAt" bson:"created_at"`
+  LastUsedAt time.Time `json:"lastUsedAt" bson:"last_used_at"`
+}
+
+// Authenticator resolves the bearer credential of a request, an access token or an API key
+type Authenticator struct {
+  tokenService Authable
+  repo         Repository
+}
+
+func NewAuthenticator(tokenService Authable, repo Repository) *Authenticator {
+  return &Authenticator{
+    tokenService: tokenService,
+    repo:         repo,
+  }
+}
+
+// Authenticate returns the claims of an access token or an API key.
+// API keys get claims with ApiKeyId and Scopes set.
+func (a *Authenticator) Authenticate(credential string) (*CustomClaims, error) {
+  if !strings.HasPrefix(credential, apiKeyPrefix) {
+    return a.tokenService.Decode(credential)
+  }
+
+  key, err := a.repo.GetApiKeyByHash(hashToken(credential))
+  if err == ErrNotFound {
+    return nil, errInvalidApiKey
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  // remember the last use, but not on every single request
+  now := time.Now()
+  if now.Sub(key.LastUsedAt) > apiKeyTouchInterval {
+    if err := a.repo.TouchApiKey(key.Id, now); err != nil {
+      return nil, err
+    }
+  }
+
+  return &CustomClaims{
+    Company:  &v1.Company{Id: key.CompanyId},
+    ApiKeyId: key.Id,
+    Scopes:   key.Scopes,
+  }, nil
+}
+
+// CreateApiKey creates an API key for the caller
+func (s *handler) CreateApiKey(ctx context.Context, req *v1.CreateApiKeyRequest) (*v1.CreateApiKeyResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := caller(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  if strings.TrimSpace(req.Name) == "" {
+    return nil, status.Error(codes.InvalidArgument, "name is empty")
+  }
+  if len(req.Scopes) == 0 {
+    return nil, status.Error(codes.InvalidArgument, "an API key needs at least one scope")
+  }
+  scopes := []string{}
+  seen := map[v1.ApiKeyScope]bool{}
+  for _, scope := range req.Scopes {
+    if _, ok := v1.ApiKeyScope_name[int32(scope)]; !ok || scope == v1.ApiKeyScope_SCOPE_UNSPECIFIED {
+      return nil, status.Errorf(codes.InvalidArgument, "invalid scope %v", scope)
+    }
+    // a key can only hand out what it may do itself
+    if !claims.HasScope(scope) {
+      return nil, status.Errorf(codes.PermissionDenied, "cannot grant scope %v", scope)
+    }
+    if !seen[scope] {
+      seen[scope] = true
+      scopes = append(scopes, scope.String())
+    }
+  }
+
+  existing, err := s.repo.ListApiKeys(claims.Company.Id)
+  if err != nil {
+    return nil, err
+  }
+  if len(existing) >= maxApiKeys {
+    return nil, status.Errorf(codes.ResourceExhausted, "a company can have at most %d API keys", maxApiKeys)
+  }
+
+  secret := apiKeyPrefix + newOpaqueToken()
+  key := &ApiKey{
+    Id:        newTokenId(),
+    Hash:      hashToken(secret),
+    CompanyId: claims.Company.Id,
+    Name:      req.Name,
+    Prefix:    secret[:len(apiKeyPrefix)+6],
+    Scopes:    scopes,
+    CreatedAt: time.Now(),
+  }
+  if err := s.repo.CreateApiKey(key); err != nil {
+    return nil, err
+  }
+
+  return &v1.CreateApiKeyResponse{
+    Api:    apiVersion,
+    ApiKey: exportApiKey(key),
+    Key:    secret,
+  }, nil
+}
+
+// ListApiKeys lists the API keys of the caller
+func (s *handler) ListApiKeys(ctx context.Context, req *v1.ListApiKeysRequest) (*v1.ListApiKeysResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := caller(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  keys, err := s.repo.ListApiKeys(claims.Company.Id)
+  if err != nil {
+    return nil, err
+  }
+
+  out := []*v1.ApiKey{}
+  for _, key := range keys {
+    out = append(out, exportApiKey(key))
+  }
+  return &v1.ListApiKeysResponse{
+    Api:     apiVersion,
+    ApiKeys: out,
+  }, nil
+}
+
+// RevokeApiKey deletes an API key of the caller
+func (s *handler) RevokeApiKey(ctx context.Context, req *v1.RevokeApiKeyRequest) (*v1.RevokeApiKeyResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := caller(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  err = s.repo.DeleteApiKey(claims.Company.Id, req.KeyId)
+  if err == ErrNotFound {
+    return nil, status.Error(codes.NotFound, "API key not found")
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  return &v1.RevokeApiKeyResponse{
+    Api:    apiVersion,
+    Status: "Revoked",
+  }, nil
+}
+
+// exportApiKey converts the database model of an API key to the gRPC message
+func exportApiKey(key *ApiKey) *v1.ApiKey {
+  out := &v1.ApiKey{
+    Id:        key.Id,
+    Name:      key.Name,
+    Prefix:    key.Prefix,
+    Scopes:    []v1.ApiKeyScope{},
+    CreatedAt: key.CreatedAt.Unix(),
+  }
+  if !key.LastUsedAt.IsZero() {
+    out.LastUsedAt = key.LastUsedAt.Unix()
+  }
+  for _, scope := range key.Scopes {
+    out.Scopes = append(out.Scopes, v1.ApiKeyScope(v1.ApiKeyScope_value[scope]))
+  }
+  return out
+}
@@ -0,0 +1,77 @@
+package v1
+
+import (
+  "strconv"
+  "time"
+
+  "github.com/go-redis/redis/v7"
+)
+
+// RedisAttemptStore is an AttemptStore shared by every instance through redis.
+// The counter of a key is a hash with the number of failures and the time of the last one.
+type RedisAttemptStore struct {
+  client *redis.Client
+}
+
+func NewRedisAttemptStore(client *redis.Client) *RedisAttemptStore {
+  return &RedisAttemptStore{
+    client: client,
+  }
+}
+
+func (s *RedisAttemptStore) Reserve(key string, ttl time.Duration) (int, time.Time, error) {
+  key = "attempts:" + key
+  now := time.Now().UnixNano() / int64(time.Millisecond)
+
+  // MULTI runs the commands in one go, the previous time is read before it is replaced
+  var failures *redis.IntCmd
+  var last *redis.StringCmd
+  _, err := s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+    failures = pipe.HIncrBy(key, "failures", 1)
+    last = pipe.HGet(key, "last")
+    pipe.HSet(key, "last", now)
+    pipe.PExpire(key, ttl)
+    return nil
+  })
+  // the first attempt has no previous time
+  if err != nil && err != redis.Nil {
+    return 0, time.Time{}, err
+  }
+
+  var previous time.Time
+  if value, err := last.Result(); err == nil {
+    millis, err := strconv.ParseInt(value, 10, 64)
+    if err != nil {
+      return 0, time.Time{}, err
+    }
+    previous = time.Unix(0, millis*int64(time.Millisecond))
+  }
+  return int(failures.Val()), previous, nil
+}
+
+// releaseScript takes back an attempt, a counter that drops to zero or had expired already is deleted
+var releaseScript = redis.NewScript(`
+  if redis.call("HINCRBY", KEYS[1], "failures", -1) <= 0 then
+    return redis.call("DEL", KEYS[1])
+  end
+  if ARGV[1] == "" then
+    return redis.call("HDEL", KEYS[1], "last")
+  end
+  return redis.call("HSET", KEYS[1], "last", ARGV[1])
+`)
+
+func (s *RedisAttemptStore) Release(key string, previous time.Time) error {
+  last := ""
+  if !previous.IsZero() {
+    last = strconv.FormatInt(previous.UnixNano()/int64(time.Millisecond), 10)
+  }
+  err := releaseScript.Run(s.client, []string{"attempts:" + key}, last).Err()
+  if err == redis.Nil {
+    return nil
+  }
+  return err
+}
+
+func (s *RedisAttemptStore) Reset(key string) error {
+  return s.client.Del("attempts:" + key).Err()
+}
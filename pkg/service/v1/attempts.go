@@ -0,0 +1,87 @@
+package v1
+
+import (
+  "sync"
+  "time"
+)
+
+// AttemptStore counts login attempts per key, see LoginLimiter. Attempts are counted before
+// they are made, so that parallel attempts cannot all pass a check of the count.
+type AttemptStore interface {
+  // Reserve counts an attempt of key and returns the number of attempts in a row including
+  // this one, and the time of the previous one. The attempts are forgotten after ttl without a new one.
+  Reserve(key string, ttl time.Duration) (attempts int, previous time.Time, err error)
+  // Release takes back an attempt that did not fail or was not checked, previous is the time Reserve returned for it
+  Release(key string, previous time.Time) error
+  // Reset forgets the attempts of key
+  Reset(key string) error
+}
+
+// MemoryAttemptStore is an AttemptStore for a single instance, counters are lost on restart
+type MemoryAttemptStore struct {
+  mu       sync.Mutex
+  attempts map[string]failedAttempts
+}
+
+type failedAttempts struct {
+  failures  int
+  last      time.Time
+  expiresAt time.Time
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+  return &MemoryAttemptStore{
+    attempts: map[string]failedAttempts{},
+  }
+}
+
+func (s *MemoryAttemptStore) Reserve(key string, ttl time.Duration) (int, time.Time, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.purge()
+  now := time.Now()
+  attempts := s.attempts[key]
+  previous := attempts.last
+  attempts.failures++
+  attempts.last = now
+  attempts.expiresAt = now.Add(ttl)
+  s.attempts[key] = attempts
+  return attempts.failures, previous, nil
+}
+
+func (s *MemoryAttemptStore) Release(key string, previous time.Time) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  attempts, ok := s.attempts[key]
+  if !ok {
+    return nil
+  }
+  attempts.failures--
+  attempts.last = previous
+  if attempts.failures <= 0 {
+    delete(s.attempts, key)
+    return nil
+  }
+  s.attempts[key] = attempts
+  return nil
+}
+
+func (s *MemoryAttemptStore) Reset(key string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  delete(s.attempts, key)
+  return nil
+}
+
+// purge drops forgotten counters, the caller must hold the lock
+func (s *MemoryAttemptStore) purge() {
+  now := time.Now()
+  for key, attempts := range s.attempts {
+    if now.After(attempts.expiresAt) {
+      delete(s.attempts, key)
+    }
+  }
+}
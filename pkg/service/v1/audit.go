@@ -0,0 +1,73 @@
+package v1
+
+import (
+  "context"
+  "time"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+const (
+  // auditOwnershipTransferStarted is recorded when the owner offers the company to a member
+  auditOwnershipTransferStarted = "ownership_transfer_started"
+  // auditOwnershipTransferred is recorded when the member accepts, the previous owner is its target
+  auditOwnershipTransferred = "ownership_transferred"
+)
+
+// AuditEvent is an entry of the audit trail of a company. Events are never changed
+// and are kept after the company is deleted.
+type AuditEvent struct {
+  Id        string `json:"id" bson:"_id"`
+  CompanyId string `json:"companyId" bson:"company_id"`
+  Action    string `json:"action" bson:"action"`
+  // ActorId is the member who did it, TargetId the member it was done to, if any
+  ActorId   string    `json:"actorId" bson:"actor_id"`
+  TargetId  string    `json:"targetId" bson:"target_id"`
+  CreatedAt time.Time `json:"createdAt" bson:"created_at"`
+}
+
+// ListAuditEvents lists the audit trail of the company of the caller, newest first
+func (s *handler) ListAuditEvents(ctx context.Context, req *v1.ListAuditEventsRequest) (*v1.ListAuditEventsResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := requireRole(ctx, v1.MemberRole_ADMIN)
+  if err != nil {
+    return nil, err
+  }
+
+  events, err := s.repo.ListAuditEvents(claims.Company.Id)
+  if err != nil {
+    return nil, err
+  }
+
+  out := []*v1.AuditEvent{}
+  for _, event := range events {
+    out = append(out, &v1.AuditEvent{
+      Id:        event.Id,
+      Action:    event.Action,
+      ActorId:   event.ActorId,
+      TargetId:  event.TargetId,
+      CreatedAt: event.CreatedAt.Unix(),
+    })
+  }
+
+  return &v1.ListAuditEventsResponse{
+    Api:    apiVersion,
+    Events: out,
+  }, nil
+}
+
+// audit records action of actorId on targetId in the audit trail of a company
+func (s *handler) audit(companyId string, action string, actorId string, targetId string) error {
+  return s.repo.CreateAuditEvent(&AuditEvent{
+    Id:        newTokenId(),
+    CompanyId: companyId,
+    Action:    action,
+    ActorId:   actorId,
+    TargetId:  targetId,
+    CreatedAt: time.Now(),
+  })
+}
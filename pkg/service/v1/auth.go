@@ -8,66 +8,284 @@ import (
 )
 
 var (
+  // errTokenRevoked is returned by Decode for revoked tokens
+  errTokenRevoked = jwt.NewValidationError("token revoked", jwt.ValidationErrorClaimsInvalid)
+  // errUnknownKey is returned by Decode for tokens signed by a key that is not in the key set
+  errUnknownKey = jwt.NewValidationError("unknown signing key", jwt.ValidationErrorUnverifiable)
+  // errWrongPurpose is returned for tokens that are valid but not meant for the call
+  errWrongPurpose = jwt.NewValidationError("wrong token purpose", jwt.ValidationErrorClaimsInvalid)
+)
+
+const (
+  // accessTokenTTL is the lifetime of access tokens, sessions are kept alive with refresh tokens
+  accessTokenTTL = 15 * time.Minute
+  // challengeTokenTTL is the time a company has to enter its second factor after its password
+  challengeTokenTTL = 5 * time.Minute
 
-  // Define a secure key string used
-  // as a salt when hashing our tokens.
-  // Please make your own way more secure than this,
-  // use a randomly generated md5 hash or something.
-  key = []byte("mySuperSecretKeyLol")
+  // purposeSecondFactor marks challenge tokens, which only prove the password and are exchanged
+  // for an access token by VerifySecondFactor. Access tokens have no purpose.
+  purposeSecondFactor = "second_factor"
+  // purposeInvitation marks invitation tokens, see invitationClaims
+  purposeInvitation = "invitation"
 )
 
-func NewTokenService() *TokenService {
-  return &TokenService{}
+// NewTokenService returns a token service signing with the keys of keys.
+// Other services verify the tokens with the public keys published by Jwks.
+// Access tokens of the members in adminIds are admin tokens, whatever their company.
+func NewTokenService(keys *KeySet, revocations RevocationStore, adminIds []string) *TokenService {
+  admins := map[string]bool{}
+  for _, id := range adminIds {
+    admins[id] = true
+  }
+
+  return &TokenService{
+    keys:        keys,
+    revocations: revocations,
+    admins:      admins,
+  }
 }
 
 // CustomClaims is our custom metadata, which will be hashed
 // and sent as the second segment in our JWT
 type CustomClaims struct {
-  User *pb.User
+  Company *pb.Company
+  // MemberId and Role are the member the token was issued to and its role in the company
+  MemberId string `json:"member_id,omitempty"`
+  Role     string `json:"role,omitempty"`
+  // Admin is set for platform administrators
+  Admin bool `json:"admin,omitempty"`
+  // Purpose is set for tokens that are not access tokens
+  Purpose string `json:"purpose,omitempty"`
+  // IssuedAtNano is the issue time in unix nanoseconds. "iat" only has seconds, which cannot tell a token
+  // issued right after a RevokeAll from the ones it revokes.
+  IssuedAtNano int64 `json:"iat_ns,omitempty"`
+  // ApiKeyId and Scopes are set for API keys, they are never part of a JWT
+  ApiKeyId string   `json:"-"`
+  Scopes   []string `json:"-"`
+  jwt.StandardClaims
+}
+
+// HasScope reports if the claims allow scope. Access tokens may do everything.
+func (c *CustomClaims) HasScope(scope pb.ApiKeyScope) bool {
+  if c.ApiKeyId == "" {
+    return true
+  }
+  for _, granted := range c.Scopes {
+    if granted == scope.String() {
+      return true
+    }
+  }
+  return false
+}
+
+// HasRole reports if the claims carry role or a role above it. API keys are limited by their scopes instead.
+func (c *CustomClaims) HasRole(role pb.MemberRole) bool {
+  if c.ApiKeyId != "" {
+    return true
+  }
+  return pb.MemberRole_value[c.Role] >= int32(role)
+}
+
+// invitationClaims are the claims of invitation tokens. They carry no member
+// and are only accepted by DecodeInvitation.
+type invitationClaims struct {
+  CompanyId string `json:"company_id"`
+  Purpose   string `json:"purpose"`
   jwt.StandardClaims
 }
 
 type Authable interface {
   Decode(token string) (*CustomClaims, error)
-  Encode(user *pb.User) (string, error)
+  // Encode returns an access token of member for company
+  Encode(company *pb.Company, member *pb.Member) (string, error)
+  // EncodeChallenge returns a challenge token for a member that still has to pass its second factor
+  EncodeChallenge(company *pb.Company, member *pb.Member) (string, error)
+  // DecodeChallenge decodes a challenge token, access tokens are rejected
+  DecodeChallenge(token string) (*CustomClaims, error)
+  // Revoke revokes a single token
+  Revoke(claims *CustomClaims) error
+  // RevokeAll revokes every token issued so far to a company or to a member
+  RevokeAll(id string) error
+  // EncodeInvitation returns a token for the invitation with id to the company with companyId
+  EncodeInvitation(id string, companyId string, expiresAt time.Time) (string, error)
+  // DecodeInvitation returns the id of the invitation of an invitation token
+  DecodeInvitation(token string) (string, error)
+  // Jwks returns the public keys tokens are verified with
+  Jwks() []*pb.Jwk
 }
 
 type TokenService struct {
+  keys        *KeySet
+  revocations RevocationStore
+  admins      map[string]bool
 }
 
-// Decode a token string into a token object
+// Decode a token string into a token object, only access tokens are accepted
 func (srv *TokenService) Decode(tokenString string) (*CustomClaims, error) {
+  return srv.decode(tokenString, "")
+}
 
-  // Parse the token
-  token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-    return key, nil
-  })
+// DecodeChallenge decodes a challenge token
+func (srv *TokenService) DecodeChallenge(tokenString string) (*CustomClaims, error) {
+  return srv.decode(tokenString, purposeSecondFactor)
+}
 
-  // Validate the token and return the custom claims
-  if claims, ok := token.Claims.(*CustomClaims); ok && token.Valid {
-    return claims, nil
-  } else {
+// decode verifies a token with the given purpose
+func (srv *TokenService) decode(tokenString string, purpose string) (*CustomClaims, error) {
+  token, err := srv.parse(tokenString, &CustomClaims{})
+  if err != nil {
     return nil, err
   }
+
+  // Validate the token
+  // tokens from before memberships have no member and are not accepted any more
+  claims, ok := token.Claims.(*CustomClaims)
+  if !ok || !token.Valid || claims.Company == nil || claims.MemberId == "" {
+    return nil, jwt.NewValidationError("invalid claims", jwt.ValidationErrorClaimsInvalid)
+  }
+  if claims.Purpose != purpose {
+    return nil, errWrongPurpose
+  }
+
+  // Reject revoked tokens
+  revoked, err := srv.revocations.IsRevoked(claims.Id)
+  if err != nil {
+    return nil, err
+  }
+  if revoked {
+    return nil, errTokenRevoked
+  }
+  for _, id := range []string{claims.Company.Id, claims.MemberId} {
+    before, err := srv.revocations.RevokedBefore(id)
+    if err != nil {
+      return nil, err
+    }
+    if !before.IsZero() && !claims.issuedAt().After(before) {
+      return nil, errTokenRevoked
+    }
+  }
+
+  return claims, nil
+}
+
+// issuedAt returns the issue time of the token, to the second for tokens without IssuedAtNano
+func (c *CustomClaims) issuedAt() time.Time {
+  if c.IssuedAtNano != 0 {
+    return time.Unix(0, c.IssuedAtNano)
+  }
+  return time.Unix(c.IssuedAt, 0)
+}
+
+// parse verifies the signature of a token and parses its claims into claims
+func (srv *TokenService) parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+
+  // Parse the token, only accepting the algorithms of our keys
+  parser := &jwt.Parser{ValidMethods: srv.keys.Methods()}
+  return parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+    kid, _ := token.Header["kid"].(string)
+    key, ok := srv.keys.Key(kid)
+    // the algorithm must match the key, never let the token choose how it is verified
+    if !ok || key.Method.Alg() != token.Method.Alg() {
+      return nil, errUnknownKey
+    }
+    return key.Public, nil
+  })
+}
+
+// DecodeInvitation verifies an invitation token and returns the id of its invitation.
+// Whether the invitation is still pending is up to the caller.
+func (srv *TokenService) DecodeInvitation(tokenString string) (string, error) {
+  token, err := srv.parse(tokenString, &invitationClaims{})
+  if err != nil {
+    return "", err
+  }
+
+  claims, ok := token.Claims.(*invitationClaims)
+  if !ok || !token.Valid || claims.Id == "" || claims.CompanyId == "" {
+    return "", jwt.NewValidationError("invalid claims", jwt.ValidationErrorClaimsInvalid)
+  }
+  if claims.Purpose != purposeInvitation {
+    return "", errWrongPurpose
+  }
+  return claims.Id, nil
+}
+
+// Revoke revokes a single token until it expires
+func (srv *TokenService) Revoke(claims *CustomClaims) error {
+  return srv.revocations.Revoke(claims.Id, time.Unix(claims.ExpiresAt, 0))
+}
+
+// RevokeAll revokes every token issued so far to a company or to a member
+func (srv *TokenService) RevokeAll(id string) error {
+  now := time.Now()
+  return srv.revocations.RevokeAllBefore(id, now, now.Add(accessTokenTTL))
 }
 
 // Encode a claim into a JWT
-func (srv *TokenService) Encode(user *pb.User) (string, error) {
+func (srv *TokenService) Encode(company *pb.Company, member *pb.Member) (string, error) {
+  return srv.encode(company, member, "", accessTokenTTL)
+}
 
-  expireToken := time.Now().Add(time.Hour * 24).Unix()
+// EncodeChallenge returns a short-lived challenge token
+func (srv *TokenService) EncodeChallenge(company *pb.Company, member *pb.Member) (string, error) {
+  return srv.encode(company, member, purposeSecondFactor, challengeTokenTTL)
+}
+
+// encode signs a token with the given purpose
+func (srv *TokenService) encode(company *pb.Company, member *pb.Member, purpose string, ttl time.Duration) (string, error) {
 
-  // Create the Claims
+  now := time.Now()
+
+  // Create the Claims, only the identity of the company and the member go into the token
   claims := CustomClaims{
-    user,
-    jwt.StandardClaims{
-      ExpiresAt: expireToken,
+    Company: &pb.Company{
+      Id:    company.Id,
+      Email: company.Email,
+    },
+    MemberId: member.Id,
+    Role:     member.Role.String(),
+    // admin rights come with access tokens only
+    Admin:        purpose == "" && srv.admins[member.Id],
+    Purpose:      purpose,
+    IssuedAtNano: now.UnixNano(),
+    StandardClaims: jwt.StandardClaims{
+      Id:        newTokenId(),
+      IssuedAt:  now.Unix(),
+      ExpiresAt: now.Add(ttl).Unix(),
       Issuer:    "one.user",
     },
   }
 
-  // Create token
-  token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+  return srv.sign(claims)
+}
+
+// EncodeInvitation returns an invitation token, its id is the id of the invitation
+func (srv *TokenService) EncodeInvitation(id string, companyId string, expiresAt time.Time) (string, error) {
+  return srv.sign(invitationClaims{
+    CompanyId: companyId,
+    Purpose:   purposeInvitation,
+    StandardClaims: jwt.StandardClaims{
+      Id:        id,
+      IssuedAt:  time.Now().Unix(),
+      ExpiresAt: expiresAt.Unix(),
+      Issuer:    "one.user",
+    },
+  })
+}
+
+// sign signs claims with the signing key
+func (srv *TokenService) sign(claims jwt.Claims) (string, error) {
+
+  // Create token, the kid tells verifiers which key to use
+  key := srv.keys.signing
+  token := jwt.NewWithClaims(key.Method, claims)
+  token.Header["kid"] = key.Id
 
   // Sign token and return
-  return token.SignedString(key)
+  return token.SignedString(key.Private)
+}
+
+// Jwks returns the public keys tokens are verified with
+func (srv *TokenService) Jwks() []*pb.Jwk {
+  return srv.keys.Jwks()
 }
@@ -2,26 +2,71 @@ package v1
 
 import (
   "context"
-  "errors"
-  "fmt"
+  "strconv"
+  "strings"
+  "time"
 
-  "golang.org/x/crypto/bcrypt"
+  "go.uber.org/zap"
+  "google.golang.org/genproto/googleapis/rpc/errdetails"
   "google.golang.org/grpc/codes"
   "google.golang.org/grpc/metadata"
   "google.golang.org/grpc/status"
 
   v1 "github.com/ckbball/os-company/pkg/api/v1"
+  "github.com/ckbball/os-company/pkg/errs"
+  "github.com/ckbball/os-company/pkg/logger"
+  "github.com/ckbball/os-company/pkg/mailer"
 )
 
+const (
+  // apiVersion is version of API is provided by server
+  apiVersion = "v1"
+  // ifMatchMetadata is the metadata the HTTP gateway passes the If-Match header in
+  ifMatchMetadata = "if-match"
+)
+
+// errCompanyNotFound is returned when the company of a request is missing
+var errCompanyNotFound = errs.New(errs.NotFound, "company not found")
+
+// errInvalidCredentials is returned by Login for unknown emails and wrong passwords alike
+var errInvalidCredentials = status.Error(codes.Unauthenticated, "invalid email or password")
+
+// errInvalidETag is returned for "if-match" metadata that is not the ETag of a company
+var errInvalidETag = badRequest("If-Match is not the ETag of a company",
+  fieldViolation(ifMatchMetadata, `must be the ETag of a company, e.g. "3"`))
+
 type handler struct {
-  repo         repository
-  tokenService Authable
+  repo          Repository
+  tokenService  Authable
+  credentials   *Authenticator
+  mailer        mailer.Mailer
+  links         Links
+  verification  VerificationPolicy
+  limiter       *LoginLimiter
+  oidcProviders map[string]*OidcProvider
+  passwords     *PasswordHasher
+  // passwordPolicy is checked for every password a member sets
+  passwordPolicy *PasswordPolicy
+  // dummyHash is verified against when Login gets an unknown email
+  dummyHash string
 }
 
-func NewCompanyServiceServer(repo repository, tokenService Authable) *handler {
+func NewCompanyServiceServer(repo Repository, tokenService Authable, mailer mailer.Mailer, links Links,
+  verification VerificationPolicy, limiter *LoginLimiter, oidcProviders map[string]*OidcProvider,
+  passwords *PasswordHasher, passwordPolicy *PasswordPolicy) *handler {
+  dummyHash, _ := passwords.Hash("dummy password")
   return &handler{
-    repo:         repo,
-    tokenService: tokenService,
+    repo:           repo,
+    tokenService:   tokenService,
+    credentials:    NewAuthenticator(tokenService, repo),
+    mailer:         mailer,
+    links:          links,
+    verification:   verification,
+    limiter:        limiter,
+    oidcProviders:  oidcProviders,
+    passwords:      passwords,
+    passwordPolicy: passwordPolicy,
+    dummyHash:      dummyHash,
   }
 }
 
@@ -35,24 +80,116 @@ func (s *handler) checkAPI(api string) error {
   return nil
 }
 
+// badRequest returns an InvalidArgument error with msg and the field violations of the request
+func badRequest(msg string, violations ...*errdetails.BadRequest_FieldViolation) error {
+  st, err := status.New(codes.InvalidArgument, msg).WithDetails(&errdetails.BadRequest{
+    FieldViolations: violations,
+  })
+  if err != nil {
+    return status.Error(codes.InvalidArgument, msg)
+  }
+  return st.Err()
+}
+
+// fieldViolation returns the violation of field for badRequest
+func fieldViolation(field string, description string) *errdetails.BadRequest_FieldViolation {
+  return &errdetails.BadRequest_FieldViolation{
+    Field:       field,
+    Description: description,
+  }
+}
+
+// expectedVersion returns the version of the company a write is based on: version if it is
+// set, otherwise the ETag of the "if-match" metadata, which is the version in quotes, e.g. "3".
+// 0 means any version, as does an If-Match of "*".
+func expectedVersion(ctx context.Context, version int64) (int64, error) {
+  if version != 0 {
+    return version, nil
+  }
+  md, ok := metadata.FromIncomingContext(ctx)
+  if !ok || len(md.Get(ifMatchMetadata)) == 0 {
+    return 0, nil
+  }
+
+  etag := strings.TrimSpace(md.Get(ifMatchMetadata)[0])
+  if etag == "*" {
+    return 0, nil
+  }
+  if len(etag) < 3 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+    return 0, errInvalidETag
+  }
+  parsed, err := strconv.ParseInt(etag[1:len(etag)-1], 10, 64)
+  if err != nil || parsed <= 0 {
+    return 0, errInvalidETag
+  }
+  return parsed, nil
+}
+
 func (s *handler) CreateCompany(ctx context.Context, req *v1.UpsertRequest) (*v1.UpsertResponse, error) {
   // check api version
   if err := s.checkAPI(req.Api); err != nil {
     return nil, err
   }
 
+  if req.Company == nil {
+    return nil, badRequest("company is required", fieldViolation("company", "company is required"))
+  }
+  // the email and password are the login of the owner
+  if req.Company.Email == "" || req.Company.Password == "" {
+    return nil, status.Error(codes.InvalidArgument, "email and password are required")
+  }
+  if err := s.checkPassword("company.password", req.Company.Password); err != nil {
+    return nil, err
+  }
+
   // generate hash of password
-  hashedPass, err := bcrypt.GenerateFromPassword([]byte(req.Company.Password), bcrypt.DefaultCost)
+  hashedPass, err := s.passwords.Hash(req.Company.Password)
   if err != nil {
-    return nil, errors.New(fmt.Sprintf("error hashing password: %v", err))
+    return nil, err
   }
-  req.Company.Password = string(hashedPass)
+  // the company itself has no login
+  req.Company.Password = ""
 
+  // new companies start unverified and get a verification link
+  req.Company.EmailVerified = false
   id, err := s.repo.Create(req.Company)
   if err != nil {
     return nil, err
   }
 
+  now := time.Now()
+  ownerId, err := s.repo.CreateMember(&Member{
+    Email:     req.Company.Email,
+    Password:  hashedPass,
+    CreatedAt: now,
+  })
+  if err == nil {
+    err = s.repo.CreateMembership(&Membership{
+      CompanyId: id,
+      MemberId:  ownerId,
+      Role:      v1.MemberRole_OWNER.String(),
+      CreatedAt: now,
+    })
+  }
+  if err != nil {
+    // a company nobody can log in to is of no use
+    if _, err := s.repo.Delete(id, 0); err != nil {
+      return nil, err
+    }
+    if err == ErrAlreadyExists {
+      return nil, errs.NewField(errs.AlreadyExists, "email", "a member with this email already exists")
+    }
+    return nil, err
+  }
+
+  company, err := s.repo.GetById(id)
+  if err != nil {
+    return nil, err
+  }
+  if err := s.sendVerification(company); err != nil {
+    return nil, err
+  }
+
   // return
   return &v1.UpsertResponse{
     Api:    apiVersion,
@@ -68,58 +205,152 @@ func (s *handler) Login(ctx context.Context, req *v1.UpsertRequest) (*v1.UpsertR
     return nil, err
   }
 
-  // get company from email
-  company, err := s.repo.GetByEmail(req.Email)
+  // count the attempt up front, and refuse to compare passwords while the account or the client are backing off
+  attempt, err := s.limiter.Reserve(req.Email, clientIP(ctx))
   if err != nil {
     return nil, err
   }
 
-  // Compare given password to stored hash
-  if err = bcrypt.CompareHashAndPassword([]byte(company.Password), []byte(req.Password)); err != nil {
+  // get member from email
+  member, err := s.memberByEmail(req.Email)
+  if err != nil && err != ErrNotFound {
     return nil, err
   }
 
-  intId := company.Id.Hex()
+  // Compare given password to stored hash. Unknown emails are compared against a dummy
+  // hash, so that neither the error nor the response time tell whether the email exists.
+  hash := s.dummyHash
+  if member != nil {
+    hash = member.Password
+  }
+  match, outdated, err := s.passwords.Verify(req.Password, hash)
+  if err != nil || !match || member == nil {
+    // the reserved attempt is the failure
+    return nil, errInvalidCredentials
+  }
+  if err := s.limiter.Pass(attempt); err != nil {
+    return nil, err
+  }
 
-  companyModel := &v1.Company{
-    Id:       intId, //
-    Email:    company.Email,
-    Password: company.Password,
+  // raising the hashing cost takes effect for every member on its next login
+  if outdated {
+    s.rehashPassword(member, req.Password)
   }
 
-  // generate new token
-  token, err := s.tokenService.Encode(companyModel)
+  return s.loginMember(member, req.Id)
+}
+
+// loginMember logs in a member that has proven its identity to the company with companyId,
+// or to its only company. Members with two-factor authentication only get a challenge.
+func (s *handler) loginMember(member *Member, companyId string) (*v1.UpsertResponse, error) {
+  membership, err := s.loginMembership(member, companyId)
+  if err != nil {
+    return nil, err
+  }
+  company, err := s.repo.GetById(membership.CompanyId)
   if err != nil {
     return nil, err
   }
 
+  if company.Unverified && !s.verification.AllowLogin {
+    return nil, status.Error(codes.FailedPrecondition, "email is not verified")
+  }
+
+  // with two-factor authentication the first factor only earns a challenge for VerifySecondFactor
+  totp, err := s.repo.GetTotp(member.Id.Hex())
+  if err != nil && err != ErrNotFound {
+    return nil, err
+  }
+  if err == nil && totp.Confirmed {
+    challenge, err := s.tokenService.EncodeChallenge(&v1.Company{
+      Id:    company.Id.Hex(),
+      Email: company.Email,
+    }, exportMember(member, membership))
+    if err != nil {
+      return nil, err
+    }
+    return &v1.UpsertResponse{
+      Api:            apiVersion,
+      Status:         "SecondFactorRequired",
+      Id:             company.Id.Hex(),
+      ChallengeToken: challenge,
+      MemberId:       member.Id.Hex(),
+    }, nil
+  }
+
+  return s.completeLogin(company, member, membership)
+}
+
+// completeLogin starts a new session for a member that has proven its identity
+func (s *handler) completeLogin(company *Company, member *Member, membership *Membership) (*v1.UpsertResponse, error) {
+  intId := company.Id.Hex()
+
+  // only a complete login clears the failures, a correct password alone does not
+  if err := s.limiter.Succeed(member.Email); err != nil {
+    return nil, err
+  }
+
   // Update the Company's LastActive field in the database
-  _, err = s.repo.UpdateActive(intId)
+  _, err := s.repo.UpdateActive(intId)
   if err != nil {
     return nil, err
   }
 
-  // return
-  return &v1.UpsertResponse{
-    Api:    apiVersion,
-    Status: "Success",
-    Token:  token,
-    // maybe in future add more data to response about the added company.
-  }, nil
+  // start a new session
+  return s.issueTokens(&v1.Company{
+    Id:    intId,
+    Email: company.Email,
+  }, exportMember(member, membership), "")
+}
+
+// rehashPassword replaces the outdated password hash of a member with one under the current policy.
+// A failure only leaves the old hash in place, so it does not fail the login.
+func (s *handler) rehashPassword(member *Member, password string) {
+  hash, err := s.passwords.Hash(password)
+  if err == nil {
+    // a password changed in the meantime is not overwritten
+    _, err = s.repo.ReplaceMemberPassword(member.Id.Hex(), member.Password, hash)
+  }
+  if err != nil {
+    logger.Log.Warn("failed to rehash password", zap.String("member", member.Id.Hex()), zap.Error(err))
+  }
+}
+
+// caller returns the claims the auth interceptor put in the context
+func caller(ctx context.Context) (*CustomClaims, error) {
+  claims, ok := ClaimsFromContext(ctx)
+  if !ok {
+    return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+  }
+  return claims, nil
+}
+
+// requireRole returns the claims of the caller if it has role or a role above it in its company
+func requireRole(ctx context.Context, role v1.MemberRole) (*CustomClaims, error) {
+  claims, err := caller(ctx)
+  if err != nil {
+    return nil, err
+  }
+  if !claims.HasRole(role) {
+    return nil, status.Errorf(codes.PermissionDenied, "requires the %s role", role)
+  }
+  return claims, nil
 }
 
 func (s *handler) GetAuth(ctx context.Context, req *v1.UpsertRequest) (*v1.AuthResponse, error) {
 
-  reqToken := req.Token
-  // validate the token company and request company
-  claims, err := s.tokenService.Decode(reqToken)
+  // identity of the caller, validated by the auth interceptor
+  claims, err := caller(ctx)
   if err != nil {
     return nil, err
   }
 
   company, err := s.repo.GetById(claims.Company.Id)
+  if err == ErrNotFound {
+    return nil, errs.New(errs.Unauthenticated, "the company of the token no longer exists")
+  }
   if err != nil {
-    return nil, errors.New("Invalid Token")
+    return nil, err
   }
 
   // Update the Company's LastActive field in the database
@@ -138,10 +369,37 @@ func (s *handler) GetAuth(ctx context.Context, req *v1.UpsertRequest) (*v1.AuthR
   }, nil
 }
 
+func (s *handler) GetById(ctx context.Context, req *v1.FindRequest) (*v1.FindResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  // fetch company from repo by id
+  company, err := s.repo.GetById(req.Id)
+  if err == ErrNotFound {
+    return nil, errCompanyNotFound
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  out := exportCompanyModel(company)
+
+  return &v1.FindResponse{
+    Api:     apiVersion,
+    Status:  "Success",
+    Company: out,
+  }, nil
+}
+
 func (s *handler) GetByEmail(ctx context.Context, req *v1.FindRequest) (*v1.FindResponse, error) {
 
   // fetch company from repo by email
   company, err := s.repo.GetByEmail(req.Email)
+  if err == ErrNotFound {
+    return nil, errCompanyNotFound
+  }
   if err != nil {
     return nil, err
   }
@@ -156,39 +414,145 @@ func (s *handler) GetByEmail(ctx context.Context, req *v1.FindRequest) (*v1.Find
   }, nil
 }
 
-func (s *handler) UpdateCompany(ctx context.Context, req *v1.UpsertRequest) (*v1.UpsertResponse, error) {
+func (s *handler) FilterCompanies(ctx context.Context, req *v1.FindRequest) (*v1.FindResponse, error) {
   // check api version
   if err := s.checkAPI(req.Api); err != nil {
     return nil, err
   }
 
-  reqToken := req.Token
-  // validate the token company and request company
-  claims, err := s.tokenService.Decode(reqToken)
+  filter, err := newCompanyFilter(req)
   if err != nil {
+    return nil, status.Error(codes.InvalidArgument, err.Error())
+  }
+  filter.VerifiedOnly = !s.verification.Listed
+
+  // fetch one company more than asked for to find out if there is a next page
+  pageSize := filter.Limit
+  filter.Limit++
+
+  companys, err := s.repo.FilterCompanys(filter)
+  if err != nil {
+    return nil, err
+  }
+
+  nextPageToken := ""
+  if len(companys) > pageSize {
+    companys = companys[:pageSize]
+    nextPageToken = encodeCursor(filter.cursorAt(companys[pageSize-1]))
+  }
+
+  return &v1.FindResponse{
+    Api:           apiVersion,
+    Status:        "Success",
+    Companies:     exportCompanyModels(companys),
+    NextPageToken: nextPageToken,
+  }, nil
+}
+
+func (s *handler) UpdateCompany(ctx context.Context, req *v1.UpsertRequest) (*v1.UpsertResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
     return nil, err
   }
 
-  // if token Company != req Company or there is no company id in claims return error
+  // the auth interceptor only lets admins of the company through, check again in case it is not installed
+  claims, err := requireRole(ctx, v1.MemberRole_ADMIN)
+  if err != nil {
+    return nil, err
+  }
   if claims.Company.Id != req.Id || claims.Company.Id == "" {
-    return nil, errors.New("Invalid Token")
+    return nil, status.Error(codes.PermissionDenied, "token does not belong to this company")
   }
 
-  // generate hashed password and save to model
-  if req.Company.Password != "" {
-    hashedPass, err := bcrypt.GenerateFromPassword([]byte(req.Company.Password), bcrypt.DefaultCost)
-    if err != nil {
-      return nil, errors.New(fmt.Sprintf("error hashing password: %v", err))
+  if req.Company == nil {
+    return nil, badRequest("company is required", fieldViolation("company", "company is required"))
+  }
+
+  // only the fields of the update mask are set
+  update, err := parseUpdateMask(req)
+  if err != nil {
+    return nil, err
+  }
+  version, err := expectedVersion(ctx, req.ExpectedVersion)
+  if err != nil {
+    return nil, err
+  }
+
+  // a password is the new password of the caller, the company itself has none
+  password := ""
+  if update.password {
+    password = req.Company.Password
+  }
+  req.Company.Password = ""
+  if password != "" && claims.MemberId == "" {
+    return nil, status.Error(codes.InvalidArgument, "API keys cannot change passwords")
+  }
+  if password != "" {
+    if err := s.checkPassword("company.password", password); err != nil {
+      return nil, err
     }
-    req.Company.Password = string(hashedPass)
   }
 
-  // update company model getting how many entries matched and modified (both should be 1)
-  match, modified, err := s.repo.Update(req.Company, req.Id)
+  existing, err := s.repo.GetById(req.Id)
+  if err == ErrNotFound {
+    return nil, errCompanyNotFound
+  }
   if err != nil {
     return nil, err
   }
 
+  // an update of only the password leaves the company and its version as they are,
+  // the expected version is checked against the company as it is read here
+  if len(update.fields) == 0 && version != 0 && version != existing.Version {
+    return nil, ErrVersionMismatch
+  }
+
+  // update company model getting how many entries matched and modified (both should be 1),
+  // and the new version
+  var match, modified int64 = 1, 0
+  current := existing.Version
+  if len(update.fields) > 0 {
+    match, modified, current, err = s.repo.Update(req.Company, req.Id, update.fields, version)
+    if err == ErrNotFound {
+      return nil, errCompanyNotFound
+    }
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  // a new email has to be verified again
+  if update.has("email") && normalizeEmail(req.Company.Email) != normalizeEmail(existing.Email) {
+    if err := s.repo.SetEmailVerified(req.Id, false); err != nil {
+      return nil, err
+    }
+    updated, err := s.repo.GetById(req.Id)
+    if err != nil {
+      return nil, err
+    }
+    if err := s.sendVerification(updated); err != nil {
+      return nil, err
+    }
+  }
+
+  // generate hashed password and save it, which signs out every existing session of the caller
+  if password != "" {
+    hashedPass, err := s.passwords.Hash(password)
+    if err != nil {
+      return nil, err
+    }
+    err = s.repo.UpdateMemberPassword(claims.MemberId, hashedPass)
+    if err == ErrNotFound {
+      return nil, errMemberNotFound
+    }
+    if err != nil {
+      return nil, err
+    }
+    if err := s.revokeMemberSessions(claims.MemberId); err != nil {
+      return nil, err
+    }
+  }
+
   // Update the Company's LastActive field in the database
   _, err = s.repo.UpdateActive(req.Id)
   if err != nil {
@@ -201,6 +565,8 @@ func (s *handler) UpdateCompany(ctx context.Context, req *v1.UpsertRequest) (*v1
     Status:   "test",
     Matched:  match,
     Modified: modified,
+    // the new version is the ETag for the next update
+    Version: current,
     // maybe in future add more data to response about the added company.
   }, nil
 }
@@ -211,22 +577,43 @@ func (s *handler) DeleteCompany(ctx context.Context, req *v1.DeleteRequest) (*v1
     return nil, err
   }
 
-  reqToken := req.Token
-  // validate the token company and request company
-  claims, err := s.tokenService.Decode(reqToken)
+  // the auth interceptor only lets the owner of the company through, check again in case it is not installed
+  claims, err := requireRole(ctx, v1.MemberRole_OWNER)
   if err != nil {
     return nil, err
   }
-
-  // if token Company != req Company or there is no company id in claims return error
   if claims.Company.Id != req.Id || claims.Company.Id == "" {
-    return nil, errors.New("Invalid Token")
+    return nil, status.Error(codes.PermissionDenied, "token does not belong to this company")
   }
 
-  count, err := s.repo.Delete(req.Id)
+  version, err := expectedVersion(ctx, req.ExpectedVersion)
   if err != nil {
     return nil, err
   }
+  count, err := s.repo.Delete(req.Id, version)
+  if err != nil {
+    return nil, err
+  }
+
+  // members, sessions, keys and invitations of a deleted company must stop working
+  memberships, err := s.repo.ListMembershipsByCompany(req.Id)
+  if err != nil {
+    return nil, err
+  }
+  for _, membership := range memberships {
+    if err := s.removeMembership(membership); err != nil {
+      return nil, err
+    }
+  }
+  if err := s.revokeAllSessions(req.Id); err != nil {
+    return nil, err
+  }
+  if err := s.repo.DeleteApiKeys(req.Id); err != nil {
+    return nil, err
+  }
+  if err := s.repo.DeleteInvitations(req.Id); err != nil {
+    return nil, err
+  }
 
   return &v1.DeleteResponse{
     Api:    req.Api,
@@ -235,21 +622,31 @@ func (s *handler) DeleteCompany(ctx context.Context, req *v1.DeleteRequest) (*v1
   }, nil
 }
 
-func (s *handler) ValidateToken(ctx context.Context, req *v1.ValidateRequest) (*v1.ValidateResponse, error) {
-  // Decode token
-  claims, err := s.tokenService.Decode(req.Token)
+func (s *handler) GetJwks(ctx context.Context, req *v1.JwksRequest) (*v1.JwksResponse, error) {
+  return &v1.JwksResponse{
+    Keys: s.tokenService.Jwks(),
+  }, nil
+}
 
-  if err != nil {
-    return nil, err
+func (s *handler) ValidateToken(ctx context.Context, req *v1.ValidateRequest) (*v1.ValidateResponse, error) {
+  // Decode token, or look up the API key
+  claims, err := s.credentials.Authenticate(req.Token)
+  if err != nil || claims.Company.Id == "" {
+    return nil, errs.Wrap(errs.Unauthenticated, "invalid token", err)
   }
 
-  if claims.Company.Id == "" {
-    return nil, errors.New("invalid Company")
+  scopes := []v1.ApiKeyScope{}
+  for _, scope := range claims.Scopes {
+    scopes = append(scopes, v1.ApiKeyScope(v1.ApiKeyScope_value[scope]))
   }
 
   return &v1.ValidateResponse{
     Valid:     true,
     CompanyId: claims.Company.Id,
+    Scopes:    scopes,
+    ApiKeyId:  claims.ApiKeyId,
+    MemberId:  claims.MemberId,
+    Role:      v1.MemberRole(v1.MemberRole_value[claims.Role]),
   }, nil
 }
 
@@ -257,12 +654,14 @@ func (s *handler) ValidateToken(ctx context.Context, req *v1.ValidateRequest) (*
 func exportCompanyModel(company *Company) *v1.Company {
   outId := company.Id.Hex()
   out := &v1.Company{
-    Id:         outId,
-    LastActive: int32(company.LastActive),
-    Name:       company.Name,
-    Mission:    company.Mission,
-    Location:   company.Location,
-    Email:      company.Email,
+    Id:            outId,
+    LastActive:    int32(company.LastActive),
+    Name:          company.Name,
+    Mission:       company.Mission,
+    Location:      company.Location,
+    Email:         company.Email,
+    EmailVerified: !company.Unverified,
+    Version:       company.Version,
   }
   return out
 }
@@ -271,16 +670,7 @@ func exportCompanyModel(company *Company) *v1.Company {
 func exportCompanyModels(companys []*Company) []*v1.Company {
   out := []*v1.Company{}
   for _, element := range companys {
-    outId := element.Id.Hex()
-    company := &v1.Company{
-      Id:         outId,
-      LastActive: int32(company.LastActive),
-      Firstname:  company.Firstname,
-      Lastname:   company.Lastname,
-      Phone:      company.Phone,
-      Email:      company.Email,
-    }
-    out = append(out, company)
+    out = append(out, exportCompanyModel(element))
   }
   return out
 }
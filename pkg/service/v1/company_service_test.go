@@ -0,0 +1,116 @@
+package v1
+
+import (
+  "context"
+  "testing"
+
+  "google.golang.org/genproto/googleapis/rpc/errdetails"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/status"
+  "google.golang.org/protobuf/types/known/fieldmaskpb"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+func TestUpdateCompanyVersion(t *testing.T) {
+  s := newTestServer(t)
+  owner := s.signUp(t, "owner@example.com")
+  asOwner := s.as(t, owner.Token)
+
+  updated, err := s.UpdateCompany(asOwner, &v1.UpsertRequest{Api: apiVersion, Id: owner.Id,
+    Company: &v1.Company{Mission: "hiring"}, ExpectedVersion: 1})
+  if err != nil || updated.Version != 2 {
+    t.Fatalf("UpdateCompany returned (%+v, %v), want version 2", updated, err)
+  }
+  _, err = s.UpdateCompany(asOwner, &v1.UpsertRequest{Api: apiVersion, Id: owner.Id,
+    Company: &v1.Company{Mission: "still hiring"}, ExpectedVersion: 1})
+  if err != ErrVersionMismatch {
+    t.Errorf("UpdateCompany of an old version returned %v, want ErrVersionMismatch", err)
+  }
+
+  // a new password leaves the version as it is, but is not set on an old one either
+  password := func(version int64) *v1.UpsertRequest {
+    return &v1.UpsertRequest{Api: apiVersion, Id: owner.Id, Company: &v1.Company{Password: "another horse 2"},
+      UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"password"}}, ExpectedVersion: version}
+  }
+  if _, err := s.UpdateCompany(asOwner, password(1)); err != ErrVersionMismatch {
+    t.Errorf("UpdateCompany of the password of an old version returned %v, want ErrVersionMismatch", err)
+  }
+  s.login(t, "owner@example.com", testPassword)
+  updated, err = s.UpdateCompany(asOwner, password(2))
+  if err != nil || updated.Version != 2 {
+    t.Fatalf("UpdateCompany of the password returned (%+v, %v), want version 2", updated, err)
+  }
+  s.login(t, "owner@example.com", "another horse 2")
+}
+
+func TestExpectedVersion(t *testing.T) {
+  tests := []struct {
+    name    string
+    version int64
+    // ifMatch is the "if-match" metadata, none if empty
+    ifMatch string
+    want    int64
+    invalid bool
+  }{
+    {"no version", 0, "", 0, false},
+    {"version", 3, "", 3, false},
+    {"ETag", 0, `"3"`, 3, false},
+    {"ETag with spaces", 0, ` "3" `, 3, false},
+    {"version before ETag", 4, `"3"`, 4, false},
+    {"any version", 0, "*", 0, false},
+    {"without quotes", 0, "3", 0, true},
+    {"weak ETag", 0, `W/"3"`, 0, true},
+    {"empty ETag", 0, `""`, 0, true},
+    {"not a number", 0, `"three"`, 0, true},
+    {"zero", 0, `"0"`, 0, true},
+    {"negative", 0, `"-1"`, 0, true},
+  }
+  for _, test := range tests {
+    ctx := context.Background()
+    if test.ifMatch != "" {
+      ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(ifMatchMetadata, test.ifMatch))
+    }
+    version, err := expectedVersion(ctx, test.version)
+    if test.invalid {
+      if err != errInvalidETag {
+        t.Errorf("%s: expectedVersion returned (%d, %v), want errInvalidETag", test.name, version, err)
+      }
+      continue
+    }
+    if err != nil || version != test.want {
+      t.Errorf("%s: expectedVersion returned (%d, %v), want %d", test.name, version, err, test.want)
+    }
+  }
+}
+
+// the validation interceptor cannot require the company, UpsertRequest is the request of Login too
+func TestWithoutCompany(t *testing.T) {
+  s := newTestServer(t)
+  owner := s.signUp(t, "owner@example.com")
+
+  _, err := s.CreateCompany(context.Background(), &v1.UpsertRequest{Api: apiVersion})
+  wantViolation(t, "CreateCompany without a company", err, "company")
+  _, err = s.UpdateCompany(s.as(t, owner.Token), &v1.UpsertRequest{Api: apiVersion, Id: owner.Id})
+  wantViolation(t, "UpdateCompany without a company", err, "company")
+}
+
+// wantViolation fails the test unless err is InvalidArgument with a violation of field
+func wantViolation(t *testing.T, what string, err error, field string) {
+  t.Helper()
+  st := status.Convert(err)
+  if st.Code() != codes.InvalidArgument {
+    t.Fatalf("%s returned %v, want InvalidArgument", what, err)
+  }
+  for _, detail := range st.Details() {
+    if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+      for _, violation := range badRequest.FieldViolations {
+        if violation.Field == field {
+          return
+        }
+      }
+    }
+  }
+  t.Errorf("%s returned %v without a violation of %s", what, err, field)
+}
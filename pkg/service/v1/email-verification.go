@@ -0,0 +1,127 @@
+package v1
+
+import (
+  "context"
+  "fmt"
+  "time"
+
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+  "github.com/ckbball/os-company/pkg/mailer"
+)
+
+const (
+  // emailVerificationTTL is how long a verification link can be used
+  emailVerificationTTL = 48 * time.Hour
+)
+
+// errInvalidVerificationToken is returned for every unusable verification token
+var errInvalidVerificationToken = status.Error(codes.InvalidArgument, "invalid or expired verification token")
+
+// VerificationPolicy decides what companies may do before they verify their email
+type VerificationPolicy struct {
+  // AllowLogin lets unverified companies log in
+  AllowLogin bool
+  // Listed shows unverified companies in FilterCompanies
+  Listed bool
+}
+
+// VerifyEmail confirms the email of a company with the token of a verification link
+func (s *handler) VerifyEmail(ctx context.Context, req *v1.VerifyEmailRequest) (*v1.VerificationResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  record, err := s.repo.ConsumeActionToken(purposeEmailVerification, hashToken(req.Token))
+  if err == ErrNotFound {
+    return nil, errInvalidVerificationToken
+  }
+  if err != nil {
+    return nil, err
+  }
+  if time.Now().After(record.ExpiresAt) {
+    return nil, errInvalidVerificationToken
+  }
+
+  // the token only verifies the email it was sent to
+  company, err := s.repo.GetById(record.CompanyId)
+  if err == ErrNotFound {
+    return nil, errInvalidVerificationToken
+  }
+  if err != nil {
+    return nil, err
+  }
+  if company.Email != record.Email {
+    return nil, errInvalidVerificationToken
+  }
+
+  if err := s.repo.SetEmailVerified(record.CompanyId, true); err != nil {
+    return nil, err
+  }
+  if err := s.repo.DeleteActionTokens(purposeEmailVerification, record.CompanyId); err != nil {
+    return nil, err
+  }
+
+  return &v1.VerificationResponse{
+    Api:    apiVersion,
+    Status: "Verified",
+  }, nil
+}
+
+// ResendVerification emails a new verification link to an unverified company
+func (s *handler) ResendVerification(ctx context.Context, req *v1.ResendVerificationRequest) (*v1.VerificationResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  // the response must not tell whether the email is registered
+  response := &v1.VerificationResponse{
+    Api:    apiVersion,
+    Status: "If the email is registered and unverified, a verification link has been sent to it",
+  }
+
+  company, err := s.repo.GetByEmail(req.Email)
+  if err == ErrNotFound {
+    return response, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  if !company.Unverified {
+    return response, nil
+  }
+
+  if err := s.sendVerification(company); err != nil {
+    return nil, err
+  }
+  return response, nil
+}
+
+// sendVerification emails a verification link to company, replacing the links sent before
+func (s *handler) sendVerification(company *Company) error {
+  if err := s.repo.DeleteActionTokens(purposeEmailVerification, company.Id.Hex()); err != nil {
+    return err
+  }
+
+  token, record := newActionToken(purposeEmailVerification, company, emailVerificationTTL)
+  if err := s.repo.CreateActionToken(record); err != nil {
+    return err
+  }
+
+  link, err := withToken(s.links.VerifyEmail, token)
+  if err != nil {
+    return err
+  }
+  s.sendMail(&mailer.Message{
+    To:      company.Email,
+    Subject: "Verify your email",
+    Body: fmt.Sprintf("Please confirm that %s is the email of %s at\n\n%s\n\n"+
+      "The link is valid for two days. If you did not sign up, ignore this email.\n",
+      company.Email, company.Name, link),
+  })
+  return nil
+}
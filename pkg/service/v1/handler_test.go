@@ -0,0 +1,138 @@
+package v1
+
+import (
+  "context"
+  "net/url"
+  "regexp"
+  "testing"
+  "time"
+
+  "golang.org/x/crypto/bcrypt"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+  "github.com/ckbball/os-company/pkg/mailer"
+)
+
+// testPassword satisfies DefaultPasswordPolicy
+const testPassword = "correct horse 1"
+
+// recordingMailer hands the emails it is asked to send to the test
+type recordingMailer struct {
+  sent chan *mailer.Message
+}
+
+func (m *recordingMailer) Send(ctx context.Context, msg *mailer.Message) error {
+  m.sent <- msg
+  return nil
+}
+
+// next returns the next email, handlers send them in the background
+func (m *recordingMailer) next(t *testing.T) *mailer.Message {
+  t.Helper()
+  select {
+  case msg := <-m.sent:
+    return msg
+  case <-time.After(5 * time.Second):
+    t.Fatalf("no email sent")
+    return nil
+  }
+}
+
+var linkPattern = regexp.MustCompile(`https?://\S+`)
+
+// linkToken returns the token of the link in the body of msg
+func linkToken(t *testing.T, msg *mailer.Message) string {
+  t.Helper()
+  link, err := url.Parse(linkPattern.FindString(msg.Body))
+  if err != nil || link.Query().Get("token") == "" {
+    t.Fatalf("no link with a token in %q", msg.Body)
+  }
+  return link.Query().Get("token")
+}
+
+// testServer is a handler on a memory repository
+type testServer struct {
+  *handler
+  repo  *MemoryRepository
+  mails *recordingMailer
+}
+
+func newTestServer(t *testing.T) *testServer {
+  key, err := GenerateSigningKey()
+  if err != nil {
+    t.Fatalf("GenerateSigningKey failed: %v", err)
+  }
+  keys, err := NewKeySet(key)
+  if err != nil {
+    t.Fatalf("NewKeySet failed: %v", err)
+  }
+  // the cheapest cost keeps the tests fast
+  passwords, err := NewPasswordHasher(HashingPolicy{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost})
+  if err != nil {
+    t.Fatalf("NewPasswordHasher failed: %v", err)
+  }
+
+  repo := NewMemoryRepository()
+  mails := &recordingMailer{sent: make(chan *mailer.Message, 10)}
+  policy := DefaultPasswordPolicy
+  links := Links{
+    ResetPassword:    "https://example.com/reset",
+    VerifyEmail:      "https://example.com/verify",
+    AcceptInvitation: "https://example.com/invitation",
+    AcceptOwnership:  "https://example.com/ownership",
+  }
+  return &testServer{
+    handler: NewCompanyServiceServer(repo, NewTokenService(keys, NewMemoryRevocationStore(), nil), mails, links,
+      VerificationPolicy{AllowLogin: true, Listed: true}, NewLoginLimiter(NewMemoryAttemptStore(), DefaultLockoutPolicy),
+      nil, passwords, &policy),
+    repo:  repo,
+    mails: mails,
+  }
+}
+
+// signUp creates a company and logs in its owner
+func (s *testServer) signUp(t *testing.T, email string) *v1.UpsertResponse {
+  t.Helper()
+  ctx := context.Background()
+  _, err := s.CreateCompany(ctx, &v1.UpsertRequest{
+    Api:     apiVersion,
+    Company: &v1.Company{Email: email, Name: "Company of " + email, Password: testPassword},
+  })
+  if err != nil {
+    t.Fatalf("CreateCompany failed: %v", err)
+  }
+  // the verification email
+  s.mails.next(t)
+
+  return s.login(t, email, testPassword)
+}
+
+// login logs in with email and password
+func (s *testServer) login(t *testing.T, email, password string) *v1.UpsertResponse {
+  t.Helper()
+  res, err := s.Login(context.Background(), &v1.UpsertRequest{Api: apiVersion, Email: email, Password: password})
+  if err != nil {
+    t.Fatalf("Login of %s failed: %v", email, err)
+  }
+  return res
+}
+
+// as returns the context of a request made with an access token
+func (s *testServer) as(t *testing.T, token string) context.Context {
+  t.Helper()
+  claims, err := s.credentials.Authenticate(token)
+  if err != nil {
+    t.Fatalf("Authenticate failed: %v", err)
+  }
+  return NewClaimsContext(context.Background(), claims)
+}
+
+// wantCode fails the test if err does not have code
+func wantCode(t *testing.T, what string, err error, code codes.Code) {
+  t.Helper()
+  if status.Code(err) != code {
+    t.Errorf("%s returned %v, want %s", what, err, code)
+  }
+}
@@ -0,0 +1,300 @@
+package v1
+
+import (
+  "context"
+  "fmt"
+  "strings"
+  "time"
+
+  "go.mongodb.org/mongo-driver/bson/primitive"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+  "github.com/ckbball/os-company/pkg/mailer"
+)
+
+const (
+  // invitationTTL is how long an invitation can be accepted
+  invitationTTL = 7 * 24 * time.Hour
+)
+
+// errInvalidInvitation is returned for every unusable invitation token so that callers learn nothing about it
+var errInvalidInvitation = status.Error(codes.InvalidArgument, "invalid, expired or revoked invitation")
+
+// Invitation is the server-side record of a pending invitation to join a company.
+// The emailed token is signed and names the invitation, revoking or accepting
+// the invitation deletes the record and with it every use of the token.
+type Invitation struct {
+  Id        string `json:"id" bson:"_id"`
+  CompanyId string `json:"companyId" bson:"company_id"`
+  Email     string `json:"email" bson:"email"`
+  // Role is the name of a v1.MemberRole value
+  Role string `json:"role" bson:"role"`
+  // InvitedBy is the id of the member who sent the invitation
+  InvitedBy string    `json:"invitedBy" bson:"invited_by"`
+  ExpiresAt time.Time `json:"expiresAt" bson:"expires_at"`
+  CreatedAt time.Time `json:"createdAt" bson:"created_at"`
+}
+
+// InviteMember emails an invitation to join the company of the caller
+func (s *handler) InviteMember(ctx context.Context, req *v1.InviteMemberRequest) (*v1.InvitationResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := requireRole(ctx, v1.MemberRole_ADMIN)
+  if err != nil {
+    return nil, err
+  }
+
+  role, err := assignableRole(req.Role)
+  if err != nil {
+    return nil, err
+  }
+  email := strings.TrimSpace(req.Email)
+  if email == "" {
+    return nil, status.Error(codes.InvalidArgument, "email is required")
+  }
+
+  company, err := s.repo.GetById(claims.Company.Id)
+  if err == ErrNotFound {
+    return nil, errCompanyNotFound
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  member, err := s.memberByEmail(email)
+  if err != nil && err != ErrNotFound {
+    return nil, err
+  }
+  if err == nil {
+    if _, err := s.repo.GetMembership(claims.Company.Id, member.Id.Hex()); err != ErrNotFound {
+      if err != nil {
+        return nil, err
+      }
+      return nil, status.Error(codes.AlreadyExists, "already a member of the company")
+    }
+  }
+
+  // a new invitation replaces the pending one of the email
+  pending, err := s.repo.ListInvitations(claims.Company.Id)
+  if err != nil {
+    return nil, err
+  }
+  for _, invitation := range pending {
+    if strings.EqualFold(invitation.Email, email) {
+      if err := s.repo.DeleteInvitation(claims.Company.Id, invitation.Id); err != nil && err != ErrNotFound {
+        return nil, err
+      }
+    }
+  }
+
+  now := time.Now()
+  invitation := &Invitation{
+    Id:        newTokenId(),
+    CompanyId: claims.Company.Id,
+    Email:     email,
+    Role:      role,
+    InvitedBy: claims.MemberId,
+    ExpiresAt: now.Add(invitationTTL),
+    CreatedAt: now,
+  }
+  if err := s.repo.CreateInvitation(invitation); err != nil {
+    return nil, err
+  }
+
+  token, err := s.tokenService.EncodeInvitation(invitation.Id, invitation.CompanyId, invitation.ExpiresAt)
+  if err != nil {
+    return nil, err
+  }
+  link, err := withToken(s.links.AcceptInvitation, token)
+  if err != nil {
+    return nil, err
+  }
+  s.sendMail(&mailer.Message{
+    To:      email,
+    Subject: fmt.Sprintf("Join %s", company.Name),
+    Body: fmt.Sprintf("You have been invited to recruit for %s.\n\n"+
+      "Accept the invitation within the next 7 days at\n\n%s\n\n"+
+      "If you do not want to join, ignore this email.\n",
+      company.Name, link),
+  })
+
+  return &v1.InvitationResponse{
+    Api:        apiVersion,
+    Status:     "Invited",
+    Invitation: exportInvitation(invitation),
+  }, nil
+}
+
+// ListInvitations lists the pending invitations of the company of the caller, oldest first
+func (s *handler) ListInvitations(ctx context.Context, req *v1.ListInvitationsRequest) (*v1.ListInvitationsResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := requireRole(ctx, v1.MemberRole_ADMIN)
+  if err != nil {
+    return nil, err
+  }
+
+  invitations, err := s.repo.ListInvitations(claims.Company.Id)
+  if err != nil {
+    return nil, err
+  }
+
+  now := time.Now()
+  out := []*v1.Invitation{}
+  for _, invitation := range invitations {
+    if now.After(invitation.ExpiresAt) {
+      continue
+    }
+    out = append(out, exportInvitation(invitation))
+  }
+
+  return &v1.ListInvitationsResponse{
+    Api:         apiVersion,
+    Invitations: out,
+  }, nil
+}
+
+// RevokeInvitation revokes a pending invitation of the company of the caller
+func (s *handler) RevokeInvitation(ctx context.Context, req *v1.RevokeInvitationRequest) (*v1.RevokeInvitationResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := requireRole(ctx, v1.MemberRole_ADMIN)
+  if err != nil {
+    return nil, err
+  }
+
+  err = s.repo.DeleteInvitation(claims.Company.Id, req.InvitationId)
+  if err == ErrNotFound {
+    return nil, status.Error(codes.NotFound, "invitation not found")
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  return &v1.RevokeInvitationResponse{
+    Api:    apiVersion,
+    Status: "Revoked",
+  }, nil
+}
+
+// AcceptInvitation joins the company of an invitation. Invitees without a login get a new member,
+// the others join with their existing one, since the token proves they own the email.
+func (s *handler) AcceptInvitation(ctx context.Context, req *v1.AcceptInvitationRequest) (*v1.AcceptInvitationResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  id, err := s.tokenService.DecodeInvitation(req.Token)
+  if err != nil {
+    return nil, errInvalidInvitation
+  }
+  invitation, err := s.repo.GetInvitation(id)
+  if err == ErrNotFound {
+    return nil, errInvalidInvitation
+  }
+  if err != nil {
+    return nil, err
+  }
+  if time.Now().After(invitation.ExpiresAt) {
+    return nil, errInvalidInvitation
+  }
+
+  member, err := s.memberByEmail(invitation.Email)
+  if err != nil && err != ErrNotFound {
+    return nil, err
+  }
+  if err == ErrNotFound {
+    // checked before the invitation is used up, so that the invitee can retry
+    if req.Password == "" {
+      return nil, status.Error(codes.InvalidArgument, "password is required")
+    }
+    if err := s.checkPassword("password", req.Password); err != nil {
+      return nil, err
+    }
+  }
+
+  // deleting the invitation first makes it single-use even when requests race
+  err = s.repo.DeleteInvitation(invitation.CompanyId, invitation.Id)
+  if err == ErrNotFound {
+    return nil, errInvalidInvitation
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  now := time.Now()
+  if member == nil {
+    hashedPass, err := s.passwords.Hash(req.Password)
+    if err != nil {
+      return nil, err
+    }
+
+    member = &Member{
+      Email:     invitation.Email,
+      Password:  hashedPass,
+      Name:      req.Name,
+      CreatedAt: now,
+    }
+    id, err := s.repo.CreateMember(member)
+    switch err {
+    case nil:
+      member.Id, _ = primitive.ObjectIDFromHex(id)
+    case ErrAlreadyExists:
+      // the email signed up in the meantime, join with that login
+      member, err = s.repo.GetMemberByEmail(invitation.Email)
+      if err == ErrNotFound {
+        return nil, errMemberNotFound
+      }
+      if err != nil {
+        return nil, err
+      }
+    default:
+      return nil, err
+    }
+  }
+
+  membership := &Membership{
+    CompanyId: invitation.CompanyId,
+    MemberId:  member.Id.Hex(),
+    Role:      invitation.Role,
+    CreatedAt: now,
+  }
+  err = s.repo.CreateMembership(membership)
+  if err == ErrAlreadyExists {
+    return nil, status.Error(codes.AlreadyExists, "already a member of the company")
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  return &v1.AcceptInvitationResponse{
+    Api:       apiVersion,
+    Status:    "Joined",
+    CompanyId: invitation.CompanyId,
+    Member:    exportMember(member, membership),
+  }, nil
+}
+
+// exportInvitation returns the api representation of an invitation
+func exportInvitation(invitation *Invitation) *v1.Invitation {
+  return &v1.Invitation{
+    Id:        invitation.Id,
+    Email:     invitation.Email,
+    Role:      v1.MemberRole(v1.MemberRole_value[invitation.Role]),
+    InvitedBy: invitation.InvitedBy,
+    CreatedAt: invitation.CreatedAt.Unix(),
+    ExpiresAt: invitation.ExpiresAt.Unix(),
+  }
+}
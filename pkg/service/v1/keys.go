@@ -0,0 +1,227 @@
+package v1
+
+import (
+  "crypto"
+  "crypto/ed25519"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "crypto/x509"
+  "encoding/base64"
+  "encoding/pem"
+  "errors"
+  "fmt"
+  "math/big"
+
+  pb "github.com/ckbball/os-company/pkg/api/v1"
+  "github.com/dgrijalva/jwt-go"
+)
+
+// SigningKey is an asymmetric key tokens are signed or verified with
+type SigningKey struct {
+  // Id is the kid of the key, its RFC 7638 thumbprint
+  Id     string
+  Method jwt.SigningMethod
+  // Private is nil for keys that only verify tokens
+  Private crypto.Signer
+  Public  crypto.PublicKey
+}
+
+// KeySet is the key signing new tokens and every key whose tokens are still accepted.
+// To rotate keys, sign with the new key and keep the old public key for verification
+// until the last token it signed has expired.
+type KeySet struct {
+  signing *SigningKey
+  keys    map[string]*SigningKey
+}
+
+// NewKeySet returns a key set signing with signing and also verifying with verification
+func NewKeySet(signing *SigningKey, verification ...*SigningKey) (*KeySet, error) {
+  if signing == nil || signing.Private == nil {
+    return nil, errors.New("signing key needs a private key")
+  }
+
+  set := &KeySet{
+    signing: signing,
+    keys:    map[string]*SigningKey{signing.Id: signing},
+  }
+  for _, key := range verification {
+    set.keys[key.Id] = key
+  }
+  return set, nil
+}
+
+// Key returns the key with id kid
+func (set *KeySet) Key(kid string) (*SigningKey, bool) {
+  key, ok := set.keys[kid]
+  return key, ok
+}
+
+// Methods returns the algorithms of the keys in the set
+func (set *KeySet) Methods() []string {
+  methods := []string{}
+  seen := map[string]bool{}
+  for _, key := range set.keys {
+    if alg := key.Method.Alg(); !seen[alg] {
+      seen[alg] = true
+      methods = append(methods, alg)
+    }
+  }
+  return methods
+}
+
+// Jwks returns the public keys of the set as JSON web keys
+func (set *KeySet) Jwks() []*pb.Jwk {
+  out := []*pb.Jwk{}
+  for _, key := range set.keys {
+    jwk := publicJwk(key.Public)
+    jwk.Kid = key.Id
+    jwk.Alg = key.Method.Alg()
+    jwk.Use = "sig"
+    out = append(out, jwk)
+  }
+  return out
+}
+
+// GenerateSigningKey returns a new Ed25519 key
+func GenerateSigningKey() (*SigningKey, error) {
+  public, private, err := ed25519.GenerateKey(rand.Reader)
+  if err != nil {
+    return nil, err
+  }
+  return newSigningKey(private, public)
+}
+
+// ParsePrivateKeyPEM parses a PKCS #8 (RSA or Ed25519) or PKCS #1 (RSA) private key
+func ParsePrivateKeyPEM(data []byte) (*SigningKey, error) {
+  block, _ := pem.Decode(data)
+  if block == nil {
+    return nil, errors.New("no PEM block found")
+  }
+
+  var private interface{}
+  var err error
+  switch block.Type {
+  case "RSA PRIVATE KEY":
+    private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+  default:
+    private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  signer, ok := private.(crypto.Signer)
+  if !ok {
+    return nil, fmt.Errorf("unsupported private key type %T", private)
+  }
+  return newSigningKey(signer, signer.Public())
+}
+
+// ParsePublicKeyPEM parses a PKIX (RSA or Ed25519) public key, used to verify tokens of retired keys
+func ParsePublicKeyPEM(data []byte) (*SigningKey, error) {
+  block, _ := pem.Decode(data)
+  if block == nil {
+    return nil, errors.New("no PEM block found")
+  }
+
+  public, err := x509.ParsePKIXPublicKey(block.Bytes)
+  if err != nil {
+    return nil, err
+  }
+  return newSigningKey(nil, public)
+}
+
+func newSigningKey(private crypto.Signer, public crypto.PublicKey) (*SigningKey, error) {
+  key := &SigningKey{
+    Private: private,
+    Public:  public,
+  }
+
+  switch public := public.(type) {
+  case *rsa.PublicKey:
+    if public.N.BitLen() < 2048 {
+      return nil, errors.New("RSA keys must have at least 2048 bits")
+    }
+    key.Method = jwt.SigningMethodRS256
+  case ed25519.PublicKey:
+    key.Method = SigningMethodEdDSA
+  default:
+    return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", public)
+  }
+
+  key.Id = thumbprint(publicJwk(public))
+  return key, nil
+}
+
+// publicJwk returns the key material of a public key as a JSON web key
+func publicJwk(public crypto.PublicKey) *pb.Jwk {
+  switch public := public.(type) {
+  case *rsa.PublicKey:
+    return &pb.Jwk{
+      Kty: "RSA",
+      N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+      E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+    }
+  case ed25519.PublicKey:
+    return &pb.Jwk{
+      Kty: "OKP",
+      Crv: "Ed25519",
+      X:   base64.RawURLEncoding.EncodeToString(public),
+    }
+  }
+  return &pb.Jwk{}
+}
+
+// thumbprint returns the RFC 7638 thumbprint of a JSON web key
+func thumbprint(jwk *pb.Jwk) string {
+  var canonical string
+  switch jwk.Kty {
+  case "RSA":
+    canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+  case "OKP":
+    canonical = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, jwk.Crv, jwk.X)
+  }
+  sum := sha256.Sum256([]byte(canonical))
+  return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// SigningMethodEdDSA signs tokens with Ed25519 keys (RFC 8037)
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+type signingMethodEdDSA struct{}
+
+func init() {
+  jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+    return SigningMethodEdDSA
+  })
+}
+
+func (m *signingMethodEdDSA) Alg() string {
+  return "EdDSA"
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+  public, ok := key.(ed25519.PublicKey)
+  if !ok {
+    return jwt.ErrInvalidKeyType
+  }
+
+  sig, err := jwt.DecodeSegment(signature)
+  if err != nil {
+    return err
+  }
+  if !ed25519.Verify(public, []byte(signingString), sig) {
+    return jwt.ErrSignatureInvalid
+  }
+  return nil
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+  private, ok := key.(ed25519.PrivateKey)
+  if !ok {
+    return "", jwt.ErrInvalidKeyType
+  }
+
+  return jwt.EncodeSegment(ed25519.Sign(private, []byte(signingString))), nil
+}
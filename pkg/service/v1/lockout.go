@@ -0,0 +1,225 @@
+package v1
+
+import (
+  "context"
+  "net"
+  "strings"
+  "time"
+
+  "google.golang.org/genproto/googleapis/rpc/errdetails"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/peer"
+  "google.golang.org/grpc/status"
+  "google.golang.org/protobuf/types/known/durationpb"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+// LockoutPolicy is how LoginLimiter slows down password guessing.
+// After the free attempts every failure doubles the delay before the next attempt,
+// and enough failures lock the account for a while.
+type LockoutPolicy struct {
+  // AccountFreeAttempts and IPFreeAttempts are the failures in a row before backoff starts
+  AccountFreeAttempts int
+  IPFreeAttempts      int
+  // BaseDelay is the delay after the first failure past the free attempts
+  BaseDelay time.Duration
+  // MaxDelay caps the delay
+  MaxDelay time.Duration
+  // LockoutAttempts failures of an account lock it for LockoutDuration
+  LockoutAttempts int
+  LockoutDuration time.Duration
+  // ResetAfter is the time without failures after which they are forgotten
+  ResetAfter time.Duration
+}
+
+// DefaultLockoutPolicy allows a few typos, then backs off up to a minute,
+// and locks an account for 15 minutes after 10 failures in a row
+var DefaultLockoutPolicy = LockoutPolicy{
+  AccountFreeAttempts: 3,
+  IPFreeAttempts:      20,
+  BaseDelay:           time.Second,
+  MaxDelay:            time.Minute,
+  LockoutAttempts:     10,
+  LockoutDuration:     15 * time.Minute,
+  ResetAfter:          time.Hour,
+}
+
+// LoginLimiter counts failed logins per account and per client ip
+type LoginLimiter struct {
+  store  AttemptStore
+  policy LockoutPolicy
+}
+
+func NewLoginLimiter(store AttemptStore, policy LockoutPolicy) *LoginLimiter {
+  return &LoginLimiter{
+    store:  store,
+    policy: policy,
+  }
+}
+
+// accountKey is the counter of an account, accounts are named by email so that
+// unknown emails are counted like known ones
+func accountKey(email string) string {
+  return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// ipKey is the counter of a client ip, empty if the ip is unknown
+func ipKey(ip string) string {
+  if ip == "" {
+    return ""
+  }
+  return "ip:" + ip
+}
+
+// LoginAttempt is an attempt counted by LoginLimiter.Reserve
+type LoginAttempt struct {
+  keys     []string
+  previous []time.Time
+}
+
+// Reserve counts an attempt of the account and the ip before the credentials are checked, and returns
+// an error if they have to wait first. Counting first makes the check hold for parallel attempts too.
+// The attempt counts as a failure unless it is given back with Pass. Attempts made while
+// waiting are given back right away, their credentials are not checked and they must not
+// let anybody keep an account locked by trying it over and over.
+func (l *LoginLimiter) Reserve(email, ip string) (*LoginAttempt, error) {
+  now := time.Now()
+  attempt := &LoginAttempt{}
+  var denied error
+
+  account := accountKey(email)
+  keys := []string{account}
+  if key := ipKey(ip); key != "" {
+    keys = append(keys, key)
+  }
+  for _, key := range keys {
+    attempts, previous, err := l.store.Reserve(key, l.policy.ResetAfter)
+    if err != nil {
+      return nil, err
+    }
+    attempt.keys = append(attempt.keys, key)
+    attempt.previous = append(attempt.previous, previous)
+
+    if denied == nil {
+      denied = l.check(key == account, attempts-1, previous, now)
+    }
+  }
+  if denied != nil {
+    if err := l.Pass(attempt); err != nil {
+      return nil, err
+    }
+    return nil, denied
+  }
+  return attempt, nil
+}
+
+// check returns an error if failures in a row, the last one at previous, keep an account or an ip waiting
+func (l *LoginLimiter) check(account bool, failures int, previous time.Time, now time.Time) error {
+  free := l.policy.IPFreeAttempts
+  if account {
+    free = l.policy.AccountFreeAttempts
+    if l.policy.LockoutAttempts > 0 && failures >= l.policy.LockoutAttempts {
+      if until := previous.Add(l.policy.LockoutDuration); now.Before(until) {
+        return retryError(codes.PermissionDenied, "account is temporarily locked", until.Sub(now))
+      }
+    }
+  }
+  if until := previous.Add(l.delay(failures, free)); now.Before(until) {
+    return retryError(codes.ResourceExhausted, "too many failed attempts", until.Sub(now))
+  }
+  return nil
+}
+
+// Pass gives back an attempt with correct credentials, which is no failure
+func (l *LoginLimiter) Pass(attempt *LoginAttempt) error {
+  for i, key := range attempt.keys {
+    if err := l.store.Release(key, attempt.previous[i]); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Succeed forgets the failures of the account, the ip keeps its count
+func (l *LoginLimiter) Succeed(email string) error {
+  return l.store.Reset(accountKey(email))
+}
+
+// Unlock forgets the failures of the account, ending a lockout
+func (l *LoginLimiter) Unlock(email string) error {
+  return l.store.Reset(accountKey(email))
+}
+
+// delay returns the wait after failures failures in a row, zero during the free attempts
+func (l *LoginLimiter) delay(failures, free int) time.Duration {
+  if failures <= free {
+    return 0
+  }
+  delay := l.policy.BaseDelay
+  for i := free + 1; i < failures && delay < l.policy.MaxDelay; i++ {
+    delay *= 2
+  }
+  if delay > l.policy.MaxDelay {
+    delay = l.policy.MaxDelay
+  }
+  return delay
+}
+
+// retryError returns an error with code telling the client when to try again
+func retryError(code codes.Code, msg string, retryAfter time.Duration) error {
+  // round up so that clients waiting for the delay do not come back too early
+  retryAfter = retryAfter.Truncate(time.Second) + time.Second
+  st, err := status.New(code, msg).WithDetails(&errdetails.RetryInfo{
+    RetryDelay: durationpb.New(retryAfter),
+  })
+  if err != nil {
+    return status.Error(code, msg)
+  }
+  return st.Err()
+}
+
+// clientIP returns the ip of the client. Requests through the HTTP gateway come from
+// localhost, for them the gateway appends the remote address to x-forwarded-for.
+func clientIP(ctx context.Context) string {
+  p, ok := peer.FromContext(ctx)
+  if !ok {
+    return ""
+  }
+  host, _, err := net.SplitHostPort(p.Addr.String())
+  if err != nil {
+    host = p.Addr.String()
+  }
+
+  // only the gateway is trusted to set the header, other clients could forge it
+  if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+    if md, ok := metadata.FromIncomingContext(ctx); ok {
+      if forwarded := md.Get("x-forwarded-for"); len(forwarded) > 0 {
+        hops := strings.Split(forwarded[len(forwarded)-1], ",")
+        return strings.TrimSpace(hops[len(hops)-1])
+      }
+    }
+  }
+  return host
+}
+
+// UnlockAccount ends the lockout of an account and forgets its failed logins
+func (s *handler) UnlockAccount(ctx context.Context, req *v1.UnlockAccountRequest) (*v1.UnlockAccountResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  if req.Email == "" {
+    return nil, status.Error(codes.InvalidArgument, "email is empty")
+  }
+  if err := s.limiter.Unlock(req.Email); err != nil {
+    return nil, err
+  }
+
+  return &v1.UnlockAccountResponse{
+    Api:    apiVersion,
+    Status: "Unlocked",
+  }, nil
+}
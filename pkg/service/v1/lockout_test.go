@@ -0,0 +1,38 @@
+package v1
+
+import (
+  "testing"
+  "time"
+
+  "google.golang.org/grpc/codes"
+)
+
+func TestLoginLimiterDeniedAttempts(t *testing.T) {
+  store := NewMemoryAttemptStore()
+  limiter := NewLoginLimiter(store, LockoutPolicy{
+    IPFreeAttempts: 10,
+    BaseDelay:      time.Hour,
+    MaxDelay:       time.Hour,
+    ResetAfter:     2 * time.Hour,
+  })
+
+  // the first failure is free, the next attempt has to wait an hour
+  if _, err := limiter.Reserve("owner@example.com", "10.0.0.1"); err != nil {
+    t.Fatalf("first Reserve failed: %v", err)
+  }
+  failed := store.attempts[accountKey("owner@example.com")]
+
+  // attempts made while waiting are not checked, so they neither count nor start the wait over
+  for i := 0; i < 5; i++ {
+    _, err := limiter.Reserve("owner@example.com", "10.0.0.1")
+    wantCode(t, "Reserve while waiting", err, codes.ResourceExhausted)
+  }
+  account := store.attempts[accountKey("owner@example.com")]
+  if account.failures != failed.failures || !account.last.Equal(failed.last) {
+    t.Errorf("account has %d failures, the last at %v, after denied attempts, want %d at %v",
+      account.failures, account.last, failed.failures, failed.last)
+  }
+  if ip := store.attempts[ipKey("10.0.0.1")]; ip.failures != 1 {
+    t.Errorf("ip has %d failures after denied attempts, want 1", ip.failures)
+  }
+}
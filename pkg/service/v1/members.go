@@ -0,0 +1,353 @@
+package v1
+
+import (
+  "context"
+  "time"
+
+  "go.mongodb.org/mongo-driver/bson/primitive"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+// errMemberNotFound is returned when a member or its membership is missing
+var errMemberNotFound = status.Error(codes.NotFound, "member not found")
+
+// Member is a person logging in for one or more companies, see Membership.
+// Companies from before memberships had their login on the company itself,
+// it becomes their owner on first use and keeps the id of the company.
+type Member struct {
+  Id        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+  Email     string             `json:"email" bson:"email"`
+  Password  string             `json:"password,omitempty" bson:"password,omitempty"`
+  Name      string             `json:"name,omitempty" bson:"name,omitempty"`
+  CreatedAt time.Time          `json:"createdAt" bson:"created_at"`
+}
+
+// Membership gives a member a role in a company
+type Membership struct {
+  CompanyId string `json:"companyId" bson:"company_id"`
+  MemberId  string `json:"memberId" bson:"member_id"`
+  // Role is the name of a v1.MemberRole value
+  Role      string    `json:"role" bson:"role"`
+  CreatedAt time.Time `json:"createdAt" bson:"created_at"`
+}
+
+// AddMember creates a member with its own login in the company of the caller
+func (s *handler) AddMember(ctx context.Context, req *v1.AddMemberRequest) (*v1.MemberResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := requireRole(ctx, v1.MemberRole_ADMIN)
+  if err != nil {
+    return nil, err
+  }
+
+  role, err := assignableRole(req.Role)
+  if err != nil {
+    return nil, err
+  }
+  if req.Email == "" || req.Password == "" {
+    return nil, status.Error(codes.InvalidArgument, "email and password are required")
+  }
+  if err := s.checkPassword("password", req.Password); err != nil {
+    return nil, err
+  }
+
+  // the email may also be the login of a company from before memberships
+  if _, err := s.memberByEmail(req.Email); err != ErrNotFound {
+    if err != nil {
+      return nil, err
+    }
+    return nil, status.Error(codes.AlreadyExists, "a member with this email exists")
+  }
+
+  hashedPass, err := s.passwords.Hash(req.Password)
+  if err != nil {
+    return nil, err
+  }
+
+  now := time.Now()
+  member := &Member{
+    Email:     req.Email,
+    Password:  hashedPass,
+    Name:      req.Name,
+    CreatedAt: now,
+  }
+  id, err := s.repo.CreateMember(member)
+  if err == ErrAlreadyExists {
+    return nil, status.Error(codes.AlreadyExists, "a member with this email exists")
+  }
+  if err != nil {
+    return nil, err
+  }
+  member.Id, _ = primitive.ObjectIDFromHex(id)
+
+  membership := &Membership{
+    CompanyId: claims.Company.Id,
+    MemberId:  id,
+    Role:      role,
+    CreatedAt: now,
+  }
+  if err := s.repo.CreateMembership(membership); err != nil {
+    // a member of no company only keeps the email from being added again
+    if err := s.repo.DeleteMember(id); err != nil {
+      return nil, err
+    }
+    if err == ErrAlreadyExists {
+      return nil, status.Error(codes.AlreadyExists, "already a member of the company")
+    }
+    return nil, err
+  }
+
+  return &v1.MemberResponse{
+    Api:    apiVersion,
+    Status: "Added",
+    Member: exportMember(member, membership),
+  }, nil
+}
+
+// ListMembers lists the members of the company of the caller, in the order they joined
+func (s *handler) ListMembers(ctx context.Context, req *v1.ListMembersRequest) (*v1.ListMembersResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := caller(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  memberships, err := s.repo.ListMembershipsByCompany(claims.Company.Id)
+  if err != nil {
+    return nil, err
+  }
+
+  out := []*v1.Member{}
+  for _, membership := range memberships {
+    member, err := s.repo.GetMemberById(membership.MemberId)
+    if err == ErrNotFound {
+      continue
+    }
+    if err != nil {
+      return nil, err
+    }
+    out = append(out, exportMember(member, membership))
+  }
+
+  return &v1.ListMembersResponse{
+    Api:     apiVersion,
+    Members: out,
+  }, nil
+}
+
+// RemoveMember removes a member from the company of the caller
+func (s *handler) RemoveMember(ctx context.Context, req *v1.RemoveMemberRequest) (*v1.RemoveMemberResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := requireRole(ctx, v1.MemberRole_ADMIN)
+  if err != nil {
+    return nil, err
+  }
+
+  membership, err := s.repo.GetMembership(claims.Company.Id, req.MemberId)
+  if err == ErrNotFound {
+    return nil, errMemberNotFound
+  }
+  if err != nil {
+    return nil, err
+  }
+  if membership.Role == v1.MemberRole_OWNER.String() {
+    return nil, status.Error(codes.FailedPrecondition, "the owner cannot be removed")
+  }
+
+  if err := s.removeMembership(membership); err != nil {
+    return nil, err
+  }
+
+  return &v1.RemoveMemberResponse{
+    Api:    apiVersion,
+    Status: "Removed",
+  }, nil
+}
+
+// ChangeMemberRole changes the role of a member of the company of the caller
+func (s *handler) ChangeMemberRole(ctx context.Context, req *v1.ChangeMemberRoleRequest) (*v1.MemberResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := requireRole(ctx, v1.MemberRole_ADMIN)
+  if err != nil {
+    return nil, err
+  }
+
+  role, err := assignableRole(req.Role)
+  if err != nil {
+    return nil, err
+  }
+
+  membership, err := s.repo.GetMembership(claims.Company.Id, req.MemberId)
+  if err == ErrNotFound {
+    return nil, errMemberNotFound
+  }
+  if err != nil {
+    return nil, err
+  }
+  if membership.Role == v1.MemberRole_OWNER.String() {
+    return nil, status.Error(codes.FailedPrecondition, "the role of the owner cannot be changed")
+  }
+
+  err = s.repo.UpdateMembershipRole(claims.Company.Id, req.MemberId, role)
+  if err == ErrNotFound {
+    return nil, errMemberNotFound
+  }
+  if err != nil {
+    return nil, err
+  }
+  membership.Role = role
+
+  // access tokens carry the role, the member picks up the new one with its next refresh
+  if err := s.tokenService.RevokeAll(req.MemberId); err != nil {
+    return nil, err
+  }
+
+  member, err := s.repo.GetMemberById(req.MemberId)
+  if err == ErrNotFound {
+    return nil, errMemberNotFound
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  return &v1.MemberResponse{
+    Api:    apiVersion,
+    Status: "Changed",
+    Member: exportMember(member, membership),
+  }, nil
+}
+
+// assignableRole returns the name of role if AddMember and ChangeMemberRole may give it
+func assignableRole(role v1.MemberRole) (string, error) {
+  if role != v1.MemberRole_RECRUITER && role != v1.MemberRole_ADMIN {
+    return "", status.Error(codes.InvalidArgument, "role must be RECRUITER or ADMIN")
+  }
+  return role.String(), nil
+}
+
+// removeMembership ends a membership. Members without any company left are deleted,
+// and the access tokens of the member die, since refreshing them fails without the membership.
+func (s *handler) removeMembership(membership *Membership) error {
+  if err := s.repo.DeleteMembership(membership.CompanyId, membership.MemberId); err != nil && err != ErrNotFound {
+    return err
+  }
+
+  remaining, err := s.repo.ListMembershipsByMember(membership.MemberId)
+  if err != nil {
+    return err
+  }
+  if len(remaining) == 0 {
+    if err := s.repo.DeleteMember(membership.MemberId); err != nil && err != ErrNotFound {
+      return err
+    }
+  }
+
+  return s.tokenService.RevokeAll(membership.MemberId)
+}
+
+// memberByEmail returns the member logging in with email, ErrNotFound if there is none.
+// The login of a company from before memberships becomes its owner here.
+func (s *handler) memberByEmail(email string) (*Member, error) {
+  member, err := s.repo.GetMemberByEmail(email)
+  if err != ErrNotFound {
+    return member, err
+  }
+
+  company, err := s.repo.GetByEmail(email)
+  if err != nil {
+    return nil, err
+  }
+  if company.Password == "" {
+    return nil, ErrNotFound
+  }
+  return s.migrateOwner(company)
+}
+
+// migrateOwner moves the login of a company from before memberships to a member owning it.
+// The member keeps the id of the company, so that records of the login such as its
+// second factor stay valid. Every step tolerates a concurrent migration of the same company.
+func (s *handler) migrateOwner(company *Company) (*Member, error) {
+  now := time.Now()
+  member := &Member{
+    Id:        company.Id,
+    Email:     company.Email,
+    Password:  company.Password,
+    CreatedAt: now,
+  }
+  if _, err := s.repo.CreateMember(member); err != nil && err != ErrAlreadyExists {
+    return nil, err
+  }
+  err := s.repo.CreateMembership(&Membership{
+    CompanyId: company.Id.Hex(),
+    MemberId:  company.Id.Hex(),
+    Role:      v1.MemberRole_OWNER.String(),
+    CreatedAt: now,
+  })
+  if err != nil && err != ErrAlreadyExists {
+    return nil, err
+  }
+
+  // the company has no login of its own any more. Its old sessions carry no member,
+  // so their tokens are not accepted and cannot be refreshed.
+  if err := s.repo.UpdatePassword(company.Id.Hex(), ""); err != nil {
+    return nil, err
+  }
+
+  return s.repo.GetMemberById(company.Id.Hex())
+}
+
+// loginMembership picks the company a member logs in to: the one with companyId,
+// or the only company of the member
+func (s *handler) loginMembership(member *Member, companyId string) (*Membership, error) {
+  memberships, err := s.repo.ListMembershipsByMember(member.Id.Hex())
+  if err != nil {
+    return nil, err
+  }
+
+  if companyId == "" {
+    switch len(memberships) {
+    case 0:
+      return nil, status.Error(codes.PermissionDenied, "not a member of any company")
+    case 1:
+      return memberships[0], nil
+    default:
+      return nil, status.Error(codes.FailedPrecondition, "member of several companies, log in with the id of one")
+    }
+  }
+
+  for _, membership := range memberships {
+    if membership.CompanyId == companyId {
+      return membership, nil
+    }
+  }
+  return nil, status.Error(codes.PermissionDenied, "not a member of this company")
+}
+
+// exportMember returns a member with its role in the company of membership
+func exportMember(member *Member, membership *Membership) *v1.Member {
+  return &v1.Member{
+    Id:       member.Id.Hex(),
+    Email:    member.Email,
+    Name:     member.Name,
+    Role:     v1.MemberRole(v1.MemberRole_value[membership.Role]),
+    JoinedAt: membership.CreatedAt.Unix(),
+  }
+}
@@ -0,0 +1,125 @@
+package v1
+
+import (
+  "context"
+  "testing"
+
+  "google.golang.org/grpc/codes"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+  "github.com/ckbball/os-company/pkg/errs"
+)
+
+func TestMembers(t *testing.T) {
+  s := newTestServer(t)
+  owner := s.signUp(t, "owner@example.com")
+  asOwner := s.as(t, owner.Token)
+
+  added, err := s.AddMember(asOwner, &v1.AddMemberRequest{
+    Api:      apiVersion,
+    Email:    "recruiter@example.com",
+    Password: testPassword,
+    Role:     v1.MemberRole_RECRUITER,
+  })
+  if err != nil {
+    t.Fatalf("AddMember failed: %v", err)
+  }
+  if added.Member.Role != v1.MemberRole_RECRUITER || added.Member.Email != "recruiter@example.com" {
+    t.Errorf("AddMember returned %+v", added.Member)
+  }
+  _, err = s.AddMember(asOwner, &v1.AddMemberRequest{
+    Api:      apiVersion,
+    Email:    "recruiter@example.com",
+    Password: testPassword,
+    Role:     v1.MemberRole_RECRUITER,
+  })
+  wantCode(t, "AddMember of a member", err, codes.AlreadyExists)
+
+  // the member logs in to the company with a role of its own
+  recruiter := s.login(t, "recruiter@example.com", testPassword)
+  asRecruiter := s.as(t, recruiter.Token)
+  if recruiter.Id != owner.Id || recruiter.MemberId != added.Member.Id {
+    t.Errorf("Login of the member returned company %s and member %s", recruiter.Id, recruiter.MemberId)
+  }
+  _, err = s.AddMember(asRecruiter, &v1.AddMemberRequest{Api: apiVersion, Email: "other@example.com",
+    Password: testPassword, Role: v1.MemberRole_RECRUITER})
+  wantCode(t, "AddMember by a recruiter", err, codes.PermissionDenied)
+
+  list, err := s.ListMembers(asRecruiter, &v1.ListMembersRequest{Api: apiVersion})
+  if err != nil {
+    t.Fatalf("ListMembers failed: %v", err)
+  }
+  if len(list.Members) != 2 {
+    t.Errorf("ListMembers returned %d members, want 2", len(list.Members))
+  }
+
+  changed, err := s.ChangeMemberRole(asOwner, &v1.ChangeMemberRoleRequest{Api: apiVersion, MemberId: added.Member.Id,
+    Role: v1.MemberRole_ADMIN})
+  if err != nil || changed.Member.Role != v1.MemberRole_ADMIN {
+    t.Fatalf("ChangeMemberRole returned (%+v, %v), want an admin", changed, err)
+  }
+  // tokens carry the role, so the old ones of the member end
+  if _, err := s.credentials.Authenticate(recruiter.Token); err == nil {
+    t.Errorf("access token with the old role accepted")
+  }
+  admin := s.login(t, "recruiter@example.com", testPassword)
+  asAdmin := s.as(t, admin.Token)
+
+  _, err = s.RemoveMember(asAdmin, &v1.RemoveMemberRequest{Api: apiVersion, MemberId: owner.MemberId})
+  wantCode(t, "RemoveMember of the owner", err, codes.FailedPrecondition)
+  _, err = s.RemoveMember(asOwner, &v1.RemoveMemberRequest{Api: apiVersion, MemberId: "5e0000000000000000000000"})
+  wantCode(t, "RemoveMember of an unknown member", err, codes.NotFound)
+
+  if _, err := s.RemoveMember(asOwner, &v1.RemoveMemberRequest{Api: apiVersion, MemberId: added.Member.Id}); err != nil {
+    t.Fatalf("RemoveMember failed: %v", err)
+  }
+  // without a company left, the member is gone with its sessions
+  if _, err := s.credentials.Authenticate(admin.Token); err == nil {
+    t.Errorf("access token of a removed member accepted")
+  }
+  _, err = s.RefreshToken(context.Background(), &v1.RefreshRequest{Api: apiVersion, RefreshToken: admin.RefreshToken})
+  wantCode(t, "RefreshToken of a removed member", err, codes.Unauthenticated)
+  _, err = s.Login(context.Background(), &v1.UpsertRequest{Api: apiVersion, Email: "recruiter@example.com", Password: testPassword})
+  wantCode(t, "Login of a removed member", err, codes.Unauthenticated)
+}
+
+// failingMemberships is a memory repository that cannot store memberships
+type failingMemberships struct {
+  *MemoryRepository
+  err error
+}
+
+func (r failingMemberships) CreateMembership(*Membership) error {
+  return r.err
+}
+
+func TestAddMemberRollback(t *testing.T) {
+  s := newTestServer(t)
+  owner := s.signUp(t, "owner@example.com")
+  add := func() error {
+    _, err := s.AddMember(s.as(t, owner.Token), &v1.AddMemberRequest{
+      Api:      apiVersion,
+      Email:    "recruiter@example.com",
+      Password: testPassword,
+      Role:     v1.MemberRole_RECRUITER,
+    })
+    return err
+  }
+
+  s.handler.repo = failingMemberships{s.repo, errs.New(errs.Unavailable, "the database is unavailable")}
+  if err := add(); err == nil {
+    t.Fatalf("AddMember without a membership succeeded")
+  }
+  // the member of no company is deleted again, so the email can be added once the database is back
+  if _, err := s.repo.GetMemberByEmail("recruiter@example.com"); err != ErrNotFound {
+    t.Errorf("GetMemberByEmail after a failed AddMember returned %v, want ErrNotFound", err)
+  }
+
+  // a taken membership is reported as one, not as the ErrAlreadyExists of the repository
+  s.handler.repo = failingMemberships{s.repo, ErrAlreadyExists}
+  err := add()
+  wantCode(t, "AddMember with a taken membership", err, codes.AlreadyExists)
+  if err == ErrAlreadyExists {
+    t.Errorf("AddMember with a taken membership returned the error of the repository")
+  }
+}
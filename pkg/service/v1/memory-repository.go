@@ -0,0 +1,991 @@
+package v1
+
+import (
+  "sort"
+  "strings"
+  "sync"
+  "time"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+  "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryRepository keeps companies in memory. It is safe for concurrent use
+// and meant for unit tests and local demos.
+type MemoryRepository struct {
+  mu            sync.RWMutex
+  companies     map[primitive.ObjectID]Company
+  refreshTokens map[string]RefreshToken
+  actionTokens  map[string]ActionToken
+  totps         map[string]Totp
+  apiKeys       map[string]ApiKey
+  members       map[primitive.ObjectID]Member
+  memberships   map[membershipKey]Membership
+  invitations   map[string]Invitation
+  auditEvents   []AuditEvent
+  oidcStates    map[string]OidcState
+  oidcIds       map[oidcIdentityKey]OidcIdentity
+}
+
+// oidcIdentityKey identifies the subject of an issuer
+type oidcIdentityKey struct {
+  issuer  string
+  subject string
+}
+
+// membershipKey identifies a membership
+type membershipKey struct {
+  companyId string
+  memberId  string
+}
+
+func NewMemoryRepository() *MemoryRepository {
+  return &MemoryRepository{
+    companies:     map[primitive.ObjectID]Company{},
+    refreshTokens: map[string]RefreshToken{},
+    actionTokens:  map[string]ActionToken{},
+    totps:         map[string]Totp{},
+    apiKeys:       map[string]ApiKey{},
+    members:       map[primitive.ObjectID]Member{},
+    memberships:   map[membershipKey]Membership{},
+    invitations:   map[string]Invitation{},
+    oidcStates:    map[string]OidcState{},
+    oidcIds:       map[oidcIdentityKey]OidcIdentity{},
+  }
+}
+
+func (repository *MemoryRepository) Create(company *v1.Company) (string, error) {
+  repository.mu.Lock()
+  defer repository.mu.Unlock()
+
+  if err := repository.checkDuplicate(company, primitive.NilObjectID); err != nil {
+    return "", err
+  }
+
+  id := primitive.NewObjectID()
+  repository.companies[id] = Company{
+    Id:         id,
+    Email:      company.Email,
+    Password:   company.Password,
+    Name:       company.Name,
+    Mission:    company.Mission,
+    Location:   company.Location,
+    LastActive: int(company.LastActive),
+    Unverified: !company.EmailVerified,
+    Version:    1,
+  }
+
+  return id.Hex(), nil
+}
+
+func (repository *MemoryRepository) Update(company *v1.Company, id string, fields []string, expectedVersion int64) (int64, int64, int64, error) {
+  repository.mu.Lock()
+  defer repository.mu.Unlock()
+
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return 0, 0, 0, nil
+  }
+  existing, ok := repository.companies[primitiveId]
+  if !ok {
+    return 0, 0, 0, nil
+  }
+
+  checked, err := updatedCompany(company, fields)
+  if err != nil {
+    return -1, -1, -1, err
+  }
+  if expectedVersion != 0 && existing.Version != expectedVersion {
+    return -1, -1, -1, ErrVersionMismatch
+  }
+  if err := repository.checkDuplicate(checked, primitiveId); err != nil {
+    return -1, -1, -1, err
+  }
+
+  updated := existing
+  for _, field := range fields {
+    switch field {
+    case "email":
+      updated.Email = company.Email
+    case "name":
+      updated.Name = company.Name
+    case "mission":
+      updated.Mission = company.Mission
+    case "location":
+      updated.Location = company.Location
+    }
+  }
+  if updated == existing {
+    return 1, 0, existing.Version, nil
+  }
+  updated.Version++
+  repository.companies[primitiveId] = updated
+
+  return 1, 1, updated.Version, nil
+}
+
+// checkDuplicate returns ErrEmailTaken or ErrNameTaken if a company other than self uses the
+// email or name of company, a taken email goes first. The caller must hold the lock.
+func (repository *MemoryRepository) checkDuplicate(company *v1.Company, self primitive.ObjectID) error {
+  email, name := normalizeEmail(company.Email), normalizeName(company.Name)
+  nameTaken := false
+  for id, existing := range repository.companies {
+    if id == self {
+      continue
+    }
+    if email != "" && normalizeEmail(existing.Email) == email {
+      return ErrEmailTaken
+    }
+    if name != "" && normalizeName(existing.Name) == name {
+      nameTaken = true
+    }
+  }
+  if nameTaken {
+    return ErrNameTaken
+  }
+  return nil
+}
+
+func (repository *MemoryRepository) Delete(id string, expectedVersion int64) (int64, error) {
+  repository.mu.Lock()
+  defer repository.mu.Unlock()
+
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return 0, nil
+  }
+  existing, ok := repository.companies[primitiveId]
+  if !ok {
+    return 0, nil
+  }
+  if expectedVersion != 0 && existing.Version != expectedVersion {
+    return -1, ErrVersionMismatch
+  }
+  delete(repository.companies, primitiveId)
+
+  return 1, nil
+}
+
+func (s *MemoryRepository) GetById(id string) (*Company, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return nil, ErrNotFound
+  }
+  company, ok := s.companies[primitiveId]
+  if !ok {
+    return nil, ErrNotFound
+  }
+
+  return &company, nil
+}
+
+func (s *MemoryRepository) GetByEmail(email string) (*Company, error) {
+  return s.find(func(company *Company) bool {
+    return email != "" && normalizeEmail(company.Email) == normalizeEmail(email)
+  })
+}
+
+func (s *MemoryRepository) GetByName(name string) (*Company, error) {
+  return s.find(func(company *Company) bool {
+    return normalizeName(name) != "" && normalizeName(company.Name) == normalizeName(name)
+  })
+}
+
+// find returns a copy of the first company matching match
+func (s *MemoryRepository) find(match func(*Company) bool) (*Company, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  for _, company := range s.companies {
+    if match(&company) {
+      return &company, nil
+    }
+  }
+
+  return nil, ErrNotFound
+}
+
+func (s *MemoryRepository) FilterCompanys(filter *CompanyFilter) ([]*Company, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  var after *Company
+  if filter.After != nil {
+    afterId, err := primitive.ObjectIDFromHex(filter.After.Id)
+    if err != nil {
+      return nil, err
+    }
+    after = &Company{
+      Id:         afterId,
+      Name:       filter.After.Name,
+      LastActive: int(filter.After.LastActive),
+    }
+  }
+
+  companys := []*Company{}
+  for _, company := range s.companies {
+    company := company
+    if !matchesFilter(filter, &company) {
+      continue
+    }
+    if after != nil && !lessInOrder(filter.Order, after, &company) {
+      continue
+    }
+    companys = append(companys, &company)
+  }
+
+  sort.Slice(companys, func(i, j int) bool {
+    return lessInOrder(filter.Order, companys[i], companys[j])
+  })
+
+  if len(companys) > filter.Limit {
+    companys = companys[:filter.Limit]
+  }
+
+  return companys, nil
+}
+
+func (s *MemoryRepository) UpdateActive(id string) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return -1, ErrNotFound
+  }
+  company, ok := s.companies[primitiveId]
+  if !ok {
+    return -1, ErrNotFound
+  }
+
+  secs := time.Now().Unix()
+  company.LastActive = int(secs)
+  s.companies[primitiveId] = company
+
+  return secs, nil
+}
+
+func (s *MemoryRepository) UpdatePassword(id string, hash string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return ErrNotFound
+  }
+  company, ok := s.companies[primitiveId]
+  if !ok {
+    return ErrNotFound
+  }
+
+  company.Password = hash
+  s.companies[primitiveId] = company
+  return nil
+}
+
+func (s *MemoryRepository) SetEmailVerified(id string, verified bool) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return ErrNotFound
+  }
+  company, ok := s.companies[primitiveId]
+  if !ok {
+    return ErrNotFound
+  }
+
+  company.Unverified = !verified
+  s.companies[primitiveId] = company
+  return nil
+}
+
+func (s *MemoryRepository) CreateRefreshToken(token *RefreshToken) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.refreshTokens[token.Hash] = *token
+  return nil
+}
+
+func (s *MemoryRepository) GetRefreshToken(hash string) (*RefreshToken, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  token, ok := s.refreshTokens[hash]
+  if !ok {
+    return nil, ErrNotFound
+  }
+  return &token, nil
+}
+
+func (s *MemoryRepository) UseRefreshToken(hash string) (*RefreshToken, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  token, ok := s.refreshTokens[hash]
+  if !ok {
+    return nil, ErrNotFound
+  }
+  used := token
+  used.Used = true
+  s.refreshTokens[hash] = used
+
+  return &token, nil
+}
+
+func (s *MemoryRepository) RevokeRefreshFamily(family string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for hash, token := range s.refreshTokens {
+    if token.Family == family {
+      token.Revoked = true
+      s.refreshTokens[hash] = token
+    }
+  }
+  return nil
+}
+
+func (s *MemoryRepository) RevokeCompanyRefreshTokens(companyId string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for hash, token := range s.refreshTokens {
+    if token.CompanyId == companyId {
+      token.Revoked = true
+      s.refreshTokens[hash] = token
+    }
+  }
+  return nil
+}
+
+func (s *MemoryRepository) RevokeMemberRefreshTokens(memberId string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for hash, token := range s.refreshTokens {
+    if token.MemberId == memberId {
+      token.Revoked = true
+      s.refreshTokens[hash] = token
+    }
+  }
+  return nil
+}
+
+func (s *MemoryRepository) CreateActionToken(token *ActionToken) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.actionTokens[token.Hash] = *token
+  return nil
+}
+
+func (s *MemoryRepository) ConsumeActionToken(purpose string, hash string) (*ActionToken, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  token, ok := s.actionTokens[hash]
+  if !ok || token.Purpose != purpose {
+    return nil, ErrNotFound
+  }
+  delete(s.actionTokens, hash)
+
+  return &token, nil
+}
+
+func (s *MemoryRepository) GetActionToken(purpose string, hash string) (*ActionToken, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  token, ok := s.actionTokens[hash]
+  if !ok || token.Purpose != purpose {
+    return nil, ErrNotFound
+  }
+
+  return &token, nil
+}
+
+func (s *MemoryRepository) ConsumeMemberActionToken(purpose string, hash string, memberId string) (*ActionToken, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  token, ok := s.actionTokens[hash]
+  if !ok || token.Purpose != purpose || token.MemberId != memberId {
+    return nil, ErrNotFound
+  }
+  delete(s.actionTokens, hash)
+
+  return &token, nil
+}
+
+func (s *MemoryRepository) DeleteActionTokens(purpose string, companyId string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for hash, token := range s.actionTokens {
+    if token.Purpose == purpose && token.CompanyId == companyId {
+      delete(s.actionTokens, hash)
+    }
+  }
+  return nil
+}
+
+func (s *MemoryRepository) DeleteMemberActionTokens(purpose string, memberId string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for hash, token := range s.actionTokens {
+    if token.Purpose == purpose && token.MemberId == memberId {
+      delete(s.actionTokens, hash)
+    }
+  }
+  return nil
+}
+
+func (s *MemoryRepository) SaveTotp(totp *Totp) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  saved := *totp
+  saved.RecoveryCodes = append([]string{}, totp.RecoveryCodes...)
+  s.totps[totp.MemberId] = saved
+  return nil
+}
+
+func (s *MemoryRepository) GetTotp(memberId string) (*Totp, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  totp, ok := s.totps[memberId]
+  if !ok {
+    return nil, ErrNotFound
+  }
+  totp.RecoveryCodes = append([]string{}, totp.RecoveryCodes...)
+
+  return &totp, nil
+}
+
+func (s *MemoryRepository) AdvanceTotpStep(memberId string, step int64) (bool, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  totp, ok := s.totps[memberId]
+  if !ok || totp.LastStep >= step {
+    return false, nil
+  }
+  totp.LastStep = step
+  s.totps[memberId] = totp
+
+  return true, nil
+}
+
+func (s *MemoryRepository) UseRecoveryCode(memberId string, hash string) (bool, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  totp, ok := s.totps[memberId]
+  if !ok {
+    return false, nil
+  }
+  for i, code := range totp.RecoveryCodes {
+    if code == hash {
+      // copy, the old slice may still be shared with a caller
+      codes := append([]string{}, totp.RecoveryCodes[:i]...)
+      totp.RecoveryCodes = append(codes, totp.RecoveryCodes[i+1:]...)
+      s.totps[memberId] = totp
+      return true, nil
+    }
+  }
+
+  return false, nil
+}
+
+func (s *MemoryRepository) CreateApiKey(key *ApiKey) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  saved := *key
+  saved.Scopes = append([]string{}, key.Scopes...)
+  s.apiKeys[key.Id] = saved
+  return nil
+}
+
+func (s *MemoryRepository) GetApiKeyByHash(hash string) (*ApiKey, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  for _, key := range s.apiKeys {
+    if key.Hash == hash {
+      key.Scopes = append([]string{}, key.Scopes...)
+      return &key, nil
+    }
+  }
+  return nil, ErrNotFound
+}
+
+func (s *MemoryRepository) ListApiKeys(companyId string) ([]*ApiKey, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  keys := []*ApiKey{}
+  for _, key := range s.apiKeys {
+    if key.CompanyId == companyId {
+      key := key
+      key.Scopes = append([]string{}, key.Scopes...)
+      keys = append(keys, &key)
+    }
+  }
+  sort.Slice(keys, func(i, j int) bool {
+    if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+      return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+    }
+    return keys[i].Id < keys[j].Id
+  })
+
+  return keys, nil
+}
+
+func (s *MemoryRepository) DeleteApiKey(companyId string, id string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  key, ok := s.apiKeys[id]
+  if !ok || key.CompanyId != companyId {
+    return ErrNotFound
+  }
+  delete(s.apiKeys, id)
+  return nil
+}
+
+func (s *MemoryRepository) DeleteApiKeys(companyId string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for id, key := range s.apiKeys {
+    if key.CompanyId == companyId {
+      delete(s.apiKeys, id)
+    }
+  }
+  return nil
+}
+
+func (s *MemoryRepository) TouchApiKey(id string, at time.Time) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if key, ok := s.apiKeys[id]; ok {
+    key.LastUsedAt = at
+    s.apiKeys[id] = key
+  }
+  return nil
+}
+
+func (s *MemoryRepository) CreateMember(member *Member) (string, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  id := member.Id
+  if id.IsZero() {
+    id = primitive.NewObjectID()
+  }
+  if _, ok := s.members[id]; ok {
+    return "", ErrAlreadyExists
+  }
+  email := normalizeEmail(member.Email)
+  for _, existing := range s.members {
+    if normalizeEmail(existing.Email) == email {
+      return "", ErrAlreadyExists
+    }
+  }
+
+  saved := *member
+  saved.Id = id
+  saved.Email = email
+  s.members[id] = saved
+  return id.Hex(), nil
+}
+
+func (s *MemoryRepository) GetMemberById(id string) (*Member, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return nil, ErrNotFound
+  }
+  member, ok := s.members[primitiveId]
+  if !ok {
+    return nil, ErrNotFound
+  }
+
+  return &member, nil
+}
+
+func (s *MemoryRepository) GetMemberByEmail(email string) (*Member, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  email = normalizeEmail(email)
+  if email == "" {
+    return nil, ErrNotFound
+  }
+  for _, member := range s.members {
+    if normalizeEmail(member.Email) == email {
+      return &member, nil
+    }
+  }
+  return nil, ErrNotFound
+}
+
+func (s *MemoryRepository) UpdateMemberPassword(id string, hash string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return ErrNotFound
+  }
+  member, ok := s.members[primitiveId]
+  if !ok {
+    return ErrNotFound
+  }
+  member.Password = hash
+  s.members[primitiveId] = member
+
+  return nil
+}
+
+func (s *MemoryRepository) ReplaceMemberPassword(id string, oldHash string, newHash string) (bool, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return false, nil
+  }
+  member, ok := s.members[primitiveId]
+  if !ok || member.Password != oldHash {
+    return false, nil
+  }
+  member.Password = newHash
+  s.members[primitiveId] = member
+
+  return true, nil
+}
+
+func (s *MemoryRepository) DeleteMember(id string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return ErrNotFound
+  }
+  if _, ok := s.members[primitiveId]; !ok {
+    return ErrNotFound
+  }
+  delete(s.members, primitiveId)
+
+  return nil
+}
+
+func (s *MemoryRepository) CreateMembership(membership *Membership) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  key := membershipKey{membership.CompanyId, membership.MemberId}
+  if _, ok := s.memberships[key]; ok {
+    return ErrAlreadyExists
+  }
+  s.memberships[key] = *membership
+  return nil
+}
+
+func (s *MemoryRepository) GetMembership(companyId string, memberId string) (*Membership, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  membership, ok := s.memberships[membershipKey{companyId, memberId}]
+  if !ok {
+    return nil, ErrNotFound
+  }
+  return &membership, nil
+}
+
+func (s *MemoryRepository) ListMembershipsByCompany(companyId string) ([]*Membership, error) {
+  return s.listMemberships(func(membership *Membership) bool {
+    return membership.CompanyId == companyId
+  }), nil
+}
+
+func (s *MemoryRepository) ListMembershipsByMember(memberId string) ([]*Membership, error) {
+  return s.listMemberships(func(membership *Membership) bool {
+    return membership.MemberId == memberId
+  }), nil
+}
+
+// listMemberships returns the memberships matching match, oldest first
+func (s *MemoryRepository) listMemberships(match func(*Membership) bool) []*Membership {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  memberships := []*Membership{}
+  for _, membership := range s.memberships {
+    membership := membership
+    if match(&membership) {
+      memberships = append(memberships, &membership)
+    }
+  }
+  sort.Slice(memberships, func(i, j int) bool {
+    a, b := memberships[i], memberships[j]
+    if !a.CreatedAt.Equal(b.CreatedAt) {
+      return a.CreatedAt.Before(b.CreatedAt)
+    }
+    if a.CompanyId != b.CompanyId {
+      return a.CompanyId < b.CompanyId
+    }
+    return a.MemberId < b.MemberId
+  })
+
+  return memberships
+}
+
+func (s *MemoryRepository) UpdateMembershipRole(companyId string, memberId string, role string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  key := membershipKey{companyId, memberId}
+  membership, ok := s.memberships[key]
+  if !ok {
+    return ErrNotFound
+  }
+  membership.Role = role
+  s.memberships[key] = membership
+
+  return nil
+}
+
+func (s *MemoryRepository) DeleteMembership(companyId string, memberId string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  key := membershipKey{companyId, memberId}
+  if _, ok := s.memberships[key]; !ok {
+    return ErrNotFound
+  }
+  delete(s.memberships, key)
+
+  return nil
+}
+
+func (s *MemoryRepository) CreateInvitation(invitation *Invitation) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.invitations[invitation.Id] = *invitation
+  return nil
+}
+
+func (s *MemoryRepository) GetInvitation(id string) (*Invitation, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  invitation, ok := s.invitations[id]
+  if !ok {
+    return nil, ErrNotFound
+  }
+  return &invitation, nil
+}
+
+func (s *MemoryRepository) ListInvitations(companyId string) ([]*Invitation, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  invitations := []*Invitation{}
+  for _, invitation := range s.invitations {
+    if invitation.CompanyId == companyId {
+      invitation := invitation
+      invitations = append(invitations, &invitation)
+    }
+  }
+  sort.Slice(invitations, func(i, j int) bool {
+    if !invitations[i].CreatedAt.Equal(invitations[j].CreatedAt) {
+      return invitations[i].CreatedAt.Before(invitations[j].CreatedAt)
+    }
+    return invitations[i].Id < invitations[j].Id
+  })
+
+  return invitations, nil
+}
+
+func (s *MemoryRepository) DeleteInvitation(companyId string, id string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  invitation, ok := s.invitations[id]
+  if !ok || invitation.CompanyId != companyId {
+    return ErrNotFound
+  }
+  delete(s.invitations, id)
+  return nil
+}
+
+func (s *MemoryRepository) DeleteInvitations(companyId string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for id, invitation := range s.invitations {
+    if invitation.CompanyId == companyId {
+      delete(s.invitations, id)
+    }
+  }
+  return nil
+}
+
+func (s *MemoryRepository) CreateAuditEvent(event *AuditEvent) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.auditEvents = append(s.auditEvents, *event)
+  return nil
+}
+
+func (s *MemoryRepository) ListAuditEvents(companyId string) ([]*AuditEvent, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  events := []*AuditEvent{}
+  for _, event := range s.auditEvents {
+    if event.CompanyId == companyId {
+      event := event
+      events = append(events, &event)
+    }
+  }
+  sort.Slice(events, func(i, j int) bool {
+    if !events[i].CreatedAt.Equal(events[j].CreatedAt) {
+      return events[i].CreatedAt.After(events[j].CreatedAt)
+    }
+    return events[i].Id > events[j].Id
+  })
+
+  return events, nil
+}
+
+func (s *MemoryRepository) CreateOidcState(state *OidcState) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.oidcStates[state.Hash] = *state
+  return nil
+}
+
+func (s *MemoryRepository) ConsumeOidcState(hash string) (*OidcState, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  state, ok := s.oidcStates[hash]
+  if !ok {
+    return nil, ErrNotFound
+  }
+  delete(s.oidcStates, hash)
+
+  return &state, nil
+}
+
+func (s *MemoryRepository) SaveOidcIdentity(identity *OidcIdentity) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.oidcIds[oidcIdentityKey{identity.Issuer, identity.Subject}] = *identity
+  return nil
+}
+
+func (s *MemoryRepository) GetOidcIdentity(issuer string, subject string) (*OidcIdentity, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  identity, ok := s.oidcIds[oidcIdentityKey{issuer, subject}]
+  if !ok {
+    return nil, ErrNotFound
+  }
+  return &identity, nil
+}
+
+// EnsureUniqueIndexes has no indexes to create, Create and Update check for duplicates under
+// the lock. It still reports the duplicates stored before.
+func (s *MemoryRepository) EnsureUniqueIndexes() ([]*Duplicate, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  emails, names := map[string][]string{}, map[string][]string{}
+  for id, company := range s.companies {
+    if email := normalizeEmail(company.Email); email != "" {
+      emails[email] = append(emails[email], id.Hex())
+    }
+    if name := normalizeName(company.Name); name != "" {
+      names[name] = append(names[name], id.Hex())
+    }
+  }
+
+  duplicates := append(memoryDuplicates("email", emails), memoryDuplicates("name", names)...)
+  return duplicates, nil
+}
+
+// memoryDuplicates returns the values of field shared by several companies, sorted by value
+func memoryDuplicates(field string, ids map[string][]string) []*Duplicate {
+  duplicates := []*Duplicate{}
+  for value, shared := range ids {
+    if len(shared) > 1 {
+      sort.Strings(shared)
+      duplicates = append(duplicates, &Duplicate{Field: field, Value: value, CompanyIds: shared})
+    }
+  }
+  sort.Slice(duplicates, func(i, j int) bool {
+    return duplicates[i].Value < duplicates[j].Value
+  })
+  return duplicates
+}
+
+// matchesFilter reports if company passes the filters, ignoring the cursor
+func matchesFilter(filter *CompanyFilter, company *Company) bool {
+  if filter.NamePrefix != "" && !strings.HasPrefix(company.Name, filter.NamePrefix) {
+    return false
+  }
+  if filter.Location != "" && company.Location != filter.Location {
+    return false
+  }
+  if filter.ActiveAfter > 0 && int64(company.LastActive) < filter.ActiveAfter {
+    return false
+  }
+  if filter.ActiveBefore > 0 && int64(company.LastActive) >= filter.ActiveBefore {
+    return false
+  }
+  if filter.VerifiedOnly && company.Unverified {
+    return false
+  }
+  return true
+}
+
+// lessInOrder reports if a sorts before b in order, ties are broken by id
+func lessInOrder(order v1.CompanyOrder, a, b *Company) bool {
+  var cmp int
+  switch order {
+  case v1.CompanyOrder_LAST_ACTIVE_ASC, v1.CompanyOrder_LAST_ACTIVE_DESC:
+    cmp = a.LastActive - b.LastActive
+  default:
+    cmp = strings.Compare(a.Name, b.Name)
+  }
+  if cmp == 0 {
+    cmp = strings.Compare(a.Id.Hex(), b.Id.Hex())
+  }
+
+  if order == v1.CompanyOrder_NAME_DESC || order == v1.CompanyOrder_LAST_ACTIVE_DESC {
+    return cmp > 0
+  }
+  return cmp < 0
+}
@@ -0,0 +1,14 @@
+package v1_test
+
+import (
+  "testing"
+
+  service "github.com/ckbball/os-company/pkg/service/v1"
+  "github.com/ckbball/os-company/pkg/service/v1/repotest"
+)
+
+func TestMemoryRepository(t *testing.T) {
+  repotest.RunConformance(t, func(t *testing.T) service.Repository {
+    return service.NewMemoryRepository()
+  })
+}
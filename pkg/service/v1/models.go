@@ -12,4 +12,10 @@ type Company struct {
   Mission    string             `json:"mission,omitempty" bson:"mission,omitempty"`
   Location   string             `json:"location,omitempty" bson:"location,omitempty"`
   LastActive int                `json:"lastActive,omitempty" bson:"last_active,omitempty"`
+  // Unverified is set until the company confirms its email.
+  // Companies created before email verification existed do not have it and count as verified.
+  Unverified bool `json:"unverified,omitempty" bson:"unverified,omitempty"`
+  // Version is 1 for new companies and incremented by every update that changes them.
+  // Companies created before versions existed do not have it until their first update.
+  Version int64 `json:"version,omitempty" bson:"version,omitempty"`
 }
@@ -0,0 +1,44 @@
+package v1_test
+
+import (
+  "context"
+  "fmt"
+  "os"
+  "testing"
+  "time"
+
+  "go.mongodb.org/mongo-driver/mongo"
+  "go.mongodb.org/mongo-driver/mongo/options"
+
+  service "github.com/ckbball/os-company/pkg/service/v1"
+  "github.com/ckbball/os-company/pkg/service/v1/repotest"
+)
+
+// TestMongoRepository runs the conformance suite against the server of TEST_MONGO_URI,
+// e.g. mongodb://localhost:27017. Every test gets a database of its own, which is dropped afterwards.
+func TestMongoRepository(t *testing.T) {
+  uri := os.Getenv("TEST_MONGO_URI")
+  if uri == "" {
+    t.Skip("TEST_MONGO_URI is not set")
+  }
+
+  ctx := context.Background()
+  client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+  if err != nil {
+    t.Fatalf("failed to connect: %v", err)
+  }
+  defer client.Disconnect(ctx)
+  if err := client.Ping(ctx, nil); err != nil {
+    t.Fatalf("failed to reach the server: %v", err)
+  }
+
+  repotest.RunConformance(t, func(t *testing.T) service.Repository {
+    db := client.Database(fmt.Sprintf("companies_test_%d", time.Now().UnixNano()))
+    t.Cleanup(func() {
+      if err := db.Drop(ctx); err != nil {
+        t.Errorf("failed to drop %s: %v", db.Name(), err)
+      }
+    })
+    return service.NewCompanyRepository(db.Collection("companies"))
+  })
+}
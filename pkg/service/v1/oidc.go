@@ -0,0 +1,275 @@
+package v1
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "strings"
+  "time"
+
+  "github.com/coreos/go-oidc/v3/oidc"
+  "go.uber.org/zap"
+  "golang.org/x/oauth2"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+  "github.com/ckbball/os-company/pkg/logger"
+)
+
+const (
+  // oidcLoginTTL is the time a user has to log in at the provider
+  oidcLoginTTL = 10 * time.Minute
+)
+
+var (
+  // errInvalidOidcState is returned for every unusable state so that callers learn nothing about it
+  errInvalidOidcState = status.Error(codes.InvalidArgument, "invalid or expired login state")
+  // errOidcLoginFailed is returned when the provider does not confirm the login, the cause is logged
+  errOidcLoginFailed = status.Error(codes.Unauthenticated, "login with the provider failed")
+  // errOidcDomain is returned when the trusted email of a login is outside the domains of the provider
+  errOidcDomain = status.Error(codes.PermissionDenied, "the domain of the email may not log in with this provider")
+)
+
+// OidcProviderConfig configures an OpenID Connect provider members can log in with
+type OidcProviderConfig struct {
+  // Name identifies the provider in BeginOidcLogin
+  Name string `json:"name"`
+  // Issuer is the issuer url of the provider, its endpoints are discovered from it
+  Issuer       string `json:"issuer"`
+  ClientId     string `json:"client_id"`
+  ClientSecret string `json:"client_secret"`
+  // RedirectURL is the frontend page the provider redirects to, it has to be registered with the provider
+  RedirectURL string `json:"redirect_url"`
+  // AllowedDomains limits logins to emails of these domains, any domain is allowed if empty
+  AllowedDomains []string `json:"allowed_domains"`
+}
+
+// OidcProvider is a configured provider with its discovered endpoints
+type OidcProvider struct {
+  name           string
+  issuer         string
+  allowedDomains map[string]bool
+  oauth2         oauth2.Config
+  verifier       *oidc.IDTokenVerifier
+}
+
+// NewOidcProviders discovers the endpoints of the configured providers and returns them by name.
+// ctx is also used to fetch the signing keys of the providers later on.
+func NewOidcProviders(ctx context.Context, configs []OidcProviderConfig) (map[string]*OidcProvider, error) {
+  providers := map[string]*OidcProvider{}
+  for _, config := range configs {
+    if config.Name == "" || config.Issuer == "" || config.ClientId == "" || config.RedirectURL == "" {
+      return nil, fmt.Errorf("oidc provider '%s' needs a name, issuer, client_id and redirect_url", config.Name)
+    }
+    if _, ok := providers[config.Name]; ok {
+      return nil, fmt.Errorf("oidc provider '%s' is configured twice", config.Name)
+    }
+
+    discovered, err := oidc.NewProvider(ctx, config.Issuer)
+    if err != nil {
+      return nil, fmt.Errorf("failed to discover oidc provider '%s': %v", config.Name, err)
+    }
+
+    domains := map[string]bool{}
+    for _, domain := range config.AllowedDomains {
+      domains[strings.ToLower(domain)] = true
+    }
+    providers[config.Name] = &OidcProvider{
+      name:           config.Name,
+      issuer:         config.Issuer,
+      allowedDomains: domains,
+      oauth2: oauth2.Config{
+        ClientID:     config.ClientId,
+        ClientSecret: config.ClientSecret,
+        RedirectURL:  config.RedirectURL,
+        Endpoint:     discovered.Endpoint(),
+        Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+      },
+      verifier: discovered.Verifier(&oidc.Config{ClientID: config.ClientId}),
+    }
+  }
+  return providers, nil
+}
+
+// allows reports if members with email may log in with the provider
+func (p *OidcProvider) allows(email string) bool {
+  if len(p.allowedDomains) == 0 {
+    return true
+  }
+  at := strings.LastIndex(email, "@")
+  return at >= 0 && p.allowedDomains[strings.ToLower(email[at+1:])]
+}
+
+// oidcIdentity is the part of an ID token we log members in with
+type oidcIdentity struct {
+  Subject       string `json:"sub"`
+  Email         string `json:"email"`
+  EmailVerified bool   `json:"email_verified"`
+}
+
+// exchange redeems the code of a redirect and returns the identity of its verified ID token
+func (p *OidcProvider) exchange(ctx context.Context, code string, state *OidcState) (*oidcIdentity, error) {
+  token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(state.Verifier))
+  if err != nil {
+    return nil, err
+  }
+  rawIDToken, ok := token.Extra("id_token").(string)
+  if !ok {
+    return nil, errors.New("token response without id_token")
+  }
+
+  idToken, err := p.verifier.Verify(ctx, rawIDToken)
+  if err != nil {
+    return nil, err
+  }
+  if idToken.Nonce != state.Nonce {
+    return nil, errors.New("id_token nonce does not match")
+  }
+
+  var identity oidcIdentity
+  if err := idToken.Claims(&identity); err != nil {
+    return nil, err
+  }
+  return &identity, nil
+}
+
+// OidcState is the server-side record of a login started with BeginOidcLogin.
+// Only the hash of the state is stored, and completing the login deletes it.
+type OidcState struct {
+  Hash      string `json:"hash" bson:"_id"`
+  Provider  string `json:"provider" bson:"provider"`
+  CompanyId string `json:"companyId" bson:"company_id"`
+  // Nonce is expected in the ID token, Verifier is the PKCE code verifier
+  Nonce     string    `json:"nonce" bson:"nonce"`
+  Verifier  string    `json:"verifier" bson:"verifier"`
+  ExpiresAt time.Time `json:"expiresAt" bson:"expires_at"`
+  CreatedAt time.Time `json:"createdAt" bson:"created_at"`
+}
+
+// OidcIdentity links the subject of an OpenID Connect provider to a member
+type OidcIdentity struct {
+  Issuer   string `json:"issuer" bson:"issuer"`
+  Subject  string `json:"subject" bson:"subject"`
+  MemberId string `json:"memberId" bson:"member_id"`
+  // Email is the email of the subject when it was linked
+  Email     string    `json:"email" bson:"email"`
+  CreatedAt time.Time `json:"createdAt" bson:"created_at"`
+}
+
+// BeginOidcLogin returns the authorization url of a provider for a new login
+func (s *handler) BeginOidcLogin(ctx context.Context, req *v1.BeginOidcLoginRequest) (*v1.BeginOidcLoginResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  provider, ok := s.oidcProviders[req.Provider]
+  if !ok {
+    return nil, status.Errorf(codes.NotFound, "unknown provider '%s'", req.Provider)
+  }
+
+  state := newOpaqueToken()
+  now := time.Now()
+  record := &OidcState{
+    Hash:      hashToken(state),
+    Provider:  provider.name,
+    CompanyId: req.CompanyId,
+    Nonce:     newOpaqueToken(),
+    Verifier:  oauth2.GenerateVerifier(),
+    ExpiresAt: now.Add(oidcLoginTTL),
+    CreatedAt: now,
+  }
+  if err := s.repo.CreateOidcState(record); err != nil {
+    return nil, err
+  }
+
+  return &v1.BeginOidcLoginResponse{
+    Api: apiVersion,
+    AuthorizationUrl: provider.oauth2.AuthCodeURL(state,
+      oidc.Nonce(record.Nonce), oauth2.S256ChallengeOption(record.Verifier)),
+    ExpiresAt: record.ExpiresAt.Unix(),
+  }, nil
+}
+
+// CompleteOidcLogin logs a member in with the code and state of a provider redirect
+func (s *handler) CompleteOidcLogin(ctx context.Context, req *v1.CompleteOidcLoginRequest) (*v1.UpsertResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  // consuming the state first makes every login single-use even when requests race
+  record, err := s.repo.ConsumeOidcState(hashToken(req.State))
+  if err == ErrNotFound {
+    return nil, errInvalidOidcState
+  }
+  if err != nil {
+    return nil, err
+  }
+  provider, ok := s.oidcProviders[record.Provider]
+  if !ok || time.Now().After(record.ExpiresAt) {
+    return nil, errInvalidOidcState
+  }
+
+  identity, err := provider.exchange(ctx, req.Code, record)
+  if err != nil {
+    logger.Log.Warn("oidc login failed", zap.String("provider", provider.name), zap.Error(err))
+    return nil, errOidcLoginFailed
+  }
+
+  member, err := s.oidcMember(provider, identity)
+  if err != nil {
+    return nil, err
+  }
+  return s.loginMember(member, record.CompanyId)
+}
+
+// oidcMember returns the member linked to identity, linking the member with its
+// email on first use. Only emails verified by the provider are trusted for that,
+// and for the allowed domains, which are checked on the email of a linked member.
+func (s *handler) oidcMember(provider *OidcProvider, identity *oidcIdentity) (*Member, error) {
+  link, err := s.repo.GetOidcIdentity(provider.issuer, identity.Subject)
+  if err != nil && err != ErrNotFound {
+    return nil, err
+  }
+  if err == nil {
+    member, err := s.repo.GetMemberById(link.MemberId)
+    // the member of a stale link was deleted, link again by email
+    if err != ErrNotFound {
+      if err != nil {
+        return nil, err
+      }
+      if !provider.allows(member.Email) {
+        return nil, errOidcDomain
+      }
+      return member, nil
+    }
+  }
+
+  if identity.Email == "" || !identity.EmailVerified {
+    return nil, status.Error(codes.PermissionDenied, "the provider has not verified the email")
+  }
+  if !provider.allows(identity.Email) {
+    return nil, errOidcDomain
+  }
+  member, err := s.memberByEmail(identity.Email)
+  if err == ErrNotFound {
+    return nil, status.Error(codes.PermissionDenied, "no member with this email, sign up or accept an invitation first")
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  err = s.repo.SaveOidcIdentity(&OidcIdentity{
+    Issuer:    provider.issuer,
+    Subject:   identity.Subject,
+    MemberId:  member.Id.Hex(),
+    Email:     identity.Email,
+    CreatedAt: time.Now(),
+  })
+  if err != nil {
+    return nil, err
+  }
+  return member, nil
+}
@@ -0,0 +1,331 @@
+package v1
+
+import (
+  "context"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/json"
+  "math/big"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "sync"
+  "testing"
+  "time"
+
+  "github.com/dgrijalva/jwt-go"
+  "go.uber.org/zap"
+  "google.golang.org/grpc/codes"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+  "github.com/ckbball/os-company/pkg/logger"
+)
+
+const (
+  testOidcClientId = "company-service"
+  // testOidcCode is the only authorization code the test issuer redeems
+  testOidcCode = "code"
+)
+
+// testIssuer is an OpenID Connect provider serving discovery, its signing keys and a token endpoint.
+// It signs ID tokens for whoever is set as the user logging in.
+type testIssuer struct {
+  *httptest.Server
+  key *rsa.PrivateKey
+
+  mu sync.Mutex
+  // user is the identity of the next ID token
+  user oidcIdentity
+  // challenge and nonce are those of the last authorization url the user followed
+  challenge string
+  nonce     string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+  key, err := rsa.GenerateKey(rand.Reader, 2048)
+  if err != nil {
+    t.Fatalf("failed to generate a key: %v", err)
+  }
+  issuer := &testIssuer{key: key}
+
+  mux := http.NewServeMux()
+  mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+      "issuer":                                issuer.URL,
+      "authorization_endpoint":                issuer.URL + "/authorize",
+      "token_endpoint":                        issuer.URL + "/token",
+      "jwks_uri":                              issuer.URL + "/keys",
+      "id_token_signing_alg_values_supported": []string{"RS256"},
+    })
+  })
+  mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+      "keys": []map[string]string{{
+        "kty": "RSA",
+        "kid": "test",
+        "alg": "RS256",
+        "use": "sig",
+        "n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+        "e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+      }},
+    })
+  })
+  mux.HandleFunc("/token", issuer.token)
+  issuer.Server = httptest.NewServer(mux)
+  t.Cleanup(issuer.Close)
+  return issuer
+}
+
+// token redeems testOidcCode if the PKCE verifier matches the challenge of the authorization url
+func (i *testIssuer) token(w http.ResponseWriter, r *http.Request) {
+  i.mu.Lock()
+  defer i.mu.Unlock()
+
+  if err := r.ParseForm(); err != nil {
+    writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+    return
+  }
+  sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+  if r.PostForm.Get("code") != testOidcCode || base64.RawURLEncoding.EncodeToString(sum[:]) != i.challenge {
+    writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+    return
+  }
+
+  now := time.Now()
+  idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+    "iss":            i.URL,
+    "aud":            testOidcClientId,
+    "sub":            i.user.Subject,
+    "email":          i.user.Email,
+    "email_verified": i.user.EmailVerified,
+    "nonce":          i.nonce,
+    "iat":            now.Unix(),
+    "exp":            now.Add(time.Hour).Unix(),
+  })
+  idToken.Header["kid"] = "test"
+  signed, err := idToken.SignedString(i.key)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+    return
+  }
+  writeJSON(w, http.StatusOK, map[string]interface{}{
+    "access_token": "access",
+    "token_type":   "Bearer",
+    "expires_in":   3600,
+    "id_token":     signed,
+  })
+}
+
+// authorize plays the user logging in at the provider with an authorization url and returns the state of the redirect
+func (i *testIssuer) authorize(t *testing.T, authorizationURL string, user oidcIdentity) string {
+  t.Helper()
+  u, err := url.Parse(authorizationURL)
+  if err != nil {
+    t.Fatalf("invalid authorization url %s: %v", authorizationURL, err)
+  }
+  query := u.Query()
+  if query.Get("client_id") != testOidcClientId || query.Get("code_challenge_method") != "S256" ||
+    query.Get("nonce") == "" || query.Get("state") == "" {
+    t.Fatalf("authorization url %s lacks the client, PKCE challenge, nonce or state", authorizationURL)
+  }
+
+  i.mu.Lock()
+  defer i.mu.Unlock()
+  i.user = user
+  i.challenge = query.Get("code_challenge")
+  i.nonce = query.Get("nonce")
+  return query.Get("state")
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(code)
+  json.NewEncoder(w).Encode(body)
+}
+
+// newOidcTestServer returns a test server with the provider "test" of issuer, which allows emails of example.com
+func newOidcTestServer(t *testing.T, issuer *testIssuer) *testServer {
+  // failed logins are logged
+  if logger.Log == nil {
+    logger.Log = zap.NewNop()
+  }
+
+  providers, err := NewOidcProviders(context.Background(), []OidcProviderConfig{{
+    Name:           "test",
+    Issuer:         issuer.URL,
+    ClientId:       testOidcClientId,
+    ClientSecret:   "secret",
+    RedirectURL:    "https://example.com/oidc",
+    AllowedDomains: []string{"example.com"},
+  }})
+  if err != nil {
+    t.Fatalf("NewOidcProviders failed: %v", err)
+  }
+  s := newTestServer(t)
+  s.oidcProviders = providers
+  return s
+}
+
+// oidcLogin logs in at the provider "test" as user and completes the login with the redirect
+func (s *testServer) oidcLogin(t *testing.T, issuer *testIssuer, user oidcIdentity) (*v1.UpsertResponse, error) {
+  t.Helper()
+  begin, err := s.BeginOidcLogin(context.Background(), &v1.BeginOidcLoginRequest{Api: apiVersion, Provider: "test"})
+  if err != nil {
+    t.Fatalf("BeginOidcLogin failed: %v", err)
+  }
+  state := issuer.authorize(t, begin.AuthorizationUrl, user)
+  return s.CompleteOidcLogin(context.Background(), &v1.CompleteOidcLoginRequest{
+    Api:   apiVersion,
+    State: state,
+    Code:  testOidcCode,
+  })
+}
+
+func TestOidcLogin(t *testing.T) {
+  issuer := newTestIssuer(t)
+  s := newOidcTestServer(t, issuer)
+  owner := s.signUp(t, "owner@example.com")
+
+  _, err := s.BeginOidcLogin(context.Background(), &v1.BeginOidcLoginRequest{Api: apiVersion, Provider: "unknown"})
+  wantCode(t, "BeginOidcLogin of an unknown provider", err, codes.NotFound)
+
+  // an email the provider has not verified is not linked
+  user := oidcIdentity{Subject: "subject", Email: "owner@example.com"}
+  _, err = s.oidcLogin(t, issuer, user)
+  wantCode(t, "login with an unverified email", err, codes.PermissionDenied)
+
+  user.EmailVerified = true
+  res, err := s.oidcLogin(t, issuer, user)
+  if err != nil {
+    t.Fatalf("login with a verified email failed: %v", err)
+  }
+  if res.Id != owner.Id || res.MemberId != owner.MemberId {
+    t.Errorf("login returned company %s and member %s, want %s and %s", res.Id, res.MemberId, owner.Id, owner.MemberId)
+  }
+  s.as(t, res.Token)
+
+  // the linked subject logs in whatever its email is now
+  if _, err := s.oidcLogin(t, issuer, oidcIdentity{Subject: "subject", Email: "renamed@example.com"}); err != nil {
+    t.Errorf("login of a linked subject failed: %v", err)
+  }
+
+  _, err = s.oidcLogin(t, issuer, oidcIdentity{Subject: "other", Email: "nobody@example.com", EmailVerified: true})
+  wantCode(t, "login with an unknown email", err, codes.PermissionDenied)
+}
+
+func TestOidcAllowedDomains(t *testing.T) {
+  issuer := newTestIssuer(t)
+  s := newOidcTestServer(t, issuer)
+  s.signUp(t, "owner@other.com")
+
+  _, err := s.oidcLogin(t, issuer, oidcIdentity{Subject: "subject", Email: "owner@other.com", EmailVerified: true})
+  wantCode(t, "login with an email of another domain", err, codes.PermissionDenied)
+  if _, err := s.repo.GetOidcIdentity(issuer.URL, "subject"); err != ErrNotFound {
+    t.Errorf("GetOidcIdentity after a denied login returned %v, want ErrNotFound", err)
+  }
+
+  // an unverified email does not count for the domain either, that of the linked member does
+  _, err = s.oidcLogin(t, issuer, oidcIdentity{Subject: "subject", Email: "owner@example.com"})
+  wantCode(t, "login with an unverified email", err, codes.PermissionDenied)
+  member, err := s.repo.GetMemberByEmail("owner@other.com")
+  if err != nil {
+    t.Fatalf("GetMemberByEmail failed: %v", err)
+  }
+  err = s.repo.SaveOidcIdentity(&OidcIdentity{Issuer: issuer.URL, Subject: "linked", MemberId: member.Id.Hex(),
+    Email: "owner@other.com"})
+  if err != nil {
+    t.Fatalf("SaveOidcIdentity failed: %v", err)
+  }
+  _, err = s.oidcLogin(t, issuer, oidcIdentity{Subject: "linked", Email: "owner@example.com"})
+  wantCode(t, "login linked to a member of another domain", err, codes.PermissionDenied)
+}
+
+func TestOidcNonce(t *testing.T) {
+  issuer := newTestIssuer(t)
+  s := newOidcTestServer(t, issuer)
+  s.signUp(t, "owner@example.com")
+  user := oidcIdentity{Subject: "subject", Email: "owner@example.com", EmailVerified: true}
+
+  begin, err := s.BeginOidcLogin(context.Background(), &v1.BeginOidcLoginRequest{Api: apiVersion, Provider: "test"})
+  if err != nil {
+    t.Fatalf("BeginOidcLogin failed: %v", err)
+  }
+  state := issuer.authorize(t, begin.AuthorizationUrl, user)
+  // an ID token issued for another login
+  issuer.mu.Lock()
+  issuer.nonce = "other"
+  issuer.mu.Unlock()
+
+  _, err = s.CompleteOidcLogin(context.Background(), &v1.CompleteOidcLoginRequest{Api: apiVersion, State: state, Code: testOidcCode})
+  wantCode(t, "login with the nonce of another login", err, codes.Unauthenticated)
+}
+
+func TestOidcCodeVerifier(t *testing.T) {
+  issuer := newTestIssuer(t)
+  s := newOidcTestServer(t, issuer)
+  s.signUp(t, "owner@example.com")
+  user := oidcIdentity{Subject: "subject", Email: "owner@example.com", EmailVerified: true}
+  ctx := context.Background()
+
+  // the code of the second login is redeemed with the state, and so the verifier, of the first
+  first, err := s.BeginOidcLogin(ctx, &v1.BeginOidcLoginRequest{Api: apiVersion, Provider: "test"})
+  if err != nil {
+    t.Fatalf("BeginOidcLogin failed: %v", err)
+  }
+  second, err := s.BeginOidcLogin(ctx, &v1.BeginOidcLoginRequest{Api: apiVersion, Provider: "test"})
+  if err != nil {
+    t.Fatalf("BeginOidcLogin failed: %v", err)
+  }
+  state := issuer.authorize(t, first.AuthorizationUrl, user)
+  issuer.authorize(t, second.AuthorizationUrl, user)
+
+  _, err = s.CompleteOidcLogin(ctx, &v1.CompleteOidcLoginRequest{Api: apiVersion, State: state, Code: testOidcCode})
+  wantCode(t, "login with the verifier of another login", err, codes.Unauthenticated)
+
+  // states are single-use
+  _, err = s.CompleteOidcLogin(ctx, &v1.CompleteOidcLoginRequest{Api: apiVersion, State: state, Code: testOidcCode})
+  wantCode(t, "login with a used state", err, codes.InvalidArgument)
+}
+
+func TestOidcStaleLink(t *testing.T) {
+  issuer := newTestIssuer(t)
+  s := newOidcTestServer(t, issuer)
+  owner := s.signUp(t, "owner@example.com")
+  asOwner := s.as(t, owner.Token)
+  add := func() string {
+    added, err := s.AddMember(asOwner, &v1.AddMemberRequest{Api: apiVersion, Email: "member@example.com",
+      Password: testPassword, Role: v1.MemberRole_RECRUITER})
+    if err != nil {
+      t.Fatalf("AddMember failed: %v", err)
+    }
+    return added.Member.Id
+  }
+
+  user := oidcIdentity{Subject: "subject", Email: "member@example.com", EmailVerified: true}
+  removed := add()
+  if _, err := s.oidcLogin(t, issuer, user); err != nil {
+    t.Fatalf("login failed: %v", err)
+  }
+  if _, err := s.RemoveMember(asOwner, &v1.RemoveMemberRequest{Api: apiVersion, MemberId: removed}); err != nil {
+    t.Fatalf("RemoveMember failed: %v", err)
+  }
+
+  // the link of the deleted member does not log in anybody
+  _, err := s.oidcLogin(t, issuer, user)
+  wantCode(t, "login with the link of a deleted member", err, codes.PermissionDenied)
+
+  // a new member with the email is linked in its place
+  added := add()
+  res, err := s.oidcLogin(t, issuer, user)
+  if err != nil {
+    t.Fatalf("login with a stale link failed: %v", err)
+  }
+  if res.MemberId != added {
+    t.Errorf("login returned member %s, want the new member %s", res.MemberId, added)
+  }
+  if link, err := s.repo.GetOidcIdentity(issuer.URL, "subject"); err != nil || link.MemberId != added {
+    t.Errorf("GetOidcIdentity returned (%+v, %v), want a link to %s", link, err, added)
+  }
+}
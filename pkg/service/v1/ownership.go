@@ -0,0 +1,194 @@
+package v1
+
+import (
+  "context"
+  "fmt"
+  "time"
+
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+  "github.com/ckbball/os-company/pkg/mailer"
+)
+
+const (
+  // purposeOwnershipTransfer tokens let a member accept the ownership of its company
+  purposeOwnershipTransfer = "ownership_transfer"
+  // ownershipTransferTTL is how long a transfer can be accepted
+  ownershipTransferTTL = 72 * time.Hour
+)
+
+// errInvalidTransferToken is returned for every unusable transfer token so that callers learn nothing about it
+var errInvalidTransferToken = status.Error(codes.InvalidArgument, "invalid or expired transfer token")
+
+// TransferOwnership offers the company of the caller to one of its members, who accepts with
+// the emailed token. A new offer replaces the pending one.
+func (s *handler) TransferOwnership(ctx context.Context, req *v1.TransferOwnershipRequest) (*v1.TransferOwnershipResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := requireRole(ctx, v1.MemberRole_OWNER)
+  if err != nil {
+    return nil, err
+  }
+  if claims.MemberId == "" {
+    return nil, status.Error(codes.PermissionDenied, "ownership is transferred by the owner itself")
+  }
+  if req.MemberId == claims.MemberId {
+    return nil, status.Error(codes.InvalidArgument, "already the owner")
+  }
+
+  _, err = s.repo.GetMembership(claims.Company.Id, req.MemberId)
+  if err == ErrNotFound {
+    return nil, errMemberNotFound
+  }
+  if err != nil {
+    return nil, err
+  }
+  member, err := s.repo.GetMemberById(req.MemberId)
+  if err == ErrNotFound {
+    return nil, errMemberNotFound
+  }
+  if err != nil {
+    return nil, err
+  }
+  company, err := s.repo.GetById(claims.Company.Id)
+  if err == ErrNotFound {
+    return nil, errCompanyNotFound
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  // only the latest offer can be accepted
+  if err := s.repo.DeleteActionTokens(purposeOwnershipTransfer, claims.Company.Id); err != nil {
+    return nil, err
+  }
+  token, record := newMemberActionToken(purposeOwnershipTransfer, member, ownershipTransferTTL)
+  record.CompanyId = claims.Company.Id
+  if err := s.repo.CreateActionToken(record); err != nil {
+    return nil, err
+  }
+
+  link, err := withToken(s.links.AcceptOwnership, token)
+  if err != nil {
+    return nil, err
+  }
+  s.sendMail(&mailer.Message{
+    To:      member.Email,
+    Subject: fmt.Sprintf("Take over %s", company.Name),
+    Body: fmt.Sprintf("The owner of %s wants to hand the company over to you.\n\n"+
+      "Log in and accept within the next 3 days at\n\n%s\n\n"+
+      "If you do not want to take over, ignore this email.\n",
+      company.Name, link),
+  })
+
+  if err := s.audit(claims.Company.Id, auditOwnershipTransferStarted, claims.MemberId, req.MemberId); err != nil {
+    return nil, err
+  }
+
+  return &v1.TransferOwnershipResponse{
+    Api:       apiVersion,
+    Status:    "Offered",
+    ExpiresAt: record.ExpiresAt.Unix(),
+  }, nil
+}
+
+// AcceptOwnership makes the caller the owner of its company with the token of a transfer email.
+// The previous owner becomes an admin, its access tokens are revoked so that it refreshes into the new role.
+func (s *handler) AcceptOwnership(ctx context.Context, req *v1.AcceptOwnershipRequest) (*v1.MemberResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := caller(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  // the token is checked before it is consumed, so that another member cannot burn it
+  hash := hashToken(req.Token)
+  record, err := s.repo.GetActionToken(purposeOwnershipTransfer, hash)
+  if err == ErrNotFound {
+    return nil, errInvalidTransferToken
+  }
+  if err != nil {
+    return nil, err
+  }
+  if time.Now().After(record.ExpiresAt) ||
+    record.CompanyId != claims.Company.Id || record.MemberId != claims.MemberId {
+    return nil, errInvalidTransferToken
+  }
+
+  // consuming it makes it single-use even when requests race
+  record, err = s.repo.ConsumeMemberActionToken(purposeOwnershipTransfer, hash, claims.MemberId)
+  if err == ErrNotFound {
+    return nil, errInvalidTransferToken
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  memberships, err := s.repo.ListMembershipsByCompany(record.CompanyId)
+  if err != nil {
+    return nil, err
+  }
+  var next, previous *Membership
+  for _, membership := range memberships {
+    switch {
+    case membership.MemberId == record.MemberId:
+      next = membership
+    case membership.Role == v1.MemberRole_OWNER.String():
+      previous = membership
+    }
+  }
+  // the member left or already owns the company
+  if next == nil || next.Role == v1.MemberRole_OWNER.String() {
+    return nil, errInvalidTransferToken
+  }
+
+  // promoting first never leaves the company without an owner
+  err = s.repo.UpdateMembershipRole(next.CompanyId, next.MemberId, v1.MemberRole_OWNER.String())
+  if err == ErrNotFound {
+    return nil, errInvalidTransferToken
+  }
+  if err != nil {
+    return nil, err
+  }
+  next.Role = v1.MemberRole_OWNER.String()
+
+  previousId := ""
+  if previous != nil {
+    previousId = previous.MemberId
+    // a previous owner that is gone meanwhile has no role to lose
+    err := s.repo.UpdateMembershipRole(previous.CompanyId, previous.MemberId, v1.MemberRole_ADMIN.String())
+    if err != nil && err != ErrNotFound {
+      return nil, err
+    }
+    if err := s.tokenService.RevokeAll(previous.MemberId); err != nil {
+      return nil, err
+    }
+  }
+
+  if err := s.audit(record.CompanyId, auditOwnershipTransferred, next.MemberId, previousId); err != nil {
+    return nil, err
+  }
+
+  member, err := s.repo.GetMemberById(next.MemberId)
+  if err == ErrNotFound {
+    return nil, errMemberNotFound
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  return &v1.MemberResponse{
+    Api:    apiVersion,
+    Status: "Transferred",
+    Member: exportMember(member, next),
+  }, nil
+}
@@ -0,0 +1,141 @@
+package v1
+
+import (
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+
+  "go.mongodb.org/mongo-driver/bson/primitive"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+// errInvalidPageToken is returned for page tokens that were not created by encodeCursor
+var errInvalidPageToken = errors.New("invalid page_token")
+
+const (
+  // page size used when FindRequest.Limit is not set
+  defaultPageSize = 20
+  // largest page size a client may ask for
+  maxPageSize = 100
+)
+
+// CompanyFilter is the validated form of a FilterCompanies request that is handed to the repository
+type CompanyFilter struct {
+  NamePrefix string
+  Location   string
+  // last_active range in unix seconds, zero means unbounded
+  ActiveAfter  int64
+  ActiveBefore int64
+  Order        v1.CompanyOrder
+  // VerifiedOnly leaves out companies that have not verified their email
+  VerifiedOnly bool
+  // After is the position of the last company of the previous page, nil on the first page
+  After *Cursor
+  // Limit is the maximum number of companies to return
+  Limit int
+}
+
+// Cursor is the position of a company in the sort order of a filter.
+// The sort key and the id are both stored so that rows added or removed
+// mid-scroll never shift the following pages.
+type Cursor struct {
+  Name       string `json:"n,omitempty"`
+  LastActive int64  `json:"a,omitempty"`
+  Id         string `json:"i"`
+  // fingerprint of the filter the cursor was created for
+  Filter string `json:"f"`
+}
+
+// newCompanyFilter validates a FindRequest and turns it into a CompanyFilter
+func newCompanyFilter(req *v1.FindRequest) (*CompanyFilter, error) {
+  if req.Limit < 0 {
+    return nil, errors.New("limit must not be negative")
+  }
+  if req.ActiveAfter < 0 || req.ActiveBefore < 0 {
+    return nil, errors.New("active range must not be negative")
+  }
+  if req.ActiveAfter > 0 && req.ActiveBefore > 0 && req.ActiveAfter >= req.ActiveBefore {
+    return nil, errors.New("active_after must be before active_before")
+  }
+  if _, ok := v1.CompanyOrder_name[int32(req.OrderBy)]; !ok {
+    return nil, fmt.Errorf("unknown order: %d", req.OrderBy)
+  }
+
+  filter := &CompanyFilter{
+    NamePrefix:   req.NamePrefix,
+    Location:     req.Location,
+    ActiveAfter:  req.ActiveAfter,
+    ActiveBefore: req.ActiveBefore,
+    Order:        req.OrderBy,
+    Limit:        int(req.Limit),
+  }
+  if filter.Limit == 0 {
+    filter.Limit = defaultPageSize
+  }
+  if filter.Limit > maxPageSize {
+    filter.Limit = maxPageSize
+  }
+
+  if req.PageToken != "" {
+    cursor, err := decodeCursor(req.PageToken)
+    if err != nil {
+      return nil, err
+    }
+    // a token is only valid for the filter it was issued for
+    if cursor.Filter != filter.fingerprint() {
+      return nil, errors.New("page token does not match the request filters")
+    }
+    filter.After = cursor
+  }
+
+  return filter, nil
+}
+
+// fingerprint identifies the filters and sort order, but not the position or page size
+func (f *CompanyFilter) fingerprint() string {
+  sum := sha256.Sum256([]byte(fmt.Sprintf("%q|%q|%d|%d|%d",
+    f.NamePrefix, f.Location, f.ActiveAfter, f.ActiveBefore, f.Order)))
+  return hex.EncodeToString(sum[:8])
+}
+
+// cursorAt returns the position of company in the filter's sort order
+func (f *CompanyFilter) cursorAt(company *Company) *Cursor {
+  cursor := &Cursor{
+    Id:     company.Id.Hex(),
+    Filter: f.fingerprint(),
+  }
+  switch f.Order {
+  case v1.CompanyOrder_LAST_ACTIVE_ASC, v1.CompanyOrder_LAST_ACTIVE_DESC:
+    cursor.LastActive = int64(company.LastActive)
+  default:
+    cursor.Name = company.Name
+  }
+  return cursor
+}
+
+// encodeCursor turns a cursor into an opaque page token
+func encodeCursor(cursor *Cursor) string {
+  raw, _ := json.Marshal(cursor)
+  return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeCursor parses a page token created by encodeCursor
+func decodeCursor(token string) (*Cursor, error) {
+  raw, err := base64.RawURLEncoding.DecodeString(token)
+  if err != nil {
+    return nil, errInvalidPageToken
+  }
+  var cursor Cursor
+  if err := json.Unmarshal(raw, &cursor); err != nil {
+    return nil, errInvalidPageToken
+  }
+  // the repositories compare the id as an object id, a forged one is the client's fault
+  if _, err := primitive.ObjectIDFromHex(cursor.Id); err != nil {
+    return nil, errInvalidPageToken
+  }
+  return &cursor, nil
+}
@@ -0,0 +1,155 @@
+package v1
+
+import (
+  "crypto/rand"
+  "crypto/subtle"
+  "encoding/base64"
+  "errors"
+  "fmt"
+  "strings"
+
+  "golang.org/x/crypto/argon2"
+  "golang.org/x/crypto/bcrypt"
+)
+
+const (
+  // HashArgon2id and HashBcrypt are the algorithms PasswordHasher hashes with
+  HashArgon2id = "argon2id"
+  HashBcrypt   = "bcrypt"
+
+  // argon2SaltLength and argon2KeyLength are the bytes of salt and hash of argon2id hashes
+  argon2SaltLength = 16
+  argon2KeyLength  = 32
+)
+
+// errUnknownHash is returned by Verify for encoded hashes of no supported algorithm
+var errUnknownHash = errors.New("unknown password hash format")
+
+// HashingPolicy is how PasswordHasher hashes new passwords. Stored hashes
+// with other parameters still verify and are replaced on the next login.
+type HashingPolicy struct {
+  // Algorithm is HashArgon2id or HashBcrypt
+  Algorithm string
+  // BcryptCost is the cost of bcrypt hashes
+  BcryptCost int
+  // Argon2Memory in KiB, Argon2Iterations and Argon2Parallelism are the parameters of argon2id hashes
+  Argon2Memory      uint32
+  Argon2Iterations  uint32
+  Argon2Parallelism uint8
+}
+
+// DefaultHashingPolicy hashes with argon2id at the parameters OWASP recommends as a minimum
+var DefaultHashingPolicy = HashingPolicy{
+  Algorithm:         HashArgon2id,
+  BcryptCost:        bcrypt.DefaultCost,
+  Argon2Memory:      19 * 1024,
+  Argon2Iterations:  2,
+  Argon2Parallelism: 1,
+}
+
+// PasswordHasher hashes passwords into encoded hashes that name their algorithm and parameters:
+// the PHC string format for argon2id ($argon2id$v=19$m=...,t=...,p=...$salt$hash)
+// and the usual modular crypt format for bcrypt ($2a$cost$...).
+type PasswordHasher struct {
+  policy HashingPolicy
+}
+
+func NewPasswordHasher(policy HashingPolicy) (*PasswordHasher, error) {
+  switch policy.Algorithm {
+  case HashArgon2id:
+    if policy.Argon2Memory < 8*uint32(policy.Argon2Parallelism) || policy.Argon2Iterations < 1 || policy.Argon2Parallelism < 1 {
+      return nil, fmt.Errorf("invalid argon2id parameters m=%d t=%d p=%d",
+        policy.Argon2Memory, policy.Argon2Iterations, policy.Argon2Parallelism)
+    }
+  case HashBcrypt:
+    if policy.BcryptCost < bcrypt.MinCost || policy.BcryptCost > bcrypt.MaxCost {
+      return nil, fmt.Errorf("invalid bcrypt cost %d", policy.BcryptCost)
+    }
+  default:
+    return nil, fmt.Errorf("unknown password hash algorithm '%s'", policy.Algorithm)
+  }
+
+  return &PasswordHasher{
+    policy: policy,
+  }, nil
+}
+
+// Hash returns the encoded hash of password under the policy
+func (h *PasswordHasher) Hash(password string) (string, error) {
+  if h.policy.Algorithm == HashBcrypt {
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), h.policy.BcryptCost)
+    if err != nil {
+      return "", fmt.Errorf("error hashing password: %v", err)
+    }
+    return string(hash), nil
+  }
+
+  salt := make([]byte, argon2SaltLength)
+  if _, err := rand.Read(salt); err != nil {
+    return "", fmt.Errorf("error hashing password: %v", err)
+  }
+  key := argon2.IDKey([]byte(password), salt,
+    h.policy.Argon2Iterations, h.policy.Argon2Memory, h.policy.Argon2Parallelism, argon2KeyLength)
+  return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+    h.policy.Argon2Memory, h.policy.Argon2Iterations, h.policy.Argon2Parallelism,
+    base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify reports if password matches encoded, and if encoded is outdated and should be
+// replaced by a new Hash of password. Outdated is only reported for matching passwords.
+func (h *PasswordHasher) Verify(password string, encoded string) (match bool, outdated bool, err error) {
+  if strings.HasPrefix(encoded, "$argon2id$") {
+    return h.verifyArgon2id(password, encoded)
+  }
+  if strings.HasPrefix(encoded, "$2") {
+    err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+    if err == bcrypt.ErrMismatchedHashAndPassword {
+      return false, false, nil
+    }
+    if err != nil {
+      return false, false, err
+    }
+    cost, err := bcrypt.Cost([]byte(encoded))
+    if err != nil {
+      return false, false, err
+    }
+    return true, h.policy.Algorithm != HashBcrypt || cost != h.policy.BcryptCost, nil
+  }
+  return false, false, errUnknownHash
+}
+
+// verifyArgon2id verifies an argon2id hash in the PHC string format
+func (h *PasswordHasher) verifyArgon2id(password string, encoded string) (bool, bool, error) {
+  // "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+  parts := strings.Split(encoded, "$")
+  if len(parts) != 6 {
+    return false, false, errUnknownHash
+  }
+  var version int
+  if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+    return false, false, errUnknownHash
+  }
+  var memory, iterations uint32
+  var parallelism uint8
+  if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism); err != nil {
+    return false, false, errUnknownHash
+  }
+  salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+  if err != nil {
+    return false, false, errUnknownHash
+  }
+  key, err := base64.RawStdEncoding.DecodeString(parts[5])
+  if err != nil || len(key) == 0 {
+    return false, false, errUnknownHash
+  }
+
+  computed := argon2.IDKey([]byte(password), salt, iterations, memory, parallelism, uint32(len(key)))
+  if subtle.ConstantTimeCompare(computed, key) != 1 {
+    return false, false, nil
+  }
+
+  outdated := h.policy.Algorithm != HashArgon2id || memory != h.policy.Argon2Memory ||
+    iterations != h.policy.Argon2Iterations || parallelism != h.policy.Argon2Parallelism ||
+    len(salt) != argon2SaltLength || len(key) != argon2KeyLength
+  return true, outdated, nil
+}
@@ -0,0 +1,174 @@
+package v1
+
+import (
+  "bufio"
+  "crypto/sha1"
+  "encoding/hex"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "unicode"
+  "unicode/utf8"
+
+  "go.uber.org/zap"
+  "google.golang.org/genproto/googleapis/rpc/errdetails"
+
+  "github.com/ckbball/os-company/pkg/logger"
+)
+
+const (
+  // breachPrefixLength is the number of hex characters of the SHA-1 hash that name a prefix file
+  breachPrefixLength = 5
+)
+
+// PasswordPolicy is what new passwords have to satisfy
+type PasswordPolicy struct {
+  // MinLength and MaxLength bound the number of characters
+  MinLength int
+  MaxLength int
+  // MinCharacterClasses is how many of lower case letters, upper case letters,
+  // digits and other characters a password has to contain
+  MinCharacterClasses int
+  // Breached rejects passwords known from breaches, no password is rejected for it if nil
+  Breached BreachedPasswords
+}
+
+// DefaultPasswordPolicy follows the NIST guidelines on length, and asks for some variety on top
+var DefaultPasswordPolicy = PasswordPolicy{
+  MinLength:           10,
+  MaxLength:           64,
+  MinCharacterClasses: 2,
+}
+
+// BreachedPasswords reports if a password is known from a breach or a list of common passwords
+type BreachedPasswords interface {
+  IsBreached(password string) (bool, error)
+}
+
+// PrefixFileBreachList looks passwords up in a directory of k-anonymity range files as
+// published by Have I Been Pwned: the file named by the first five hex characters of the
+// SHA-1 hash of a password ("5BAA6" or "5BAA6.txt") lists the remaining 35 characters of
+// every breached hash with that prefix, one per line and optionally followed by ":count".
+// Only the file of the prefix is read for a check, so the full list never has to fit in memory.
+type PrefixFileBreachList struct {
+  dir string
+}
+
+func NewPrefixFileBreachList(dir string) (*PrefixFileBreachList, error) {
+  info, err := os.Stat(dir)
+  if err != nil {
+    return nil, fmt.Errorf("failed to open breached password list: %v", err)
+  }
+  if !info.IsDir() {
+    return nil, fmt.Errorf("breached password list '%s' is not a directory", dir)
+  }
+  return &PrefixFileBreachList{
+    dir: dir,
+  }, nil
+}
+
+// IsBreached reports if the SHA-1 hash of password is listed in its prefix file
+func (l *PrefixFileBreachList) IsBreached(password string) (bool, error) {
+  sum := sha1.Sum([]byte(password))
+  hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+  prefix, suffix := hash[:breachPrefixLength], hash[breachPrefixLength:]
+
+  file, err := l.openPrefix(prefix)
+  if os.IsNotExist(err) {
+    // no breached hash has this prefix
+    return false, nil
+  }
+  if err != nil {
+    return false, err
+  }
+  defer file.Close()
+
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    if i := strings.IndexByte(line, ':'); i >= 0 {
+      line = line[:i]
+    }
+    if strings.EqualFold(line, suffix) {
+      return true, nil
+    }
+  }
+  return false, scanner.Err()
+}
+
+// openPrefix opens the file of prefix, with or without a .txt extension
+func (l *PrefixFileBreachList) openPrefix(prefix string) (*os.File, error) {
+  file, err := os.Open(filepath.Join(l.dir, prefix+".txt"))
+  if os.IsNotExist(err) {
+    file, err = os.Open(filepath.Join(l.dir, prefix))
+  }
+  return file, err
+}
+
+// Violations returns why password does not satisfy the policy, nothing if it does
+func (p *PasswordPolicy) Violations(password string) ([]string, error) {
+  violations := []string{}
+
+  length := utf8.RuneCountInString(password)
+  if length < p.MinLength {
+    violations = append(violations, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+  }
+  if p.MaxLength > 0 && length > p.MaxLength {
+    violations = append(violations, fmt.Sprintf("must be at most %d characters long", p.MaxLength))
+  }
+  if classes := characterClasses(password); classes < p.MinCharacterClasses {
+    violations = append(violations, fmt.Sprintf(
+      "must contain %d of lower case letters, upper case letters, digits and other characters", p.MinCharacterClasses))
+  }
+
+  // a password short of the rules is rejected anyway, spare the lookup
+  if len(violations) == 0 && p.Breached != nil {
+    breached, err := p.Breached.IsBreached(password)
+    if err != nil {
+      return nil, err
+    }
+    if breached {
+      violations = append(violations, "is known from a data breach or too common, choose another one")
+    }
+  }
+  return violations, nil
+}
+
+// characterClasses counts the classes of characters password contains
+func characterClasses(password string) int {
+  var lower, upper, digit, other int
+  for _, r := range password {
+    switch {
+    case unicode.IsLower(r):
+      lower = 1
+    case unicode.IsUpper(r):
+      upper = 1
+    case unicode.IsDigit(r):
+      digit = 1
+    default:
+      other = 1
+    }
+  }
+  return lower + upper + digit + other
+}
+
+// checkPassword returns an InvalidArgument error with a field violation for every rule
+// of the policy password breaks, field is the name of the password in the request
+func (s *handler) checkPassword(field string, password string) error {
+  violations, err := s.passwordPolicy.Violations(password)
+  if err != nil {
+    // an unreadable breach list must not lock everybody out of changing passwords
+    logger.Log.Error("failed to check password against breached passwords", zap.Error(err))
+    return nil
+  }
+  if len(violations) == 0 {
+    return nil
+  }
+
+  out := []*errdetails.BadRequest_FieldViolation{}
+  for _, violation := range violations {
+    out = append(out, fieldViolation(field, "password "+violation))
+  }
+  return badRequest("password does not satisfy the password policy", out...)
+}
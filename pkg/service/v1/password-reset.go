@@ -0,0 +1,116 @@
+package v1
+
+import (
+  "context"
+  "fmt"
+  "time"
+
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+  "github.com/ckbball/os-company/pkg/mailer"
+)
+
+const (
+  // passwordResetTTL is how long a reset link can be used
+  passwordResetTTL = time.Hour
+)
+
+// errInvalidResetToken is returned for every unusable reset token so that callers learn nothing about it
+var errInvalidResetToken = status.Error(codes.InvalidArgument, "invalid or expired reset token")
+
+// RequestPasswordReset emails a reset link to the member with the email of the request
+func (s *handler) RequestPasswordReset(ctx context.Context, req *v1.RequestPasswordResetRequest) (*v1.PasswordResetResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  // the response must not tell whether the email is registered
+  response := &v1.PasswordResetResponse{
+    Api:    apiVersion,
+    Status: "If the email is registered, a reset link has been sent to it",
+  }
+
+  member, err := s.memberByEmail(req.Email)
+  if err == ErrNotFound {
+    return response, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  token, record := newMemberActionToken(purposePasswordReset, member, passwordResetTTL)
+  if err := s.repo.CreateActionToken(record); err != nil {
+    return nil, err
+  }
+
+  link, err := withToken(s.links.ResetPassword, token)
+  if err != nil {
+    return nil, err
+  }
+  s.sendMail(&mailer.Message{
+    To:      member.Email,
+    Subject: "Reset your password",
+    Body: fmt.Sprintf("Somebody asked to reset the password of %s.\n\n"+
+      "Choose a new password within the next hour at\n\n%s\n\n"+
+      "If it was not you, ignore this email and your password stays the same.\n",
+      member.Email, link),
+  })
+
+  return response, nil
+}
+
+// ResetPassword sets a new password with the token of a reset link
+func (s *handler) ResetPassword(ctx context.Context, req *v1.ResetPasswordRequest) (*v1.PasswordResetResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  if req.NewPassword == "" {
+    return nil, status.Error(codes.InvalidArgument, "new password is empty")
+  }
+  // checked before the token is used up, so that the link can be used again with a better password
+  if err := s.checkPassword("new_password", req.NewPassword); err != nil {
+    return nil, err
+  }
+
+  // consuming the token first makes it single-use even when requests race
+  record, err := s.repo.ConsumeActionToken(purposePasswordReset, hashToken(req.Token))
+  if err == ErrNotFound {
+    return nil, errInvalidResetToken
+  }
+  if err != nil {
+    return nil, err
+  }
+  if time.Now().After(record.ExpiresAt) {
+    return nil, errInvalidResetToken
+  }
+
+  hashedPass, err := s.passwords.Hash(req.NewPassword)
+  if err != nil {
+    return nil, err
+  }
+  err = s.repo.UpdateMemberPassword(record.MemberId, hashedPass)
+  if err == ErrNotFound {
+    return nil, errInvalidResetToken
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  // other reset links die with the old password, and so does every session
+  if err := s.repo.DeleteMemberActionTokens(purposePasswordReset, record.MemberId); err != nil {
+    return nil, err
+  }
+  if err := s.revokeMemberSessions(record.MemberId); err != nil {
+    return nil, err
+  }
+
+  return &v1.PasswordResetResponse{
+    Api:    apiVersion,
+    Status: "Success",
+  }, nil
+}
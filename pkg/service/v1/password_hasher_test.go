@@ -0,0 +1,98 @@
+package v1
+
+import (
+  "testing"
+
+  "golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2 is an argon2id policy cheap enough for tests
+var testArgon2 = HashingPolicy{Algorithm: HashArgon2id, Argon2Memory: 64, Argon2Iterations: 1, Argon2Parallelism: 1}
+
+func newTestHasher(t *testing.T, policy HashingPolicy) *PasswordHasher {
+  t.Helper()
+  hasher, err := NewPasswordHasher(policy)
+  if err != nil {
+    t.Fatalf("NewPasswordHasher failed: %v", err)
+  }
+  return hasher
+}
+
+func TestNewPasswordHasher(t *testing.T) {
+  for name, policy := range map[string]HashingPolicy{
+    "unknown algorithm":           {Algorithm: "md5"},
+    "bcrypt cost too low":         {Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost - 1},
+    "bcrypt cost too high":        {Algorithm: HashBcrypt, BcryptCost: bcrypt.MaxCost + 1},
+    "argon2id without iterations": {Algorithm: HashArgon2id, Argon2Memory: 64, Argon2Parallelism: 1},
+    "argon2id memory below 8 KiB per lane": {Algorithm: HashArgon2id, Argon2Memory: 15, Argon2Iterations: 1,
+      Argon2Parallelism: 2},
+  } {
+    if _, err := NewPasswordHasher(policy); err == nil {
+      t.Errorf("NewPasswordHasher with %s succeeded", name)
+    }
+  }
+}
+
+func TestPasswordHasherVerify(t *testing.T) {
+  argon2id := newTestHasher(t, testArgon2)
+  bcryptHasher := newTestHasher(t, HashingPolicy{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost})
+  argon2Hash, err := argon2id.Hash(testPassword)
+  if err != nil {
+    t.Fatalf("Hash failed: %v", err)
+  }
+  bcryptHash, err := bcryptHasher.Hash(testPassword)
+  if err != nil {
+    t.Fatalf("Hash failed: %v", err)
+  }
+
+  changed := func(change func(*HashingPolicy)) *PasswordHasher {
+    policy := testArgon2
+    change(&policy)
+    return newTestHasher(t, policy)
+  }
+  tests := []struct {
+    name     string
+    hasher   *PasswordHasher
+    encoded  string
+    outdated bool
+  }{
+    {"argon2id under its policy", argon2id, argon2Hash, false},
+    {"argon2id with more memory", changed(func(p *HashingPolicy) { p.Argon2Memory = 128 }), argon2Hash, true},
+    {"argon2id with more iterations", changed(func(p *HashingPolicy) { p.Argon2Iterations = 2 }), argon2Hash, true},
+    {"argon2id with more lanes", changed(func(p *HashingPolicy) { p.Argon2Parallelism = 2 }), argon2Hash, true},
+    {"argon2id under bcrypt", bcryptHasher, argon2Hash, true},
+    {"bcrypt under its policy", bcryptHasher, bcryptHash, false},
+    {"bcrypt with a higher cost", newTestHasher(t, HashingPolicy{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost + 1}),
+      bcryptHash, true},
+    {"bcrypt under argon2id", argon2id, bcryptHash, true},
+  }
+  for _, test := range tests {
+    match, outdated, err := test.hasher.Verify(testPassword, test.encoded)
+    if err != nil || !match || outdated != test.outdated {
+      t.Errorf("%s: Verify returned (%v, %v, %v), want a match outdated %v", test.name, match, outdated, err, test.outdated)
+    }
+    // wrong passwords are never outdated, they are not to be rehashed
+    match, outdated, err = test.hasher.Verify("wrong password 1", test.encoded)
+    if err != nil || match || outdated {
+      t.Errorf("%s: Verify of a wrong password returned (%v, %v, %v), want no match", test.name, match, outdated, err)
+    }
+  }
+}
+
+func TestPasswordHasherVerifyUnknownHash(t *testing.T) {
+  hasher := newTestHasher(t, testArgon2)
+  for _, encoded := range []string{
+    "",
+    "plain text",
+    "$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaA",
+    "$argon2id$v=18$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaA",
+    "$argon2id$v=19$m=64,t=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaA",
+    "$argon2id$v=19$m=64,t=1,p=1$not base64!$aGFzaA",
+    "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$",
+    "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA",
+  } {
+    if match, _, err := hasher.Verify(testPassword, encoded); err != errUnknownHash || match {
+      t.Errorf("Verify of %q returned (%v, %v), want errUnknownHash", encoded, match, err)
+    }
+  }
+}
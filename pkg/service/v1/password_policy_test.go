@@ -0,0 +1,114 @@
+package v1
+
+import (
+  "crypto/sha1"
+  "encoding/hex"
+  "errors"
+  "io/ioutil"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+// breachedPassword returns the prefix and suffix of the SHA-1 hash of password as in range files
+func breachedPassword(password string) (string, string) {
+  sum := sha1.Sum([]byte(password))
+  hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+  return hash[:breachPrefixLength], hash[breachPrefixLength:]
+}
+
+// newTestBreachList writes range files to a temporary directory: a .txt file with
+// counts and CRLF line ends, and a file without extension in lower case
+func newTestBreachList(t *testing.T) *PrefixFileBreachList {
+  t.Helper()
+  dir := t.TempDir()
+  prefix, suffix := breachedPassword("Password123")
+  content := "0000000000000000000000000000000000A:3\r\n" + suffix + ":42\r\n"
+  if err := ioutil.WriteFile(filepath.Join(dir, prefix+".txt"), []byte(content), 0600); err != nil {
+    t.Fatalf("WriteFile failed: %v", err)
+  }
+  prefix, suffix = breachedPassword("Summer2024!")
+  if err := ioutil.WriteFile(filepath.Join(dir, prefix), []byte(strings.ToLower(suffix)+"\n"), 0600); err != nil {
+    t.Fatalf("WriteFile failed: %v", err)
+  }
+
+  list, err := NewPrefixFileBreachList(dir)
+  if err != nil {
+    t.Fatalf("NewPrefixFileBreachList failed: %v", err)
+  }
+  return list
+}
+
+func TestPrefixFileBreachList(t *testing.T) {
+  list := newTestBreachList(t)
+  for password, want := range map[string]bool{
+    "Password123":  true,
+    "Summer2024!":  true,
+    "Password1234": false,
+    testPassword:   false,
+  } {
+    if breached, err := list.IsBreached(password); err != nil || breached != want {
+      t.Errorf("IsBreached(%q) returned (%v, %v), want %v", password, breached, err, want)
+    }
+  }
+
+  dir := t.TempDir()
+  if _, err := NewPrefixFileBreachList(filepath.Join(dir, "missing")); err == nil {
+    t.Errorf("NewPrefixFileBreachList of a missing directory succeeded")
+  }
+  file := filepath.Join(dir, "file")
+  if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+    t.Fatalf("WriteFile failed: %v", err)
+  }
+  if _, err := NewPrefixFileBreachList(file); err == nil {
+    t.Errorf("NewPrefixFileBreachList of a file succeeded")
+  }
+}
+
+// countingBreachList counts the lookups and fails them with err if it is set
+type countingBreachList struct {
+  lookups int
+  err     error
+}
+
+func (l *countingBreachList) IsBreached(password string) (bool, error) {
+  l.lookups++
+  return false, l.err
+}
+
+func TestPasswordPolicyViolations(t *testing.T) {
+  policy := DefaultPasswordPolicy
+  policy.Breached = newTestBreachList(t)
+  tests := []struct {
+    password   string
+    violations int
+  }{
+    {testPassword, 0},
+    {"Password1234", 0},
+    {"short 1", 1},
+    // characters are counted, not bytes
+    {"äöüäöüäöü1", 0},
+    {strings.Repeat("a1", 33), 1},
+    {"onlylowercase", 1},
+    {"short", 2},
+    {"Password123", 1},
+  }
+  for _, test := range tests {
+    violations, err := policy.Violations(test.password)
+    if err != nil || len(violations) != test.violations {
+      t.Errorf("Violations(%q) returned (%v, %v), want %d violations", test.password, violations, err, test.violations)
+    }
+  }
+
+  // the breach list is only asked about passwords satisfying the other rules
+  breached := &countingBreachList{}
+  policy.Breached = breached
+  policy.Violations("short")
+  if breached.lookups != 0 {
+    t.Errorf("Violations looked up a password breaking the rules")
+  }
+  breached.err = errors.New("unreadable")
+  if _, err := policy.Violations(testPassword); err == nil || breached.lookups != 1 {
+    t.Errorf("Violations with a failing breach list returned %v after %d lookups, want the error", err, breached.lookups)
+  }
+}
@@ -0,0 +1,66 @@
+package v1
+
+import (
+  "context"
+  "testing"
+
+  "google.golang.org/grpc/codes"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+func TestPasswordReset(t *testing.T) {
+  s := newTestServer(t)
+  login := s.signUp(t, "owner@example.com")
+  ctx := context.Background()
+
+  if _, err := s.RequestPasswordReset(ctx, &v1.RequestPasswordResetRequest{Api: apiVersion, Email: "owner@example.com"}); err != nil {
+    t.Fatalf("RequestPasswordReset failed: %v", err)
+  }
+  msg := s.mails.next(t)
+  if msg.To != "owner@example.com" {
+    t.Errorf("reset email sent to %s, want owner@example.com", msg.To)
+  }
+  token := linkToken(t, msg)
+
+  // a weak password does not use up the link
+  _, err := s.ResetPassword(ctx, &v1.ResetPasswordRequest{Api: apiVersion, Token: token, NewPassword: "short"})
+  wantCode(t, "ResetPassword with a weak password", err, codes.InvalidArgument)
+
+  const newPassword = "another horse 2"
+  if _, err := s.ResetPassword(ctx, &v1.ResetPasswordRequest{Api: apiVersion, Token: token, NewPassword: newPassword}); err != nil {
+    t.Fatalf("ResetPassword failed: %v", err)
+  }
+  _, err = s.ResetPassword(ctx, &v1.ResetPasswordRequest{Api: apiVersion, Token: token, NewPassword: newPassword})
+  wantCode(t, "second ResetPassword with a token", err, codes.InvalidArgument)
+
+  // the new password replaces the old one, and the sessions of the old one end
+  _, err = s.Login(ctx, &v1.UpsertRequest{Api: apiVersion, Email: "owner@example.com", Password: testPassword})
+  wantCode(t, "Login with the old password", err, codes.Unauthenticated)
+  s.login(t, "owner@example.com", newPassword)
+  if _, err := s.credentials.Authenticate(login.Token); err == nil {
+    t.Errorf("access token from before the reset accepted")
+  }
+  _, err = s.RefreshToken(ctx, &v1.RefreshRequest{Api: apiVersion, RefreshToken: login.RefreshToken})
+  wantCode(t, "RefreshToken from before the reset", err, codes.Unauthenticated)
+}
+
+func TestPasswordResetUnknownEmail(t *testing.T) {
+  s := newTestServer(t)
+  s.signUp(t, "owner@example.com")
+  ctx := context.Background()
+
+  // the response does not tell whether the email is registered
+  known, err := s.RequestPasswordReset(ctx, &v1.RequestPasswordResetRequest{Api: apiVersion, Email: "owner@example.com"})
+  if err != nil {
+    t.Fatalf("RequestPasswordReset failed: %v", err)
+  }
+  s.mails.next(t)
+  unknown, err := s.RequestPasswordReset(ctx, &v1.RequestPasswordResetRequest{Api: apiVersion, Email: "nobody@example.com"})
+  if err != nil || unknown.Status != known.Status {
+    t.Errorf("RequestPasswordReset of an unknown email returned (%+v, %v), want %+v", unknown, err, known)
+  }
+
+  _, err = s.ResetPassword(ctx, &v1.ResetPasswordRequest{Api: apiVersion, Token: "unknown", NewPassword: "another horse 2"})
+  wantCode(t, "ResetPassword with an unknown token", err, codes.InvalidArgument)
+}
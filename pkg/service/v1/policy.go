@@ -0,0 +1,106 @@
+package v1
+
+import (
+  "context"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+// Policy is the authorization a method requires, enforced by the auth interceptor in
+// pkg/protocol/grpc/middleware before the handler runs
+type Policy int
+
+const (
+  // PolicyPublic methods need no token
+  PolicyPublic Policy = iota
+  // PolicyAuthenticated methods need a valid token
+  PolicyAuthenticated
+  // PolicyOwner methods need a token of the company whose id is in the request,
+  // not necessarily of its owner, see MethodRoles
+  PolicyOwner
+  // PolicyAdmin methods need a token of a platform administrator
+  PolicyAdmin
+)
+
+// MethodPolicies is the policy of every CompanyService method.
+// Methods missing here are denied.
+var MethodPolicies = map[string]Policy{
+  "/company.CompanyService/CreateCompany":         PolicyPublic,
+  "/company.CompanyService/GetAuth":               PolicyAuthenticated,
+  "/company.CompanyService/Login":                 PolicyPublic,
+  "/company.CompanyService/VerifySecondFactor":    PolicyPublic,
+  "/company.CompanyService/BeginOidcLogin":        PolicyPublic,
+  "/company.CompanyService/CompleteOidcLogin":     PolicyPublic,
+  "/company.CompanyService/UpdateCompany":         PolicyOwner,
+  "/company.CompanyService/DeleteCompany":         PolicyOwner,
+  "/company.CompanyService/GetById":               PolicyPublic,
+  "/company.CompanyService/GetByEmail":            PolicyPublic,
+  "/company.CompanyService/FilterCompanies":       PolicyPublic,
+  "/company.CompanyService/RefreshToken":          PolicyPublic,
+  "/company.CompanyService/Logout":                PolicyAuthenticated,
+  "/company.CompanyService/RevokeAllSessions":     PolicyAuthenticated,
+  "/company.CompanyService/RequestPasswordReset":  PolicyPublic,
+  "/company.CompanyService/ResetPassword":         PolicyPublic,
+  "/company.CompanyService/VerifyEmail":           PolicyPublic,
+  "/company.CompanyService/ResendVerification":    PolicyPublic,
+  "/company.CompanyService/BeginTotpEnrollment":   PolicyAuthenticated,
+  "/company.CompanyService/ConfirmTotpEnrollment": PolicyAuthenticated,
+  "/company.CompanyService/UnlockAccount":         PolicyAdmin,
+  "/company.CompanyService/CreateApiKey":          PolicyAuthenticated,
+  "/company.CompanyService/ListApiKeys":           PolicyAuthenticated,
+  "/company.CompanyService/RevokeApiKey":          PolicyAuthenticated,
+  "/company.CompanyService/AddMember":             PolicyAuthenticated,
+  "/company.CompanyService/ListMembers":           PolicyAuthenticated,
+  "/company.CompanyService/RemoveMember":          PolicyAuthenticated,
+  "/company.CompanyService/ChangeMemberRole":      PolicyAuthenticated,
+  "/company.CompanyService/InviteMember":          PolicyAuthenticated,
+  "/company.CompanyService/ListInvitations":       PolicyAuthenticated,
+  "/company.CompanyService/RevokeInvitation":      PolicyAuthenticated,
+  "/company.CompanyService/AcceptInvitation":      PolicyPublic,
+  "/company.CompanyService/TransferOwnership":     PolicyAuthenticated,
+  "/company.CompanyService/AcceptOwnership":       PolicyAuthenticated,
+  "/company.CompanyService/ListAuditEvents":       PolicyAuthenticated,
+  "/company.CompanyService/GetJwks":               PolicyPublic,
+  "/company.CompanyService/ValidateToken":         PolicyPublic,
+}
+
+// MethodScopes is the scope an API key needs for a method that is not public.
+// API keys cannot call the other methods.
+var MethodScopes = map[string]v1.ApiKeyScope{
+  "/company.CompanyService/GetAuth":       v1.ApiKeyScope_READ_PROFILE,
+  "/company.CompanyService/UpdateCompany": v1.ApiKeyScope_UPDATE_PROFILE,
+  "/company.CompanyService/CreateApiKey":  v1.ApiKeyScope_MANAGE_KEYS,
+  "/company.CompanyService/ListApiKeys":   v1.ApiKeyScope_MANAGE_KEYS,
+  "/company.CompanyService/RevokeApiKey":  v1.ApiKeyScope_MANAGE_KEYS,
+}
+
+// MethodRoles is the role a member needs in its company for a method.
+// Members of any role can call the other methods their policy allows.
+var MethodRoles = map[string]v1.MemberRole{
+  "/company.CompanyService/UpdateCompany":     v1.MemberRole_ADMIN,
+  "/company.CompanyService/DeleteCompany":     v1.MemberRole_OWNER,
+  "/company.CompanyService/CreateApiKey":      v1.MemberRole_ADMIN,
+  "/company.CompanyService/ListApiKeys":       v1.MemberRole_ADMIN,
+  "/company.CompanyService/RevokeApiKey":      v1.MemberRole_ADMIN,
+  "/company.CompanyService/AddMember":         v1.MemberRole_ADMIN,
+  "/company.CompanyService/RemoveMember":      v1.MemberRole_ADMIN,
+  "/company.CompanyService/ChangeMemberRole":  v1.MemberRole_ADMIN,
+  "/company.CompanyService/InviteMember":      v1.MemberRole_ADMIN,
+  "/company.CompanyService/ListInvitations":   v1.MemberRole_ADMIN,
+  "/company.CompanyService/RevokeInvitation":  v1.MemberRole_ADMIN,
+  "/company.CompanyService/TransferOwnership": v1.MemberRole_OWNER,
+  "/company.CompanyService/ListAuditEvents":   v1.MemberRole_ADMIN,
+}
+
+type claimsKey struct{}
+
+// NewClaimsContext returns a context carrying the claims of the caller
+func NewClaimsContext(ctx context.Context, claims *CustomClaims) context.Context {
+  return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims of the caller, put there by the auth interceptor
+func ClaimsFromContext(ctx context.Context) (*CustomClaims, bool) {
+  claims, ok := ctx.Value(claimsKey{}).(*CustomClaims)
+  return claims, ok
+}
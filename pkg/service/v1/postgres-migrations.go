@@ -0,0 +1,265 @@
+package v1
+
+import (
+  "context"
+  "database/sql"
+  "fmt"
+)
+
+// migrationLockId is the advisory lock key held while migrating, so that
+// several instances starting at once do not apply the same version twice
+const migrationLockId = 727364
+
+// postgresMigration is a versioned schema change
+type postgresMigration struct {
+  version    int
+  statements string
+}
+
+// postgresMigrations are applied in order by MigratePostgres.
+// Append new versions at the end, never edit a version that has been released.
+var postgresMigrations = []postgresMigration{
+  {
+    version: 1,
+    statements: `
+      CREATE TABLE companies (
+        id          CHAR(24) PRIMARY KEY,
+        email       TEXT NOT NULL DEFAULT '',
+        password    TEXT NOT NULL DEFAULT '',
+        name        TEXT NOT NULL DEFAULT '',
+        mission     TEXT NOT NULL DEFAULT '',
+        location    TEXT NOT NULL DEFAULT '',
+        last_active BIGINT NOT NULL DEFAULT 0
+      );
+      CREATE INDEX companies_email_idx ON companies (email);
+      CREATE INDEX companies_name_idx ON companies (name COLLATE "C", id);
+      CREATE INDEX companies_location_idx ON companies (location);
+      CREATE INDEX companies_last_active_idx ON companies (last_active, id);
+    `,
+  },
+  {
+    version: 2,
+    statements: `
+      CREATE TABLE refresh_tokens (
+        hash       TEXT PRIMARY KEY,
+        family     TEXT NOT NULL,
+        company_id CHAR(24) NOT NULL,
+        used       BOOLEAN NOT NULL DEFAULT FALSE,
+        revoked    BOOLEAN NOT NULL DEFAULT FALSE,
+        expires_at TIMESTAMPTZ NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL
+      );
+      CREATE INDEX refresh_tokens_family_idx ON refresh_tokens (family);
+    `,
+  },
+  {
+    version: 3,
+    statements: `
+      CREATE INDEX refresh_tokens_company_id_idx ON refresh_tokens (company_id);
+    `,
+  },
+  {
+    version: 4,
+    statements: `
+      CREATE TABLE action_tokens (
+        hash       TEXT PRIMARY KEY,
+        purpose    TEXT NOT NULL,
+        company_id CHAR(24) NOT NULL,
+        expires_at TIMESTAMPTZ NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL
+      );
+      CREATE INDEX action_tokens_company_id_idx ON action_tokens (company_id, purpose);
+    `,
+  },
+  {
+    version: 5,
+    statements: `
+      -- existing companies predate email verification and stay verified
+      ALTER TABLE companies ADD COLUMN unverified BOOLEAN NOT NULL DEFAULT FALSE;
+      ALTER TABLE action_tokens ADD COLUMN email TEXT NOT NULL DEFAULT '';
+    `,
+  },
+  {
+    version: 6,
+    statements: `
+      CREATE TABLE totp (
+        company_id     CHAR(24) PRIMARY KEY,
+        secret         TEXT NOT NULL,
+        confirmed      BOOLEAN NOT NULL DEFAULT FALSE,
+        last_step      BIGINT NOT NULL DEFAULT 0,
+        recovery_codes TEXT[] NOT NULL DEFAULT '{}',
+        created_at     TIMESTAMPTZ NOT NULL
+      );
+    `,
+  },
+  {
+    version: 7,
+    statements: `
+      CREATE TABLE api_keys (
+        id           TEXT PRIMARY KEY,
+        hash         TEXT NOT NULL UNIQUE,
+        company_id   CHAR(24) NOT NULL,
+        name         TEXT NOT NULL,
+        prefix       TEXT NOT NULL,
+        scopes       TEXT[] NOT NULL DEFAULT '{}',
+        created_at   TIMESTAMPTZ NOT NULL,
+        last_used_at TIMESTAMPTZ NOT NULL
+      );
+      CREATE INDEX api_keys_company_id_idx ON api_keys (company_id, created_at);
+    `,
+  },
+  {
+    version: 8,
+    statements: `
+      CREATE TABLE members (
+        id         CHAR(24) PRIMARY KEY,
+        email      TEXT NOT NULL UNIQUE,
+        password   TEXT NOT NULL DEFAULT '',
+        name       TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMPTZ NOT NULL
+      );
+      CREATE TABLE memberships (
+        company_id CHAR(24) NOT NULL,
+        member_id  CHAR(24) NOT NULL,
+        role       TEXT NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL,
+        PRIMARY KEY (company_id, member_id)
+      );
+      CREATE INDEX memberships_member_id_idx ON memberships (member_id);
+      -- sessions and password resets belong to members, second factors are moved
+      -- along with the login of a company to the owner, who keeps the id of the company
+      ALTER TABLE refresh_tokens ADD COLUMN member_id TEXT NOT NULL DEFAULT '';
+      CREATE INDEX refresh_tokens_member_id_idx ON refresh_tokens (member_id);
+      ALTER TABLE action_tokens ALTER COLUMN company_id TYPE TEXT;
+      ALTER TABLE action_tokens ADD COLUMN member_id TEXT NOT NULL DEFAULT '';
+      CREATE INDEX action_tokens_member_id_idx ON action_tokens (member_id, purpose);
+      ALTER TABLE totp RENAME COLUMN company_id TO member_id;
+    `,
+  },
+  {
+    version: 9,
+    statements: `
+      CREATE TABLE invitations (
+        id         TEXT PRIMARY KEY,
+        company_id CHAR(24) NOT NULL,
+        email      TEXT NOT NULL,
+        role       TEXT NOT NULL,
+        invited_by TEXT NOT NULL,
+        expires_at TIMESTAMPTZ NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL
+      );
+      CREATE INDEX invitations_company_id_idx ON invitations (company_id, created_at);
+    `,
+  },
+  {
+    version: 10,
+    statements: `
+      CREATE TABLE audit_events (
+        id         TEXT PRIMARY KEY,
+        company_id CHAR(24) NOT NULL,
+        action     TEXT NOT NULL,
+        actor_id   TEXT NOT NULL,
+        target_id  TEXT NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL
+      );
+      CREATE INDEX audit_events_company_id_idx ON audit_events (company_id, created_at);
+    `,
+  },
+  {
+    version: 11,
+    statements: `
+      CREATE TABLE oidc_states (
+        hash       TEXT PRIMARY KEY,
+        provider   TEXT NOT NULL,
+        company_id TEXT NOT NULL,
+        nonce      TEXT NOT NULL,
+        verifier   TEXT NOT NULL,
+        expires_at TIMESTAMPTZ NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL
+      );
+      CREATE TABLE oidc_identities (
+        issuer     TEXT NOT NULL,
+        subject    TEXT NOT NULL,
+        member_id  CHAR(24) NOT NULL,
+        email      TEXT NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL,
+        PRIMARY KEY (issuer, subject)
+      );
+    `,
+  },
+  {
+    version: 12,
+    statements: `
+      -- the normalized name, filled in for existing companies and made unique by EnsureUniqueIndexes
+      ALTER TABLE companies ADD COLUMN name_key TEXT NOT NULL DEFAULT '';
+    `,
+  },
+  {
+    version: 13,
+    statements: `
+      -- incremented by every update of a company, for optimistic concurrency control
+      ALTER TABLE companies ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+    `,
+  },
+  {
+    version: 14,
+    statements: `
+      -- member emails are normalized and unique regardless of case, members whose
+      -- emails only differ in case have to be merged before this version applies
+      ALTER TABLE members DROP CONSTRAINT members_email_key;
+      UPDATE members SET email = lower(btrim(email));
+      CREATE UNIQUE INDEX members_email_key ON members (lower(email));
+    `,
+  },
+}
+
+// MigratePostgres brings the database schema up to the latest version
+func MigratePostgres(ctx context.Context, db *sql.DB) error {
+  _, err := db.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+      version    INTEGER PRIMARY KEY,
+      applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`)
+  if err != nil {
+    return fmt.Errorf("failed to create schema_migrations: %v", err)
+  }
+
+  for _, migration := range postgresMigrations {
+    if err := applyPostgresMigration(ctx, db, migration); err != nil {
+      return fmt.Errorf("failed to apply migration %d: %v", migration.version, err)
+    }
+  }
+  return nil
+}
+
+// applyPostgresMigration runs a single migration in its own transaction unless it is already applied
+func applyPostgresMigration(ctx context.Context, db *sql.DB, migration postgresMigration) error {
+  tx, err := db.BeginTx(ctx, nil)
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+
+  if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLockId); err != nil {
+    return err
+  }
+
+  var applied bool
+  err = tx.QueryRowContext(ctx,
+    `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, migration.version).Scan(&applied)
+  if err != nil {
+    return err
+  }
+  if applied {
+    return nil
+  }
+
+  if _, err := tx.ExecContext(ctx, migration.statements); err != nil {
+    return err
+  }
+  if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, migration.version); err != nil {
+    return err
+  }
+
+  return tx.Commit()
+}
@@ -0,0 +1,1012 @@
+package v1
+
+import (
+  "context"
+  "database/sql"
+  "database/sql/driver"
+  "fmt"
+  "strings"
+  "time"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+  "github.com/ckbball/os-company/pkg/errs"
+  "github.com/lib/pq"
+  "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// companyColumns is the column list scanned by scanCompany
+const companyColumns = `id, email, password, name, mission, location, last_active, unverified, version`
+
+// PostgresRepository stores companies in PostgreSQL.
+// Ids are generated as object ids so that they look the same as with the mongo repository.
+type PostgresRepository struct {
+  db *sql.DB
+}
+
+func NewPostgresRepository(db *sql.DB) *PostgresRepository {
+  return &PostgresRepository{
+    db: db,
+  }
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+  Scan(dest ...interface{}) error
+}
+
+func scanCompany(row rowScanner) (*Company, error) {
+  var company Company
+  var id string
+  err := row.Scan(&id, &company.Email, &company.Password, &company.Name,
+    &company.Mission, &company.Location, &company.LastActive, &company.Unverified, &company.Version)
+  if err == sql.ErrNoRows {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, postgresError(err)
+  }
+
+  company.Id, err = primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return nil, postgresError(err)
+  }
+  return &company, nil
+}
+
+func (repository *PostgresRepository) Create(company *v1.Company) (string, error) {
+  // the unique indexes catch what the check misses, but it names the field without parsing errors
+  if err := repository.checkDuplicate(company, ""); err != nil {
+    return "", postgresError(err)
+  }
+
+  id := primitive.NewObjectID().Hex()
+
+  _, err := repository.db.ExecContext(context.TODO(),
+    `INSERT INTO companies (`+companyColumns+`, name_key) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 1, $9)`,
+    id, company.Email, company.Password, company.Name, company.Mission, company.Location, company.LastActive,
+    !company.EmailVerified, normalizeName(company.Name))
+  if err != nil {
+    return "", companyConstraintError(err)
+  }
+
+  return id, nil
+}
+
+func (repository *PostgresRepository) Update(company *v1.Company, id string, fields []string, expectedVersion int64) (int64, int64, int64, error) {
+  checked, err := updatedCompany(company, fields)
+  if err != nil {
+    return -1, -1, -1, err
+  }
+  if err := repository.checkDuplicate(checked, id); err != nil {
+    return -1, -1, -1, postgresError(err)
+  }
+
+  args := []interface{}{id, expectedVersion}
+  var columns, values, set []string
+  add := func(column string, value interface{}) {
+    args = append(args, value)
+    columns = append(columns, column)
+    values = append(values, fmt.Sprintf("$%d", len(args)))
+    set = append(set, fmt.Sprintf("%s = $%d", column, len(args)))
+  }
+  for _, field := range fields {
+    switch field {
+    case "email":
+      add("email", company.Email)
+    case "name":
+      add("name", company.Name)
+      add("name_key", normalizeName(company.Name))
+    case "mission":
+      add("mission", company.Mission)
+    case "location":
+      add("location", company.Location)
+    }
+  }
+
+  var matched, modified, previous, version int64
+
+  // rows whose values do not change are matched but not modified, like in mongo, and keep their version.
+  // ROW() keeps a single column a row, the columns come from the switch above and not from callers.
+  err = repository.db.QueryRowContext(context.TODO(), `
+    WITH target AS (
+      SELECT id, version FROM companies WHERE id = $1
+    ), updated AS (
+      UPDATE companies SET `+strings.Join(set, ", ")+`, version = version + 1
+      WHERE id = $1 AND ($2::BIGINT = 0 OR version = $2)
+        AND ROW(`+strings.Join(columns, ", ")+`) IS DISTINCT FROM ROW(`+strings.Join(values, ", ")+`)
+      RETURNING version
+    )
+    SELECT (SELECT count(*) FROM target), (SELECT count(*) FROM updated), COALESCE((SELECT version FROM target), 0),
+      COALESCE((SELECT version FROM updated), (SELECT version FROM target), 0)`,
+    args...,
+  ).Scan(&matched, &modified, &previous, &version)
+  if err != nil {
+    return -1, -1, -1, companyConstraintError(err)
+  }
+  if matched > 0 && modified == 0 && expectedVersion != 0 && previous != expectedVersion {
+    return -1, -1, -1, ErrVersionMismatch
+  }
+
+  return matched, modified, version, nil
+}
+
+// checkDuplicate returns ErrEmailTaken or ErrNameTaken if a company other than self uses the email or name of company
+func (repository *PostgresRepository) checkDuplicate(company *v1.Company, self string) error {
+  var emailTaken, nameTaken bool
+  err := repository.db.QueryRowContext(context.TODO(), `
+    SELECT
+      EXISTS (SELECT 1 FROM companies WHERE id <> $1 AND lower(email) = lower($2) AND $2 <> ''),
+      EXISTS (SELECT 1 FROM companies WHERE id <> $1 AND name_key = $3 AND $3 <> '')`,
+    self, company.Email, normalizeName(company.Name)).Scan(&emailTaken, &nameTaken)
+  if err != nil {
+    return postgresError(err)
+  }
+  if emailTaken {
+    return ErrEmailTaken
+  }
+  if nameTaken {
+    return ErrNameTaken
+  }
+  return nil
+}
+
+// companyConstraintError maps violations of the unique company indexes onto ErrEmailTaken and ErrNameTaken
+func companyConstraintError(err error) error {
+  if pqErr, ok := err.(*pq.Error); ok && isUniqueViolation(err) {
+    switch pqErr.Constraint {
+    case companyEmailIndex:
+      return ErrEmailTaken
+    case companyNameIndex:
+      return ErrNameTaken
+    }
+  }
+  return postgresError(err)
+}
+
+func (repository *PostgresRepository) Delete(id string, expectedVersion int64) (int64, error) {
+  var deleted, remaining int64
+  err := repository.db.QueryRowContext(context.TODO(), `
+    WITH deleted AS (
+      DELETE FROM companies WHERE id = $1 AND ($2::BIGINT = 0 OR version = $2) RETURNING id
+    )
+    SELECT (SELECT count(*) FROM deleted), (SELECT count(*) FROM companies WHERE id = $1)`,
+    id, expectedVersion).Scan(&deleted, &remaining)
+  if err != nil {
+    return -1, postgresError(err)
+  }
+  // the select sees the table as it was before the delete, a company that was not deleted is of another version
+  if deleted == 0 && remaining > 0 {
+    return -1, ErrVersionMismatch
+  }
+  return deleted, nil
+}
+
+func (s *PostgresRepository) GetById(id string) (*Company, error) {
+  return scanCompany(s.db.QueryRowContext(context.TODO(),
+    `SELECT `+companyColumns+` FROM companies WHERE id = $1`, id))
+}
+
+func (s *PostgresRepository) GetByEmail(email string) (*Company, error) {
+  return scanCompany(s.db.QueryRowContext(context.TODO(),
+    `SELECT `+companyColumns+` FROM companies WHERE lower(email) = lower($1) AND email <> '' LIMIT 1`, email))
+}
+
+func (s *PostgresRepository) GetByName(name string) (*Company, error) {
+  return scanCompany(s.db.QueryRowContext(context.TODO(),
+    `SELECT `+companyColumns+` FROM companies WHERE name_key = $1 AND name_key <> '' LIMIT 1`,
+    normalizeName(name)))
+}
+
+func (s *PostgresRepository) FilterCompanys(filter *CompanyFilter) ([]*Company, error) {
+  conditions := []string{}
+  args := []interface{}{}
+  arg := func(value interface{}) string {
+    args = append(args, value)
+    return fmt.Sprintf("$%d", len(args))
+  }
+
+  if filter.NamePrefix != "" {
+    conditions = append(conditions, `name COLLATE "C" LIKE `+arg(escapeLike(filter.NamePrefix)+"%"))
+  }
+  if filter.Location != "" {
+    conditions = append(conditions, `location = `+arg(filter.Location))
+  }
+  if filter.ActiveAfter > 0 {
+    conditions = append(conditions, `last_active >= `+arg(filter.ActiveAfter))
+  }
+  if filter.ActiveBefore > 0 {
+    conditions = append(conditions, `last_active < `+arg(filter.ActiveBefore))
+  }
+  if filter.VerifiedOnly {
+    conditions = append(conditions, `NOT unverified`)
+  }
+
+  // names are compared bytewise so that the order matches the other repositories
+  column, direction := `name COLLATE "C"`, "ASC"
+  switch filter.Order {
+  case v1.CompanyOrder_NAME_DESC:
+    direction = "DESC"
+  case v1.CompanyOrder_LAST_ACTIVE_ASC:
+    column = "last_active"
+  case v1.CompanyOrder_LAST_ACTIVE_DESC:
+    column, direction = "last_active", "DESC"
+  }
+
+  // keyset pagination: continue strictly after the (sort key, id) of the cursor
+  if filter.After != nil {
+    var value interface{} = filter.After.Name
+    if column == "last_active" {
+      value = filter.After.LastActive
+    }
+    op := ">"
+    if direction == "DESC" {
+      op = "<"
+    }
+    conditions = append(conditions, fmt.Sprintf(`(%s, id) %s (%s, %s)`, column, op, arg(value), arg(filter.After.Id)))
+  }
+
+  query := `SELECT ` + companyColumns + ` FROM companies`
+  if len(conditions) > 0 {
+    query += ` WHERE ` + strings.Join(conditions, ` AND `)
+  }
+  query += fmt.Sprintf(` ORDER BY %s %s, id %s LIMIT %s`, column, direction, direction, arg(filter.Limit))
+
+  rows, err := s.db.QueryContext(context.TODO(), query, args...)
+  if err != nil {
+    return nil, postgresError(err)
+  }
+  defer rows.Close()
+
+  companys := []*Company{}
+  for rows.Next() {
+    company, err := scanCompany(rows)
+    if err != nil {
+      return nil, postgresError(err)
+    }
+    companys = append(companys, company)
+  }
+
+  return companys, rows.Err()
+}
+
+func (s *PostgresRepository) UpdateActive(id string) (int64, error) {
+  secs := time.Now().Unix()
+
+  result, err := s.db.ExecContext(context.TODO(), `UPDATE companies SET last_active = $2 WHERE id = $1`, id, secs)
+  if err != nil {
+    return -1, postgresError(err)
+  }
+  if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+    return -1, ErrNotFound
+  }
+
+  return secs, nil
+}
+
+func (s *PostgresRepository) UpdatePassword(id string, hash string) error {
+  result, err := s.db.ExecContext(context.TODO(), `UPDATE companies SET password = $2 WHERE id = $1`, id, hash)
+  if err != nil {
+    return postgresError(err)
+  }
+  if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+func (s *PostgresRepository) SetEmailVerified(id string, verified bool) error {
+  result, err := s.db.ExecContext(context.TODO(), `UPDATE companies SET unverified = $2 WHERE id = $1`, id, !verified)
+  if err != nil {
+    return postgresError(err)
+  }
+  if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+func (s *PostgresRepository) CreateRefreshToken(token *RefreshToken) error {
+  _, err := s.db.ExecContext(context.TODO(), `
+    INSERT INTO refresh_tokens (hash, family, company_id, member_id, used, revoked, expires_at, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+    token.Hash, token.Family, token.CompanyId, token.MemberId, token.Used, token.Revoked, token.ExpiresAt,
+    token.CreatedAt)
+  return postgresError(err)
+}
+
+func (s *PostgresRepository) GetRefreshToken(hash string) (*RefreshToken, error) {
+  var token RefreshToken
+  err := s.db.QueryRowContext(context.TODO(), `
+    SELECT hash, family, company_id, member_id, used, revoked, expires_at, created_at
+    FROM refresh_tokens WHERE hash = $1`, hash,
+  ).Scan(&token.Hash, &token.Family, &token.CompanyId, &token.MemberId, &token.Used, &token.Revoked,
+    &token.ExpiresAt, &token.CreatedAt)
+  if err == sql.ErrNoRows {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, postgresError(err)
+  }
+
+  return &token, nil
+}
+
+func (s *PostgresRepository) UseRefreshToken(hash string) (*RefreshToken, error) {
+  var token RefreshToken
+  err := s.db.QueryRowContext(context.TODO(), `
+    UPDATE refresh_tokens r SET used = TRUE
+    FROM (SELECT hash, used FROM refresh_tokens WHERE hash = $1 FOR UPDATE) old
+    WHERE r.hash = old.hash
+    RETURNING r.hash, r.family, r.company_id, r.member_id, old.used, r.revoked, r.expires_at, r.created_at`, hash,
+  ).Scan(&token.Hash, &token.Family, &token.CompanyId, &token.MemberId, &token.Used, &token.Revoked,
+    &token.ExpiresAt, &token.CreatedAt)
+  if err == sql.ErrNoRows {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, postgresError(err)
+  }
+
+  return &token, nil
+}
+
+func (s *PostgresRepository) RevokeRefreshFamily(family string) error {
+  _, err := s.db.ExecContext(context.TODO(), `UPDATE refresh_tokens SET revoked = TRUE WHERE family = $1`, family)
+  return postgresError(err)
+}
+
+func (s *PostgresRepository) RevokeCompanyRefreshTokens(companyId string) error {
+  _, err := s.db.ExecContext(context.TODO(), `UPDATE refresh_tokens SET revoked = TRUE WHERE company_id = $1`, companyId)
+  return postgresError(err)
+}
+
+func (s *PostgresRepository) RevokeMemberRefreshTokens(memberId string) error {
+  _, err := s.db.ExecContext(context.TODO(), `UPDATE refresh_tokens SET revoked = TRUE WHERE member_id = $1`, memberId)
+  return postgresError(err)
+}
+
+func (s *PostgresRepository) CreateActionToken(token *ActionToken) error {
+  _, err := s.db.ExecContext(context.TODO(), `
+    INSERT INTO action_tokens (hash, purpose, company_id, member_id, email, expires_at, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+    token.Hash, token.Purpose, token.CompanyId, token.MemberId, token.Email, token.ExpiresAt, token.CreatedAt)
+  return postgresError(err)
+}
+
+func (s *PostgresRepository) ConsumeActionToken(purpose string, hash string) (*ActionToken, error) {
+  var token ActionToken
+  err := s.db.QueryRowContext(context.TODO(), `
+    DELETE FROM action_tokens WHERE hash = $1 AND purpose = $2
+    RETURNING hash, purpose, company_id, member_id, email, expires_at, created_at`, hash, purpose,
+  ).Scan(&token.Hash, &token.Purpose, &token.CompanyId, &token.MemberId, &token.Email, &token.ExpiresAt,
+    &token.CreatedAt)
+  if err == sql.ErrNoRows {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, postgresError(err)
+  }
+
+  return &token, nil
+}
+
+func (s *PostgresRepository) GetActionToken(purpose string, hash string) (*ActionToken, error) {
+  var token ActionToken
+  err := s.db.QueryRowContext(context.TODO(), `
+    SELECT hash, purpose, company_id, member_id, email, expires_at, created_at
+    FROM action_tokens WHERE hash = $1 AND purpose = $2`, hash, purpose,
+  ).Scan(&token.Hash, &token.Purpose, &token.CompanyId, &token.MemberId, &token.Email, &token.ExpiresAt,
+    &token.CreatedAt)
+  if err == sql.ErrNoRows {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, postgresError(err)
+  }
+
+  return &token, nil
+}
+
+func (s *PostgresRepository) ConsumeMemberActionToken(purpose string, hash string, memberId string) (*ActionToken, error) {
+  var token ActionToken
+  err := s.db.QueryRowContext(context.TODO(), `
+    DELETE FROM action_tokens WHERE hash = $1 AND purpose = $2 AND member_id = $3
+    RETURNING hash, purpose, company_id, member_id, email, expires_at, created_at`, hash, purpose, memberId,
+  ).Scan(&token.Hash, &token.Purpose, &token.CompanyId, &token.MemberId, &token.Email, &token.ExpiresAt,
+    &token.CreatedAt)
+  if err == sql.ErrNoRows {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, postgresError(err)
+  }
+
+  return &token, nil
+}
+
+func (s *PostgresRepository) DeleteActionTokens(purpose string, companyId string) error {
+  _, err := s.db.ExecContext(context.TODO(),
+    `DELETE FROM action_tokens WHERE purpose = $1 AND company_id = $2`, purpose, companyId)
+  return postgresError(err)
+}
+
+func (s *PostgresRepository) DeleteMemberActionTokens(purpose string, memberId string) error {
+  _, err := s.db.ExecContext(context.TODO(),
+    `DELETE FROM action_tokens WHERE purpose = $1 AND member_id = $2`, purpose, memberId)
+  return postgresError(err)
+}
+
+func (s *PostgresRepository) SaveTotp(totp *Totp) error {
+  // a nil slice would be stored as NULL
+  codes := totp.RecoveryCodes
+  if codes == nil {
+    codes = []string{}
+  }
+
+  _, err := s.db.ExecContext(context.TODO(), `
+    INSERT INTO totp (member_id, secret, confirmed, last_step, recovery_codes, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6)
+    ON CONFLICT (member_id) DO UPDATE SET secret = EXCLUDED.secret, confirmed = EXCLUDED.confirmed,
+      last_step = EXCLUDED.last_step, recovery_codes = EXCLUDED.recovery_codes, created_at = EXCLUDED.created_at`,
+    totp.MemberId, totp.Secret, totp.Confirmed, totp.LastStep, pq.Array(codes), totp.CreatedAt)
+  return postgresError(err)
+}
+
+func (s *PostgresRepository) GetTotp(memberId string) (*Totp, error) {
+  var totp Totp
+  err := s.db.QueryRowContext(context.TODO(), `
+    SELECT member_id, secret, confirmed, last_step, recovery_codes, created_at
+    FROM totp WHERE member_id = $1`, memberId,
+  ).Scan(&totp.MemberId, &totp.Secret, &totp.Confirmed, &totp.LastStep, pq.Array(&totp.RecoveryCodes), &totp.CreatedAt)
+  if err == sql.ErrNoRows {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, postgresError(err)
+  }
+
+  return &totp, nil
+}
+
+func (s *PostgresRepository) AdvanceTotpStep(memberId string, step int64) (bool, error) {
+  result, err := s.db.ExecContext(context.TODO(),
+    `UPDATE totp SET last_step = $2 WHERE member_id = $1 AND last_step < $2`, memberId, step)
+  if err != nil {
+    return false, postgresError(err)
+  }
+  affected, err := result.RowsAffected()
+  return affected > 0, postgresError(err)
+}
+
+func (s *PostgresRepository) UseRecoveryCode(memberId string, hash string) (bool, error) {
+  result, err := s.db.ExecContext(context.TODO(), `
+    UPDATE totp SET recovery_codes = array_remove(recovery_codes, $2)
+    WHERE member_id = $1 AND $2 = ANY(recovery_codes)`, memberId, hash)
+  if err != nil {
+    return false, postgresError(err)
+  }
+  affected, err := result.RowsAffected()
+  return affected > 0, postgresError(err)
+}
+
+// apiKeyColumns is the column list scanned by scanApiKey
+const apiKeyColumns = `id, hash, company_id, name, prefix, scopes, created_at, last_used_at`
+
+func scanApiKey(row rowScanner) (*ApiKey, error) {
+  var key ApiKey
+  err := row.Scan(&key.Id, &key.Hash, &key.CompanyId, &key.Name, &key.Prefix, pq.Array(&key.Scopes),
+    &key.CreatedAt, &key.LastUsedAt)
+  if err == sql.ErrNoRows {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, postgresError(err)
+  }
+  return &key, nil
+}
+
+func (s *PostgresRepository) CreateApiKey(key *ApiKey) error {
+  _, err := s.db.ExecContext(context.TODO(),
+    `INSERT INTO api_keys (`+apiKeyColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+    key.Id, key.Hash, key.CompanyId, key.Name, key.Prefix, pq.Array(key.Scopes), key.CreatedAt, key.LastUsedAt)
+  return postgresError(err)
+}
+
+func (s *PostgresRepository) GetApiKeyByHash(hash string) (*ApiKey, error) {
+  return scanApiKey(s.db.QueryRowContext(context.TODO(),
+    `SELECT `+apiKeyColumns+` FROM api_keys WHERE hash = $1`, hash))
+}
+
+func (s *PostgresRepository) ListApiKeys(companyId string) ([]*ApiKey, error) {
+  rows, err := s.db.QueryContext(context.TODO(),
+    `SELECT `+apiKeyColumns+` FROM api_keys WHERE company_id = $1 ORDER BY created_at, id`, companyId)
+  if err != nil {
+    return nil, postgresError(err)
+  }
+  defer rows.Close()
+
+  keys := []*ApiKey{}
+  for rows.Next() {
+    key, err := scanApiKey(rows)
+    if err != nil {
+      return nil, postgresError(err)
+    }
+    keys = append(keys, key)
+  }
+
+  return keys, rows.Err()
+}
+
+func (s *PostgresRepository) DeleteApiKey(companyId string, id string) error {
+  result, err := s.db.ExecContext(context.TODO(),
+    `DELETE FROM api_keys WHERE id = $1 AND company_id = $2`, id, companyId)
+  if err != nil {
+    return postgresError(err)
+  }
+  if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+func (s *PostgresRepository) DeleteApiKeys(companyId string) error {
+  _, err := s.db.ExecContext(context.TODO(), `DELETE FROM api_keys WHERE company_id = $1`, companyId)
+  return postgresError(err)
+}
+
+func (s *PostgresRepository) TouchApiKey(id string, at time.Time) error {
+  _, err := s.db.ExecContext(context.TODO(), `UPDATE api_keys SET last_used_at = $2 WHERE id = $1`, id, at)
+  return postgresError(err)
+}
+
+// memberColumns is the column list scanned by scanMember
+const memberColumns = `id, email, password, name, created_at`
+
+func scanMember(row rowScanner) (*Member, error) {
+  var member Member
+  var id string
+  err := row.Scan(&id, &member.Email, &member.Password, &member.Name, &member.CreatedAt)
+  if err == sql.ErrNoRows {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, postgresError(err)
+  }
+
+  member.Id, err = primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return nil, postgresError(err)
+  }
+  return &member, nil
+}
+
+func (s *PostgresRepository) CreateMember(member *Member) (string, error) {
+  id := member.Id.Hex()
+  if member.Id.IsZero() {
+    id = primitive.NewObjectID().Hex()
+  }
+
+  _, err := s.db.ExecContext(context.TODO(),
+    `INSERT INTO members (`+memberColumns+`) VALUES ($1, $2, $3, $4, $5)`,
+    id, normalizeEmail(member.Email), member.Password, member.Name, member.CreatedAt)
+  if isUniqueViolation(err) {
+    return "", ErrAlreadyExists
+  }
+  if err != nil {
+    return "", postgresError(err)
+  }
+
+  return id, nil
+}
+
+func (s *PostgresRepository) GetMemberById(id string) (*Member, error) {
+  return scanMember(s.db.QueryRowContext(context.TODO(),
+    `SELECT `+memberColumns+` FROM members WHERE id = $1`, id))
+}
+
+func (s *PostgresRepository) GetMemberByEmail(email string) (*Member, error) {
+  email = normalizeEmail(email)
+  if email == "" {
+    return nil, ErrNotFound
+  }
+
+  return scanMember(s.db.QueryRowContext(context.TODO(),
+    `SELECT `+memberColumns+` FROM members WHERE lower(email) = $1`, email))
+}
+
+func (s *PostgresRepository) UpdateMemberPassword(id string, hash string) error {
+  result, err := s.db.ExecContext(context.TODO(), `UPDATE members SET password = $2 WHERE id = $1`, id, hash)
+  if err != nil {
+    return postgresError(err)
+  }
+  if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+func (s *PostgresRepository) ReplaceMemberPassword(id string, oldHash string, newHash string) (bool, error) {
+  result, err := s.db.ExecContext(context.TODO(),
+    `UPDATE members SET password = $3 WHERE id = $1 AND password = $2`, id, oldHash, newHash)
+  if err != nil {
+    return false, postgresError(err)
+  }
+  affected, err := result.RowsAffected()
+  return affected > 0, postgresError(err)
+}
+
+func (s *PostgresRepository) DeleteMember(id string) error {
+  result, err := s.db.ExecContext(context.TODO(), `DELETE FROM members WHERE id = $1`, id)
+  if err != nil {
+    return postgresError(err)
+  }
+  if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+// membershipColumns is the column list scanned by scanMembership
+const membershipColumns = `company_id, member_id, role, created_at`
+
+func scanMembership(row rowScanner) (*Membership, error) {
+  var membership Membership
+  err := row.Scan(&membership.CompanyId, &membership.MemberId, &membership.Role, &membership.CreatedAt)
+  if err == sql.ErrNoRows {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, postgresError(err)
+  }
+  return &membership, nil
+}
+
+func (s *PostgresRepository) CreateMembership(membership *Membership) error {
+  result, err := s.db.ExecContext(context.TODO(),
+    `INSERT INTO memberships (`+membershipColumns+`) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`,
+    membership.CompanyId, membership.MemberId, membership.Role, membership.CreatedAt)
+  if err != nil {
+    return postgresError(err)
+  }
+  if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+    return ErrAlreadyExists
+  }
+  return nil
+}
+
+func (s *PostgresRepository) GetMembership(companyId string, memberId string) (*Membership, error) {
+  return scanMembership(s.db.QueryRowContext(context.TODO(),
+    `SELECT `+membershipColumns+` FROM memberships WHERE company_id = $1 AND member_id = $2`, companyId, memberId))
+}
+
+func (s *PostgresRepository) ListMembershipsByCompany(companyId string) ([]*Membership, error) {
+  return s.queryMemberships(
+    `SELECT `+membershipColumns+` FROM memberships WHERE company_id = $1 ORDER BY created_at, member_id`, companyId)
+}
+
+func (s *PostgresRepository) ListMembershipsByMember(memberId string) ([]*Membership, error) {
+  return s.queryMemberships(
+    `SELECT `+membershipColumns+` FROM memberships WHERE member_id = $1 ORDER BY created_at, company_id`, memberId)
+}
+
+// queryMemberships returns the memberships selected by query
+func (s *PostgresRepository) queryMemberships(query string, args ...interface{}) ([]*Membership, error) {
+  rows, err := s.db.QueryContext(context.TODO(), query, args...)
+  if err != nil {
+    return nil, postgresError(err)
+  }
+  defer rows.Close()
+
+  memberships := []*Membership{}
+  for rows.Next() {
+    membership, err := scanMembership(rows)
+    if err != nil {
+      return nil, postgresError(err)
+    }
+    memberships = append(memberships, membership)
+  }
+
+  return memberships, rows.Err()
+}
+
+func (s *PostgresRepository) UpdateMembershipRole(companyId string, memberId string, role string) error {
+  result, err := s.db.ExecContext(context.TODO(),
+    `UPDATE memberships SET role = $3 WHERE company_id = $1 AND member_id = $2`, companyId, memberId, role)
+  if err != nil {
+    return postgresError(err)
+  }
+  if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+func (s *PostgresRepository) DeleteMembership(companyId string, memberId string) error {
+  result, err := s.db.ExecContext(context.TODO(),
+    `DELETE FROM memberships WHERE company_id = $1 AND member_id = $2`, companyId, memberId)
+  if err != nil {
+    return postgresError(err)
+  }
+  if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+// invitationColumns is the column list scanned by scanInvitation
+const invitationColumns = `id, company_id, email, role, invited_by, expires_at, created_at`
+
+func scanInvitation(row rowScanner) (*Invitation, error) {
+  var invitation Invitation
+  err := row.Scan(&invitation.Id, &invitation.CompanyId, &invitation.Email, &invitation.Role, &invitation.InvitedBy,
+    &invitation.ExpiresAt, &invitation.CreatedAt)
+  if err == sql.ErrNoRows {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, postgresError(err)
+  }
+  return &invitation, nil
+}
+
+func (s *PostgresRepository) CreateInvitation(invitation *Invitation) error {
+  _, err := s.db.ExecContext(context.TODO(),
+    `INSERT INTO invitations (`+invitationColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+    invitation.Id, invitation.CompanyId, invitation.Email, invitation.Role, invitation.InvitedBy,
+    invitation.ExpiresAt, invitation.CreatedAt)
+  return postgresError(err)
+}
+
+func (s *PostgresRepository) GetInvitation(id string) (*Invitation, error) {
+  return scanInvitation(s.db.QueryRowContext(context.TODO(),
+    `SELECT `+invitationColumns+` FROM invitations WHERE id = $1`, id))
+}
+
+func (s *PostgresRepository) ListInvitations(companyId string) ([]*Invitation, error) {
+  rows, err := s.db.QueryContext(context.TODO(),
+    `SELECT `+invitationColumns+` FROM invitations WHERE company_id = $1 ORDER BY created_at, id`, companyId)
+  if err != nil {
+    return nil, postgresError(err)
+  }
+  defer rows.Close()
+
+  invitations := []*Invitation{}
+  for rows.Next() {
+    invitation, err := scanInvitation(rows)
+    if err != nil {
+      return nil, postgresError(err)
+    }
+    invitations = append(invitations, invitation)
+  }
+
+  return invitations, rows.Err()
+}
+
+func (s *PostgresRepository) DeleteInvitation(companyId string, id string) error {
+  result, err := s.db.ExecContext(context.TODO(),
+    `DELETE FROM invitations WHERE id = $1 AND company_id = $2`, id, companyId)
+  if err != nil {
+    return postgresError(err)
+  }
+  if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+func (s *PostgresRepository) DeleteInvitations(companyId string) error {
+  _, err := s.db.ExecContext(context.TODO(), `DELETE FROM invitations WHERE company_id = $1`, companyId)
+  return postgresError(err)
+}
+
+// auditEventColumns is the column list scanned by scanAuditEvent
+const auditEventColumns = `id, company_id, action, actor_id, target_id, created_at`
+
+func scanAuditEvent(row rowScanner) (*AuditEvent, error) {
+  var event AuditEvent
+  err := row.Scan(&event.Id, &event.CompanyId, &event.Action, &event.ActorId, &event.TargetId, &event.CreatedAt)
+  if err == sql.ErrNoRows {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, postgresError(err)
+  }
+  return &event, nil
+}
+
+func (s *PostgresRepository) CreateAuditEvent(event *AuditEvent) error {
+  _, err := s.db.ExecContext(context.TODO(),
+    `INSERT INTO audit_events (`+auditEventColumns+`) VALUES ($1, $2, $3, $4, $5, $6)`,
+    event.Id, event.CompanyId, event.Action, event.ActorId, event.TargetId, event.CreatedAt)
+  return postgresError(err)
+}
+
+func (s *PostgresRepository) ListAuditEvents(companyId string) ([]*AuditEvent, error) {
+  rows, err := s.db.QueryContext(context.TODO(),
+    `SELECT `+auditEventColumns+` FROM audit_events WHERE company_id = $1 ORDER BY created_at DESC, id DESC`, companyId)
+  if err != nil {
+    return nil, postgresError(err)
+  }
+  defer rows.Close()
+
+  events := []*AuditEvent{}
+  for rows.Next() {
+    event, err := scanAuditEvent(rows)
+    if err != nil {
+      return nil, postgresError(err)
+    }
+    events = append(events, event)
+  }
+
+  return events, rows.Err()
+}
+
+func (s *PostgresRepository) CreateOidcState(state *OidcState) error {
+  _, err := s.db.ExecContext(context.TODO(), `
+    INSERT INTO oidc_states (hash, provider, company_id, nonce, verifier, expires_at, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+    state.Hash, state.Provider, state.CompanyId, state.Nonce, state.Verifier, state.ExpiresAt, state.CreatedAt)
+  return postgresError(err)
+}
+
+func (s *PostgresRepository) ConsumeOidcState(hash string) (*OidcState, error) {
+  var state OidcState
+  err := s.db.QueryRowContext(context.TODO(), `
+    DELETE FROM oidc_states WHERE hash = $1
+    RETURNING hash, provider, company_id, nonce, verifier, expires_at, created_at`, hash,
+  ).Scan(&state.Hash, &state.Provider, &state.CompanyId, &state.Nonce, &state.Verifier, &state.ExpiresAt,
+    &state.CreatedAt)
+  if err == sql.ErrNoRows {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, postgresError(err)
+  }
+  return &state, nil
+}
+
+func (s *PostgresRepository) SaveOidcIdentity(identity *OidcIdentity) error {
+  _, err := s.db.ExecContext(context.TODO(), `
+    INSERT INTO oidc_identities (issuer, subject, member_id, email, created_at)
+    VALUES ($1, $2, $3, $4, $5)
+    ON CONFLICT (issuer, subject) DO UPDATE SET member_id = EXCLUDED.member_id, email = EXCLUDED.email,
+      created_at = EXCLUDED.created_at`,
+    identity.Issuer, identity.Subject, identity.MemberId, identity.Email, identity.CreatedAt)
+  return postgresError(err)
+}
+
+func (s *PostgresRepository) GetOidcIdentity(issuer string, subject string) (*OidcIdentity, error) {
+  var identity OidcIdentity
+  err := s.db.QueryRowContext(context.TODO(), `
+    SELECT issuer, subject, member_id, email, created_at FROM oidc_identities
+    WHERE issuer = $1 AND subject = $2`, issuer, subject,
+  ).Scan(&identity.Issuer, &identity.Subject, &identity.MemberId, &identity.Email, &identity.CreatedAt)
+  if err == sql.ErrNoRows {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, postgresError(err)
+  }
+  return &identity, nil
+}
+
+func (s *PostgresRepository) EnsureUniqueIndexes() ([]*Duplicate, error) {
+  ctx := context.TODO()
+
+  // companies from before name_key get it now, so that they are covered by the name index
+  rows, err := s.db.QueryContext(ctx, `SELECT id, name FROM companies WHERE name_key = '' AND name <> ''`)
+  if err != nil {
+    return nil, postgresError(err)
+  }
+  names := map[string]string{}
+  for rows.Next() {
+    var id, name string
+    if err := rows.Scan(&id, &name); err != nil {
+      rows.Close()
+      return nil, postgresError(err)
+    }
+    names[id] = name
+  }
+  rows.Close()
+  if err := rows.Err(); err != nil {
+    return nil, postgresError(err)
+  }
+  for id, name := range names {
+    _, err := s.db.ExecContext(ctx, `UPDATE companies SET name_key = $2 WHERE id = $1`, id, normalizeName(name))
+    if err != nil {
+      return nil, postgresError(err)
+    }
+  }
+
+  duplicates := []*Duplicate{}
+  indexes := []struct {
+    field string
+    // key is the indexed expression
+    key    string
+    create string
+  }{
+    {"email", "lower(email)",
+      `CREATE UNIQUE INDEX IF NOT EXISTS ` + companyEmailIndex + ` ON companies (lower(email)) WHERE email <> ''`},
+    {"name", "name_key",
+      `CREATE UNIQUE INDEX IF NOT EXISTS ` + companyNameIndex + ` ON companies (name_key) WHERE name_key <> ''`},
+  }
+  for _, index := range indexes {
+    found, err := s.findDuplicates(ctx, index.field, index.key)
+    if err != nil {
+      return nil, err
+    }
+    if len(found) > 0 {
+      duplicates = append(duplicates, found...)
+      continue
+    }
+    if _, err := s.db.ExecContext(ctx, index.create); err != nil {
+      return nil, companyConstraintError(err)
+    }
+  }
+  return duplicates, nil
+}
+
+// findDuplicates returns the values of key several companies share, reported for field
+func (s *PostgresRepository) findDuplicates(ctx context.Context, field string, key string) ([]*Duplicate, error) {
+  rows, err := s.db.QueryContext(ctx, `
+    SELECT `+key+`, array_agg(id ORDER BY id) FROM companies
+    WHERE `+key+` <> ''
+    GROUP BY `+key+` HAVING count(*) > 1
+    ORDER BY `+key)
+  if err != nil {
+    return nil, postgresError(err)
+  }
+  defer rows.Close()
+
+  duplicates := []*Duplicate{}
+  for rows.Next() {
+    duplicate := &Duplicate{Field: field}
+    if err := rows.Scan(&duplicate.Value, pq.Array(&duplicate.CompanyIds)); err != nil {
+      return nil, postgresError(err)
+    }
+    duplicates = append(duplicates, duplicate)
+  }
+  return duplicates, postgresError(rows.Err())
+}
+
+// postgresError maps errors of database/sql and the postgres driver onto the domain errors
+// of package errs, domain errors like ErrNotFound are returned as they are
+func postgresError(err error) error {
+  if err == nil {
+    return nil
+  }
+  if _, ok := errs.As(err); ok {
+    return err
+  }
+  if err == sql.ErrNoRows {
+    return ErrNotFound
+  }
+  if isUniqueViolation(err) {
+    return ErrAlreadyExists
+  }
+  if err == driver.ErrBadConn || err == context.DeadlineExceeded {
+    return errs.Wrap(errs.Unavailable, "the database is unavailable", err)
+  }
+  if pqErr, ok := err.(*pq.Error); ok {
+    switch pqErr.Code.Class() {
+    // serialization failures and deadlocks
+    case "40":
+      return errs.Wrap(errs.Conflict, "the write conflicted with another one, try again", err)
+    // connection exceptions, insufficient resources and operator intervention
+    case "08", "53", "57":
+      return errs.Wrap(errs.Unavailable, "the database is unavailable", err)
+    }
+  }
+  return errs.Wrap(errs.Internal, "database error", err)
+}
+
+// isUniqueViolation reports if err is a violated unique constraint
+func isUniqueViolation(err error) bool {
+  pqErr, ok := err.(*pq.Error)
+  return ok && pqErr.Code == "23505"
+}
+
+// escapeLike escapes the LIKE wildcards of a literal prefix
+func escapeLike(s string) string {
+  return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
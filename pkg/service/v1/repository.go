@@ -2,26 +2,201 @@ package v1
 
 import (
   "context"
+  "fmt"
+  "regexp"
+  "strings"
   "time"
 
   v1 "github.com/ckbball/os-company/pkg/api/v1"
+  "github.com/ckbball/os-company/pkg/errs"
   "go.mongodb.org/mongo-driver/bson"
   "go.mongodb.org/mongo-driver/bson/primitive"
   "go.mongodb.org/mongo-driver/mongo"
   "go.mongodb.org/mongo-driver/mongo/options"
 )
 
-type repository interface {
+var (
+  // ErrNotFound is returned by repositories when no record matches. Its message names no record,
+  // handlers return an error naming the missing one, e.g. errCompanyNotFound or errMemberNotFound.
+  ErrNotFound = errs.New(errs.NotFound, "not found")
+  // ErrAlreadyExists is returned by repositories when a record with the same key exists,
+  // e.g. a member with the email or a membership of the member in the company
+  ErrAlreadyExists = errs.New(errs.AlreadyExists, "already exists")
+  // ErrEmailTaken and ErrNameTaken are returned by Create and Update when another company
+  // has the email or name, compared as normalized by normalizeEmail and normalizeName
+  ErrEmailTaken = errs.NewField(errs.AlreadyExists, "email", "a company with this email already exists")
+  ErrNameTaken  = errs.NewField(errs.AlreadyExists, "name", "a company with this name already exists")
+)
+
+var (
+  // ErrVersionMismatch is returned by Update and Delete when the company has another version than expected,
+  // somebody else changed it since it was read
+  ErrVersionMismatch = errs.NewField(errs.Conflict, "expected_version",
+    "the company has been changed since the expected version, get it again and retry")
+)
+
+const (
+  // companyEmailIndex and companyNameIndex are the unique indexes on the normalized email and name of companies
+  companyEmailIndex = "companies_email_key"
+  companyNameIndex  = "companies_name_key"
+)
+
+// normalizeEmail returns the email as compared for uniqueness, emails differing in case are the same
+func normalizeEmail(email string) string {
+  return strings.ToLower(strings.TrimSpace(email))
+}
+
+// normalizeName returns the name as compared for uniqueness,
+// names differing in case or white space are the same
+func normalizeName(name string) string {
+  return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// UpdatableCompanyFields are the fields of companies Repository.Update can set, named like in the proto
+var UpdatableCompanyFields = []string{"email", "name", "mission", "location"}
+
+// Duplicate is a normalized email or name several companies share, which
+// keeps EnsureUniqueIndexes from creating the unique index of the field
+type Duplicate struct {
+  // Field is "email" or "name"
+  Field      string
+  Value      string
+  CompanyIds []string
+}
+
+func (d *Duplicate) String() string {
+  return fmt.Sprintf("%s '%s' is shared by companies %s", d.Field, d.Value, strings.Join(d.CompanyIds, ", "))
+}
+
+// Repository is the storage of companies, implemented by CompanyRepository (mongo),
+// PostgresRepository and MemoryRepository. Every implementation must pass repotest.RunConformance.
+type Repository interface {
+  // Create and Update return ErrEmailTaken or ErrNameTaken if another company has the email or name
   Create(*v1.Company) (string, error)
-  Update(*v1.Company, string) (int64, int64, error)
-  Delete(string) (int64, error)
+  // Update sets the UpdatableCompanyFields listed in fields to their values in the company
+  // and leaves the others as they are. fields must not be empty. An update that changes the
+  // company increments its version.
+  // Update and Delete return ErrVersionMismatch if expectedVersion is not 0 and not the version of the company.
+  // Besides the matched and modified counts, Update returns the version the company has after it,
+  // read in the same write.
+  Update(company *v1.Company, id string, fields []string, expectedVersion int64) (int64, int64, int64, error)
+  Delete(id string, expectedVersion int64) (int64, error)
   GetById(string) (*Company, error)
   GetByEmail(string) (*Company, error)
   GetByName(string) (*Company, error)
-  FilterCompanys(*v1.FindRequest) ([]*Company, error)
+  FilterCompanys(*CompanyFilter) ([]*Company, error)
   UpdateActive(string) (int64, error)
+  // SetEmailVerified marks the email of a company verified or unverified
+  SetEmailVerified(id string, verified bool) error
+  // UpdatePassword replaces the password hash of a company
+  UpdatePassword(id string, hash string) error
+
+  // refresh tokens, see RefreshToken
+  CreateRefreshToken(*RefreshToken) error
+  // GetRefreshToken returns the token with the given hash without using it
+  GetRefreshToken(string) (*RefreshToken, error)
+  // UseRefreshToken marks the token with the given hash used and returns it as it was before
+  UseRefreshToken(string) (*RefreshToken, error)
+  RevokeRefreshFamily(string) error
+  // RevokeCompanyRefreshTokens revokes every refresh token of a company
+  RevokeCompanyRefreshTokens(string) error
+  // RevokeMemberRefreshTokens revokes every refresh token of a member
+  RevokeMemberRefreshTokens(memberId string) error
+
+  // action tokens, see ActionToken
+  CreateActionToken(*ActionToken) error
+  // ConsumeActionToken deletes the token with the given purpose and hash and returns it.
+  // Of several concurrent calls only one gets the token.
+  ConsumeActionToken(purpose string, hash string) (*ActionToken, error)
+  // GetActionToken returns the token with the given purpose and hash without consuming it
+  GetActionToken(purpose string, hash string) (*ActionToken, error)
+  // ConsumeMemberActionToken is ConsumeActionToken for a token of memberId only,
+  // a token of another member is not deleted and returns ErrNotFound
+  ConsumeMemberActionToken(purpose string, hash string, memberId string) (*ActionToken, error)
+  // DeleteActionTokens deletes every token with purpose of a company
+  DeleteActionTokens(purpose string, companyId string) error
+  // DeleteMemberActionTokens deletes every token with purpose of a member
+  DeleteMemberActionTokens(purpose string, memberId string) error
+
+  // second factors, see Totp
+  // SaveTotp creates or replaces the second factor of a member
+  SaveTotp(*Totp) error
+  GetTotp(memberId string) (*Totp, error)
+  // AdvanceTotpStep records step as the last used time step if it is newer than the
+  // recorded one, and reports if it was. Of several concurrent calls only one succeeds.
+  AdvanceTotpStep(memberId string, step int64) (bool, error)
+  // UseRecoveryCode removes the recovery code with the given hash and reports if it was there
+  UseRecoveryCode(memberId string, hash string) (bool, error)
+
+  // API keys, see ApiKey
+  CreateApiKey(*ApiKey) error
+  GetApiKeyByHash(hash string) (*ApiKey, error)
+  // ListApiKeys returns the keys of a company, oldest first
+  ListApiKeys(companyId string) ([]*ApiKey, error)
+  // DeleteApiKey deletes a key of a company, ErrNotFound if the company has no key with the id
+  DeleteApiKey(companyId string, id string) error
+  // DeleteApiKeys deletes every key of a company
+  DeleteApiKeys(companyId string) error
+  // TouchApiKey records the last use of a key
+  TouchApiKey(id string, at time.Time) error
+
+  // members, see Member and Membership
+  // CreateMember stores a member under its id, or a new id if it has none, and returns the id.
+  // The email is stored as normalized by normalizeEmail, ErrAlreadyExists if it or the id is taken.
+  CreateMember(*Member) (string, error)
+  GetMemberById(id string) (*Member, error)
+  // GetMemberByEmail finds the member with email, compared as normalized by normalizeEmail
+  GetMemberByEmail(email string) (*Member, error)
+  // UpdateMemberPassword replaces the password hash of a member
+  UpdateMemberPassword(id string, hash string) error
+  // ReplaceMemberPassword replaces the password hash of a member if it still is oldHash,
+  // and reports if it was
+  ReplaceMemberPassword(id string, oldHash string, newHash string) (bool, error)
+  DeleteMember(id string) error
+  // CreateMembership stores a membership, ErrAlreadyExists if the member already belongs to the company
+  CreateMembership(*Membership) error
+  GetMembership(companyId string, memberId string) (*Membership, error)
+  // ListMembershipsByCompany returns the memberships of a company, oldest first
+  ListMembershipsByCompany(companyId string) ([]*Membership, error)
+  // ListMembershipsByMember returns the memberships of a member, oldest first
+  ListMembershipsByMember(memberId string) ([]*Membership, error)
+  UpdateMembershipRole(companyId string, memberId string, role string) error
+  DeleteMembership(companyId string, memberId string) error
+
+  // invitations, see Invitation
+  CreateInvitation(*Invitation) error
+  GetInvitation(id string) (*Invitation, error)
+  // ListInvitations returns the invitations of a company, oldest first
+  ListInvitations(companyId string) ([]*Invitation, error)
+  // DeleteInvitation deletes an invitation of a company, ErrNotFound if the company has no invitation with the id
+  DeleteInvitation(companyId string, id string) error
+  // DeleteInvitations deletes every invitation of a company
+  DeleteInvitations(companyId string) error
+
+  // audit trail, see AuditEvent
+  CreateAuditEvent(*AuditEvent) error
+  // ListAuditEvents returns the audit events of a company, newest first
+  ListAuditEvents(companyId string) ([]*AuditEvent, error)
+
+  // OpenID Connect logins, see OidcState and OidcIdentity
+  CreateOidcState(*OidcState) error
+  // ConsumeOidcState deletes the state with the given hash and returns it.
+  // Of several concurrent calls only one gets the state.
+  ConsumeOidcState(hash string) (*OidcState, error)
+  // SaveOidcIdentity creates or replaces the link of the subject of an issuer
+  SaveOidcIdentity(*OidcIdentity) error
+  GetOidcIdentity(issuer string, subject string) (*OidcIdentity, error)
+
+  // EnsureUniqueIndexes makes the storage enforce unique company emails and names, it is
+  // called at startup. Values existing companies share keep the index of their field from
+  // being created until they are resolved, they are returned so that they can be reported.
+  // Storages without migrations also create the indexes of their other records here.
+  EnsureUniqueIndexes() ([]*Duplicate, error)
 }
 
+// CompanyRepository stores companies in a mongo collection.
+// Other records live in collections of the same database, see refreshTokens, actionTokens, totps, apiKeys,
+// members, memberships, invitations, auditEvents, oidcStates and oidcIdentities.
 type CompanyRepository struct {
   cs *mongo.Collection
 }
@@ -33,21 +208,27 @@ func NewCompanyRepository(client *mongo.Collection) *CompanyRepository {
 }
 
 func (repository *CompanyRepository) Create(company *v1.Company) (string, error) {
-  // add a duplicate email and a duplicate company name check
+  // the unique indexes catch what the check misses, but it names the field without parsing errors
+  if err := repository.checkDuplicate(company, primitive.NilObjectID); err != nil {
+    return "", mongoError(err)
+  }
 
   insertCompany := bson.D{
     {"email", company.Email},
     {"password", company.Password},
     {"name", company.Name},
+    {"name_key", normalizeName(company.Name)},
     {"mission", company.Mission},
     {"last_active", company.LastActive},
     {"location", company.Location},
+    {"unverified", !company.EmailVerified},
+    {"version", int64(1)},
   }
 
   result, err := repository.cs.InsertOne(context.TODO(), insertCompany)
 
   if err != nil {
-    return "", err
+    return "", companyWriteError(err)
   }
 
   id := result.InsertedID
@@ -55,118 +236,1078 @@ func (repository *CompanyRepository) Create(company *v1.Company) (string, error)
 
   out := w.Hex()
 
-  return out, err
+  return out, mongoError(err)
 }
 
-func (repository *CompanyRepository) Update(company *v1.Company, id string) (int64, int64, error) {
-  // add a duplicate email and a duplicate companyname check
+func (repository *CompanyRepository) Update(company *v1.Company, id string, fields []string, expectedVersion int64) (int64, int64, int64, error) {
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return 0, 0, 0, nil
+  }
 
-  primitiveId, _ := primitive.ObjectIDFromHex(id)
+  updated, err := updatedCompany(company, fields)
+  if err != nil {
+    return -1, -1, -1, err
+  }
+  if err := repository.checkDuplicate(updated, primitiveId); err != nil {
+    return -1, -1, -1, mongoError(err)
+  }
 
-  insertCompany := bson.D{
-    {"email", company.Email},
-    {"password", company.Password},
-    {"name", company.Name},
-    {"mission", company.Mission},
-    {"last_active", company.LastActive},
-    {"location", company.Location},
+  insertCompany := bson.D{}
+  for _, field := range fields {
+    switch field {
+    case "email":
+      insertCompany = append(insertCompany, bson.E{"email", company.Email})
+    case "name":
+      insertCompany = append(insertCompany, bson.E{"name", company.Name}, bson.E{"name_key", normalizeName(company.Name)})
+    case "mission":
+      insertCompany = append(insertCompany, bson.E{"mission", company.Mission})
+    case "location":
+      insertCompany = append(insertCompany, bson.E{"location", company.Location})
+    }
   }
 
-  result, err := repository.cs.UpdateOne(context.TODO(),
-    bson.D{
-      {"_id", primitiveId},
-    },
+  // only an update that changes something matches, so that the version stays as it is otherwise
+  filter := bson.D{{"_id", primitiveId}}
+  if expectedVersion != 0 {
+    filter = append(filter, bson.E{"version", expectedVersion})
+  }
+  changes := bson.A{}
+  for _, field := range insertCompany {
+    changes = append(changes, bson.D{{field.Key, bson.D{{"$ne", field.Value}}}})
+  }
+  filter = append(filter, bson.E{"$or", changes})
+
+  // the updated document carries the new version
+  var result struct {
+    Version int64 `bson:"version"`
+  }
+  err = repository.cs.FindOneAndUpdate(context.TODO(), filter,
     bson.D{
       {"$set", insertCompany},
+      {"$inc", bson.D{{"version", 1}}},
     },
-  )
+    options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.D{{"version", 1}}),
+  ).Decode(&result)
+  if err == nil {
+    return 1, 1, result.Version, nil
+  }
+  if err != mongo.ErrNoDocuments {
+    return -1, -1, -1, companyWriteError(err)
+  }
 
+  // nothing matched, the company is missing, unchanged or of another version
+  existing, err := repository.GetById(id)
+  if err == ErrNotFound {
+    return 0, 0, 0, nil
+  }
   if err != nil {
-    return -1, -1, err
+    return -1, -1, -1, err
+  }
+  if expectedVersion != 0 && existing.Version != expectedVersion {
+    return -1, -1, -1, ErrVersionMismatch
   }
+  return 1, 0, existing.Version, nil
+}
 
-  return result.MatchedCount, result.ModifiedCount, nil
+// updatedCompany returns the email and name of company that fields update, the others stay empty,
+// so that only the updated ones are checked for duplicates. It fails for fields Update cannot set.
+func updatedCompany(company *v1.Company, fields []string) (*v1.Company, error) {
+  if len(fields) == 0 {
+    return nil, fmt.Errorf("no company fields to update")
+  }
+  updated := &v1.Company{}
+  for _, field := range fields {
+    switch field {
+    case "email":
+      updated.Email = company.Email
+    case "name":
+      updated.Name = company.Name
+    case "mission", "location":
+    default:
+      return nil, fmt.Errorf("company field '%s' cannot be updated", field)
+    }
+  }
+  return updated, nil
+}
+
+// checkDuplicate returns ErrEmailTaken or ErrNameTaken if a company other than self uses the email or name of company
+func (repository *CompanyRepository) checkDuplicate(company *v1.Company, self primitive.ObjectID) error {
+  if company.Email != "" {
+    count, err := repository.cs.CountDocuments(context.TODO(), bson.D{
+      {"email", company.Email},
+      {"_id", bson.D{{"$ne", self}}},
+    }, options.Count().SetCollation(emailCollation))
+    if err != nil {
+      return mongoError(err)
+    }
+    if count > 0 {
+      return ErrEmailTaken
+    }
+  }
+  if key := normalizeName(company.Name); key != "" {
+    count, err := repository.cs.CountDocuments(context.TODO(), bson.D{
+      {"name_key", key},
+      {"_id", bson.D{{"$ne", self}}},
+    })
+    if err != nil {
+      return mongoError(err)
+    }
+    if count > 0 {
+      return ErrNameTaken
+    }
+  }
+  return nil
 }
 
-func (repository *CompanyRepository) Delete(id string) (int64, error) {
-  primitiveId, _ := primitive.ObjectIDFromHex(id)
+// companyWriteError maps the duplicate key errors of the unique company indexes onto ErrEmailTaken and ErrNameTaken
+func companyWriteError(err error) error {
+  if mongo.IsDuplicateKeyError(err) {
+    if strings.Contains(err.Error(), companyNameIndex) {
+      return ErrNameTaken
+    }
+    return ErrEmailTaken
+  }
+  return mongoError(err)
+}
+
+func (repository *CompanyRepository) Delete(id string, expectedVersion int64) (int64, error) {
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return 0, nil
+  }
   filter := bson.D{{"_id", primitiveId}}
+  if expectedVersion != 0 {
+    filter = append(filter, bson.E{"version", expectedVersion})
+  }
 
   result, err := repository.cs.DeleteOne(context.TODO(), filter)
   if err != nil {
-    return -1, err
+    return -1, mongoError(err)
+  }
+  if result.DeletedCount == 0 && expectedVersion != 0 {
+    // the company is missing or of another version
+    if _, err := repository.GetById(id); err != ErrNotFound {
+      if err != nil {
+        return -1, err
+      }
+      return -1, ErrVersionMismatch
+    }
   }
   return result.DeletedCount, nil
 }
 
 func (s *CompanyRepository) GetById(id string) (*Company, error) {
-  primitiveId, _ := primitive.ObjectIDFromHex(id)
-
-  var company Company
-  err := s.cs.FindOne(context.TODO(), Company{Id: primitiveId}).Decode(&company)
+  primitiveId, err := primitive.ObjectIDFromHex(id)
   if err != nil {
-    return nil, err
+    return nil, ErrNotFound
   }
 
-  return &company, nil
+  return s.findOne(bson.D{{"_id", primitiveId}})
 }
 
 func (s *CompanyRepository) GetByEmail(email string) (*Company, error) {
-
-  var company Company
-  err := s.cs.FindOne(context.TODO(), Company{Email: email}).Decode(&company)
-  if err != nil {
-    return nil, err
+  if email == "" {
+    return nil, ErrNotFound
   }
 
-  return &company, nil
+  return s.findOne(bson.D{{"email", email}}, options.FindOne().SetCollation(emailCollation))
 }
 
 func (s *CompanyRepository) GetByName(name string) (*Company, error) {
+  if name == "" {
+    return nil, ErrNotFound
+  }
 
+  return s.findOne(bson.D{{"name_key", normalizeName(name)}})
+}
+
+// findOne decodes the first company matching filter
+func (s *CompanyRepository) findOne(filter bson.D, opts ...*options.FindOneOptions) (*Company, error) {
   var company Company
-  err := s.cs.FindOne(context.TODO(), Company{Name: name}).Decode(&company)
+  err := s.cs.FindOne(context.TODO(), filter, opts...).Decode(&company)
+  if err == mongo.ErrNoDocuments {
+    return nil, ErrNotFound
+  }
   if err != nil {
-    return nil, err
+    return nil, mongoError(err)
   }
 
   return &company, nil
 }
 
-func (s *CompanyRepository) UpdateActive(id string) (int64, error) {
+func (s *CompanyRepository) FilterCompanys(filter *CompanyFilter) ([]*Company, error) {
+  conditions := bson.A{}
+  if filter.NamePrefix != "" {
+    conditions = append(conditions, bson.D{{"name", bson.D{{"$regex", "^" + regexp.QuoteMeta(filter.NamePrefix)}}}})
+  }
+  if filter.Location != "" {
+    conditions = append(conditions, bson.D{{"location", filter.Location}})
+  }
+  if filter.ActiveAfter > 0 {
+    conditions = append(conditions, bson.D{{"last_active", bson.D{{"$gte", filter.ActiveAfter}}}})
+  }
+  if filter.ActiveBefore > 0 {
+    conditions = append(conditions, bson.D{{"last_active", bson.D{{"$lt", filter.ActiveBefore}}}})
+  }
+  if filter.VerifiedOnly {
+    conditions = append(conditions, bson.D{{"unverified", bson.D{{"$ne", true}}}})
+  }
 
-  now := time.Now()
-  secs := now.Unix()
+  field, direction := mongoSort(filter.Order)
 
-  var company Company
-  err := s.cs.FindOne(context.TODO(), Company{id: id}).Decode(&company)
+  // keyset pagination: continue strictly after the (sort key, _id) of the cursor
+  if filter.After != nil {
+    afterId, err := primitive.ObjectIDFromHex(filter.After.Id)
+    if err != nil {
+      return nil, mongoError(err)
+    }
+    var value interface{} = filter.After.Name
+    if field == "last_active" {
+      value = filter.After.LastActive
+    }
+    op := "$gt"
+    if direction < 0 {
+      op = "$lt"
+    }
+    conditions = append(conditions, bson.D{{"$or", bson.A{
+      bson.D{{field, bson.D{{op, value}}}},
+      bson.D{{field, value}, {"_id", bson.D{{op, afterId}}}},
+    }}})
+  }
+
+  query := bson.D{}
+  if len(conditions) > 0 {
+    query = bson.D{{"$and", conditions}}
+  }
+
+  findOptions := options.Find().
+    SetSort(bson.D{{field, direction}, {"_id", direction}}).
+    SetLimit(int64(filter.Limit))
+
+  cursor, err := s.cs.Find(context.TODO(), query, findOptions)
   if err != nil {
-    return nil, err
+    return nil, mongoError(err)
   }
 
-  primitiveId, _ := primitive.ObjectIDFromHex(id)
+  companys := []*Company{}
+  if err := cursor.All(context.TODO(), &companys); err != nil {
+    return nil, mongoError(err)
+  }
 
-  insertCompany := bson.D{
-    {"email", company.Email},
-    {"password", company.Password},
-    {"name", company.Name},
-    {"mission", company.Mission},
-    {"last_active", secs},
-    {"location", company.Location},
+  return companys, nil
+}
+
+// mongoSort returns the sort field and direction of a FilterCompanies order
+func mongoSort(order v1.CompanyOrder) (string, int) {
+  switch order {
+  case v1.CompanyOrder_NAME_DESC:
+    return "name", -1
+  case v1.CompanyOrder_LAST_ACTIVE_ASC:
+    return "last_active", 1
+  case v1.CompanyOrder_LAST_ACTIVE_DESC:
+    return "last_active", -1
+  default:
+    return "name", 1
+  }
+}
+
+func (s *CompanyRepository) UpdateActive(id string) (int64, error) {
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return -1, ErrNotFound
   }
 
-  result, err := repository.cs.UpdateOne(context.TODO(),
+  now := time.Now()
+  secs := now.Unix()
+
+  result, err := s.cs.UpdateOne(context.TODO(),
     bson.D{
       {"_id", primitiveId},
     },
     bson.D{
-      {"$set", insertCompany},
+      {"$set", bson.D{{"last_active", secs}}},
     },
   )
 
   if err != nil {
-    return nil, err
+    return -1, mongoError(err)
+  }
+  if result.MatchedCount == 0 {
+    return -1, ErrNotFound
   }
 
   return secs, nil
 }
+
+func (s *CompanyRepository) UpdatePassword(id string, hash string) error {
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return ErrNotFound
+  }
+
+  result, err := s.cs.UpdateOne(context.TODO(),
+    bson.D{{"_id", primitiveId}},
+    bson.D{{"$set", bson.D{{"password", hash}}}},
+  )
+  if err != nil {
+    return mongoError(err)
+  }
+  if result.MatchedCount == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+func (s *CompanyRepository) SetEmailVerified(id string, verified bool) error {
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return ErrNotFound
+  }
+
+  result, err := s.cs.UpdateOne(context.TODO(),
+    bson.D{{"_id", primitiveId}},
+    bson.D{{"$set", bson.D{{"unverified", !verified}}}},
+  )
+  if err != nil {
+    return mongoError(err)
+  }
+  if result.MatchedCount == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+// refreshTokens is the collection of refresh tokens
+func (s *CompanyRepository) refreshTokens() *mongo.Collection {
+  return s.cs.Database().Collection("refresh_tokens")
+}
+
+func (s *CompanyRepository) CreateRefreshToken(token *RefreshToken) error {
+  _, err := s.refreshTokens().InsertOne(context.TODO(), token)
+  return mongoError(err)
+}
+
+func (s *CompanyRepository) GetRefreshToken(hash string) (*RefreshToken, error) {
+  var token RefreshToken
+  err := s.refreshTokens().FindOne(context.TODO(), bson.D{{"_id", hash}}).Decode(&token)
+  if err == mongo.ErrNoDocuments {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  return &token, nil
+}
+
+func (s *CompanyRepository) UseRefreshToken(hash string) (*RefreshToken, error) {
+  var token RefreshToken
+  err := s.refreshTokens().FindOneAndUpdate(context.TODO(),
+    bson.D{{"_id", hash}},
+    bson.D{{"$set", bson.D{{"used", true}}}},
+    options.FindOneAndUpdate().SetReturnDocument(options.Before),
+  ).Decode(&token)
+  if err == mongo.ErrNoDocuments {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  return &token, nil
+}
+
+func (s *CompanyRepository) RevokeRefreshFamily(family string) error {
+  _, err := s.refreshTokens().UpdateMany(context.TODO(),
+    bson.D{{"family", family}},
+    bson.D{{"$set", bson.D{{"revoked", true}}}},
+  )
+  return mongoError(err)
+}
+
+func (s *CompanyRepository) RevokeCompanyRefreshTokens(companyId string) error {
+  _, err := s.refreshTokens().UpdateMany(context.TODO(),
+    bson.D{{"company_id", companyId}},
+    bson.D{{"$set", bson.D{{"revoked", true}}}},
+  )
+  return mongoError(err)
+}
+
+func (s *CompanyRepository) RevokeMemberRefreshTokens(memberId string) error {
+  _, err := s.refreshTokens().UpdateMany(context.TODO(),
+    bson.D{{"member_id", memberId}},
+    bson.D{{"$set", bson.D{{"revoked", true}}}},
+  )
+  return mongoError(err)
+}
+
+// actionTokens is the collection of action tokens
+func (s *CompanyRepository) actionTokens() *mongo.Collection {
+  return s.cs.Database().Collection("action_tokens")
+}
+
+func (s *CompanyRepository) CreateActionToken(token *ActionToken) error {
+  _, err := s.actionTokens().InsertOne(context.TODO(), token)
+  return mongoError(err)
+}
+
+func (s *CompanyRepository) ConsumeActionToken(purpose string, hash string) (*ActionToken, error) {
+  var token ActionToken
+  err := s.actionTokens().FindOneAndDelete(context.TODO(),
+    bson.D{{"_id", hash}, {"purpose", purpose}},
+  ).Decode(&token)
+  if err == mongo.ErrNoDocuments {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  return &token, nil
+}
+
+func (s *CompanyRepository) GetActionToken(purpose string, hash string) (*ActionToken, error) {
+  var token ActionToken
+  err := s.actionTokens().FindOne(context.TODO(),
+    bson.D{{"_id", hash}, {"purpose", purpose}},
+  ).Decode(&token)
+  if err == mongo.ErrNoDocuments {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  return &token, nil
+}
+
+func (s *CompanyRepository) ConsumeMemberActionToken(purpose string, hash string, memberId string) (*ActionToken, error) {
+  var token ActionToken
+  err := s.actionTokens().FindOneAndDelete(context.TODO(),
+    bson.D{{"_id", hash}, {"purpose", purpose}, {"member_id", memberId}},
+  ).Decode(&token)
+  if err == mongo.ErrNoDocuments {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  return &token, nil
+}
+
+func (s *CompanyRepository) DeleteActionTokens(purpose string, companyId string) error {
+  _, err := s.actionTokens().DeleteMany(context.TODO(),
+    bson.D{{"purpose", purpose}, {"company_id", companyId}},
+  )
+  return mongoError(err)
+}
+
+func (s *CompanyRepository) DeleteMemberActionTokens(purpose string, memberId string) error {
+  _, err := s.actionTokens().DeleteMany(context.TODO(),
+    bson.D{{"purpose", purpose}, {"member_id", memberId}},
+  )
+  return mongoError(err)
+}
+
+// totps is the collection of second factors
+func (s *CompanyRepository) totps() *mongo.Collection {
+  return s.cs.Database().Collection("totp")
+}
+
+func (s *CompanyRepository) SaveTotp(totp *Totp) error {
+  _, err := s.totps().ReplaceOne(context.TODO(),
+    bson.D{{"_id", totp.MemberId}},
+    totp,
+    options.Replace().SetUpsert(true),
+  )
+  return mongoError(err)
+}
+
+func (s *CompanyRepository) GetTotp(memberId string) (*Totp, error) {
+  var totp Totp
+  err := s.totps().FindOne(context.TODO(), bson.D{{"_id", memberId}}).Decode(&totp)
+  if err == mongo.ErrNoDocuments {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  return &totp, nil
+}
+
+func (s *CompanyRepository) AdvanceTotpStep(memberId string, step int64) (bool, error) {
+  result, err := s.totps().UpdateOne(context.TODO(),
+    bson.D{{"_id", memberId}, {"last_step", bson.D{{"$lt", step}}}},
+    bson.D{{"$set", bson.D{{"last_step", step}}}},
+  )
+  if err != nil {
+    return false, mongoError(err)
+  }
+  return result.ModifiedCount > 0, nil
+}
+
+func (s *CompanyRepository) UseRecoveryCode(memberId string, hash string) (bool, error) {
+  result, err := s.totps().UpdateOne(context.TODO(),
+    bson.D{{"_id", memberId}, {"recovery_codes", hash}},
+    bson.D{{"$pull", bson.D{{"recovery_codes", hash}}}},
+  )
+  if err != nil {
+    return false, mongoError(err)
+  }
+  return result.ModifiedCount > 0, nil
+}
+
+// apiKeys is the collection of API keys
+func (s *CompanyRepository) apiKeys() *mongo.Collection {
+  return s.cs.Database().Collection("api_keys")
+}
+
+func (s *CompanyRepository) CreateApiKey(key *ApiKey) error {
+  _, err := s.apiKeys().InsertOne(context.TODO(), key)
+  return mongoError(err)
+}
+
+func (s *CompanyRepository) GetApiKeyByHash(hash string) (*ApiKey, error) {
+  var key ApiKey
+  err := s.apiKeys().FindOne(context.TODO(), bson.D{{"hash", hash}}).Decode(&key)
+  if err == mongo.ErrNoDocuments {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  return &key, nil
+}
+
+func (s *CompanyRepository) ListApiKeys(companyId string) ([]*ApiKey, error) {
+  cursor, err := s.apiKeys().Find(context.TODO(),
+    bson.D{{"company_id", companyId}},
+    options.Find().SetSort(bson.D{{"created_at", 1}, {"_id", 1}}),
+  )
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  keys := []*ApiKey{}
+  if err := cursor.All(context.TODO(), &keys); err != nil {
+    return nil, mongoError(err)
+  }
+  return keys, nil
+}
+
+func (s *CompanyRepository) DeleteApiKey(companyId string, id string) error {
+  result, err := s.apiKeys().DeleteOne(context.TODO(), bson.D{{"_id", id}, {"company_id", companyId}})
+  if err != nil {
+    return mongoError(err)
+  }
+  if result.DeletedCount == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+func (s *CompanyRepository) DeleteApiKeys(companyId string) error {
+  _, err := s.apiKeys().DeleteMany(context.TODO(), bson.D{{"company_id", companyId}})
+  return mongoError(err)
+}
+
+func (s *CompanyRepository) TouchApiKey(id string, at time.Time) error {
+  _, err := s.apiKeys().UpdateOne(context.TODO(),
+    bson.D{{"_id", id}},
+    bson.D{{"$set", bson.D{{"last_used_at", at}}}},
+  )
+  return mongoError(err)
+}
+
+// members is the collection of members
+func (s *CompanyRepository) members() *mongo.Collection {
+  return s.cs.Database().Collection("members")
+}
+
+func (s *CompanyRepository) CreateMember(member *Member) (string, error) {
+  saved := *member
+  saved.Email = normalizeEmail(member.Email)
+  // racy without the unique index, but catches the common case
+  count, err := s.members().CountDocuments(context.TODO(), bson.D{{"email", saved.Email}},
+    options.Count().SetCollation(emailCollation))
+  if err != nil {
+    return "", mongoError(err)
+  }
+  if count > 0 {
+    return "", ErrAlreadyExists
+  }
+
+  result, err := s.members().InsertOne(context.TODO(), &saved)
+  if mongo.IsDuplicateKeyError(err) {
+    return "", ErrAlreadyExists
+  }
+  if err != nil {
+    return "", mongoError(err)
+  }
+
+  id, _ := result.InsertedID.(primitive.ObjectID)
+  return id.Hex(), nil
+}
+
+func (s *CompanyRepository) GetMemberById(id string) (*Member, error) {
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return nil, ErrNotFound
+  }
+
+  return s.findMember(bson.D{{"_id", primitiveId}})
+}
+
+func (s *CompanyRepository) GetMemberByEmail(email string) (*Member, error) {
+  email = normalizeEmail(email)
+  if email == "" {
+    return nil, ErrNotFound
+  }
+
+  // the collation of the unique index also finds members stored before emails were normalized
+  return s.findMember(bson.D{{"email", email}}, options.FindOne().SetCollation(emailCollation))
+}
+
+// findMember decodes the first member matching filter
+func (s *CompanyRepository) findMember(filter bson.D, opts ...*options.FindOneOptions) (*Member, error) {
+  var member Member
+  err := s.members().FindOne(context.TODO(), filter, opts...).Decode(&member)
+  if err == mongo.ErrNoDocuments {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  return &member, nil
+}
+
+func (s *CompanyRepository) UpdateMemberPassword(id string, hash string) error {
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return ErrNotFound
+  }
+
+  result, err := s.members().UpdateOne(context.TODO(),
+    bson.D{{"_id", primitiveId}},
+    bson.D{{"$set", bson.D{{"password", hash}}}},
+  )
+  if err != nil {
+    return mongoError(err)
+  }
+  if result.MatchedCount == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+func (s *CompanyRepository) ReplaceMemberPassword(id string, oldHash string, newHash string) (bool, error) {
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return false, nil
+  }
+
+  result, err := s.members().UpdateOne(context.TODO(),
+    bson.D{{"_id", primitiveId}, {"password", oldHash}},
+    bson.D{{"$set", bson.D{{"password", newHash}}}},
+  )
+  if err != nil {
+    return false, mongoError(err)
+  }
+  return result.ModifiedCount > 0, nil
+}
+
+func (s *CompanyRepository) DeleteMember(id string) error {
+  primitiveId, err := primitive.ObjectIDFromHex(id)
+  if err != nil {
+    return ErrNotFound
+  }
+
+  result, err := s.members().DeleteOne(context.TODO(), bson.D{{"_id", primitiveId}})
+  if err != nil {
+    return mongoError(err)
+  }
+  if result.DeletedCount == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+// memberships is the collection of memberships
+func (s *CompanyRepository) memberships() *mongo.Collection {
+  return s.cs.Database().Collection("memberships")
+}
+
+func (s *CompanyRepository) CreateMembership(membership *Membership) error {
+  // inserting through an upsert finds out if the membership exists in the same step
+  result, err := s.memberships().UpdateOne(context.TODO(),
+    bson.D{{"company_id", membership.CompanyId}, {"member_id", membership.MemberId}},
+    bson.D{{"$setOnInsert", membership}},
+    options.Update().SetUpsert(true),
+  )
+  if err != nil {
+    return mongoError(err)
+  }
+  if result.UpsertedCount == 0 {
+    return ErrAlreadyExists
+  }
+  return nil
+}
+
+func (s *CompanyRepository) GetMembership(companyId string, memberId string) (*Membership, error) {
+  var membership Membership
+  err := s.memberships().FindOne(context.TODO(),
+    bson.D{{"company_id", companyId}, {"member_id", memberId}},
+  ).Decode(&membership)
+  if err == mongo.ErrNoDocuments {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  return &membership, nil
+}
+
+func (s *CompanyRepository) ListMembershipsByCompany(companyId string) ([]*Membership, error) {
+  return s.findMemberships(bson.D{{"company_id", companyId}}, "member_id")
+}
+
+func (s *CompanyRepository) ListMembershipsByMember(memberId string) ([]*Membership, error) {
+  return s.findMemberships(bson.D{{"member_id", memberId}}, "company_id")
+}
+
+// findMemberships returns the memberships matching filter, oldest first and ties broken by tieBreak
+func (s *CompanyRepository) findMemberships(filter bson.D, tieBreak string) ([]*Membership, error) {
+  cursor, err := s.memberships().Find(context.TODO(), filter,
+    options.Find().SetSort(bson.D{{"created_at", 1}, {tieBreak, 1}}),
+  )
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  memberships := []*Membership{}
+  if err := cursor.All(context.TODO(), &memberships); err != nil {
+    return nil, mongoError(err)
+  }
+  return memberships, nil
+}
+
+func (s *CompanyRepository) UpdateMembershipRole(companyId string, memberId string, role string) error {
+  result, err := s.memberships().UpdateOne(context.TODO(),
+    bson.D{{"company_id", companyId}, {"member_id", memberId}},
+    bson.D{{"$set", bson.D{{"role", role}}}},
+  )
+  if err != nil {
+    return mongoError(err)
+  }
+  if result.MatchedCount == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+func (s *CompanyRepository) DeleteMembership(companyId string, memberId string) error {
+  result, err := s.memberships().DeleteOne(context.TODO(),
+    bson.D{{"company_id", companyId}, {"member_id", memberId}},
+  )
+  if err != nil {
+    return mongoError(err)
+  }
+  if result.DeletedCount == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+// invitations is the collection of invitations
+func (s *CompanyRepository) invitations() *mongo.Collection {
+  return s.cs.Database().Collection("invitations")
+}
+
+func (s *CompanyRepository) CreateInvitation(invitation *Invitation) error {
+  _, err := s.invitations().InsertOne(context.TODO(), invitation)
+  return mongoError(err)
+}
+
+func (s *CompanyRepository) GetInvitation(id string) (*Invitation, error) {
+  var invitation Invitation
+  err := s.invitations().FindOne(context.TODO(), bson.D{{"_id", id}}).Decode(&invitation)
+  if err == mongo.ErrNoDocuments {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  return &invitation, nil
+}
+
+func (s *CompanyRepository) ListInvitations(companyId string) ([]*Invitation, error) {
+  cursor, err := s.invitations().Find(context.TODO(),
+    bson.D{{"company_id", companyId}},
+    options.Find().SetSort(bson.D{{"created_at", 1}, {"_id", 1}}),
+  )
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  invitations := []*Invitation{}
+  if err := cursor.All(context.TODO(), &invitations); err != nil {
+    return nil, mongoError(err)
+  }
+  return invitations, nil
+}
+
+func (s *CompanyRepository) DeleteInvitation(companyId string, id string) error {
+  result, err := s.invitations().DeleteOne(context.TODO(), bson.D{{"_id", id}, {"company_id", companyId}})
+  if err != nil {
+    return mongoError(err)
+  }
+  if result.DeletedCount == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+func (s *CompanyRepository) DeleteInvitations(companyId string) error {
+  _, err := s.invitations().DeleteMany(context.TODO(), bson.D{{"company_id", companyId}})
+  return mongoError(err)
+}
+
+// auditEvents is the collection of audit events
+func (s *CompanyRepository) auditEvents() *mongo.Collection {
+  return s.cs.Database().Collection("audit_events")
+}
+
+func (s *CompanyRepository) CreateAuditEvent(event *AuditEvent) error {
+  _, err := s.auditEvents().InsertOne(context.TODO(), event)
+  return mongoError(err)
+}
+
+func (s *CompanyRepository) ListAuditEvents(companyId string) ([]*AuditEvent, error) {
+  cursor, err := s.auditEvents().Find(context.TODO(),
+    bson.D{{"company_id", companyId}},
+    options.Find().SetSort(bson.D{{"created_at", -1}, {"_id", -1}}),
+  )
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  events := []*AuditEvent{}
+  if err := cursor.All(context.TODO(), &events); err != nil {
+    return nil, mongoError(err)
+  }
+  return events, nil
+}
+
+// oidcStates is the collection of OpenID Connect logins in progress
+func (s *CompanyRepository) oidcStates() *mongo.Collection {
+  return s.cs.Database().Collection("oidc_states")
+}
+
+func (s *CompanyRepository) CreateOidcState(state *OidcState) error {
+  _, err := s.oidcStates().InsertOne(context.TODO(), state)
+  return mongoError(err)
+}
+
+func (s *CompanyRepository) ConsumeOidcState(hash string) (*OidcState, error) {
+  var state OidcState
+  err := s.oidcStates().FindOneAndDelete(context.TODO(), bson.D{{"_id", hash}}).Decode(&state)
+  if err == mongo.ErrNoDocuments {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  return &state, nil
+}
+
+// oidcIdentities is the collection of identities linked to members
+func (s *CompanyRepository) oidcIdentities() *mongo.Collection {
+  return s.cs.Database().Collection("oidc_identities")
+}
+
+func (s *CompanyRepository) SaveOidcIdentity(identity *OidcIdentity) error {
+  _, err := s.oidcIdentities().ReplaceOne(context.TODO(),
+    bson.D{{"issuer", identity.Issuer}, {"subject", identity.Subject}},
+    identity,
+    options.Replace().SetUpsert(true),
+  )
+  return mongoError(err)
+}
+
+func (s *CompanyRepository) GetOidcIdentity(issuer string, subject string) (*OidcIdentity, error) {
+  var identity OidcIdentity
+  err := s.oidcIdentities().FindOne(context.TODO(),
+    bson.D{{"issuer", issuer}, {"subject", subject}},
+  ).Decode(&identity)
+  if err == mongo.ErrNoDocuments {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, mongoError(err)
+  }
+
+  return &identity, nil
+}
+
+// emailCollation compares emails case-insensitively, it is the collation of the unique email index
+var emailCollation = &options.Collation{Locale: "en", Strength: 2}
+
+func (s *CompanyRepository) EnsureUniqueIndexes() ([]*Duplicate, error) {
+  ctx := context.TODO()
+
+  // companies from before name_key get it now, so that they are covered by the name index
+  cursor, err := s.cs.Find(ctx, bson.D{{"name_key", bson.D{{"$exists", false}}}},
+    options.Find().SetProjection(bson.D{{"name", 1}}))
+  if err != nil {
+    return nil, mongoError(err)
+  }
+  var missing []*Company
+  if err := cursor.All(ctx, &missing); err != nil {
+    return nil, mongoError(err)
+  }
+  for _, company := range missing {
+    _, err := s.cs.UpdateOne(ctx, bson.D{{"_id", company.Id}},
+      bson.D{{"$set", bson.D{{"name_key", normalizeName(company.Name)}}}})
+    if err != nil {
+      return nil, mongoError(err)
+    }
+  }
+
+  duplicates := []*Duplicate{}
+  indexes := []struct {
+    field string
+    // path is the indexed field, key groups the companies the same way the index compares them
+    path  string
+    key   interface{}
+    model mongo.IndexModel
+  }{
+    {"email", "email", bson.D{{"$toLower", "$email"}}, mongo.IndexModel{
+      Keys: bson.D{{"email", 1}},
+      Options: options.Index().SetName(companyEmailIndex).SetUnique(true).SetCollation(emailCollation).
+        SetPartialFilterExpression(bson.D{{"email", bson.D{{"$gt", ""}}}}),
+    }},
+    {"name", "name_key", "$name_key", mongo.IndexModel{
+      Keys: bson.D{{"name_key", 1}},
+      Options: options.Index().SetName(companyNameIndex).SetUnique(true).
+        SetPartialFilterExpression(bson.D{{"name_key", bson.D{{"$gt", ""}}}}),
+    }},
+  }
+  for _, index := range indexes {
+    found, err := s.findDuplicates(ctx, index.field, index.path, index.key)
+    if err != nil {
+      return nil, err
+    }
+    if len(found) > 0 {
+      duplicates = append(duplicates, found...)
+      continue
+    }
+    if _, err := s.cs.Indexes().CreateOne(ctx, index.model); err != nil {
+      return nil, companyWriteError(err)
+    }
+  }
+
+  // the indexes of the other collections are created in full, records that
+  // violate a unique index have to be resolved by hand before it is created
+  others := []struct {
+    collection *mongo.Collection
+    model      mongo.IndexModel
+  }{
+    {s.members(), mongo.IndexModel{
+      Keys:    bson.D{{"email", 1}},
+      Options: options.Index().SetName("members_email_key").SetUnique(true).SetCollation(emailCollation),
+    }},
+    // keys are looked up by hash on every request they authenticate
+    {s.apiKeys(), mongo.IndexModel{
+      Keys:    bson.D{{"hash", 1}},
+      Options: options.Index().SetName("api_keys_hash_key").SetUnique(true),
+    }},
+    // CreateMembership relies on this index to keep parallel upserts from adding a member twice
+    {s.memberships(), mongo.IndexModel{
+      Keys:    bson.D{{"company_id", 1}, {"member_id", 1}},
+      Options: options.Index().SetName("memberships_company_id_member_id_key").SetUnique(true),
+    }},
+    // tokens and login states are stored under their hash as _id, which is unique already.
+    // Reusing a refresh token revokes its family, and expired records are deleted by mongo.
+    {s.refreshTokens(), mongo.IndexModel{
+      Keys:    bson.D{{"family", 1}},
+      Options: options.Index().SetName("refresh_tokens_family_idx"),
+    }},
+    {s.refreshTokens(), mongo.IndexModel{
+      Keys:    bson.D{{"expires_at", 1}},
+      Options: options.Index().SetName("refresh_tokens_expires_at_idx").SetExpireAfterSeconds(0),
+    }},
+    {s.actionTokens(), mongo.IndexModel{
+      Keys:    bson.D{{"expires_at", 1}},
+      Options: options.Index().SetName("action_tokens_expires_at_idx").SetExpireAfterSeconds(0),
+    }},
+    {s.oidcStates(), mongo.IndexModel{
+      Keys:    bson.D{{"expires_at", 1}},
+      Options: options.Index().SetName("oidc_states_expires_at_idx").SetExpireAfterSeconds(0),
+    }},
+  }
+  for _, index := range others {
+    if _, err := index.collection.Indexes().CreateOne(ctx, index.model); err != nil {
+      return nil, errs.Wrap(errs.Internal, fmt.Sprintf("failed to create index %s on %s",
+        *index.model.Options.Name, index.collection.Name()), err)
+    }
+  }
+  return duplicates, nil
+}
+
+// findDuplicates returns the values of key several companies with a non-empty path share, reported for field
+func (s *CompanyRepository) findDuplicates(ctx context.Context, field string, path string, key interface{}) ([]*Duplicate, error) {
+  cursor, err := s.cs.Aggregate(ctx, mongo.Pipeline{
+    {{"$match", bson.D{{path, bson.D{{"$gt", ""}}}}}},
+    {{"$group", bson.D{{"_id", key}, {"ids", bson.D{{"$push", "$_id"}}}, {"count", bson.D{{"$sum", 1}}}}}},
+    {{"$match", bson.D{{"count", bson.D{{"$gt", 1}}}}}},
+    {{"$sort", bson.D{{"_id", 1}}}},
+  })
+  if err != nil {
+    return nil, mongoError(err)
+  }
+  var groups []struct {
+    Value string               `bson:"_id"`
+    Ids   []primitive.ObjectID `bson:"ids"`
+  }
+  if err := cursor.All(ctx, &groups); err != nil {
+    return nil, mongoError(err)
+  }
+
+  duplicates := []*Duplicate{}
+  for _, group := range groups {
+    duplicate := &Duplicate{Field: field, Value: group.Value}
+    for _, id := range group.Ids {
+      duplicate.CompanyIds = append(duplicate.CompanyIds, id.Hex())
+    }
+    duplicates = append(duplicates, duplicate)
+  }
+  return duplicates, nil
+}
+
+// mongoError maps errors of the mongo driver onto the domain errors of package errs,
+// domain errors like ErrNotFound are returned as they are
+func mongoError(err error) error {
+  if err == nil {
+    return nil
+  }
+  if _, ok := errs.As(err); ok {
+    return err
+  }
+  switch {
+  case err == mongo.ErrNoDocuments:
+    return ErrNotFound
+  case mongo.IsDuplicateKeyError(err):
+    return ErrAlreadyExists
+  case mongo.IsTimeout(err), mongo.IsNetworkError(err), err == context.DeadlineExceeded:
+    return errs.Wrap(errs.Unavailable, "the database is unavailable", err)
+  }
+  return errs.Wrap(errs.Internal, "database error", err)
+}
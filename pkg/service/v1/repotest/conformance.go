@@ -0,0 +1,1204 @@
+// Package repotest holds the conformance suite every company repository must pass.
+//
+// A backend runs it from its own tests with a factory returning an empty repository:
+//
+//   func TestMemoryRepository(t *testing.T) {
+//     repotest.RunConformance(t, func(t *testing.T) service.Repository {
+//       return service.NewMemoryRepository()
+//     })
+//   }
+package repotest
+
+import (
+  "fmt"
+  "testing"
+  "time"
+
+  "go.mongodb.org/mongo-driver/bson/primitive"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+  service "github.com/ckbball/os-company/pkg/service/v1"
+)
+
+// Factory returns an empty repository, it is called once per test
+type Factory func(t *testing.T) service.Repository
+
+// RunConformance runs the conformance suite against the repositories returned by newRepository
+func RunConformance(t *testing.T, newRepository Factory) {
+  tests := []struct {
+    name string
+    test func(*testing.T, service.Repository)
+  }{
+    {"CreateAndGet", testCreateAndGet},
+    {"NotFound", testNotFound},
+    {"Duplicates", testDuplicates},
+    {"Update", testUpdate},
+    {"PartialUpdate", testPartialUpdate},
+    {"Versions", testVersions},
+    {"Delete", testDelete},
+    {"UpdateActive", testUpdateActive},
+    {"FilterCompanys", testFilterCompanys},
+    {"FilterCompanysOrders", testFilterCompanysOrders},
+    {"FilterCompanysConcurrentInsert", testFilterCompanysConcurrentInsert},
+    {"RefreshTokens", testRefreshTokens},
+    {"UpdatePassword", testUpdatePassword},
+    {"ActionTokens", testActionTokens},
+    {"EmailVerification", testEmailVerification},
+    {"Totp", testTotp},
+    {"ApiKeys", testApiKeys},
+    {"Members", testMembers},
+    {"Memberships", testMemberships},
+    {"Invitations", testInvitations},
+    {"AuditEvents", testAuditEvents},
+    {"Oidc", testOidc},
+  }
+
+  for _, tt := range tests {
+    tt := tt
+    t.Run(tt.name, func(t *testing.T) {
+      tt.test(t, newRepository(t))
+    })
+  }
+}
+
+// create stores a company and fails the test on error
+func create(t *testing.T, repo service.Repository, company *v1.Company) string {
+  t.Helper()
+  id, err := repo.Create(company)
+  if err != nil {
+    t.Fatalf("Create(%q) failed: %v", company.Name, err)
+  }
+  if id == "" {
+    t.Fatalf("Create(%q) returned an empty id", company.Name)
+  }
+  return id
+}
+
+func sample(n int) *v1.Company {
+  return &v1.Company{
+    Email:    fmt.Sprintf("company%d@example.com", n),
+    Password: "hash",
+    Name:     fmt.Sprintf("Company %d", n),
+    Mission:  "hiring",
+    Location: "Berlin",
+  }
+}
+
+func testCreateAndGet(t *testing.T, repo service.Repository) {
+  want := sample(1)
+  id := create(t, repo, want)
+
+  for name, get := range map[string]func() (*service.Company, error){
+    "GetById":    func() (*service.Company, error) { return repo.GetById(id) },
+    "GetByEmail": func() (*service.Company, error) { return repo.GetByEmail(want.Email) },
+    "GetByName":  func() (*service.Company, error) { return repo.GetByName(want.Name) },
+  } {
+    got, err := get()
+    if err != nil {
+      t.Fatalf("%s failed: %v", name, err)
+    }
+    if got.Id.Hex() != id || got.Email != want.Email || got.Password != want.Password ||
+      got.Name != want.Name || got.Mission != want.Mission || got.Location != want.Location {
+      t.Errorf("%s returned %+v, want %+v with id %s", name, got, want, id)
+    }
+  }
+}
+
+func testNotFound(t *testing.T, repo service.Repository) {
+  create(t, repo, sample(1))
+
+  lookups := map[string]func() (*service.Company, error){
+    "GetById unknown":   func() (*service.Company, error) { return repo.GetById("5e0000000000000000000000") },
+    "GetById malformed": func() (*service.Company, error) { return repo.GetById("not-an-id") },
+    "GetById empty":     func() (*service.Company, error) { return repo.GetById("") },
+    "GetByEmail":        func() (*service.Company, error) { return repo.GetByEmail("missing@example.com") },
+    "GetByEmail empty":  func() (*service.Company, error) { return repo.GetByEmail("") },
+    "GetByName":         func() (*service.Company, error) { return repo.GetByName("Missing") },
+    "GetByName empty":   func() (*service.Company, error) { return repo.GetByName("") },
+  }
+  for name, get := range lookups {
+    if _, err := get(); err != service.ErrNotFound {
+      t.Errorf("%s returned %v, want ErrNotFound", name, err)
+    }
+  }
+
+  if _, err := repo.UpdateActive("5e0000000000000000000000"); err != service.ErrNotFound {
+    t.Errorf("UpdateActive of unknown id returned %v, want ErrNotFound", err)
+  }
+}
+
+func testDuplicates(t *testing.T, repo service.Repository) {
+  create(t, repo, sample(1))
+
+  sameEmail := sample(2)
+  sameEmail.Email = "COMPANY1@Example.com"
+  if _, err := repo.Create(sameEmail); err != service.ErrEmailTaken {
+    t.Errorf("Create with a taken email in other case returned %v, want ErrEmailTaken", err)
+  }
+
+  sameName := sample(2)
+  sameName.Name = "  company   1 "
+  if _, err := repo.Create(sameName); err != service.ErrNameTaken {
+    t.Errorf("Create with a taken name in other case and spacing returned %v, want ErrNameTaken", err)
+  }
+
+  id := create(t, repo, sample(2))
+  if _, _, _, err := repo.Update(sameEmail, id, service.UpdatableCompanyFields, 0); err != service.ErrEmailTaken {
+    t.Errorf("Update to a taken email returned %v, want ErrEmailTaken", err)
+  }
+  if _, _, _, err := repo.Update(sameName, id, service.UpdatableCompanyFields, 0); err != service.ErrNameTaken {
+    t.Errorf("Update to a taken name returned %v, want ErrNameTaken", err)
+  }
+
+  // a company does not conflict with itself
+  if _, _, _, err := repo.Update(sample(2), id, service.UpdatableCompanyFields, 0); err != nil {
+    t.Errorf("Update with its own email and name failed: %v", err)
+  }
+
+  if got, err := repo.GetByEmail("Company1@EXAMPLE.com"); err != nil || got.Email != sample(1).Email {
+    t.Errorf("GetByEmail in other case returned (%v, %v), want company 1", got, err)
+  }
+  if got, err := repo.GetByName("company  1"); err != nil || got.Name != sample(1).Name {
+    t.Errorf("GetByName in other case and spacing returned (%v, %v), want company 1", got, err)
+  }
+
+  duplicates, err := repo.EnsureUniqueIndexes()
+  if err != nil {
+    t.Fatalf("EnsureUniqueIndexes failed: %v", err)
+  }
+  if len(duplicates) != 0 {
+    t.Errorf("EnsureUniqueIndexes reported %v, want no duplicates", duplicates)
+  }
+  // a second run finds the indexes in place
+  if _, err := repo.EnsureUniqueIndexes(); err != nil {
+    t.Errorf("second EnsureUniqueIndexes failed: %v", err)
+  }
+  // company 2 holds the name of sameEmail by now
+  sameEmail.Name = "company 3"
+  if _, err := repo.Create(sameEmail); err != service.ErrEmailTaken {
+    t.Errorf("Create with a taken email after EnsureUniqueIndexes returned %v, want ErrEmailTaken", err)
+  }
+}
+
+func testUpdate(t *testing.T, repo service.Repository) {
+  id := create(t, repo, sample(1))
+
+  changed := sample(1)
+  changed.Mission = "changed"
+  matched, modified, _, err := repo.Update(changed, id, service.UpdatableCompanyFields, 0)
+  if err != nil || matched != 1 || modified != 1 {
+    t.Fatalf("Update returned (%d, %d, %v), want (1, 1, nil)", matched, modified, err)
+  }
+
+  got, err := repo.GetById(id)
+  if err != nil {
+    t.Fatalf("GetById failed: %v", err)
+  }
+  if got.Mission != "changed" {
+    t.Errorf("mission is %q after update, want %q", got.Mission, "changed")
+  }
+
+  matched, modified, _, err = repo.Update(changed, id, service.UpdatableCompanyFields, 0)
+  if err != nil || matched != 1 || modified != 0 {
+    t.Errorf("Update without changes returned (%d, %d, %v), want (1, 0, nil)", matched, modified, err)
+  }
+
+  matched, modified, _, err = repo.Update(sample(2), "5e0000000000000000000000", service.UpdatableCompanyFields, 0)
+  if err != nil || matched != 0 || modified != 0 {
+    t.Errorf("Update of unknown id returned (%d, %d, %v), want (0, 0, nil)", matched, modified, err)
+  }
+
+  if _, _, _, err := repo.Update(changed, id, []string{"last_active"}, 0); err == nil {
+    t.Errorf("Update of last_active succeeded, want an error")
+  }
+  if _, _, _, err := repo.Update(changed, id, nil, 0); err == nil {
+    t.Errorf("Update without fields succeeded, want an error")
+  }
+}
+
+func testPartialUpdate(t *testing.T, repo service.Repository) {
+  id := create(t, repo, sample(1))
+  create(t, repo, sample(2))
+
+  // only the listed fields are set, the empty email and name of the update are not
+  partial := &v1.Company{Mission: "partial", Email: sample(2).Email}
+  matched, modified, _, err := repo.Update(partial, id, []string{"mission", "location"}, 0)
+  if err != nil || matched != 1 || modified != 1 {
+    t.Fatalf("partial Update returned (%d, %d, %v), want (1, 1, nil)", matched, modified, err)
+  }
+
+  got, err := repo.GetById(id)
+  if err != nil {
+    t.Fatalf("GetById failed: %v", err)
+  }
+  want := sample(1)
+  if got.Email != want.Email || got.Name != want.Name || got.Password != want.Password {
+    t.Errorf("partial Update changed unlisted fields: %+v", got)
+  }
+  if got.Mission != "partial" || got.Location != "" {
+    t.Errorf("partial Update set mission %q and location %q, want %q and %q", got.Mission, got.Location, "partial", "")
+  }
+
+  renamed := &v1.Company{Name: "Renamed"}
+  if _, _, _, err := repo.Update(renamed, id, []string{"name"}, 0); err != nil {
+    t.Fatalf("Update of name failed: %v", err)
+  }
+  if got, err := repo.GetByName("renamed"); err != nil || got.Id.Hex() != id || got.Email != want.Email {
+    t.Errorf("GetByName after renaming returned (%+v, %v), want company 1", got, err)
+  }
+  if _, _, _, err := repo.Update(&v1.Company{Name: sample(2).Name}, id, []string{"name"}, 0); err != service.ErrNameTaken {
+    t.Errorf("Update to a taken name returned %v, want ErrNameTaken", err)
+  }
+}
+
+func testVersions(t *testing.T, repo service.Repository) {
+  id := create(t, repo, sample(1))
+
+  version := func() int64 {
+    got, err := repo.GetById(id)
+    if err != nil {
+      t.Fatalf("GetById failed: %v", err)
+    }
+    return got.Version
+  }
+  if v := version(); v != 1 {
+    t.Fatalf("version of a new company is %d, want 1", v)
+  }
+
+  changed := sample(1)
+  changed.Mission = "changed"
+  if _, modified, v, err := repo.Update(changed, id, []string{"mission"}, 1); err != nil || modified != 1 || v != 2 {
+    t.Fatalf("Update of the expected version returned (%d, %d, %v), want (1, 2, nil)", modified, v, err)
+  }
+  if v := version(); v != 2 {
+    t.Errorf("version after an update is %d, want 2", v)
+  }
+
+  // updates that change nothing keep the version
+  if _, modified, v, err := repo.Update(changed, id, []string{"mission"}, 2); err != nil || modified != 0 || v != 2 {
+    t.Errorf("Update without changes returned (%d, %d, %v), want (0, 2, nil)", modified, v, err)
+  }
+  if v := version(); v != 2 {
+    t.Errorf("version after an update without changes is %d, want 2", v)
+  }
+
+  changed.Mission = "stale"
+  if _, _, _, err := repo.Update(changed, id, []string{"mission"}, 1); err != service.ErrVersionMismatch {
+    t.Errorf("Update of an old version returned %v, want ErrVersionMismatch", err)
+  }
+  if got, err := repo.GetById(id); err != nil || got.Mission != "changed" {
+    t.Errorf("Update of an old version changed the company: %+v, %v", got, err)
+  }
+
+  // 0 updates any version
+  if _, _, v, err := repo.Update(changed, id, []string{"mission"}, 0); err != nil || v != 3 {
+    t.Errorf("Update of any version returned (%d, %v), want (3, nil)", v, err)
+  }
+  if v := version(); v != 3 {
+    t.Errorf("version after an update of any version is %d, want 3", v)
+  }
+
+  if _, _, v, err := repo.Update(changed, "5e0000000000000000000000", []string{"mission"}, 3); err != nil || v != 0 {
+    t.Errorf("Update of unknown id with a version returned (%d, %v), want (0, nil)", v, err)
+  }
+
+  if _, err := repo.Delete(id, 2); err != service.ErrVersionMismatch {
+    t.Errorf("Delete of an old version returned %v, want ErrVersionMismatch", err)
+  }
+  if count, err := repo.Delete(id, 3); err != nil || count != 1 {
+    t.Errorf("Delete of the expected version returned (%d, %v), want (1, nil)", count, err)
+  }
+  if count, err := repo.Delete(id, 3); err != nil || count != 0 {
+    t.Errorf("Delete of a deleted company returned (%d, %v), want (0, nil)", count, err)
+  }
+}
+
+func testDelete(t *testing.T, repo service.Repository) {
+  id := create(t, repo, sample(1))
+  other := create(t, repo, sample(2))
+
+  if count, err := repo.Delete(id, 0); err != nil || count != 1 {
+    t.Fatalf("Delete returned (%d, %v), want (1, nil)", count, err)
+  }
+  if _, err := repo.GetById(id); err != service.ErrNotFound {
+    t.Errorf("GetById after Delete returned %v, want ErrNotFound", err)
+  }
+  if _, err := repo.GetById(other); err != nil {
+    t.Errorf("Delete removed another company: %v", err)
+  }
+
+  if count, err := repo.Delete(id, 0); err != nil || count != 0 {
+    t.Errorf("second Delete returned (%d, %v), want (0, nil)", count, err)
+  }
+}
+
+func testUpdateActive(t *testing.T, repo service.Repository) {
+  id := create(t, repo, sample(1))
+
+  before := time.Now().Unix()
+  secs, err := repo.UpdateActive(id)
+  if err != nil {
+    t.Fatalf("UpdateActive failed: %v", err)
+  }
+  if secs < before || secs > time.Now().Unix() {
+    t.Errorf("UpdateActive returned %d, want the current time", secs)
+  }
+
+  got, err := repo.GetById(id)
+  if err != nil {
+    t.Fatalf("GetById failed: %v", err)
+  }
+  if int64(got.LastActive) != secs {
+    t.Errorf("last active is %d, want %d", got.LastActive, secs)
+  }
+  if got.Email != sample(1).Email || got.Name != sample(1).Name {
+    t.Errorf("UpdateActive changed other fields: %+v", got)
+  }
+}
+
+func testFilterCompanys(t *testing.T, repo service.Repository) {
+  for i, company := range []*v1.Company{
+    {Name: "Acme", Email: "a@example.com", Location: "Berlin", LastActive: 100},
+    {Name: "Acme Labs", Email: "b@example.com", Location: "Paris", LastActive: 200},
+    {Name: "Beta", Email: "c@example.com", Location: "Berlin", LastActive: 300},
+    {Name: "acme lower", Email: "d@example.com", Location: "Berlin", LastActive: 400},
+  } {
+    if _, err := repo.Create(company); err != nil {
+      t.Fatalf("Create %d failed: %v", i, err)
+    }
+  }
+
+  tests := []struct {
+    name   string
+    filter service.CompanyFilter
+    want   []string
+  }{
+    {"all", service.CompanyFilter{}, []string{"Acme", "Acme Labs", "Beta", "acme lower"}},
+    {"name prefix", service.CompanyFilter{NamePrefix: "Acme"}, []string{"Acme", "Acme Labs"}},
+    {"location", service.CompanyFilter{Location: "Berlin"}, []string{"Acme", "Beta", "acme lower"}},
+    {"active range", service.CompanyFilter{ActiveAfter: 200, ActiveBefore: 400}, []string{"Acme Labs", "Beta"}},
+    {"combined", service.CompanyFilter{NamePrefix: "A", Location: "Berlin"}, []string{"Acme"}},
+    {"limit", service.CompanyFilter{Limit: 2}, []string{"Acme", "Acme Labs"}},
+  }
+
+  for _, tt := range tests {
+    filter := tt.filter
+    if filter.Limit == 0 {
+      filter.Limit = 10
+    }
+    companys, err := repo.FilterCompanys(&filter)
+    if err != nil {
+      t.Fatalf("%s: FilterCompanys failed: %v", tt.name, err)
+    }
+    if got := names(companys); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+      t.Errorf("%s: FilterCompanys returned %q, want %q", tt.name, got, tt.want)
+    }
+  }
+}
+
+func testFilterCompanysOrders(t *testing.T, repo service.Repository) {
+  // duplicate sort keys make sure ties are broken by id
+  for i := 0; i < 7; i++ {
+    create(t, repo, &v1.Company{
+      Name:       fmt.Sprintf("Company %d", i),
+      Email:      fmt.Sprintf("c%d@example.com", i),
+      LastActive: int32(100 * (i % 3)),
+    })
+  }
+
+  for order := range v1.CompanyOrder_name {
+    order := v1.CompanyOrder(order)
+    all := pageThrough(t, repo, service.CompanyFilter{Order: order}, 100)
+    if len(all) != 7 {
+      t.Fatalf("%v: got %d companies, want 7", order, len(all))
+    }
+    for i := 1; i < len(all); i++ {
+      if !inOrder(order, all[i-1], all[i]) {
+        t.Errorf("%v: %q sorted before %q", order, all[i-1].Name, all[i].Name)
+      }
+    }
+
+    paged := pageThrough(t, repo, service.CompanyFilter{Order: order}, 2)
+    if fmt.Sprint(names(paged)) != fmt.Sprint(names(all)) {
+      t.Errorf("%v: pages of 2 returned %q, want %q", order, names(paged), names(all))
+    }
+  }
+}
+
+func testFilterCompanysConcurrentInsert(t *testing.T, repo service.Repository) {
+  for _, name := range []string{"B", "D", "F"} {
+    create(t, repo, &v1.Company{Name: name, Email: name + "@example.com"})
+  }
+
+  filter := service.CompanyFilter{Limit: 2}
+  first, err := repo.FilterCompanys(&filter)
+  if err != nil {
+    t.Fatalf("FilterCompanys failed: %v", err)
+  }
+
+  // rows added before and after the cursor while scrolling
+  create(t, repo, &v1.Company{Name: "A", Email: "A@example.com"})
+  create(t, repo, &v1.Company{Name: "E", Email: "E@example.com"})
+
+  last := first[len(first)-1]
+  filter.After = &service.Cursor{Id: last.Id.Hex(), Name: last.Name}
+  second, err := repo.FilterCompanys(&filter)
+  if err != nil {
+    t.Fatalf("FilterCompanys failed: %v", err)
+  }
+
+  got := append(names(first), names(second)...)
+  if want := []string{"B", "D", "E", "F"}; fmt.Sprint(got) != fmt.Sprint(want) {
+    t.Errorf("pages returned %q, want %q", got, want)
+  }
+}
+
+// pageThrough collects every company matching filter, pageSize at a time
+func pageThrough(t *testing.T, repo service.Repository, filter service.CompanyFilter, pageSize int) []*service.Company {
+  t.Helper()
+  filter.Limit = pageSize
+  all := []*service.Company{}
+  for {
+    page, err := repo.FilterCompanys(&filter)
+    if err != nil {
+      t.Fatalf("FilterCompanys failed: %v", err)
+    }
+    all = append(all, page...)
+    if len(page) < pageSize {
+      return all
+    }
+    if len(all) > 1000 {
+      t.Fatalf("pagination does not terminate")
+    }
+    last := page[len(page)-1]
+    filter.After = &service.Cursor{Id: last.Id.Hex(), Name: last.Name, LastActive: int64(last.LastActive)}
+  }
+}
+
+// inOrder reports if a may be listed before b in order
+func inOrder(order v1.CompanyOrder, a, b *service.Company) bool {
+  switch order {
+  case v1.CompanyOrder_NAME_ASC:
+    return a.Name < b.Name || a.Name == b.Name && a.Id.Hex() < b.Id.Hex()
+  case v1.CompanyOrder_NAME_DESC:
+    return a.Name > b.Name || a.Name == b.Name && a.Id.Hex() > b.Id.Hex()
+  case v1.CompanyOrder_LAST_ACTIVE_ASC:
+    return a.LastActive < b.LastActive || a.LastActive == b.LastActive && a.Id.Hex() < b.Id.Hex()
+  default:
+    return a.LastActive > b.LastActive || a.LastActive == b.LastActive && a.Id.Hex() > b.Id.Hex()
+  }
+}
+
+func names(companys []*service.Company) []string {
+  out := []string{}
+  for _, company := range companys {
+    out = append(out, company.Name)
+  }
+  return out
+}
+
+func testRefreshTokens(t *testing.T, repo service.Repository) {
+  now := time.Now().Truncate(time.Second)
+  for _, hash := range []string{"first", "second"} {
+    err := repo.CreateRefreshToken(&service.RefreshToken{
+      Hash:      hash,
+      Family:    "family",
+      CompanyId: "5e0000000000000000000000",
+      ExpiresAt: now.Add(time.Hour),
+      CreatedAt: now,
+    })
+    if err != nil {
+      t.Fatalf("CreateRefreshToken failed: %v", err)
+    }
+  }
+
+  token, err := repo.GetRefreshToken("first")
+  if err != nil {
+    t.Fatalf("GetRefreshToken failed: %v", err)
+  }
+  if token.Hash != "first" || token.Used || token.Family != "family" || token.CompanyId != "5e0000000000000000000000" {
+    t.Errorf("GetRefreshToken returned %+v", token)
+  }
+
+  // getting a token does not use it
+  token, err = repo.UseRefreshToken("first")
+  if err != nil {
+    t.Fatalf("UseRefreshToken failed: %v", err)
+  }
+  if token.Used || token.Revoked || token.Family != "family" || !token.ExpiresAt.Equal(now.Add(time.Hour)) {
+    t.Errorf("first use returned %+v, want an unused token", token)
+  }
+
+  // the second use sees the token as used
+  token, err = repo.UseRefreshToken("first")
+  if err != nil || !token.Used {
+    t.Errorf("second use returned (%+v, %v), want a used token", token, err)
+  }
+
+  if err := repo.RevokeRefreshFamily("family"); err != nil {
+    t.Fatalf("RevokeRefreshFamily failed: %v", err)
+  }
+  token, err = repo.UseRefreshToken("second")
+  if err != nil || !token.Revoked {
+    t.Errorf("use after revocation returned (%+v, %v), want a revoked token", token, err)
+  }
+
+  err = repo.CreateRefreshToken(&service.RefreshToken{
+    Hash:      "other",
+    Family:    "other family",
+    CompanyId: "5e0000000000000000000001",
+    ExpiresAt: now.Add(time.Hour),
+    CreatedAt: now,
+  })
+  if err != nil {
+    t.Fatalf("CreateRefreshToken failed: %v", err)
+  }
+  if err := repo.RevokeCompanyRefreshTokens("5e0000000000000000000001"); err != nil {
+    t.Fatalf("RevokeCompanyRefreshTokens failed: %v", err)
+  }
+  token, err = repo.UseRefreshToken("other")
+  if err != nil || !token.Revoked {
+    t.Errorf("use after company revocation returned (%+v, %v), want a revoked token", token, err)
+  }
+
+  for hash, memberId := range map[string]string{
+    "member":       "5e0000000000000000000010",
+    "other member": "5e0000000000000000000011",
+  } {
+    err = repo.CreateRefreshToken(&service.RefreshToken{
+      Hash:      hash,
+      Family:    hash,
+      CompanyId: "5e0000000000000000000001",
+      MemberId:  memberId,
+      ExpiresAt: now.Add(time.Hour),
+      CreatedAt: now,
+    })
+    if err != nil {
+      t.Fatalf("CreateRefreshToken failed: %v", err)
+    }
+  }
+  if err := repo.RevokeMemberRefreshTokens("5e0000000000000000000010"); err != nil {
+    t.Fatalf("RevokeMemberRefreshTokens failed: %v", err)
+  }
+  token, err = repo.UseRefreshToken("member")
+  if err != nil || !token.Revoked || token.MemberId != "5e0000000000000000000010" {
+    t.Errorf("use after member revocation returned (%+v, %v), want a revoked token of the member", token, err)
+  }
+  token, err = repo.UseRefreshToken("other member")
+  if err != nil || token.Revoked {
+    t.Errorf("RevokeMemberRefreshTokens revoked the token of another member: (%+v, %v)", token, err)
+  }
+
+  if _, err := repo.GetRefreshToken("unknown"); err != service.ErrNotFound {
+    t.Errorf("GetRefreshToken of unknown hash returned %v, want ErrNotFound", err)
+  }
+  if _, err := repo.UseRefreshToken("unknown"); err != service.ErrNotFound {
+    t.Errorf("UseRefreshToken of unknown hash returned %v, want ErrNotFound", err)
+  }
+}
+
+func testUpdatePassword(t *testing.T, repo service.Repository) {
+  id := create(t, repo, sample(1))
+
+  if err := repo.UpdatePassword(id, "new hash"); err != nil {
+    t.Fatalf("UpdatePassword failed: %v", err)
+  }
+  got, err := repo.GetById(id)
+  if err != nil {
+    t.Fatalf("GetById failed: %v", err)
+  }
+  if got.Password != "new hash" || got.Email != sample(1).Email || got.Name != sample(1).Name {
+    t.Errorf("after UpdatePassword got %+v, want only the password changed", got)
+  }
+
+  if err := repo.UpdatePassword("5e0000000000000000000000", "hash"); err != service.ErrNotFound {
+    t.Errorf("UpdatePassword of unknown id returned %v, want ErrNotFound", err)
+  }
+}
+
+func testActionTokens(t *testing.T, repo service.Repository) {
+  now := time.Now().Truncate(time.Second)
+  for _, token := range []*service.ActionToken{
+    {Hash: "first", Purpose: "reset", CompanyId: "5e0000000000000000000000", Email: "a@example.com"},
+    {Hash: "second", Purpose: "reset", CompanyId: "5e0000000000000000000000"},
+    {Hash: "other purpose", Purpose: "verify", CompanyId: "5e0000000000000000000000"},
+    {Hash: "other company", Purpose: "reset", CompanyId: "5e0000000000000000000001"},
+    {Hash: "member", Purpose: "reset", MemberId: "5e0000000000000000000010", Email: "m@example.com"},
+    {Hash: "other member", Purpose: "reset", MemberId: "5e0000000000000000000011"},
+  } {
+    token.ExpiresAt = now.Add(time.Hour)
+    token.CreatedAt = now
+    if err := repo.CreateActionToken(token); err != nil {
+      t.Fatalf("CreateActionToken(%q) failed: %v", token.Hash, err)
+    }
+  }
+
+  if _, err := repo.ConsumeActionToken("verify", "first"); err != service.ErrNotFound {
+    t.Errorf("ConsumeActionToken with the wrong purpose returned %v, want ErrNotFound", err)
+  }
+  if _, err := repo.GetActionToken("verify", "first"); err != service.ErrNotFound {
+    t.Errorf("GetActionToken with the wrong purpose returned %v, want ErrNotFound", err)
+  }
+  got, err := repo.GetActionToken("reset", "first")
+  if err != nil || got.CompanyId != "5e0000000000000000000000" || got.Email != "a@example.com" {
+    t.Errorf("GetActionToken returned (%+v, %v)", got, err)
+  }
+
+  token, err := repo.ConsumeActionToken("reset", "first")
+  if err != nil {
+    t.Fatalf("ConsumeActionToken failed: %v", err)
+  }
+  if token.CompanyId != "5e0000000000000000000000" || token.Email != "a@example.com" ||
+    !token.ExpiresAt.Equal(now.Add(time.Hour)) {
+    t.Errorf("ConsumeActionToken returned %+v", token)
+  }
+  if _, err := repo.ConsumeActionToken("reset", "first"); err != service.ErrNotFound {
+    t.Errorf("second ConsumeActionToken returned %v, want ErrNotFound", err)
+  }
+
+  if err := repo.DeleteActionTokens("reset", "5e0000000000000000000000"); err != nil {
+    t.Fatalf("DeleteActionTokens failed: %v", err)
+  }
+  if _, err := repo.ConsumeActionToken("reset", "second"); err != service.ErrNotFound {
+    t.Errorf("ConsumeActionToken after DeleteActionTokens returned %v, want ErrNotFound", err)
+  }
+  for hash, purpose := range map[string]string{"other purpose": "verify", "other company": "reset"} {
+    if _, err := repo.ConsumeActionToken(purpose, hash); err != nil {
+      t.Errorf("DeleteActionTokens removed %q: %v", hash, err)
+    }
+  }
+
+  if err := repo.DeleteMemberActionTokens("reset", "5e0000000000000000000011"); err != nil {
+    t.Fatalf("DeleteMemberActionTokens failed: %v", err)
+  }
+  if _, err := repo.ConsumeActionToken("reset", "other member"); err != service.ErrNotFound {
+    t.Errorf("ConsumeActionToken after DeleteMemberActionTokens returned %v, want ErrNotFound", err)
+  }
+  // another member neither gets nor deletes the token
+  if _, err := repo.ConsumeMemberActionToken("reset", "member", "5e0000000000000000000011"); err != service.ErrNotFound {
+    t.Errorf("ConsumeMemberActionToken of another member returned %v, want ErrNotFound", err)
+  }
+  token, err = repo.ConsumeMemberActionToken("reset", "member", "5e0000000000000000000010")
+  if err != nil || token.MemberId != "5e0000000000000000000010" || token.Email != "m@example.com" {
+    t.Errorf("ConsumeMemberActionToken returned (%+v, %v)", token, err)
+  }
+  if _, err := repo.ConsumeMemberActionToken("reset", "member", "5e0000000000000000000010"); err != service.ErrNotFound {
+    t.Errorf("second ConsumeMemberActionToken returned %v, want ErrNotFound", err)
+  }
+}
+
+func testEmailVerification(t *testing.T, repo service.Repository) {
+  unverified := create(t, repo, sample(1))
+  verifiedCompany := sample(2)
+  verifiedCompany.EmailVerified = true
+  verified := create(t, repo, verifiedCompany)
+
+  got, err := repo.GetById(unverified)
+  if err != nil {
+    t.Fatalf("GetById failed: %v", err)
+  }
+  if !got.Unverified {
+    t.Errorf("company created without a verified email is not unverified")
+  }
+
+  filter := service.CompanyFilter{VerifiedOnly: true, Limit: 10}
+  companys, err := repo.FilterCompanys(&filter)
+  if err != nil {
+    t.Fatalf("FilterCompanys failed: %v", err)
+  }
+  if want := []string{sample(2).Name}; fmt.Sprint(names(companys)) != fmt.Sprint(want) {
+    t.Errorf("FilterCompanys of verified companies returned %q, want %q", names(companys), want)
+  }
+
+  // updates keep the verification state
+  changed := sample(1)
+  changed.Mission = "changed"
+  if _, _, _, err := repo.Update(changed, unverified, []string{"mission"}, 0); err != nil {
+    t.Fatalf("Update failed: %v", err)
+  }
+  if got, err := repo.GetById(unverified); err != nil || !got.Unverified {
+    t.Errorf("Update changed the verification state: %+v, %v", got, err)
+  }
+
+  if err := repo.SetEmailVerified(unverified, true); err != nil {
+    t.Fatalf("SetEmailVerified failed: %v", err)
+  }
+  if err := repo.SetEmailVerified(verified, false); err != nil {
+    t.Fatalf("SetEmailVerified failed: %v", err)
+  }
+  companys, err = repo.FilterCompanys(&filter)
+  if err != nil {
+    t.Fatalf("FilterCompanys failed: %v", err)
+  }
+  if want := []string{sample(1).Name}; fmt.Sprint(names(companys)) != fmt.Sprint(want) {
+    t.Errorf("FilterCompanys after SetEmailVerified returned %q, want %q", names(companys), want)
+  }
+
+  if err := repo.SetEmailVerified("5e0000000000000000000000", true); err != service.ErrNotFound {
+    t.Errorf("SetEmailVerified of unknown id returned %v, want ErrNotFound", err)
+  }
+}
+
+func testTotp(t *testing.T, repo service.Repository) {
+  memberId := "5e0000000000000000000000"
+  if _, err := repo.GetTotp(memberId); err != service.ErrNotFound {
+    t.Errorf("GetTotp before SaveTotp returned %v, want ErrNotFound", err)
+  }
+
+  now := time.Now().Truncate(time.Second)
+  if err := repo.SaveTotp(&service.Totp{MemberId: memberId, Secret: "first", CreatedAt: now}); err != nil {
+    t.Fatalf("SaveTotp failed: %v", err)
+  }
+  // saving again replaces the secret
+  err := repo.SaveTotp(&service.Totp{
+    MemberId:      memberId,
+    Secret:        "second",
+    Confirmed:     true,
+    LastStep:      10,
+    RecoveryCodes: []string{"a", "b"},
+    CreatedAt:     now,
+  })
+  if err != nil {
+    t.Fatalf("SaveTotp failed: %v", err)
+  }
+  totp, err := repo.GetTotp(memberId)
+  if err != nil {
+    t.Fatalf("GetTotp failed: %v", err)
+  }
+  if totp.Secret != "second" || !totp.Confirmed || totp.LastStep != 10 ||
+    fmt.Sprint(totp.RecoveryCodes) != "[a b]" || !totp.CreatedAt.Equal(now) {
+    t.Errorf("GetTotp returned %+v", totp)
+  }
+
+  for _, tt := range []struct {
+    step int64
+    want bool
+  }{{9, false}, {10, false}, {11, true}, {11, false}} {
+    if ok, err := repo.AdvanceTotpStep(memberId, tt.step); err != nil || ok != tt.want {
+      t.Errorf("AdvanceTotpStep(%d) returned (%v, %v), want %v", tt.step, ok, err, tt.want)
+    }
+  }
+
+  if ok, err := repo.UseRecoveryCode(memberId, "a"); err != nil || !ok {
+    t.Errorf("UseRecoveryCode returned (%v, %v), want true", ok, err)
+  }
+  if ok, err := repo.UseRecoveryCode(memberId, "a"); err != nil || ok {
+    t.Errorf("second UseRecoveryCode returned (%v, %v), want false", ok, err)
+  }
+  if totp, err := repo.GetTotp(memberId); err != nil || fmt.Sprint(totp.RecoveryCodes) != "[b]" {
+    t.Errorf("recovery codes after use are %v (%v), want [b]", totp.RecoveryCodes, err)
+  }
+
+  if ok, err := repo.AdvanceTotpStep("5e0000000000000000000001", 1); err != nil || ok {
+    t.Errorf("AdvanceTotpStep of unknown member returned (%v, %v), want false", ok, err)
+  }
+}
+
+func testApiKeys(t *testing.T, repo service.Repository) {
+  companyId := "5e0000000000000000000000"
+  now := time.Now().Truncate(time.Second)
+  for i, id := range []string{"key-b", "key-a"} {
+    err := repo.CreateApiKey(&service.ApiKey{
+      Id:         id,
+      Hash:       "hash-" + id,
+      CompanyId:  companyId,
+      Name:       id,
+      Prefix:     "osk_" + id,
+      Scopes:     []string{"READ_PROFILE"},
+      CreatedAt:  now.Add(time.Duration(i) * time.Minute),
+      LastUsedAt: now,
+    })
+    if err != nil {
+      t.Fatalf("CreateApiKey failed: %v", err)
+    }
+  }
+  if err := repo.CreateApiKey(&service.ApiKey{
+    Id:        "key-other",
+    Hash:      "hash-key-other",
+    CompanyId: "5e0000000000000000000001",
+    Name:      "other",
+    CreatedAt: now,
+  }); err != nil {
+    t.Fatalf("CreateApiKey failed: %v", err)
+  }
+
+  key, err := repo.GetApiKeyByHash("hash-key-a")
+  if err != nil {
+    t.Fatalf("GetApiKeyByHash failed: %v", err)
+  }
+  if key.Id != "key-a" || key.CompanyId != companyId || fmt.Sprint(key.Scopes) != "[READ_PROFILE]" ||
+    !key.LastUsedAt.Equal(now) {
+    t.Errorf("GetApiKeyByHash returned %+v", key)
+  }
+  if _, err := repo.GetApiKeyByHash("unknown"); err != service.ErrNotFound {
+    t.Errorf("GetApiKeyByHash of unknown hash returned %v, want ErrNotFound", err)
+  }
+
+  keys, err := repo.ListApiKeys(companyId)
+  if err != nil {
+    t.Fatalf("ListApiKeys failed: %v", err)
+  }
+  if len(keys) != 2 || keys[0].Id != "key-b" || keys[1].Id != "key-a" {
+    t.Errorf("ListApiKeys returned %d keys, want key-b and key-a in creation order", len(keys))
+  }
+
+  later := now.Add(time.Hour)
+  if err := repo.TouchApiKey("key-a", later); err != nil {
+    t.Fatalf("TouchApiKey failed: %v", err)
+  }
+  if key, err := repo.GetApiKeyByHash("hash-key-a"); err != nil || !key.LastUsedAt.Equal(later) {
+    t.Errorf("last use after TouchApiKey is %v (%v), want %v", key.LastUsedAt, err, later)
+  }
+
+  // keys of other companies cannot be deleted
+  if err := repo.DeleteApiKey(companyId, "key-other"); err != service.ErrNotFound {
+    t.Errorf("DeleteApiKey of another company's key returned %v, want ErrNotFound", err)
+  }
+  if err := repo.DeleteApiKey(companyId, "key-a"); err != nil {
+    t.Fatalf("DeleteApiKey failed: %v", err)
+  }
+  if _, err := repo.GetApiKeyByHash("hash-key-a"); err != service.ErrNotFound {
+    t.Errorf("GetApiKeyByHash after DeleteApiKey returned %v, want ErrNotFound", err)
+  }
+
+  if err := repo.DeleteApiKeys(companyId); err != nil {
+    t.Fatalf("DeleteApiKeys failed: %v", err)
+  }
+  if keys, err := repo.ListApiKeys(companyId); err != nil || len(keys) != 0 {
+    t.Errorf("ListApiKeys after DeleteApiKeys returned %d keys (%v), want none", len(keys), err)
+  }
+  if _, err := repo.GetApiKeyByHash("hash-key-other"); err != nil {
+    t.Errorf("DeleteApiKeys deleted the key of another company: %v", err)
+  }
+}
+
+func testMembers(t *testing.T, repo service.Repository) {
+  now := time.Now().Truncate(time.Second)
+  id, err := repo.CreateMember(&service.Member{Email: "a@example.com", Password: "hash", Name: "A", CreatedAt: now})
+  if err != nil {
+    t.Fatalf("CreateMember failed: %v", err)
+  }
+
+  member, err := repo.GetMemberById(id)
+  if err != nil {
+    t.Fatalf("GetMemberById failed: %v", err)
+  }
+  if member.Id.Hex() != id || member.Email != "a@example.com" || member.Password != "hash" || member.Name != "A" ||
+    !member.CreatedAt.Equal(now) {
+    t.Errorf("GetMemberById returned %+v", member)
+  }
+  if member, err := repo.GetMemberByEmail("a@example.com"); err != nil || member.Id.Hex() != id {
+    t.Errorf("GetMemberByEmail returned (%+v, %v), want member %s", member, err, id)
+  }
+  // emails are normalized, a member is found by its email in any case
+  if member, err := repo.GetMemberByEmail(" A@Example.COM"); err != nil || member.Id.Hex() != id {
+    t.Errorf("GetMemberByEmail in another case returned (%+v, %v), want member %s", member, err, id)
+  }
+
+  // members keep an id they are created with
+  preset, _ := primitive.ObjectIDFromHex("5e0000000000000000000010")
+  if id, err := repo.CreateMember(&service.Member{Id: preset, Email: "b@example.com", CreatedAt: now}); err != nil ||
+    id != preset.Hex() {
+    t.Errorf("CreateMember with an id returned (%s, %v), want %s", id, err, preset.Hex())
+  }
+
+  if _, err := repo.CreateMember(&service.Member{Email: "a@example.com", CreatedAt: now}); err != service.ErrAlreadyExists {
+    t.Errorf("CreateMember with a taken email returned %v, want ErrAlreadyExists", err)
+  }
+  if _, err := repo.CreateMember(&service.Member{Email: "A@example.com", CreatedAt: now}); err != service.ErrAlreadyExists {
+    t.Errorf("CreateMember with a taken email in another case returned %v, want ErrAlreadyExists", err)
+  }
+  if created, err := repo.CreateMember(&service.Member{Email: "D@Example.com", CreatedAt: now}); err != nil {
+    t.Errorf("CreateMember failed: %v", err)
+  } else if member, err := repo.GetMemberById(created); err != nil {
+    t.Errorf("GetMemberById failed: %v", err)
+  } else if member.Email != "d@example.com" {
+    t.Errorf("member created with D@Example.com has email %q, want d@example.com", member.Email)
+  }
+  if _, err := repo.CreateMember(&service.Member{Id: preset, Email: "c@example.com", CreatedAt: now}); err != service.ErrAlreadyExists {
+    t.Errorf("CreateMember with a taken id returned %v, want ErrAlreadyExists", err)
+  }
+
+  if err := repo.UpdateMemberPassword(id, "new hash"); err != nil {
+    t.Fatalf("UpdateMemberPassword failed: %v", err)
+  }
+  if member, err := repo.GetMemberById(id); err != nil || member.Password != "new hash" {
+    t.Errorf("password after UpdateMemberPassword is %q (%v), want \"new hash\"", member.Password, err)
+  }
+
+  // only the hash that is still stored is replaced
+  if replaced, err := repo.ReplaceMemberPassword(id, "old hash", "rehashed"); err != nil || replaced {
+    t.Errorf("ReplaceMemberPassword of a changed hash returned %v, %v, want false", replaced, err)
+  }
+  if replaced, err := repo.ReplaceMemberPassword(id, "new hash", "rehashed"); err != nil || !replaced {
+    t.Errorf("ReplaceMemberPassword returned %v, %v, want true", replaced, err)
+  }
+  if member, err := repo.GetMemberById(id); err != nil || member.Password != "rehashed" {
+    t.Errorf("password after ReplaceMemberPassword is %q (%v), want \"rehashed\"", member.Password, err)
+  }
+
+  if err := repo.DeleteMember(id); err != nil {
+    t.Fatalf("DeleteMember failed: %v", err)
+  }
+  if _, err := repo.GetMemberById(id); err != service.ErrNotFound {
+    t.Errorf("GetMemberById after DeleteMember returned %v, want ErrNotFound", err)
+  }
+
+  unknown := "5e0000000000000000000000"
+  if _, err := repo.GetMemberByEmail("unknown@example.com"); err != service.ErrNotFound {
+    t.Errorf("GetMemberByEmail of unknown email returned %v, want ErrNotFound", err)
+  }
+  if err := repo.UpdateMemberPassword(unknown, "hash"); err != service.ErrNotFound {
+    t.Errorf("UpdateMemberPassword of unknown id returned %v, want ErrNotFound", err)
+  }
+  if replaced, err := repo.ReplaceMemberPassword(unknown, "hash", "rehashed"); err != nil || replaced {
+    t.Errorf("ReplaceMemberPassword of unknown id returned %v, %v, want false", replaced, err)
+  }
+  if err := repo.DeleteMember(unknown); err != service.ErrNotFound {
+    t.Errorf("DeleteMember of unknown id returned %v, want ErrNotFound", err)
+  }
+}
+
+func testMemberships(t *testing.T, repo service.Repository) {
+  companyA, companyB := "5e0000000000000000000000", "5e0000000000000000000001"
+  memberA, memberB := "5e0000000000000000000010", "5e0000000000000000000011"
+  now := time.Now().Truncate(time.Second)
+  for i, membership := range []*service.Membership{
+    {CompanyId: companyA, MemberId: memberA, Role: "OWNER"},
+    {CompanyId: companyA, MemberId: memberB, Role: "RECRUITER"},
+    {CompanyId: companyB, MemberId: memberA, Role: "ADMIN"},
+  } {
+    membership.CreatedAt = now.Add(time.Duration(i) * time.Minute)
+    if err := repo.CreateMembership(membership); err != nil {
+      t.Fatalf("CreateMembership failed: %v", err)
+    }
+  }
+  err := repo.CreateMembership(&service.Membership{CompanyId: companyA, MemberId: memberB, Role: "ADMIN", CreatedAt: now})
+  if err != service.ErrAlreadyExists {
+    t.Errorf("second CreateMembership returned %v, want ErrAlreadyExists", err)
+  }
+
+  membership, err := repo.GetMembership(companyA, memberB)
+  if err != nil {
+    t.Fatalf("GetMembership failed: %v", err)
+  }
+  if membership.Role != "RECRUITER" || !membership.CreatedAt.Equal(now.Add(time.Minute)) {
+    t.Errorf("GetMembership returned %+v", membership)
+  }
+
+  byCompany, err := repo.ListMembershipsByCompany(companyA)
+  if err != nil {
+    t.Fatalf("ListMembershipsByCompany failed: %v", err)
+  }
+  if len(byCompany) != 2 || byCompany[0].MemberId != memberA || byCompany[1].MemberId != memberB {
+    t.Errorf("ListMembershipsByCompany returned %d memberships, want memberA and memberB in joining order", len(byCompany))
+  }
+  byMember, err := repo.ListMembershipsByMember(memberA)
+  if err != nil {
+    t.Fatalf("ListMembershipsByMember failed: %v", err)
+  }
+  if len(byMember) != 2 || byMember[0].CompanyId != companyA || byMember[1].CompanyId != companyB {
+    t.Errorf("ListMembershipsByMember returned %d memberships, want companyA and companyB in joining order", len(byMember))
+  }
+
+  if err := repo.UpdateMembershipRole(companyA, memberB, "ADMIN"); err != nil {
+    t.Fatalf("UpdateMembershipRole failed: %v", err)
+  }
+  if membership, err := repo.GetMembership(companyA, memberB); err != nil || membership.Role != "ADMIN" {
+    t.Errorf("role after UpdateMembershipRole is %q (%v), want ADMIN", membership.Role, err)
+  }
+
+  if err := repo.DeleteMembership(companyA, memberA); err != nil {
+    t.Fatalf("DeleteMembership failed: %v", err)
+  }
+  if _, err := repo.GetMembership(companyA, memberA); err != service.ErrNotFound {
+    t.Errorf("GetMembership after DeleteMembership returned %v, want ErrNotFound", err)
+  }
+  if _, err := repo.GetMembership(companyB, memberA); err != nil {
+    t.Errorf("DeleteMembership removed the membership in another company: %v", err)
+  }
+
+  if _, err := repo.GetMembership(companyB, memberB); err != service.ErrNotFound {
+    t.Errorf("GetMembership of unknown membership returned %v, want ErrNotFound", err)
+  }
+  if err := repo.UpdateMembershipRole(companyB, memberB, "ADMIN"); err != service.ErrNotFound {
+    t.Errorf("UpdateMembershipRole of unknown membership returned %v, want ErrNotFound", err)
+  }
+  if err := repo.DeleteMembership(companyB, memberB); err != service.ErrNotFound {
+    t.Errorf("DeleteMembership of unknown membership returned %v, want ErrNotFound", err)
+  }
+}
+
+func testInvitations(t *testing.T, repo service.Repository) {
+  companyId := "5e0000000000000000000000"
+  now := time.Now().Truncate(time.Second)
+  for i, id := range []string{"invitation-b", "invitation-a"} {
+    err := repo.CreateInvitation(&service.Invitation{
+      Id:        id,
+      CompanyId: companyId,
+      Email:     id + "@example.com",
+      Role:      "RECRUITER",
+      InvitedBy: "5e0000000000000000000010",
+      ExpiresAt: now.Add(time.Hour),
+      CreatedAt: now.Add(time.Duration(i) * time.Minute),
+    })
+    if err != nil {
+      t.Fatalf("CreateInvitation failed: %v", err)
+    }
+  }
+  if err := repo.CreateInvitation(&service.Invitation{
+    Id:        "invitation-other",
+    CompanyId: "5e0000000000000000000001",
+    Email:     "other@example.com",
+    Role:      "ADMIN",
+    ExpiresAt: now,
+    CreatedAt: now,
+  }); err != nil {
+    t.Fatalf("CreateInvitation failed: %v", err)
+  }
+
+  invitation, err := repo.GetInvitation("invitation-a")
+  if err != nil {
+    t.Fatalf("GetInvitation failed: %v", err)
+  }
+  if invitation.CompanyId != companyId || invitation.Email != "invitation-a@example.com" ||
+    invitation.Role != "RECRUITER" || invitation.InvitedBy != "5e0000000000000000000010" ||
+    !invitation.ExpiresAt.Equal(now.Add(time.Hour)) {
+    t.Errorf("GetInvitation returned %+v", invitation)
+  }
+  if _, err := repo.GetInvitation("unknown"); err != service.ErrNotFound {
+    t.Errorf("GetInvitation of unknown id returned %v, want ErrNotFound", err)
+  }
+
+  invitations, err := repo.ListInvitations(companyId)
+  if err != nil {
+    t.Fatalf("ListInvitations failed: %v", err)
+  }
+  if len(invitations) != 2 || invitations[0].Id != "invitation-b" || invitations[1].Id != "invitation-a" {
+    t.Errorf("ListInvitations returned %d invitations, want invitation-b and invitation-a in creation order",
+      len(invitations))
+  }
+
+  // invitations of other companies cannot be deleted
+  if err := repo.DeleteInvitation(companyId, "invitation-other"); err != service.ErrNotFound {
+    t.Errorf("DeleteInvitation of another company's invitation returned %v, want ErrNotFound", err)
+  }
+  if err := repo.DeleteInvitation(companyId, "invitation-a"); err != nil {
+    t.Fatalf("DeleteInvitation failed: %v", err)
+  }
+  if err := repo.DeleteInvitation(companyId, "invitation-a"); err != service.ErrNotFound {
+    t.Errorf("second DeleteInvitation returned %v, want ErrNotFound", err)
+  }
+  if _, err := repo.GetInvitation("invitation-a"); err != service.ErrNotFound {
+    t.Errorf("GetInvitation after DeleteInvitation returned %v, want ErrNotFound", err)
+  }
+
+  if err := repo.DeleteInvitations(companyId); err != nil {
+    t.Fatalf("DeleteInvitations failed: %v", err)
+  }
+  if invitations, err := repo.ListInvitations(companyId); err != nil || len(invitations) != 0 {
+    t.Errorf("ListInvitations after DeleteInvitations returned %d invitations (%v), want none", len(invitations), err)
+  }
+  if _, err := repo.GetInvitation("invitation-other"); err != nil {
+    t.Errorf("DeleteInvitations deleted the invitation of another company: %v", err)
+  }
+}
+
+func testAuditEvents(t *testing.T, repo service.Repository) {
+  companyId := "5e0000000000000000000000"
+  now := time.Now().Truncate(time.Second)
+  for i, id := range []string{"event-b", "event-a"} {
+    err := repo.CreateAuditEvent(&service.AuditEvent{
+      Id:        id,
+      CompanyId: companyId,
+      Action:    "ownership_transferred",
+      ActorId:   "5e0000000000000000000010",
+      TargetId:  "5e0000000000000000000011",
+      CreatedAt: now.Add(time.Duration(i) * time.Minute),
+    })
+    if err != nil {
+      t.Fatalf("CreateAuditEvent failed: %v", err)
+    }
+  }
+  if err := repo.CreateAuditEvent(&service.AuditEvent{
+    Id:        "event-other",
+    CompanyId: "5e0000000000000000000001",
+    Action:    "ownership_transferred",
+    CreatedAt: now,
+  }); err != nil {
+    t.Fatalf("CreateAuditEvent failed: %v", err)
+  }
+
+  events, err := repo.ListAuditEvents(companyId)
+  if err != nil {
+    t.Fatalf("ListAuditEvents failed: %v", err)
+  }
+  if len(events) != 2 || events[0].Id != "event-a" || events[1].Id != "event-b" {
+    t.Fatalf("ListAuditEvents returned %d events, want event-a and event-b, newest first", len(events))
+  }
+  event := events[1]
+  if event.CompanyId != companyId || event.Action != "ownership_transferred" ||
+    event.ActorId != "5e0000000000000000000010" || event.TargetId != "5e0000000000000000000011" ||
+    !event.CreatedAt.Equal(now) {
+    t.Errorf("ListAuditEvents returned %+v", event)
+  }
+
+  if events, err := repo.ListAuditEvents("5e0000000000000000000002"); err != nil || len(events) != 0 {
+    t.Errorf("ListAuditEvents of a company without events returned %d events (%v), want none", len(events), err)
+  }
+}
+
+func testOidc(t *testing.T, repo service.Repository) {
+  now := time.Now().Truncate(time.Second)
+  err := repo.CreateOidcState(&service.OidcState{
+    Hash:      "state-hash",
+    Provider:  "google",
+    CompanyId: "5e0000000000000000000000",
+    Nonce:     "nonce",
+    Verifier:  "verifier",
+    ExpiresAt: now.Add(10 * time.Minute),
+    CreatedAt: now,
+  })
+  if err != nil {
+    t.Fatalf("CreateOidcState failed: %v", err)
+  }
+
+  state, err := repo.ConsumeOidcState("state-hash")
+  if err != nil {
+    t.Fatalf("ConsumeOidcState failed: %v", err)
+  }
+  if state.Provider != "google" || state.CompanyId != "5e0000000000000000000000" || state.Nonce != "nonce" ||
+    state.Verifier != "verifier" || !state.ExpiresAt.Equal(now.Add(10*time.Minute)) {
+    t.Errorf("ConsumeOidcState returned %+v", state)
+  }
+  if _, err := repo.ConsumeOidcState("state-hash"); err != service.ErrNotFound {
+    t.Errorf("second ConsumeOidcState returned %v, want ErrNotFound", err)
+  }
+
+  if _, err := repo.GetOidcIdentity("https://issuer", "subject"); err != service.ErrNotFound {
+    t.Errorf("GetOidcIdentity of unknown subject returned %v, want ErrNotFound", err)
+  }
+  for _, memberId := range []string{"5e0000000000000000000010", "5e0000000000000000000011"} {
+    err := repo.SaveOidcIdentity(&service.OidcIdentity{
+      Issuer:    "https://issuer",
+      Subject:   "subject",
+      MemberId:  memberId,
+      Email:     "member@example.com",
+      CreatedAt: now,
+    })
+    if err != nil {
+      t.Fatalf("SaveOidcIdentity failed: %v", err)
+    }
+  }
+  identity, err := repo.GetOidcIdentity("https://issuer", "subject")
+  if err != nil {
+    t.Fatalf("GetOidcIdentity failed: %v", err)
+  }
+  if identity.MemberId != "5e0000000000000000000011" || identity.Email != "member@example.com" ||
+    !identity.CreatedAt.Equal(now) {
+    t.Errorf("GetOidcIdentity after a second SaveOidcIdentity returned %+v, want the second member", identity)
+  }
+  if _, err := repo.GetOidcIdentity("https://other-issuer", "subject"); err != service.ErrNotFound {
+    t.Errorf("GetOidcIdentity of another issuer returned %v, want ErrNotFound", err)
+  }
+}
@@ -0,0 +1,64 @@
+package v1
+
+import (
+  "strconv"
+  "time"
+
+  "github.com/go-redis/redis/v7"
+)
+
+// RedisRevocationStore is a RevocationStore shared by every instance through redis.
+// Keys expire together with the tokens they revoke.
+type RedisRevocationStore struct {
+  client *redis.Client
+}
+
+func NewRedisRevocationStore(client *redis.Client) *RedisRevocationStore {
+  return &RedisRevocationStore{
+    client: client,
+  }
+}
+
+func (s *RedisRevocationStore) Revoke(jti string, expiresAt time.Time) error {
+  ttl := time.Until(expiresAt)
+  if ttl <= 0 {
+    return nil
+  }
+  return s.client.Set("revoked:jti:"+jti, 1, ttl).Err()
+}
+
+func (s *RedisRevocationStore) IsRevoked(jti string) (bool, error) {
+  n, err := s.client.Exists("revoked:jti:" + jti).Result()
+  if err != nil {
+    return false, err
+  }
+  return n > 0, nil
+}
+
+func (s *RedisRevocationStore) RevokeAllBefore(subject string, before time.Time, until time.Time) error {
+  ttl := time.Until(until)
+  if ttl <= 0 {
+    return nil
+  }
+  return s.client.Set("revoked:before:"+subject, before.UTC().Format(time.RFC3339Nano), ttl).Err()
+}
+
+func (s *RedisRevocationStore) RevokedBefore(subject string) (time.Time, error) {
+  value, err := s.client.Get("revoked:before:" + subject).Result()
+  if err == redis.Nil {
+    return time.Time{}, nil
+  }
+  if err != nil {
+    return time.Time{}, err
+  }
+
+  if before, err := time.Parse(time.RFC3339Nano, value); err == nil {
+    return before, nil
+  }
+  // revocations stored before they had sub-second precision hold unix seconds
+  secs, err := strconv.ParseInt(value, 10, 64)
+  if err != nil {
+    return time.Time{}, err
+  }
+  return time.Unix(secs, 0), nil
+}
@@ -0,0 +1,90 @@
+package v1
+
+import (
+  "sync"
+  "time"
+)
+
+// RevocationStore remembers revoked access tokens until they would have expired anyway
+type RevocationStore interface {
+  // Revoke revokes the token with id jti until expiresAt
+  Revoke(jti string, expiresAt time.Time) error
+  // IsRevoked reports if the token with id jti is revoked
+  IsRevoked(jti string) (bool, error)
+  // RevokeAllBefore revokes every token of subject issued at or before before, which is kept to the nanosecond.
+  // The revocation is kept until until, the expiry of the newest token it covers.
+  RevokeAllBefore(subject string, before time.Time, until time.Time) error
+  // RevokedBefore returns the time of the last RevokeAllBefore of subject, zero if there is none
+  RevokedBefore(subject string) (time.Time, error)
+}
+
+// MemoryRevocationStore is a RevocationStore for a single instance, revocations are lost on restart
+type MemoryRevocationStore struct {
+  mu       sync.Mutex
+  tokens   map[string]time.Time
+  subjects map[string]revokedSubject
+}
+
+type revokedSubject struct {
+  before time.Time
+  until  time.Time
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+  return &MemoryRevocationStore{
+    tokens:   map[string]time.Time{},
+    subjects: map[string]revokedSubject{},
+  }
+}
+
+func (s *MemoryRevocationStore) Revoke(jti string, expiresAt time.Time) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.purge()
+  s.tokens[jti] = expiresAt
+  return nil
+}
+
+func (s *MemoryRevocationStore) IsRevoked(jti string) (bool, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  expiresAt, ok := s.tokens[jti]
+  return ok && time.Now().Before(expiresAt), nil
+}
+
+func (s *MemoryRevocationStore) RevokeAllBefore(subject string, before time.Time, until time.Time) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.purge()
+  s.subjects[subject] = revokedSubject{before: before, until: until}
+  return nil
+}
+
+func (s *MemoryRevocationStore) RevokedBefore(subject string) (time.Time, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  revoked, ok := s.subjects[subject]
+  if !ok || time.Now().After(revoked.until) {
+    return time.Time{}, nil
+  }
+  return revoked.before, nil
+}
+
+// purge drops revocations of tokens that have expired, the caller must hold the lock
+func (s *MemoryRevocationStore) purge() {
+  now := time.Now()
+  for jti, expiresAt := range s.tokens {
+    if now.After(expiresAt) {
+      delete(s.tokens, jti)
+    }
+  }
+  for subject, revoked := range s.subjects {
+    if now.After(revoked.until) {
+      delete(s.subjects, subject)
+    }
+  }
+}
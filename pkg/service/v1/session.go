@@ -0,0 +1,228 @@
+package v1
+
+import (
+  "context"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/hex"
+  "time"
+
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+const (
+  // refreshTokenTTL is how long a session survives without being refreshed
+  refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// RefreshToken is the server-side record of a refresh token.
+// Only the hash of the token is stored. Every token is single-use: refreshing
+// marks it used and issues the next token of the same family, so presenting a
+// used token means it was copied, and the whole family is revoked.
+type RefreshToken struct {
+  Hash      string `json:"hash" bson:"_id"`
+  Family    string `json:"family" bson:"family"`
+  CompanyId string `json:"companyId" bson:"company_id"`
+  // MemberId is empty for sessions from before memberships, which cannot be refreshed
+  MemberId  string    `json:"memberId" bson:"member_id"`
+  Used      bool      `json:"used" bson:"used"`
+  Revoked   bool      `json:"revoked" bson:"revoked"`
+  ExpiresAt time.Time `json:"expiresAt" bson:"expires_at"`
+  CreatedAt time.Time `json:"createdAt" bson:"created_at"`
+}
+
+// errInvalidRefreshToken is returned for every refresh failure so that callers learn nothing about the token
+var errInvalidRefreshToken = status.Error(codes.Unauthenticated, "invalid refresh token")
+
+// newOpaqueToken returns a random url-safe token
+func newOpaqueToken() string {
+  b := make([]byte, 32)
+  if _, err := rand.Read(b); err != nil {
+    panic(err)
+  }
+  return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// newTokenId returns a random id for jwt ids and token families
+func newTokenId() string {
+  b := make([]byte, 16)
+  if _, err := rand.Read(b); err != nil {
+    panic(err)
+  }
+  return hex.EncodeToString(b)
+}
+
+// hashToken returns the hash under which an opaque token is stored
+func hashToken(token string) string {
+  sum := sha256.Sum256([]byte(token))
+  return hex.EncodeToString(sum[:])
+}
+
+// issueTokens returns a response with a new access token of member and the next refresh token of family.
+// An empty family starts a new session.
+func (s *handler) issueTokens(company *v1.Company, member *v1.Member, family string) (*v1.UpsertResponse, error) {
+  token, err := s.tokenService.Encode(company, member)
+  if err != nil {
+    return nil, err
+  }
+
+  if family == "" {
+    family = newTokenId()
+  }
+  now := time.Now()
+  refreshToken := newOpaqueToken()
+  err = s.repo.CreateRefreshToken(&RefreshToken{
+    Hash:      hashToken(refreshToken),
+    Family:    family,
+    CompanyId: company.Id,
+    MemberId:  member.Id,
+    ExpiresAt: now.Add(refreshTokenTTL),
+    CreatedAt: now,
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  return &v1.UpsertResponse{
+    Api:          apiVersion,
+    Status:       "Success",
+    Id:           company.Id,
+    Token:        token,
+    RefreshToken: refreshToken,
+    ExpiresAt:    now.Add(accessTokenTTL).Unix(),
+    MemberId:     member.Id,
+  }, nil
+}
+
+// RefreshToken exchanges a refresh token for a new access token and the next refresh token
+func (s *handler) RefreshToken(ctx context.Context, req *v1.RefreshRequest) (*v1.UpsertResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  stored, err := s.repo.UseRefreshToken(hashToken(req.RefreshToken))
+  if err == ErrNotFound {
+    return nil, errInvalidRefreshToken
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  if stored.Revoked || time.Now().After(stored.ExpiresAt) {
+    return nil, errInvalidRefreshToken
+  }
+
+  // a used token is presented again: either the client or an attacker holds a copy,
+  // so end the session for both
+  if stored.Used {
+    if err := s.repo.RevokeRefreshFamily(stored.Family); err != nil {
+      return nil, err
+    }
+    return nil, errInvalidRefreshToken
+  }
+
+  // the role is looked up again, and members removed from the company cannot refresh
+  membership, err := s.repo.GetMembership(stored.CompanyId, stored.MemberId)
+  if err == ErrNotFound {
+    return nil, errInvalidRefreshToken
+  }
+  if err != nil {
+    return nil, err
+  }
+  company, err := s.repo.GetById(stored.CompanyId)
+  if err == ErrNotFound {
+    return nil, errInvalidRefreshToken
+  }
+  if err != nil {
+    return nil, err
+  }
+  member, err := s.repo.GetMemberById(stored.MemberId)
+  if err == ErrNotFound {
+    return nil, errInvalidRefreshToken
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  return s.issueTokens(&v1.Company{Id: company.Id.Hex(), Email: company.Email},
+    exportMember(member, membership), stored.Family)
+}
+
+// Logout revokes the access token of the request and the session of its refresh token
+func (s *handler) Logout(ctx context.Context, req *v1.LogoutRequest) (*v1.LogoutResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := caller(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  if err := s.tokenService.Revoke(claims); err != nil {
+    return nil, err
+  }
+
+  // end the session of the refresh token, unless it belongs to somebody else. The token is only
+  // looked up, so that presenting the token of another session does not count as its reuse.
+  if req.RefreshToken != "" {
+    stored, err := s.repo.GetRefreshToken(hashToken(req.RefreshToken))
+    if err != nil && err != ErrNotFound {
+      return nil, err
+    }
+    if err == nil && stored.CompanyId == claims.Company.Id && stored.MemberId == claims.MemberId {
+      if err := s.repo.RevokeRefreshFamily(stored.Family); err != nil {
+        return nil, err
+      }
+    }
+  }
+
+  return &v1.LogoutResponse{
+    Api:    apiVersion,
+    Status: "Success",
+  }, nil
+}
+
+// RevokeAllSessions signs the member out everywhere
+func (s *handler) RevokeAllSessions(ctx context.Context, req *v1.LogoutRequest) (*v1.LogoutResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := caller(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  if err := s.revokeMemberSessions(claims.MemberId); err != nil {
+    return nil, err
+  }
+
+  return &v1.LogoutResponse{
+    Api:    apiVersion,
+    Status: "Success",
+  }, nil
+}
+
+// revokeAllSessions revokes every access and refresh token of a company
+func (s *handler) revokeAllSessions(companyId string) error {
+  if err := s.tokenService.RevokeAll(companyId); err != nil {
+    return err
+  }
+  return s.repo.RevokeCompanyRefreshTokens(companyId)
+}
+
+// revokeMemberSessions revokes every access and refresh token of a member
+func (s *handler) revokeMemberSessions(memberId string) error {
+  if err := s.tokenService.RevokeAll(memberId); err != nil {
+    return err
+  }
+  return s.repo.RevokeMemberRefreshTokens(memberId)
+}
@@ -0,0 +1,97 @@
+package v1
+
+import (
+  "context"
+  "testing"
+
+  "google.golang.org/grpc/codes"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+func TestLogin(t *testing.T) {
+  s := newTestServer(t)
+  res := s.signUp(t, "owner@example.com")
+  if res.Token == "" || res.RefreshToken == "" || res.MemberId == "" {
+    t.Fatalf("Login returned %+v, want tokens and a member", res)
+  }
+
+  claims, ok := ClaimsFromContext(s.as(t, res.Token))
+  if !ok || claims.Company.Id != res.Id || claims.MemberId != res.MemberId || claims.Role != v1.MemberRole_OWNER.String() {
+    t.Errorf("access token has claims %+v, want the owner of company %s", claims, res.Id)
+  }
+
+  ctx := context.Background()
+  if _, err := s.Login(ctx, &v1.UpsertRequest{Api: apiVersion, Email: "Owner@Example.com", Password: testPassword}); err != nil {
+    t.Errorf("Login with the email in another case failed: %v", err)
+  }
+  _, err := s.Login(ctx, &v1.UpsertRequest{Api: apiVersion, Email: "owner@example.com", Password: "wrong password 1"})
+  wantCode(t, "Login with a wrong password", err, codes.Unauthenticated)
+  _, err = s.Login(ctx, &v1.UpsertRequest{Api: apiVersion, Email: "nobody@example.com", Password: testPassword})
+  wantCode(t, "Login with an unknown email", err, codes.Unauthenticated)
+}
+
+func TestLoginBackoff(t *testing.T) {
+  s := newTestServer(t)
+  s.signUp(t, "owner@example.com")
+
+  ctx := context.Background()
+  wrong := &v1.UpsertRequest{Api: apiVersion, Email: "owner@example.com", Password: "wrong password 1"}
+  for i := 0; i <= DefaultLockoutPolicy.AccountFreeAttempts; i++ {
+    _, err := s.Login(ctx, wrong)
+    wantCode(t, "Login with a wrong password", err, codes.Unauthenticated)
+  }
+
+  // backing off, even the right password is not checked
+  _, err := s.Login(ctx, &v1.UpsertRequest{Api: apiVersion, Email: "owner@example.com", Password: testPassword})
+  wantCode(t, "Login while backing off", err, codes.ResourceExhausted)
+}
+
+func TestRefreshToken(t *testing.T) {
+  s := newTestServer(t)
+  login := s.signUp(t, "owner@example.com")
+  ctx := context.Background()
+
+  refreshed, err := s.RefreshToken(ctx, &v1.RefreshRequest{Api: apiVersion, RefreshToken: login.RefreshToken})
+  if err != nil {
+    t.Fatalf("RefreshToken failed: %v", err)
+  }
+  if refreshed.RefreshToken == login.RefreshToken || refreshed.MemberId != login.MemberId {
+    t.Errorf("RefreshToken returned %+v, want a new refresh token of member %s", refreshed, login.MemberId)
+  }
+  s.as(t, refreshed.Token)
+
+  // presenting a used token again ends the whole session, the current token included
+  _, err = s.RefreshToken(ctx, &v1.RefreshRequest{Api: apiVersion, RefreshToken: login.RefreshToken})
+  wantCode(t, "RefreshToken with a used token", err, codes.Unauthenticated)
+  _, err = s.RefreshToken(ctx, &v1.RefreshRequest{Api: apiVersion, RefreshToken: refreshed.RefreshToken})
+  wantCode(t, "RefreshToken after a reuse", err, codes.Unauthenticated)
+
+  _, err = s.RefreshToken(ctx, &v1.RefreshRequest{Api: apiVersion, RefreshToken: "unknown"})
+  wantCode(t, "RefreshToken with an unknown token", err, codes.Unauthenticated)
+}
+
+func TestLogout(t *testing.T) {
+  s := newTestServer(t)
+  login := s.signUp(t, "owner@example.com")
+
+  _, err := s.Logout(s.as(t, login.Token), &v1.LogoutRequest{Api: apiVersion, RefreshToken: login.RefreshToken})
+  if err != nil {
+    t.Fatalf("Logout failed: %v", err)
+  }
+
+  if _, err := s.credentials.Authenticate(login.Token); err == nil {
+    t.Errorf("access token accepted after Logout")
+  }
+  _, err = s.RefreshToken(context.Background(), &v1.RefreshRequest{Api: apiVersion, RefreshToken: login.RefreshToken})
+  wantCode(t, "RefreshToken after Logout", err, codes.Unauthenticated)
+  // the refresh token of somebody else is left alone, it does not even count as used
+  other := s.signUp(t, "other@example.com")
+  third := s.signUp(t, "third@example.com")
+  if _, err := s.Logout(s.as(t, third.Token), &v1.LogoutRequest{Api: apiVersion, RefreshToken: other.RefreshToken}); err != nil {
+    t.Fatalf("Logout failed: %v", err)
+  }
+  if _, err := s.RefreshToken(context.Background(), &v1.RefreshRequest{Api: apiVersion, RefreshToken: other.RefreshToken}); err != nil {
+    t.Errorf("RefreshToken after Logout with it by somebody else failed: %v", err)
+  }
+}
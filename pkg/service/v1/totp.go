@@ -0,0 +1,134 @@
+package v1
+
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha1"
+  "crypto/subtle"
+  "encoding/base32"
+  "encoding/binary"
+  "fmt"
+  "net/url"
+  "strings"
+  "time"
+)
+
+const (
+  // totpPeriod is the length of a time step (RFC 6238)
+  totpPeriod = 30
+  // totpDigits is the length of a code
+  totpDigits = 6
+  // totpModulus is 10^totpDigits
+  totpModulus = 1000000
+  // totpSkew is the number of steps a code may be off, to allow for clock drift
+  totpSkew = 1
+  // totpIssuer names us in authenticator apps
+  totpIssuer = "os-company"
+
+  // recoveryCodeCount is the number of recovery codes handed out on enrollment
+  recoveryCodeCount = 10
+)
+
+// Totp is the second factor of a member. The secret is shared with the authenticator
+// app of the member, recovery codes are stored hashed.
+type Totp struct {
+  MemberId string `json:"memberId" bson:"_id"`
+  // Secret is the base32 encoded shared secret
+  Secret string `json:"secret" bson:"secret"`
+  // Confirmed is set once the member has entered a code, before that Login ignores the secret
+  Confirmed bool `json:"confirmed" bson:"confirmed"`
+  // LastStep is the time step of the last accepted code, so that every code is used once
+  LastStep      int64     `json:"lastStep" bson:"last_step"`
+  RecoveryCodes []string  `json:"recoveryCodes" bson:"recovery_codes"`
+  CreatedAt     time.Time `json:"createdAt" bson:"created_at"`
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTotpSecret returns a random 160 bit secret, base32 encoded
+func newTotpSecret() string {
+  b := make([]byte, 20)
+  if _, err := rand.Read(b); err != nil {
+    panic(err)
+  }
+  return totpEncoding.EncodeToString(b)
+}
+
+// totpURI returns the otpauth URI authenticator apps enroll with, usually shown as a QR code
+func totpURI(secret, account string) string {
+  query := url.Values{
+    "secret":    {secret},
+    "issuer":    {totpIssuer},
+    "algorithm": {"SHA1"},
+    "digits":    {fmt.Sprint(totpDigits)},
+    "period":    {fmt.Sprint(totpPeriod)},
+  }
+  u := url.URL{
+    Scheme:   "otpauth",
+    Host:     "totp",
+    Path:     "/" + totpIssuer + ":" + account,
+    RawQuery: query.Encode(),
+  }
+  return u.String()
+}
+
+// totpCode returns the code of a time step (RFC 4226 HOTP with the step as counter)
+func totpCode(secret string, step int64) (string, error) {
+  key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+  if err != nil {
+    return "", err
+  }
+
+  var counter [8]byte
+  binary.BigEndian.PutUint64(counter[:], uint64(step))
+  mac := hmac.New(sha1.New, key)
+  mac.Write(counter[:])
+  sum := mac.Sum(nil)
+
+  // dynamic truncation
+  offset := sum[len(sum)-1] & 0x0f
+  value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+  return fmt.Sprintf("%0*d", totpDigits, value%totpModulus), nil
+}
+
+// verifyTotp returns the time step code belongs to, looking totpSkew steps around now.
+// ok is false if the code matches none of them.
+func verifyTotp(secret, code string, now time.Time) (step int64, ok bool) {
+  code = strings.TrimSpace(code)
+  if len(code) != totpDigits {
+    return 0, false
+  }
+
+  current := now.Unix() / totpPeriod
+  for step := current - totpSkew; step <= current+totpSkew; step++ {
+    expected, err := totpCode(secret, step)
+    if err != nil {
+      return 0, false
+    }
+    if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+      return step, true
+    }
+  }
+  return 0, false
+}
+
+// newRecoveryCodes returns recovery codes to show the member once and their hashes to store
+func newRecoveryCodes() (codes []string, hashes []string) {
+  for i := 0; i < recoveryCodeCount; i++ {
+    b := make([]byte, 5)
+    if _, err := rand.Read(b); err != nil {
+      panic(err)
+    }
+    code := strings.ToLower(totpEncoding.EncodeToString(b))
+    code = code[:4] + "-" + code[4:]
+    codes = append(codes, code)
+    hashes = append(hashes, hashRecoveryCode(code))
+  }
+  return codes, hashes
+}
+
+// hashRecoveryCode returns the hash a recovery code is stored under, ignoring case and dashes
+func hashRecoveryCode(code string) string {
+  code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+  return hashToken(code)
+}
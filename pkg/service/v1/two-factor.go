@@ -0,0 +1,181 @@
+package v1
+
+import (
+  "context"
+  "time"
+
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+// errInvalidSecondFactor is returned for every failed second factor so that callers learn nothing about it
+var errInvalidSecondFactor = status.Error(codes.Unauthenticated, "invalid challenge or code")
+
+// BeginTotpEnrollment generates a new TOTP secret for the caller. It is not used by Login
+// until ConfirmTotpEnrollment proves the authenticator app has it.
+func (s *handler) BeginTotpEnrollment(ctx context.Context, req *v1.TotpEnrollmentRequest) (*v1.TotpEnrollmentResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := caller(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  member, err := s.repo.GetMemberById(claims.MemberId)
+  if err == ErrNotFound {
+    return nil, errMemberNotFound
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  existing, err := s.repo.GetTotp(claims.MemberId)
+  if err != nil && err != ErrNotFound {
+    return nil, err
+  }
+  if err == nil && existing.Confirmed {
+    return nil, status.Error(codes.FailedPrecondition, "two-factor authentication is already enabled")
+  }
+
+  // starting again replaces an unconfirmed secret
+  secret := newTotpSecret()
+  err = s.repo.SaveTotp(&Totp{
+    MemberId:  claims.MemberId,
+    Secret:    secret,
+    CreatedAt: time.Now(),
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  return &v1.TotpEnrollmentResponse{
+    Api:        apiVersion,
+    Secret:     secret,
+    OtpauthUri: totpURI(secret, member.Email),
+  }, nil
+}
+
+// ConfirmTotpEnrollment enables two-factor authentication once the caller enters a valid code
+func (s *handler) ConfirmTotpEnrollment(ctx context.Context, req *v1.ConfirmTotpRequest) (*v1.ConfirmTotpResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := caller(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  totp, err := s.repo.GetTotp(claims.MemberId)
+  if err == ErrNotFound || err == nil && totp.Confirmed {
+    return nil, status.Error(codes.FailedPrecondition, "no two-factor enrollment in progress")
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  step, ok := verifyTotp(totp.Secret, req.Code, time.Now())
+  if !ok {
+    return nil, status.Error(codes.InvalidArgument, "invalid code")
+  }
+
+  recoveryCodes, hashes := newRecoveryCodes()
+  totp.Confirmed = true
+  totp.LastStep = step
+  totp.RecoveryCodes = hashes
+  if err := s.repo.SaveTotp(totp); err != nil {
+    return nil, err
+  }
+
+  return &v1.ConfirmTotpResponse{
+    Api:           apiVersion,
+    Status:        "Enabled",
+    RecoveryCodes: recoveryCodes,
+  }, nil
+}
+
+// VerifySecondFactor exchanges the challenge token of Login and a TOTP or recovery code for an access token
+func (s *handler) VerifySecondFactor(ctx context.Context, req *v1.SecondFactorRequest) (*v1.UpsertResponse, error) {
+  // check api version
+  if err := s.checkAPI(req.Api); err != nil {
+    return nil, err
+  }
+
+  claims, err := s.tokenService.DecodeChallenge(req.ChallengeToken)
+  if err != nil {
+    return nil, errInvalidSecondFactor
+  }
+  memberId := claims.MemberId
+
+  member, err := s.repo.GetMemberById(memberId)
+  if err == ErrNotFound {
+    return nil, errInvalidSecondFactor
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  // codes are guessed more easily than passwords, so they count against the same limits
+  attempt, err := s.limiter.Reserve(member.Email, clientIP(ctx))
+  if err != nil {
+    return nil, err
+  }
+
+  totp, err := s.repo.GetTotp(memberId)
+  if err == ErrNotFound {
+    return nil, errInvalidSecondFactor
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  // codes are single-use: a code of a step at or before the last accepted one is a replay
+  var ok bool
+  switch {
+  case req.Code != "":
+    step, valid := verifyTotp(totp.Secret, req.Code, time.Now())
+    if valid {
+      ok, err = s.repo.AdvanceTotpStep(memberId, step)
+    }
+  case req.RecoveryCode != "":
+    ok, err = s.repo.UseRecoveryCode(memberId, hashRecoveryCode(req.RecoveryCode))
+  }
+  if err != nil {
+    return nil, err
+  }
+  if !ok {
+    // the reserved attempt is the failure
+    return nil, errInvalidSecondFactor
+  }
+  if err := s.limiter.Pass(attempt); err != nil {
+    return nil, err
+  }
+
+  // the challenge is used up
+  if err := s.tokenService.Revoke(claims); err != nil {
+    return nil, err
+  }
+
+  // the role may have changed since the password was checked
+  membership, err := s.repo.GetMembership(claims.Company.Id, memberId)
+  if err == ErrNotFound {
+    return nil, errInvalidSecondFactor
+  }
+  if err != nil {
+    return nil, err
+  }
+  company, err := s.repo.GetById(claims.Company.Id)
+  if err == ErrNotFound {
+    return nil, errInvalidSecondFactor
+  }
+  if err != nil {
+    return nil, err
+  }
+  return s.completeLogin(company, member, membership)
+}
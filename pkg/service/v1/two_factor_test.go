@@ -0,0 +1,141 @@
+package v1
+
+import (
+  "context"
+  "testing"
+  "time"
+
+  "google.golang.org/grpc/codes"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+func TestTotpCode(t *testing.T) {
+  // the SHA1 vectors of RFC 6238, cut to six digits
+  secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+  for unix, want := range map[int64]string{
+    59:         "287082",
+    1111111109: "081804",
+    2000000000: "279037",
+  } {
+    code, err := totpCode(secret, unix/totpPeriod)
+    if err != nil || code != want {
+      t.Errorf("totpCode at %d returned (%q, %v), want %q", unix, code, err, want)
+    }
+  }
+
+  now := time.Unix(1111111109, 0)
+  step := now.Unix() / totpPeriod
+  for offset, ok := range map[int64]bool{-2: false, -1: true, 0: true, 1: true, 2: false} {
+    code, _ := totpCode(secret, step+offset)
+    if got, valid := verifyTotp(secret, code, now); valid != ok || valid && got != step+offset {
+      t.Errorf("verifyTotp of the code %d steps off returned (%d, %v), want %v", offset, got, valid, ok)
+    }
+  }
+  if _, ok := verifyTotp(secret, "81804", now); ok {
+    t.Errorf("verifyTotp accepted a code that is too short")
+  }
+}
+
+// enrollTotp enables two-factor authentication for the owner of a new company
+// and returns the secret and the recovery codes
+func (s *testServer) enrollTotp(t *testing.T, email string) (string, []string) {
+  t.Helper()
+  ctx := s.as(t, s.signUp(t, email).Token)
+  begin, err := s.BeginTotpEnrollment(ctx, &v1.TotpEnrollmentRequest{Api: apiVersion})
+  if err != nil {
+    t.Fatalf("BeginTotpEnrollment failed: %v", err)
+  }
+
+  _, err = s.ConfirmTotpEnrollment(ctx, &v1.ConfirmTotpRequest{Api: apiVersion, Code: "abcdef"})
+  wantCode(t, "ConfirmTotpEnrollment with a wrong code", err, codes.InvalidArgument)
+  code, _ := totpCode(begin.Secret, time.Now().Unix()/totpPeriod)
+  confirmed, err := s.ConfirmTotpEnrollment(ctx, &v1.ConfirmTotpRequest{Api: apiVersion, Code: code})
+  if err != nil {
+    t.Fatalf("ConfirmTotpEnrollment failed: %v", err)
+  }
+  if len(confirmed.RecoveryCodes) != recoveryCodeCount {
+    t.Fatalf("ConfirmTotpEnrollment returned %d recovery codes, want %d", len(confirmed.RecoveryCodes), recoveryCodeCount)
+  }
+
+  _, err = s.BeginTotpEnrollment(ctx, &v1.TotpEnrollmentRequest{Api: apiVersion})
+  wantCode(t, "BeginTotpEnrollment when enabled", err, codes.FailedPrecondition)
+  return begin.Secret, confirmed.RecoveryCodes
+}
+
+// challenge logs in with the password and returns the challenge token of the second factor
+func (s *testServer) challenge(t *testing.T, email string) string {
+  t.Helper()
+  res := s.login(t, email, testPassword)
+  if res.ChallengeToken == "" || res.Token != "" {
+    t.Fatalf("Login with two-factor authentication returned %+v, want a challenge only", res)
+  }
+  return res.ChallengeToken
+}
+
+func TestTwoFactor(t *testing.T) {
+  s := newTestServer(t)
+  secret, _ := s.enrollTotp(t, "owner@example.com")
+  ctx := context.Background()
+
+  code, _ := totpCode(secret, time.Now().Unix()/totpPeriod+1)
+  res, err := s.VerifySecondFactor(ctx, &v1.SecondFactorRequest{Api: apiVersion,
+    ChallengeToken: s.challenge(t, "owner@example.com"), Code: code})
+  if err != nil {
+    t.Fatalf("VerifySecondFactor failed: %v", err)
+  }
+  s.as(t, res.Token)
+
+  // a code is used once, and so are the codes of the steps before it
+  _, err = s.VerifySecondFactor(ctx, &v1.SecondFactorRequest{Api: apiVersion,
+    ChallengeToken: s.challenge(t, "owner@example.com"), Code: code})
+  wantCode(t, "VerifySecondFactor with a used code", err, codes.Unauthenticated)
+  earlier, _ := totpCode(secret, time.Now().Unix()/totpPeriod)
+  _, err = s.VerifySecondFactor(ctx, &v1.SecondFactorRequest{Api: apiVersion,
+    ChallengeToken: s.challenge(t, "owner@example.com"), Code: earlier})
+  wantCode(t, "VerifySecondFactor with an earlier code", err, codes.Unauthenticated)
+
+  _, err = s.VerifySecondFactor(ctx, &v1.SecondFactorRequest{Api: apiVersion, ChallengeToken: res.Token, Code: code})
+  wantCode(t, "VerifySecondFactor with an access token", err, codes.Unauthenticated)
+}
+
+func TestTwoFactorRecoveryCode(t *testing.T) {
+  s := newTestServer(t)
+  _, recoveryCodes := s.enrollTotp(t, "owner@example.com")
+  ctx := context.Background()
+
+  // recovery codes are compared without case and dashes
+  challenge := s.challenge(t, "owner@example.com")
+  if _, err := s.VerifySecondFactor(ctx, &v1.SecondFactorRequest{Api: apiVersion, ChallengeToken: challenge,
+    RecoveryCode: " " + recoveryCodes[0] + " "}); err != nil {
+    t.Fatalf("VerifySecondFactor with a recovery code failed: %v", err)
+  }
+  // the challenge is used up as well
+  _, err := s.VerifySecondFactor(ctx, &v1.SecondFactorRequest{Api: apiVersion, ChallengeToken: challenge,
+    RecoveryCode: recoveryCodes[1]})
+  wantCode(t, "VerifySecondFactor with a used challenge", err, codes.Unauthenticated)
+
+  _, err = s.VerifySecondFactor(ctx, &v1.SecondFactorRequest{Api: apiVersion,
+    ChallengeToken: s.challenge(t, "owner@example.com"), RecoveryCode: recoveryCodes[0]})
+  wantCode(t, "VerifySecondFactor with a used recovery code", err, codes.Unauthenticated)
+}
+
+func TestTwoFactorBackoff(t *testing.T) {
+  s := newTestServer(t)
+  secret, _ := s.enrollTotp(t, "owner@example.com")
+  ctx := context.Background()
+  challenge := s.challenge(t, "owner@example.com")
+
+  // wrong codes are failed logins of the account
+  for i := 0; i <= DefaultLockoutPolicy.AccountFreeAttempts; i++ {
+    _, err := s.VerifySecondFactor(ctx, &v1.SecondFactorRequest{Api: apiVersion, ChallengeToken: challenge,
+      RecoveryCode: "wrong"})
+    wantCode(t, "VerifySecondFactor with a wrong recovery code", err, codes.Unauthenticated)
+  }
+
+  code, _ := totpCode(secret, time.Now().Unix()/totpPeriod)
+  _, err := s.VerifySecondFactor(ctx, &v1.SecondFactorRequest{Api: apiVersion, ChallengeToken: challenge, Code: code})
+  wantCode(t, "VerifySecondFactor while backing off", err, codes.ResourceExhausted)
+  _, err = s.Login(ctx, &v1.UpsertRequest{Api: apiVersion, Email: "owner@example.com", Password: testPassword})
+  wantCode(t, "Login while backing off", err, codes.ResourceExhausted)
+}
@@ -0,0 +1,100 @@
+package v1
+
+import (
+  "google.golang.org/genproto/googleapis/rpc/errdetails"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+// immutableCompanyFields are fields of companies the service sets, an update mask may not list them
+var immutableCompanyFields = map[string]bool{
+  "id":             true,
+  "last_active":    true,
+  "email_verified": true,
+}
+
+// companyUpdate is what UpdateCompany changes
+type companyUpdate struct {
+  // fields are the UpdatableCompanyFields to pass to Repository.Update
+  fields []string
+  // password is set if the password of the calling member is updated
+  password bool
+}
+
+// has reports if the update sets field
+func (u *companyUpdate) has(field string) bool {
+  for _, f := range u.fields {
+    if f == field {
+      return true
+    }
+  }
+  return false
+}
+
+// parseUpdateMask returns the fields req updates: the paths of its update mask,
+// or the non-empty fields of its company if it has none. Unknown and immutable paths
+// and empty values of fields that cannot be cleared fail with InvalidArgument.
+func parseUpdateMask(req *v1.UpsertRequest) (*companyUpdate, error) {
+  company := req.Company
+  paths := req.GetUpdateMask().GetPaths()
+  if req.UpdateMask == nil {
+    values := map[string]string{
+      "email":    company.Email,
+      "name":     company.Name,
+      "mission":  company.Mission,
+      "location": company.Location,
+      "password": company.Password,
+    }
+    for _, field := range []string{"email", "name", "mission", "location", "password"} {
+      if values[field] != "" {
+        paths = append(paths, field)
+      }
+    }
+  }
+
+  update := &companyUpdate{}
+  violations := []*errdetails.BadRequest_FieldViolation{}
+  for _, path := range paths {
+    switch {
+    case path == "password":
+      update.password = true
+    case isUpdatableCompanyField(path):
+      if !update.has(path) {
+        update.fields = append(update.fields, path)
+      }
+    case immutableCompanyFields[path]:
+      violations = append(violations, fieldViolation("update_mask", "'"+path+"' cannot be updated"))
+    default:
+      violations = append(violations, fieldViolation("update_mask", "'"+path+"' is not a field of company"))
+    }
+  }
+  if len(violations) > 0 {
+    return nil, badRequest("invalid update mask", violations...)
+  }
+
+  // the login email and the password cannot be cleared
+  if update.has("email") && company.Email == "" {
+    violations = append(violations, fieldViolation("company.email", "email cannot be empty"))
+  }
+  if update.password && company.Password == "" {
+    violations = append(violations, fieldViolation("company.password", "password cannot be empty"))
+  }
+  if len(violations) > 0 {
+    return nil, badRequest("invalid update", violations...)
+  }
+
+  if len(update.fields) == 0 && !update.password {
+    return nil, badRequest("nothing to update", fieldViolation("update_mask", "no field to update"))
+  }
+  return update, nil
+}
+
+// isUpdatableCompanyField reports if field is one of UpdatableCompanyFields
+func isUpdatableCompanyField(field string) bool {
+  for _, f := range UpdatableCompanyFields {
+    if f == field {
+      return true
+    }
+  }
+  return false
+}
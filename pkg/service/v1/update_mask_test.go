@@ -0,0 +1,57 @@
+package v1
+
+import (
+  "reflect"
+  "testing"
+
+  "google.golang.org/protobuf/types/known/fieldmaskpb"
+
+  v1 "github.com/ckbball/os-company/pkg/api/v1"
+)
+
+func TestParseUpdateMask(t *testing.T) {
+  tests := []struct {
+    name string
+    // paths is the update mask, nil for none
+    paths    []string
+    company  *v1.Company
+    fields   []string
+    password bool
+    // violation is the field of the expected violation, empty if the mask is valid
+    violation string
+  }{
+    {"mask", []string{"mission", "name", "mission"}, &v1.Company{Mission: "hiring"}, []string{"mission", "name"}, false, ""},
+    {"mask clearing a field", []string{"location"}, &v1.Company{Name: "ignored"}, []string{"location"}, false, ""},
+    {"no mask", nil, &v1.Company{Email: "owner@example.com", Location: "Berlin", Id: "ignored"},
+      []string{"email", "location"}, false, ""},
+    {"no mask, only the password", nil, &v1.Company{Password: "another horse 2"}, nil, true, ""},
+    {"only the password", []string{"password"}, &v1.Company{Password: "another horse 2", Name: "ignored"}, nil, true, ""},
+    {"no mask and no values", nil, &v1.Company{}, nil, false, "update_mask"},
+    {"empty mask", []string{}, &v1.Company{Name: "ignored"}, nil, false, "update_mask"},
+    {"unknown path", []string{"name", "size"}, &v1.Company{Name: "Acme"}, nil, false, "update_mask"},
+    {"immutable path", []string{"email_verified"}, &v1.Company{EmailVerified: true}, nil, false, "update_mask"},
+    {"empty email", []string{"email"}, &v1.Company{}, nil, false, "company.email"},
+    {"empty password", []string{"password"}, &v1.Company{}, nil, false, "company.password"},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      req := &v1.UpsertRequest{Company: test.company}
+      if test.paths != nil {
+        req.UpdateMask = &fieldmaskpb.FieldMask{Paths: test.paths}
+      }
+
+      update, err := parseUpdateMask(req)
+      if test.violation != "" {
+        wantViolation(t, "parseUpdateMask", err, test.violation)
+        return
+      }
+      if err != nil {
+        t.Fatalf("parseUpdateMask failed: %v", err)
+      }
+      if !reflect.DeepEqual(update.fields, test.fields) || update.password != test.password {
+        t.Errorf("parseUpdateMask returned fields %v and password %v, want %v and %v",
+          update.fields, update.password, test.fields, test.password)
+      }
+    })
+  }
+}
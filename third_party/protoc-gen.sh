@@ -0,0 +1,18 @@
+#!/bin/sh
+# Generates the gRPC code, the HTTP gateway and the OpenAPI spec of proto/company/v1/company.proto.
+# Needs protoc, protoc-gen-go, protoc-gen-grpc-gateway, protoc-gen-swagger and protoc-gen-validate on the PATH.
+set -e
+cd "$(dirname "$0")/.."
+
+OUT=$(mktemp -d)
+trap 'rm -rf "$OUT"' EXIT
+
+protoc --proto_path=proto --proto_path=third_party \
+  --go_out=plugins=grpc:"$OUT" \
+  --grpc-gateway_out=logtostderr=true:"$OUT" \
+  --validate_out=lang=go:"$OUT" \
+  --swagger_out=logtostderr=true:pkg/protocol/rest/openapi \
+  company/v1/company.proto
+
+mkdir -p pkg/api/v1
+cp "$OUT"/github.com/ckbball/os-company/pkg/api/v1/*.go pkg/api/v1/